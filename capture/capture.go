@@ -0,0 +1,237 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package capture
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// Before captures packets before the plugins are applied, which for outgoing packets is the plaintext packet read from the TUN device, and for incoming packets is the packet as it was received off the wire.
+	Before Point = iota
+
+	// After captures packets after the plugins are applied, which for outgoing packets is the packet as it is written to the wire, and for incoming packets is the plaintext packet written to the TUN device.
+	After
+)
+
+const (
+	// AnyProtocol matches packets of any ip protocol.
+	AnyProtocol = -1
+
+	// The number of captured packets buffered for each session, packets are dropped from the session if it falls further behind.
+	sessionBuffer = 1024
+)
+
+// Point in the worker pipelines to capture packets at.
+type Point int
+
+func (point Point) String() string {
+	if point == After {
+		return "after plugins"
+	}
+	return "before plugins"
+}
+
+// Filter selects the packets a capture session receives.
+type Filter struct {
+	// The private ip of the remote peer, packets to and from any peer are captured if nil.
+	Peer net.IP
+
+	// Whether to capture incoming and outgoing packets respectively.
+	Rx, Tx bool
+
+	// The ip protocol of the captured packet, or AnyProtocol. Packets captured on the wire are udp packets.
+	Protocol int
+
+	// The point in the worker pipelines to capture packets at.
+	Point Point
+}
+
+func (filter *Filter) match(direction int, point Point, mapping *common.Mapping) bool {
+	if point != filter.Point || (direction == metric.Rx && !filter.Rx) || (direction == metric.Tx && !filter.Tx) {
+		return false
+	}
+	return filter.Peer == nil || (mapping != nil && filter.Peer.Equal(mapping.PrivateIP))
+}
+
+func (filter *Filter) matchProtocol(data []byte) bool {
+	return filter.Protocol == AnyProtocol || protocol(data) == filter.Protocol
+}
+
+// Packet is a single captured packet.
+type Packet struct {
+	// The time the packet was captured.
+	Time time.Time
+
+	// The direction of the packet, either metric.Rx or metric.Tx.
+	Direction int
+
+	// The point in the worker pipeline the packet was captured at.
+	Point Point
+
+	// The worker queue that handled the packet.
+	Queue int
+
+	// The raw ip packet.
+	Data []byte
+}
+
+func (packet *Packet) String() string {
+	return "queue " + strconv.Itoa(packet.Queue) + ", " + packet.Point.String()
+}
+
+// Session receives the captured packets that match its filter until it is closed.
+type Session struct {
+	tap     *Tap
+	filter  *Filter
+	packets chan *Packet
+	dropped uint64
+}
+
+// Packets returns the channel the captured packets are delivered on.
+func (session *Session) Packets() <-chan *Packet {
+	return session.packets
+}
+
+// Dropped returns the number of captured packets that were dropped because the session fell behind.
+func (session *Session) Dropped() uint64 {
+	return atomic.LoadUint64(&session.dropped)
+}
+
+// Close the session, no further packets are captured for it.
+func (session *Session) Close() {
+	session.tap.remove(session)
+}
+
+// Tap struct for capturing the packets handled by the workers, and delivering them to the open capture sessions.
+type Tap struct {
+	cfg      *common.Config
+	mux      sync.Mutex
+	sessions atomic.Value
+}
+
+// Capture the packet handled by the given queue, in the given direction at the given point in the pipeline, for every session with a matching filter. This is effectively free when no sessions are open.
+func (tap *Tap) Capture(direction int, point Point, queue int, payload *common.Payload, mapping *common.Mapping) {
+	sessions := tap.sessions.Load().([]*Session)
+	if len(sessions) == 0 {
+		return
+	}
+
+	var packet *Packet
+	for _, session := range sessions {
+		if !session.filter.match(direction, point, mapping) {
+			continue
+		}
+
+		if packet == nil {
+			packet = tap.packet(direction, point, queue, payload, mapping)
+			if packet == nil {
+				return
+			}
+		}
+
+		if !session.filter.matchProtocol(packet.Data) {
+			continue
+		}
+
+		select {
+		case session.packets <- packet:
+		default:
+			atomic.AddUint64(&session.dropped, 1)
+		}
+	}
+}
+
+// packet copies the payload out of the pipeline, wrapping the packets on the wire in their outer ip and udp headers.
+func (tap *Tap) packet(direction int, point Point, queue int, payload *common.Payload, mapping *common.Mapping) *Packet {
+	var data []byte
+	if (direction == metric.Tx) == (point == After) {
+		data = tap.encapsulate(direction, payload.Raw[:payload.Length], mapping)
+	} else {
+		data = make([]byte, len(payload.Packet))
+		copy(data, payload.Packet)
+	}
+
+	if data == nil {
+		return nil
+	}
+
+	return &Packet{
+		Time:      time.Now(),
+		Direction: direction,
+		Point:     point,
+		Queue:     queue,
+		Data:      data,
+	}
+}
+
+func (tap *Tap) encapsulate(direction int, datagram []byte, mapping *common.Mapping) []byte {
+	if mapping == nil {
+		return nil
+	}
+
+	local := &net.UDPAddr{Port: tap.cfg.ListenPort}
+	remote := sockaddrToUDPAddr(mapping)
+	if remote == nil {
+		return nil
+	}
+
+	if remote.IP.To4() != nil {
+		local.IP = tap.cfg.PublicIPv4
+	} else {
+		local.IP = tap.cfg.PublicIPv6
+	}
+
+	if direction == metric.Rx {
+		return udpPacket(remote, local, datagram)
+	}
+	return udpPacket(local, remote, datagram)
+}
+
+// Open a capture session that receives the captured packets matching the filter.
+func (tap *Tap) Open(filter *Filter) *Session {
+	session := &Session{
+		tap:     tap,
+		filter:  filter,
+		packets: make(chan *Packet, sessionBuffer),
+	}
+
+	tap.mux.Lock()
+	defer tap.mux.Unlock()
+
+	current := tap.sessions.Load().([]*Session)
+	sessions := make([]*Session, len(current), len(current)+1)
+	copy(sessions, current)
+	tap.sessions.Store(append(sessions, session))
+
+	return session
+}
+
+func (tap *Tap) remove(session *Session) {
+	tap.mux.Lock()
+	defer tap.mux.Unlock()
+
+	current := tap.sessions.Load().([]*Session)
+	sessions := make([]*Session, 0, len(current))
+	for i := 0; i < len(current); i++ {
+		if current[i] != session {
+			sessions = append(sessions, current[i])
+		}
+	}
+	tap.sessions.Store(sessions)
+}
+
+// New generates a Tap struct based on the passed in configuration, no packets are captured until a session is opened.
+func New(cfg *common.Config) *Tap {
+	tap := &Tap{cfg: cfg}
+	tap.sessions.Store([]*Session{})
+	return tap
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+func testPayload(protocol byte) *common.Payload {
+	raw := make([]byte, common.HeaderSize+common.IPv4HeaderSize)
+	payload := common.NewTunPayload(raw, common.IPv4HeaderSize)
+	payload.Packet[0] = 0x45
+	payload.Packet[9] = protocol
+	return payload
+}
+
+func testFilter() *Filter {
+	return &Filter{Rx: true, Tx: true, Protocol: AnyProtocol, Point: Before}
+}
+
+func TestTap(t *testing.T) {
+	cfg := &common.Config{PublicIPv4: net.ParseIP("1.1.1.1"), ListenPort: 1099}
+	tap := New(cfg)
+
+	peer := &common.Mapping{PrivateIP: net.ParseIP("10.99.0.2"), Sockaddr: &syscall.SockaddrInet4{Addr: [4]byte{2, 2, 2, 2}, Port: 1099}}
+	other := &common.Mapping{PrivateIP: net.ParseIP("10.99.0.3"), Sockaddr: &syscall.SockaddrInet4{Addr: [4]byte{3, 3, 3, 3}, Port: 1099}}
+
+	// Capturing without any sessions is a noop.
+	tap.Capture(metric.Tx, Before, 0, testPayload(6), peer)
+
+	all := tap.Open(testFilter())
+
+	filtered := testFilter()
+	filtered.Peer = net.ParseIP("10.99.0.2")
+	filtered.Rx = false
+	filtered.Protocol = 6
+	byPeer := tap.Open(filtered)
+
+	wire := testFilter()
+	wire.Point = After
+	onWire := tap.Open(wire)
+
+	tap.Capture(metric.Tx, Before, 0, testPayload(6), peer)
+	tap.Capture(metric.Tx, Before, 1, testPayload(17), peer)
+	tap.Capture(metric.Rx, Before, 0, testPayload(6), peer)
+	tap.Capture(metric.Tx, Before, 0, testPayload(6), other)
+	tap.Capture(metric.Tx, After, 0, testPayload(6), peer)
+
+	if len(all.Packets()) != 4 || len(byPeer.Packets()) != 1 || len(onWire.Packets()) != 1 {
+		t.Fatal("Capture did not filter the packets:", len(all.Packets()), len(byPeer.Packets()), len(onWire.Packets()))
+	}
+
+	packet := <-byPeer.Packets()
+	if packet.Direction != metric.Tx || packet.Point != Before || packet.Queue != 0 || protocol(packet.Data) != 6 || len(packet.Data) != common.IPv4HeaderSize {
+		t.Fatal("Capture returned the wrong packet:", packet)
+	}
+
+	// The packets on the wire are the whole tunneled datagram wrapped in udp.
+	packet = <-onWire.Packets()
+	if protocol(packet.Data) != udpProtocol || len(packet.Data) != common.IPv4HeaderSize+udpHeaderSize+common.HeaderSize+common.IPv4HeaderSize {
+		t.Fatal("Capture did not encapsulate the packet on the wire:", packet.Data)
+	}
+	if !net.IP(packet.Data[12:16]).Equal(cfg.PublicIPv4) || !net.IP(packet.Data[16:20]).Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatal("Capture encapsulated the packet with the wrong addresses:", packet.Data[:20])
+	}
+
+	all.Close()
+	byPeer.Close()
+	onWire.Close()
+	if len(tap.sessions.Load().([]*Session)) != 0 {
+		t.Fatal("Close did not remove the sessions.")
+	}
+
+	slow := tap.Open(testFilter())
+	for i := 0; i < sessionBuffer+10; i++ {
+		tap.Capture(metric.Rx, Before, 0, testPayload(6), peer)
+	}
+	if slow.Dropped() != 10 {
+		t.Fatal("Capture did not drop the packets of a slow session:", slow.Dropped())
+	}
+	slow.Close()
+}
+
+func TestUDPPacket(t *testing.T) {
+	datagram := []byte("quantum")
+
+	src := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 1}
+	dst := &net.UDPAddr{IP: net.ParseIP("2.2.2.2"), Port: 2}
+	v4 := udpPacket(src, dst, datagram)
+	if checksum(v4[:common.IPv4HeaderSize]) != 0 || int(binary.BigEndian.Uint16(v4[2:4])) != len(v4) {
+		t.Fatal("udpPacket returned an invalid ipv4 header:", v4[:common.IPv4HeaderSize])
+	}
+	if binary.BigEndian.Uint16(v4[20:22]) != 1 || binary.BigEndian.Uint16(v4[22:24]) != 2 || !bytes.Equal(v4[28:], datagram) {
+		t.Fatal("udpPacket returned an invalid udp packet:", v4)
+	}
+
+	src = &net.UDPAddr{IP: net.ParseIP("dead::beef"), Port: 1}
+	dst = &net.UDPAddr{IP: net.ParseIP("beef::dead"), Port: 2}
+	v6 := udpPacket(src, dst, datagram)
+	if protocol(v6) != udpProtocol || int(binary.BigEndian.Uint16(v6[4:6])) != udpHeaderSize+len(datagram) || !bytes.Equal(v6[48:], datagram) {
+		t.Fatal("udpPacket returned an invalid ipv6 packet:", v6)
+	}
+
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:32], v6[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(v6)-common.IPv6HeaderSize))
+	pseudo[39] = udpProtocol
+	if checksum(append(pseudo, v6[common.IPv6HeaderSize:]...)) != 0 {
+		t.Fatal("udpPacket returned an invalid ipv6 udp checksum.")
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package capture contains the structs and logic to capture the packets handled by the quantum workers, and write them out as pcapng streams.
+
+Running tcpdump against the quantum TUN device only shows the plaintext packets, so the workers instead tap their pipelines at two points:
+    - Before the plugins are applied, which is the plaintext packet for outgoing traffic and the packet as received off the wire for incoming traffic.
+    - After the plugins are applied, which is the packet as written to the wire for outgoing traffic and the plaintext packet for incoming traffic.
+
+Packets on the wire are captured as the whole tunneled datagram, after any compression or encryption, wrapped in rebuilt ip and udp headers using the public addresses of the local and remote nodes, so that they can be decoded like any other udp traffic. Note that when using the dtls backend the datagrams are encrypted again by the socket, after they are captured.
+
+Each capture session supplies a filter on the remote peer, the direction, the ip protocol, and the capture point. The protocol filter applies to the captured packet, so packets captured on the wire only match 'udp'. Captured packets are buffered per session, and are dropped rather than stall the workers if the session falls behind.
+
+The rest api exposes the capture sessions at 'http://127.0.0.1:1099/capture' by default, for example:
+    curl -s 'http://127.0.0.1:1099/capture?peer=10.99.0.5&dir=rx&proto=tcp&point=after&count=1000' | wireshark -k -i -
+*/
+package capture
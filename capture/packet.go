@@ -0,0 +1,120 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"github.com/supernomad/quantum/common"
+)
+
+const (
+	udpHeaderSize = 8
+	udpProtocol   = 17
+	ttl           = 64
+)
+
+// protocol returns the ip protocol of the raw ip packet, or AnyProtocol if the packet is not a valid ip packet.
+func protocol(packet []byte) int {
+	if len(packet) < 1 {
+		return AnyProtocol
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= common.IPv4HeaderSize {
+			return int(packet[9])
+		}
+	case 6:
+		if len(packet) >= common.IPv6HeaderSize {
+			return int(packet[6])
+		}
+	}
+	return AnyProtocol
+}
+
+func sockaddrToUDPAddr(mapping *common.Mapping) *net.UDPAddr {
+	switch sa := mapping.Sockaddr.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+	}
+	return nil
+}
+
+// udpPacket rebuilds the ip and udp headers of a tunneled datagram, so that the packets on the wire can be decoded like any other udp traffic.
+func udpPacket(src, dst *net.UDPAddr, datagram []byte) []byte {
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); dst4 != nil {
+		if src4 == nil {
+			src4 = net.IPv4zero.To4()
+		}
+
+		buf := make([]byte, common.IPv4HeaderSize+udpHeaderSize+len(datagram))
+		iph := buf[:common.IPv4HeaderSize]
+		iph[0] = 0x45
+		binary.BigEndian.PutUint16(iph[2:4], uint16(len(buf)))
+		iph[8] = ttl
+		iph[9] = udpProtocol
+		copy(iph[12:16], src4)
+		copy(iph[16:20], dst4)
+		binary.BigEndian.PutUint16(iph[10:12], checksum(iph))
+
+		// The udp checksum is optional over ipv4, and is left empty.
+		putUDPHeader(buf[common.IPv4HeaderSize:], src.Port, dst.Port, datagram)
+		return buf
+	}
+
+	src6 := src.IP.To16()
+	if src6 == nil {
+		src6 = net.IPv6zero
+	}
+
+	buf := make([]byte, common.IPv6HeaderSize+udpHeaderSize+len(datagram))
+	iph := buf[:common.IPv6HeaderSize]
+	iph[0] = 0x60
+	binary.BigEndian.PutUint16(iph[4:6], uint16(udpHeaderSize+len(datagram)))
+	iph[6] = udpProtocol
+	iph[7] = ttl
+	copy(iph[8:24], src6)
+	copy(iph[24:40], dst.IP.To16())
+
+	udp := buf[common.IPv6HeaderSize:]
+	putUDPHeader(udp, src.Port, dst.Port, datagram)
+
+	// The udp checksum is mandatory over ipv6, and covers a pseudo header made up of the addresses, length, and protocol.
+	pseudo := make([]byte, 40, 40+len(udp))
+	copy(pseudo[0:32], iph[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(udp)))
+	pseudo[39] = udpProtocol
+	sum := checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+	return buf
+}
+
+func putUDPHeader(buf []byte, srcPort, dstPort int, datagram []byte) {
+	binary.BigEndian.PutUint16(buf[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(buf[4:6], uint16(udpHeaderSize+len(datagram)))
+	copy(buf[udpHeaderSize:], datagram)
+}
+
+func checksum(buf []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	}
+	if len(buf)%2 == 1 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package capture
+
+import (
+	"io"
+
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// ContentType is the media type of a pcapng stream.
+	ContentType = "application/x-pcapng"
+
+	sectionHeaderBlock        = 0x0A0D0D0A
+	interfaceDescriptionBlock = 0x00000001
+	enhancedPacketBlock       = 0x00000006
+	byteOrderMagic            = 0x1A2B3C4D
+
+	// Every captured packet is a raw ip packet, either the plaintext packet or the tunneled packet wrapped in its outer ip and udp headers.
+	linkTypeRaw = 101
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optIfName   = 2
+	optEPBFlags = 2
+
+	epbFlagsInbound  = 1
+	epbFlagsOutbound = 2
+
+	// Captured packets are never truncated.
+	snaplen = 65535
+)
+
+// Writer writes captured packets to an underlying io.Writer as a little endian pcapng stream, as defined by https://tools.ietf.org/html/draft-tuexen-opsawg-pcapng.
+type Writer struct {
+	w io.Writer
+}
+
+// WritePacket writes the packet to the stream as an enhanced packet block, recording the direction of the packet in the block flags and the queue and capture point in the block comment.
+func (pw *Writer) WritePacket(packet *Packet) error {
+	flags := uint32(epbFlagsInbound)
+	if packet.Direction == metric.Tx {
+		flags = epbFlagsOutbound
+	}
+
+	ts := uint64(packet.Time.UnixNano() / 1000)
+
+	body := make([]byte, 0, 64+len(packet.Data))
+	body = appendUint32(body, 0)
+	body = appendUint32(body, uint32(ts>>32))
+	body = appendUint32(body, uint32(ts))
+	body = appendUint32(body, uint32(len(packet.Data)))
+	body = appendUint32(body, uint32(len(packet.Data)))
+	body = appendPadded(body, packet.Data)
+
+	body = appendOption(body, optEPBFlags, appendUint32(nil, flags))
+	body = appendOption(body, optComment, []byte(packet.String()))
+	body = appendOption(body, optEndOfOpt, nil)
+
+	return pw.writeBlock(enhancedPacketBlock, body)
+}
+
+func (pw *Writer) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+
+	block := make([]byte, 0, length)
+	block = appendUint32(block, blockType)
+	block = appendUint32(block, length)
+	block = append(block, body...)
+	block = appendUint32(block, length)
+
+	_, err := pw.w.Write(block)
+	return err
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// appendPadded appends the data padded out to a 4 byte boundary.
+func appendPadded(buf []byte, data []byte) []byte {
+	buf = append(buf, data...)
+	for i := len(data); i%4 != 0; i++ {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	buf = appendUint16(buf, code)
+	buf = appendUint16(buf, uint16(len(value)))
+	return appendPadded(buf, value)
+}
+
+// NewWriter generates a Writer which writes to the supplied io.Writer, the section header and the interface description are written immediately.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	var shb []byte
+	shb = appendUint32(shb, byteOrderMagic)
+	shb = appendUint16(shb, 1)
+	shb = appendUint16(shb, 0)
+	// The section length is unknown as the packets are streamed.
+	shb = append(shb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if err := pw.writeBlock(sectionHeaderBlock, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = appendUint16(idb, linkTypeRaw)
+	idb = appendUint16(idb, 0)
+	idb = appendUint32(idb, uint32(snaplen))
+	idb = appendOption(idb, optIfName, []byte("quantum"))
+	idb = appendOption(idb, optEndOfOpt, nil)
+	if err := pw.writeBlock(interfaceDescriptionBlock, idb); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/metric"
+)
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	pw, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := &Packet{Time: time.Unix(1, 0), Direction: metric.Tx, Point: After, Queue: 3, Data: []byte{0x45, 1, 2}}
+	if err := pw.WritePacket(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	// Walk the blocks, each of which must begin and end with the same length.
+	var types []uint32
+	data := buf.Bytes()
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatal("NewWriter wrote a truncated block:", data)
+		}
+
+		length := binary.LittleEndian.Uint32(data[4:8])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:length]) != length {
+			t.Fatal("NewWriter wrote a malformed block:", data)
+		}
+
+		types = append(types, binary.LittleEndian.Uint32(data[0:4]))
+		if types[len(types)-1] == enhancedPacketBlock {
+			ts := uint64(binary.LittleEndian.Uint32(data[12:16]))<<32 | uint64(binary.LittleEndian.Uint32(data[16:20]))
+			if ts != 1000000 || binary.LittleEndian.Uint32(data[20:24]) != 3 || !bytes.Equal(data[28:31], packet.Data) {
+				t.Fatal("WritePacket wrote the wrong packet:", data[:length])
+			}
+			if !bytes.Contains(data[:length], []byte("queue 3, after plugins")) {
+				t.Fatal("WritePacket did not comment the packet:", data[:length])
+			}
+		}
+		data = data[length:]
+	}
+
+	if len(types) != 3 || types[0] != sectionHeaderBlock || types[1] != interfaceDescriptionBlock || types[2] != enhancedPacketBlock {
+		t.Fatal("NewWriter wrote the wrong blocks:", types)
+	}
+}
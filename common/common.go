@@ -12,6 +12,9 @@ const (
 	// RealDeviceNameEnv is the environment variable that the real network device name is stored in for reloads.
 	RealDeviceNameEnv = "_QUANTUM_REAL_DEVICE_NAME_"
 
+	// HandoffFDEnv is the environment variable that the file descriptor of the unix socket the running state is handed off over is stored in for reloads.
+	HandoffFDEnv = "_QUANTUM_HANDOFF_FD_"
+
 	// IPStart - The ip start position within a quantum packet.
 	IPStart = 0
 
@@ -24,9 +27,27 @@ const (
 	// PacketStart - The real packet start position within a quantum packet.
 	PacketStart = 4
 
-	// MaxPacketLength - The maximum packet size to send via the UDP device.
+	// IPv4HeaderSize - The size of an ipv4 header without any options.
+	IPv4HeaderSize = 20
+
+	// IPv6HeaderSize - The size of an ipv6 header without any extension headers.
+	IPv6HeaderSize = 40
+
+	// UDPHeaderSize - The size of a udp header.
+	UDPHeaderSize = 8
+
+	// DefaultLinkMTU - The MTU of a standard ethernet link.
+	DefaultLinkMTU = 1500
+
+	// MinLinkMTU - The smallest MTU that every ipv4 link is required to support.
+	MinLinkMTU = 576
+
+	// MaxLinkMTU - The largest MTU that can be represented in an ip header.
+	MaxLinkMTU = 65535
+
+	// MaxPacketLength - The default maximum packet size to send via the UDP device, used when the link MTU isn't configured.
 	// StandardMTU(1500) - IPHeader(20) - UDPHeader(8).
-	MaxPacketLength = 1472
+	MaxPacketLength = DefaultLinkMTU - IPv4HeaderSize - UDPHeaderSize
 
 	// HeaderSize - The size of the data perpended tp the real packet.
 	HeaderSize = IPLength
@@ -34,10 +55,19 @@ const (
 	// OverflowSize - An extra buffer for overflow of the MTU for plugins and other things to use incase its necessary.
 	OverflowSize = 35
 
-	// MTU - The max size packet to receive from the TUN device.
+	// MTU - The default max size packet to receive from the TUN device, used when the link MTU isn't configured.
 	MTU = MaxPacketLength - HeaderSize - OverflowSize
 )
 
+// PacketLengths returns the maximum packet size to send via the UDP device and the max size packet to receive from the TUN device, for the given link MTU.
+func PacketLengths(linkMTU int, ipv6 bool) (maxPacketLength, mtu int) {
+	maxPacketLength = linkMTU - IPv4HeaderSize - UDPHeaderSize
+	if ipv6 {
+		maxPacketLength = linkMTU - IPv6HeaderSize - UDPHeaderSize
+	}
+	return maxPacketLength, maxPacketLength - HeaderSize - OverflowSize
+}
+
 // IPtoInt takes an ipv4 net.IP and returns a uint32 that represents it.
 func IPtoInt(IP net.IP) uint32 {
 	buf := IP.To4()
@@ -4,13 +4,23 @@
 package common
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/systemd"
 )
 
 const (
@@ -258,6 +268,33 @@ func testInvalidIntConfig(t *testing.T, args []string) {
 	os.Setenv("QUANTUM_WORKERS", "")
 }
 
+func testInvalidMTUConfig(t *testing.T, args []string) {
+	os.Setenv("QUANTUM_LINK_MTU", "100")
+	_, err := NewConfig(NewLogger(NoopLogger))
+	if err == nil {
+		t.Fatal("NewConfig shuld have returned an error for a link MTU that is too small.")
+	}
+	os.Setenv("QUANTUM_LINK_MTU", "")
+}
+
+func testInvalidFlowProtocolConfig(t *testing.T, args []string) {
+	os.Setenv("QUANTUM_FLOW_PROTOCOL", "sflow")
+	_, err := NewConfig(NewLogger(NoopLogger))
+	if err == nil {
+		t.Fatal("NewConfig shuld have returned an error for an unsupported flow protocol.")
+	}
+	os.Setenv("QUANTUM_FLOW_PROTOCOL", "")
+}
+
+func testInvalidStatsTLSConfig(t *testing.T, args []string) {
+	os.Setenv("QUANTUM_STATS_TLS_CERT", "/etc/quantum/api.crt")
+	_, err := NewConfig(NewLogger(NoopLogger))
+	if err == nil {
+		t.Fatal("NewConfig shuld have returned an error for an api tls certificate without a key.")
+	}
+	os.Setenv("QUANTUM_STATS_TLS_CERT", "")
+}
+
 func testInvalidDurationConfig(t *testing.T, args []string) {
 	os.Setenv("QUANTUM_NETWORK_LEASE_TIME", "hello")
 	_, err := NewConfig(NewLogger(NoopLogger))
@@ -326,6 +363,15 @@ func TestNewConfig(t *testing.T) {
 		t.Run("int", func(t *testing.T) {
 			testInvalidIntConfig(t, os.Args)
 		})
+		t.Run("mtu", func(t *testing.T) {
+			testInvalidMTUConfig(t, os.Args)
+		})
+		t.Run("flow-protocol", func(t *testing.T) {
+			testInvalidFlowProtocolConfig(t, os.Args)
+		})
+		t.Run("stats-tls", func(t *testing.T) {
+			testInvalidStatsTLSConfig(t, os.Args)
+		})
 		t.Run("duration", func(t *testing.T) {
 			testInvalidDurationConfig(t, os.Args)
 		})
@@ -362,6 +408,112 @@ func TestNewConfig(t *testing.T) {
 	})
 }
 
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, KeysFileName)
+
+	cfg := &Config{DataDir: dir, PidFile: path.Join(dir, "quantum.pid")}
+	cfg.loadKeys()
+	if len(cfg.problems) != 0 || !cfg.newKeys || len(cfg.PrivateKey) != keyLength || len(cfg.PublicSalt) != keyLength {
+		t.Fatal("loadKeys did not generate new encryption keys:", cfg.problems)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("loadKeys wrote out the new encryption keys before the configuration was applied.")
+	}
+	if err := cfg.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("persist did not write out the encryption keys only accessible by the owner:", err)
+	}
+
+	loaded := &Config{DataDir: dir}
+	loaded.loadKeys()
+	if len(loaded.problems) != 0 || loaded.newKeys || !bytes.Equal(loaded.PrivateKey, cfg.PrivateKey) || !bytes.Equal(loaded.PublicKey, cfg.PublicKey) || !bytes.Equal(loaded.PublicSalt, cfg.PublicSalt) {
+		t.Fatal("loadKeys did not load the stored encryption keys:", loaded.problems)
+	}
+
+	os.Chmod(file, 0644)
+	loaded = &Config{DataDir: dir}
+	loaded.loadKeys()
+	if len(loaded.problems) != 1 || !strings.Contains(loaded.problems[0], "accessible by other users") {
+		t.Fatal("loadKeys should have refused encryption keys accessible by other users:", loaded.problems)
+	}
+
+	// Keys loaded from a key file are never written by quantum.
+	external := path.Join(dir, "external")
+	loaded = &Config{DataDir: dir, EncryptionKeyFile: external}
+	loaded.loadKeys()
+	if len(loaded.problems) != 1 || loaded.PrivateKey != nil {
+		t.Fatal("loadKeys should have reported the missing key file:", loaded.problems)
+	}
+
+	ioutil.WriteFile(external, []byte(`{"privateKey":"woot","privateSalt":""}`), 0600)
+	loaded = &Config{DataDir: dir, EncryptionKeyFile: external}
+	loaded.loadKeys()
+	if len(loaded.problems) != 1 || !strings.Contains(loaded.problems[0], "private key") {
+		t.Fatal("loadKeys should have reported the invalid key file:", loaded.problems)
+	}
+
+	ioutil.WriteFile(external, []byte(`{"privateKey":"`+hex.EncodeToString(cfg.PrivateKey)+`","privateSalt":"`+hex.EncodeToString(cfg.PrivateSalt)+`"}`), 0600)
+	loaded = &Config{DataDir: dir, EncryptionKeyFile: external}
+	loaded.loadKeys()
+	if len(loaded.problems) != 0 || !bytes.Equal(loaded.PublicKey, cfg.PublicKey) {
+		t.Fatal("loadKeys did not load the encryption keys from the key file:", loaded.problems)
+	}
+
+	os.Remove(file)
+	if err := loaded.UseKeys(cfg.PrivateSalt, cfg.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) || !bytes.Equal(loaded.Current().PrivateKey, cfg.PrivateSalt) {
+		t.Fatal("UseKeys wrote out encryption keys loaded from a key file.")
+	}
+
+	if err := cfg.UseKeys(cfg.PrivateSalt, cfg.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if priv, salt, err := readKeys(file); err != nil || !bytes.Equal(priv, cfg.PrivateSalt) || !bytes.Equal(salt, cfg.PrivateKey) {
+		t.Fatal("UseKeys did not write out the new encryption keys:", err)
+	}
+	if running := cfg.Current(); !bytes.Equal(running.PrivateKey, cfg.PrivateSalt) || !bytes.Equal(running.PublicSalt, crypto.GenerateECPublicKey(cfg.PrivateKey)) {
+		t.Fatal("UseKeys did not publish the new encryption keys as the running configuration.")
+	}
+	if err := cfg.UseKeys([]byte("woot"), cfg.PrivateSalt); err == nil {
+		t.Fatal("UseKeys should have refused a private key of the wrong length.")
+	}
+
+	pskFile := path.Join(dir, "psk")
+	psks := []struct {
+		contents string
+		perm     os.FileMode
+		problem  string
+	}{
+		{"", 0, "does not exist"},
+		{"PreSharedKey-32Characters1234567\n", 0640, "accessible by other users"},
+		{"too short\n", 0600, "at least 32 characters"},
+		{"PreSharedKey-32Characters1234567\n", 0600, ""},
+	}
+	for _, test := range psks {
+		if test.perm != 0 {
+			ioutil.WriteFile(pskFile, []byte(test.contents), test.perm)
+			os.Chmod(pskFile, test.perm)
+		}
+
+		loaded = &Config{EncryptionPSKFile: pskFile}
+		loaded.loadPSK()
+		if test.problem == "" && (len(loaded.problems) != 0 || string(loaded.PSK) != "PreSharedKey-32Characters1234567") {
+			t.Fatal("loadPSK did not load the pre-shared key:", loaded.problems)
+		} else if test.problem != "" && (len(loaded.problems) != 1 || !strings.Contains(loaded.problems[0], test.problem) || loaded.PSK != nil) {
+			t.Fatal("loadPSK should have reported that the pre-shared key file "+test.problem+":", loaded.problems)
+		}
+	}
+}
+
 func TestNewMapping(t *testing.T) {
 	cfg := &Config{
 		PrivateIP:  net.ParseIP("0.0.0.0"),
@@ -417,6 +569,41 @@ func TestParseMapping(t *testing.T) {
 	}
 }
 
+func TestParseMappingPSK(t *testing.T) {
+	psk := []byte("PreSharedKey-32Characters1234567")
+	nodes := make([]*Config, 3)
+	for i := 0; i < len(nodes); i++ {
+		nodes[i] = &Config{PublicIPv4: net.ParseIP("1.1.1.1"), IsIPv4Enabled: true, PSK: psk}
+		_, priv := crypto.GenerateECKeyPair()
+		_, salt := crypto.GenerateECKeyPair()
+		nodes[i].setKeys(priv, salt)
+	}
+	nodes[2].UsePSK([]byte("PreSharedKey-32Characters7654321"))
+
+	buf := make([]byte, 1500)
+	for i, peer := range nodes[1:] {
+		sender, err := ParseMapping(NewMapping(peer).String(), nodes[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := ParseMapping(NewMapping(nodes[0]).String(), peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		length, err := sender.AES.Encrypt(buf, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = receiver.AES.Decrypt(buf[:length], nil)
+		if i == 0 && err != nil {
+			t.Fatal("Nodes holding the same pre-shared key derived different encryption keys:", err)
+		} else if i == 1 && err == nil {
+			t.Fatal("Nodes holding different pre-shared keys derived the same encryption key.")
+		}
+	}
+}
+
 func TestParseNetworkConfig(t *testing.T) {
 	defaultLeaseTime, _ := time.ParseDuration("48h")
 	DefaultNetworkConfig := &NetworkConfig{
@@ -529,19 +716,157 @@ func TestNewSockPayload(t *testing.T) {
 	}
 }
 
+func TestNewControlPayload(t *testing.T) {
+	buf := make([]byte, MaxPacketLength)
+	copy(buf, testPacket)
+
+	payload := NewControlPayload(buf, PMTUProbe, net.ParseIP("10.99.0.1"), 6)
+	if payload.Length != ControlHeaderSize+6 || len(payload.Packet) != payload.Length-HeaderSize {
+		t.Fatal("NewControlPayload returned an incorrect length.")
+	}
+
+	if !IsControlPayload(NewSockPayload(buf, payload.Length)) {
+		t.Fatal("IsControlPayload should have identified the control payload.")
+	}
+
+	if ControlType(payload.Packet[0]) != PMTUProbe || !net.IP(buf[ControlIPStart:ControlIPEnd]).Equal(net.ParseIP("10.99.0.1")) {
+		t.Fatal("NewControlPayload returned an incorrect control header.")
+	}
+
+	if IsControlPayload(NewSockPayload(testPacket, 6)) {
+		t.Fatal("IsControlPayload should not have identified a tunneled payload.")
+	}
+}
+
+func TestSignControlPayload(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	buf := make([]byte, MaxPacketLength)
+
+	payload := NewControlPayload(buf, LatencyProbe, net.ParseIP("10.99.0.1"), 12)
+	copy(buf[ControlDataStart:], "latencyprobe")
+
+	SignControlPayload(payload, nil)
+	if !VerifyControlPayload(payload, nil) || VerifyControlPayload(payload, psk) {
+		t.Fatal("VerifyControlPayload accepted a control payload signed without the pre-shared key.")
+	}
+
+	SignControlPayload(payload, psk)
+	if !VerifyControlPayload(payload, psk) {
+		t.Fatal("VerifyControlPayload rejected a control payload signed with the pre-shared key.")
+	}
+	if VerifyControlPayload(payload, []byte("fedcba9876543210fedcba9876543210")) {
+		t.Fatal("VerifyControlPayload accepted a control payload signed with a different pre-shared key.")
+	}
+
+	buf[ControlDataStart]++
+	if VerifyControlPayload(payload, psk) {
+		t.Fatal("VerifyControlPayload accepted a control payload whose control data was tampered with.")
+	}
+	buf[ControlDataStart]--
+
+	NewControlPayload(buf, LatencyProbe, net.ParseIP("10.99.0.1"), 12)
+	if VerifyControlPayload(payload, psk) {
+		t.Fatal("NewControlPayload did not clear the MAC of the payload it was written over.")
+	}
+}
+
+func TestPacketLengths(t *testing.T) {
+	if maxPacketLength, mtu := PacketLengths(DefaultLinkMTU, false); maxPacketLength != MaxPacketLength || mtu != MTU {
+		t.Fatal("PacketLengths returned incorrect lengths for the default link MTU.")
+	}
+
+	if maxPacketLength, mtu := PacketLengths(9000, true); maxPacketLength != 8952 || mtu != 8952-HeaderSize-OverflowSize {
+		t.Fatal("PacketLengths returned incorrect lengths for an ipv6 jumbo frame link MTU.")
+	}
+}
+
 func TestNewLogger(t *testing.T) {
-	log := NewLogger(NoopLogger)
-	if log.Error == nil {
-		t.Fatal("NewLogger returned a nil Error log.")
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	log := NewLogger(InfoLogger)
+	log.out.stdout, log.out.stderr = stdout, stderr
+	log.out.now = func() time.Time { return time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	log.Debug("test", "Not logged.")
+	log.With("peer", net.ParseIP("10.99.0.1")).Info("etcd", "Synchronized the mappings.", "queue", 1, "key", "")
+	log.Error("rest", "Error writing api response", "error", errors.New("broken pipe"), "dangling")
+
+	if expected := "time=2018-01-02T03:04:05.000Z level=info component=etcd msg=\"Synchronized the mappings.\" peer=10.99.0.1 queue=1 key=\"\"\n"; stdout.String() != expected {
+		t.Fatal("NewLogger wrote the wrong logfmt entry:", stdout.String())
+	}
+	if expected := "time=2018-01-02T03:04:05.000Z level=error component=rest msg=\"Error writing api response\" error=\"broken pipe\" dangling=\n"; stderr.String() != expected {
+		t.Fatal("NewLogger wrote the wrong logfmt entry to stderr:", stderr.String())
+	}
+
+	if err := log.Configure("debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	log.Debug("worker", "Started the incoming worker.", "queue", 2, "interval", time.Second)
+
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(stdout.Bytes(), &entry); err != nil {
+		t.Fatal("NewLogger wrote an invalid json entry:", err, stdout.String())
+	}
+	if entry["level"] != "debug" || entry["component"] != "worker" || entry["queue"] != float64(2) || entry["interval"] != "1s" {
+		t.Fatal("NewLogger wrote the wrong json entry:", stdout.String())
+	}
+
+	if err := log.Configure("trace", "json"); err == nil || log.Level() != DebugLogger {
+		t.Fatal("Configure accepted an unknown log level.")
+	}
+	if err := log.Configure("info", "xml"); err == nil {
+		t.Fatal("Configure accepted an unknown log format.")
+	}
+
+	for _, name := range []string{"error", "warn", "info", "debug"} {
+		if level, err := ParseLoggerType(name); err != nil || level.String() != name {
+			t.Fatal("ParseLoggerType failed to round trip the log level:", name)
+		}
+	}
+
+	noop := NewLogger(NoopLogger)
+	if noop.Enabled(ErrorLogger) {
+		t.Fatal("NewLogger returned a noop logger which logs errors.")
+	}
+}
+
+func TestPoller(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
 	}
-	if log.Warn == nil {
-		t.Fatal("NewLogger returned a nil Warn log.")
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	poller, err := NewPoller([]int{fds[0]})
+	if err != nil {
+		t.Fatal("NewPoller returned an error:", err)
 	}
-	if log.Info == nil {
-		t.Fatal("NewLogger returned a nil Info log.")
+	defer poller.Close()
+
+	woken := make(chan bool)
+	go func() {
+		woken <- poller.Wait(0)
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	if err := poller.Wake(); err != nil {
+		t.Fatal("Wake returned an error:", err)
 	}
-	if log.Debug == nil {
-		t.Fatal("NewLogger returned a nil Debug log.")
+	if <-woken {
+		t.Fatal("Wait reported an empty queue as readable once woken.")
+	}
+
+	// Once woken the queue is still reported as readable until it has been drained.
+	syscall.Write(fds[1], []byte("woot"))
+	if !poller.Wait(0) {
+		t.Fatal("Wait did not report a queued packet once woken.")
+	}
+
+	buf := make([]byte, 4)
+	syscall.Read(fds[0], buf)
+	if poller.Wait(0) {
+		t.Fatal("Wait reported a drained queue as readable once woken.")
 	}
 }
 
@@ -669,7 +994,7 @@ func TestGenerateFloatingMapping(t *testing.T) {
 func TestSignaler(t *testing.T) {
 	log := NewLogger(NoopLogger)
 	cfg, err := NewConfig(log)
-	signaler := NewSignaler(log, cfg, []int{1}, map[string]string{"QUANTUM_TESTING": "woot"})
+	signaler := NewSignaler(log, cfg, []int{1}, map[string]string{"QUANTUM_TESTING": "woot"}, nil, nil)
 
 	go func() {
 		signaler.signals <- syscall.SIGHUP
@@ -684,4 +1009,212 @@ func TestSignaler(t *testing.T) {
 	if err != nil {
 		t.Fatal("Wait returned an error: " + err.Error())
 	}
+
+	// Reloads applied in place, or abandoned because of an error, leave the process running.
+	results := []struct {
+		applied bool
+		err     error
+	}{{true, nil}, {false, errors.New("invalid configuration")}, {false, nil}}
+	calls := 0
+	signaler = NewSignaler(log, cfg, []int{1}, nil, func() (bool, error) {
+		result := results[calls]
+		calls++
+		return result.applied, result.err
+	}, nil)
+
+	go func() {
+		signaler.signals <- syscall.SIGHUP
+		signaler.signals <- syscall.SIGHUP
+		signaler.signals <- syscall.SIGHUP
+	}()
+
+	err = signaler.Wait(false)
+	if err != nil {
+		t.Fatal("Wait returned an error: " + err.Error())
+	}
+	if calls != 3 {
+		t.Fatal("Wait returned before falling back to a rolling restart.")
+	}
+
+	// Log level signals toggle debug logging without returning, turning it off restores the configured level.
+	for _, expected := range []LoggerType{DebugLogger, InfoLogger} {
+		go func() {
+			signaler.signals <- syscall.SIGUSR1
+			signaler.signals <- syscall.SIGINT
+		}()
+
+		if err := signaler.Wait(false); err != nil {
+			t.Fatal("Wait returned an error: " + err.Error())
+		}
+		if log.Level() != expected {
+			t.Fatal("Wait did not toggle debug logging, logging at:", log.Level())
+		}
+	}
+
+	// Reloads and termination are reported to systemd over the notify socket.
+	dir, err := ioutil.TempDir("", "quantum-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifications.Close()
+
+	os.Setenv(systemd.NotifySocketEnv, path.Join(dir, "notify"))
+	defer os.Unsetenv(systemd.NotifySocketEnv)
+
+	signaler = NewSignaler(log, cfg, []int{1}, nil, func() (bool, error) { return true, nil }, nil)
+	go func() {
+		signaler.signals <- syscall.SIGHUP
+		signaler.signals <- syscall.SIGTERM
+	}()
+
+	if err := signaler.Wait(false); err != nil {
+		t.Fatal("Wait returned an error: " + err.Error())
+	}
+
+	buf := make([]byte, 1024)
+	notifications.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{"RELOADING=1\nSTATUS=Reloading", "READY=1\nSTATUS=Reloaded the configuration in place", "STOPPING=1\nSTATUS=Stopping"} {
+		n, err := notifications.Read(buf)
+		if err != nil {
+			t.Fatal("Wait did not notify systemd: " + err.Error())
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("Wait notified systemd with '%s' instead of '%s'.", buf[:n], expected)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	running := &Config{
+		ListenPort: 1099,
+		PrivateIP:  net.ParseIP("10.99.0.1"),
+		Plugins:    []string{"compression"},
+		sources:    map[string]string{"listen-port": SourceDefault, "private-ip": SourceDefault, "plugins": SourceCLI},
+	}
+	updated := &Config{
+		ListenPort:       1099,
+		Plugins:          []string{"compression", "encryption"},
+		StatsAdminTokens: []string{"woot"},
+		sources:          map[string]string{"listen-port": SourceDefault, "private-ip": SourceDefault, "plugins": SourceFile, "stats-admin-tokens": SourceEnv},
+	}
+
+	// The private ip assigned to the running node is left at its default in both.
+	changes := Diff(running, updated)
+	if len(changes) != 2 || changes[0] != "plugins" || changes[1] != "stats-admin-tokens" {
+		t.Fatal("Diff returned the wrong changes:", changes)
+	}
+
+	// The running configuration is replaced rather than modified, so that it can be read while it is updated.
+	running.Update(updated, changes)
+	current := running.Current()
+	if len(current.Plugins) != 2 || len(current.StatsAdminTokens) != 1 || current.PrivateIP == nil || current.sources["plugins"] != SourceFile {
+		t.Fatal("Update did not copy the changed options.")
+	}
+	if len(running.Plugins) != 1 || running.sources["plugins"] != SourceCLI {
+		t.Fatal("Update modified the configuration quantum started with.")
+	}
+	if changes := Diff(current, updated); len(changes) != 0 {
+		t.Fatal("Diff returned changes for updated options:", changes)
+	}
+
+	current.Update(&Config{Plugins: []string{}, sources: map[string]string{"plugins": SourceEnv}}, []string{"plugins"})
+	if running.Current() != current.Current() || len(running.Current().Plugins) != 0 || len(current.Plugins) != 2 {
+		t.Fatal("Update did not publish the running configuration to every component.")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	dir, err := ioutil.TempDir("", "quantum-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := path.Join(dir, "quantum.pid")
+
+	os.Setenv("QUANTUM_DEVICE_NAME", "different")
+	os.Setenv("QUANTUM_LISTEN_PORT", "1")
+	os.Setenv("QUANTUM_CONF_FILE", jsonConfFile)
+	os.Setenv("QUANTUM_PID_FILE", pidFile)
+	os.Setenv("QUANTUM_FLOATING_IPS", "")
+	os.Setenv("_QUANTUM_REAL_DEVICE_NAME_", "quantum0")
+	os.Setenv("QUANTUM_WORKERS", "1.23")
+	os.Setenv("QUANTUM_LINK_MTU", "100")
+	os.Setenv("QUANTUM_FLOW_PROTOCOL", "sflow")
+
+	os.Args = append(args, "-d", dir, "--datastore-prefix", "woot", "-6", "fd00:dead:beef::2", "--network", "", "--network-backend", "", "--network-lease-time", "0")
+	validation := ValidateConfig(NewLogger(NoopLogger))
+	if len(validation.Problems) != 3 {
+		t.Fatal("ValidateConfig did not report every problem:", validation.Problems)
+	}
+	if _, err := validation.Apply(); err == nil || !strings.HasPrefix(err.Error(), "found 3 problems") {
+		t.Fatal("Apply should have returned every problem:", err)
+	}
+
+	sources := map[string]string{
+		"device-name":        SourceEnv,
+		"datastore-prefix":   SourceCLI,
+		"datastore-password": SourceFile,
+		"datastore-username": SourceFile,
+		"stats-port":         SourceDefault,
+		"machine-id":         SourceComputed,
+	}
+	for _, setting := range validation.Settings {
+		if source, ok := sources[setting.Name]; ok && setting.Source != source {
+			t.Fatal("ValidateConfig reported the wrong source for", setting.Name, setting.Source)
+		}
+		if setting.Name == "datastore-password" && setting.Value != redacted {
+			t.Fatal("ValidateConfig did not redact the datastore password.")
+		}
+		if setting.Name == "datastore-prefix" && (setting.Value != "/woot" || !setting.Resolved) {
+			t.Fatal("ValidateConfig did not mark the datastore prefix as resolved.")
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := validation.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "problem: ") || strings.Contains(out, "Password1") || !strings.HasSuffix(out, "Found 3 problem(s) with the configuration.\n") {
+		t.Fatal("Write returned the wrong output:", out)
+	}
+
+	os.Setenv("QUANTUM_WORKERS", "")
+	os.Setenv("QUANTUM_LINK_MTU", "")
+	os.Setenv("QUANTUM_FLOW_PROTOCOL", "")
+
+	// A dry run never writes anything out.
+	os.Args = append(os.Args, "--dry-run")
+	cfg, err := ValidateConfig(NewLogger(NoopLogger)).Apply()
+	if err != nil {
+		t.Fatal("Apply returned an error for a valid configuration:", err)
+	}
+	if !cfg.DryRun {
+		t.Fatal("ValidateConfig didn't pick up the cli replacement for DryRun")
+	}
+	for _, file := range []string{pidFile, path.Join(dir, "machine-id")} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Fatal("ValidateConfig wrote out a file during a dry run:", file)
+		}
+	}
+
+	os.Args = os.Args[:len(os.Args)-1]
+	cfg, err = ValidateConfig(NewLogger(NoopLogger)).Apply()
+	if err != nil {
+		t.Fatal("Apply returned an error for a valid configuration:", err)
+	}
+	if machineID, err := ioutil.ReadFile(path.Join(dir, "machine-id")); err != nil || hex.EncodeToString(machineID) != cfg.MachineID {
+		t.Fatal("Apply did not write out the new machine id:", err)
+	}
+	if _, err := os.Stat(pidFile); err != nil {
+		t.Fatal("Apply did not write out the pid file:", err)
+	}
 }
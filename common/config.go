@@ -16,10 +16,11 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/systemd"
 	"github.com/supernomad/quantum/version"
 	"github.com/vishvananda/netlink"
 	"gopkg.in/yaml.v2"
@@ -71,7 +72,21 @@ type Config struct {
 	PidFile                  string                 `internal:"false"  type:"string"    short:"pf"   long:"pid-file"                    default:"/var/run/quantum.pid"  description:"The pid file to use for tracking rolling restarts."                                                                                                         section:"General"    name:"PID File Path"`
 	Forward                  bool                   `internal:"false"  type:"bool"      short:"f"    long:"forward"                     default:"false"                 description:"Whether or not the quantum device should forward all network traffic through quantum. Requires '-g|--gateway' to be specified."                             section:"General"    name:"Forward Traffic"`
 	Gateway                  net.IP                 `internal:"false"  type:"ip"        short:"g"    long:"gateway"                     default:""                      description:"The private ip address of the remote quantum node to forward traffic to. Ignored unless '-f|--forward' is specified."                                       section:"General"    name:"Gateway"`
+	LinkMTU                  int                    `internal:"false"  type:"int"       short:"mtu"  long:"link-mtu"                    default:"1500"                  description:"The MTU of the network links between quantum nodes, the quantum device MTU is derived from this value. Set to '9000' on jumbo frame capable networks."      section:"General"    name:"Link MTU"`
+	PMTUDiscovery            bool                   `internal:"false"  type:"bool"      short:"pmtu" long:"pmtu-discovery"              default:"false"                 description:"Whether or not to discover the path MTU to each remote node, sending ICMP errors back to the source of packets that are too big for the path."              section:"General"    name:"Path MTU Discovery"`
+	PMTUInterval             time.Duration          `internal:"false"  type:"duration"  short:"pmi"  long:"pmtu-interval"               default:"10m"                   description:"The interval of path MTU discovery for each remote node. Ignored unless '-pmtu|--pmtu-discovery' is specified."                                             section:"General"    name:"Path MTU Discovery Interval"`
+	ClampMSS                 bool                   `internal:"false"  type:"bool"      short:"mss"  long:"clamp-mss"                   default:"false"                 description:"Whether or not to rewrite the MSS of TCP connections crossing quantum, so that their packets fit within the path MTU to the remote node."                   section:"General"    name:"Clamp TCP MSS"`
+	LatencyMonitoring        bool                   `internal:"false"  type:"bool"      short:"lm"   long:"latency-monitoring"          default:"false"                 description:"Whether or not to measure the round trip time, jitter, and packet loss to each remote node with in-band probes."                                            section:"General"    name:"Latency Monitoring"`
+	LatencyInterval          time.Duration          `internal:"false"  type:"duration"  short:"lmi"  long:"latency-interval"            default:"1s"                    description:"The interval between latency probes to each remote node. Ignored unless '-lm|--latency-monitoring' is specified."                                           section:"General"    name:"Latency Monitoring Interval"`
+	MasqueradeInterfaces     []string               `internal:"false"  type:"list"      short:"mi"   long:"masquerade-interfaces"       default:""                      description:"A comma delimited list of egress interfaces to masquerade traffic from the quantum network out of, when this node is used as a gateway."                    section:"General"    name:"Masquerade Interfaces"`
+	DryRun                   bool                   `internal:"false"  type:"bool"      short:"dr"   long:"dry-run"                     default:"false"                 description:"Whether or not to only print the effective configuration and every problem with it, without writing files or touching the datastore."                       section:"General"    name:"Dry Run"`
+	LogLevel                 string                 `internal:"false"  type:"string"    short:"ll"   long:"log-level"                   default:"info"                  description:"The level to log at, one of 'error', 'warn', 'info', or 'debug'. Can be changed while quantum is running with a SIGUSR1 or the administrative api."         section:"General"    name:"Log Level"`
+	LogFormat                string                 `internal:"false"  type:"string"    short:"lf"   long:"log-format"                  default:"logfmt"                description:"The format to write log entries in, either 'logfmt' or 'json'."                                                                                             section:"General"    name:"Log Format"`
+	DrainTimeout             time.Duration          `internal:"false"  type:"duration"  short:"dt"   long:"drain-timeout"               default:"5s"                    description:"How long to wait on shutdown for the workers to flush the packets already queued, set to '0' to drop them."                                                 section:"General"    name:"Drain Timeout"`
+	HandoffTimeout           time.Duration          `internal:"false"  type:"duration"  short:"ht"   long:"handoff-timeout"             default:"30s"                   description:"How long to wait during a rolling restart for the new process to start, before stopping it and continuing to run."                                          section:"General"    name:"Handoff Timeout"`
 	Plugins                  []string               `internal:"false"  type:"list"      short:"x"    long:"plugins"                     default:""                      description:"The plugins supported by this node."                                                                                                                        section:"Plugins"    name:"Plugins"`
+	EncryptionKeyFile        string                 `internal:"false"  type:"string"    short:"ekf"  long:"encryption-key-file"         default:""                      description:"A file to load the encryption keys from, such as one written by a secrets manager, rather than generating and storing them in the data directory."          section:"Plugins"    name:"Encryption Key File"`
+	EncryptionPSKFile        string                 `internal:"false"  type:"string"    short:"epsk" long:"encryption-psk-file"         default:""                      description:"A file holding a pre-shared key, the same on every node, to mix into the encryption keys so that only nodes holding it can communicate."                    section:"Plugins"    name:"Encryption Pre-Shared Key File"`
 	Datastore                string                 `internal:"false"  type:"string"    short:"s"    long:"datastore"                   default:"etcdv2"                description:"The key/value datastore to use to store quantum configuration. Note that this MUST be set to the same value on all quantum instances in the same network."  section:"Datastore"  name:"Datastore"`
 	DatastorePrefix          string                 `internal:"false"  type:"string"    short:"pr"   long:"datastore-prefix"            default:"/quantum"              description:"The prefix to store quantum configuration data under in the key/value datastore."                                                                           section:"Datastore"  name:"Prefix"`
 	DatastoreSyncInterval    time.Duration          `internal:"false"  type:"duration"  short:"si"   long:"datastore-sync-interval"     default:"60s"                   description:"The interval of full datastore syncs."                                                                                                                      section:"Datastore"  name:"Datastore Resync Interval"`
@@ -89,8 +104,23 @@ type Config struct {
 	DTLSCert                 string                 `internal:"false"  type:"string"    short:"dtc"  long:"dtls-cert"                   default:""                      description:"The DTLS client certificate to use to authenticate when using the DTLS backend."                                                                            section:"DTLS"       name:"DTLS Public Certificate Path"`
 	DTLSKey                  string                 `internal:"false"  type:"string"    short:"dtk"  long:"dtls-key"                    default:""                      description:"The DTLS client key to use to authenticate when using the DTLS backend."                                                                                    section:"DTLS"       name:"DTLS Private Key Path"`
 	StatsRoute               string                 `internal:"false"  type:"string"    short:"sr"   long:"stats-route"                 default:"/stats"                description:"The api route to serve statistics data from."                                                                                                               section:"Stats"      name:"API URI Route"`
+	MetricsRoute             string                 `internal:"false"  type:"string"    short:"mr"   long:"metrics-route"               default:"/metrics"              description:"The api route to serve statistics data from in the prometheus text exposition format."                                                                      section:"Stats"      name:"API Prometheus Route"`
+	LatencyRoute             string                 `internal:"false"  type:"string"    short:"lr"   long:"latency-route"               default:"/latency"              description:"The api route to serve the latency matrix of the quantum network from."                                                                                     section:"Stats"      name:"API Latency Route"`
+	CaptureRoute             string                 `internal:"false"  type:"string"    short:"cr"   long:"capture-route"               default:"/capture"              description:"The api route to stream live packet captures, in the pcapng format, from."                                                                                  section:"Stats"      name:"API Capture Route"`
+	EventsRoute              string                 `internal:"false"  type:"string"    short:"er"   long:"events-route"                default:"/events"               description:"The api route to stream mapping, floating ip, gateway, and peer liveness changes from as server-sent events."                                               section:"Stats"      name:"API Events Route"`
+	HealthRoute              string                 `internal:"false"  type:"string"    short:"hr"   long:"health-route"                default:"/healthz"              description:"The unauthenticated api route reporting the liveness of the worker goroutines, responding with a 503 if any are failing."                                   section:"Stats"      name:"API Liveness Route"`
+	ReadyRoute               string                 `internal:"false"  type:"string"    short:"rr"   long:"ready-route"                 default:"/readyz"               description:"The unauthenticated api route reporting whether the datastore, network device, socket, and workers are ready, responding with a 503 if any are not."        section:"Stats"      name:"API Readiness Route"`
+	FlowCollector            string                 `internal:"false"  type:"string"    short:"fc"   long:"flow-collector"              default:""                      description:"The 'host:port' of a collector to export flow records of the traffic crossing quantum to over udp, flow export is disabled if empty."                       section:"Stats"      name:"Flow Collector"`
+	FlowProtocol             string                 `internal:"false"  type:"string"    short:"fp"   long:"flow-protocol"               default:"ipfix"                 description:"The protocol to export flow records with, either 'ipfix' or 'netflow9'."                                                                                    section:"Stats"      name:"Flow Protocol"`
+	FlowActiveTimeout        time.Duration          `internal:"false"  type:"duration"  short:"fat"  long:"flow-active-timeout"         default:"1m"                    description:"The interval to export the records of long lived flows at."                                                                                                 section:"Stats"      name:"Flow Active Timeout"`
+	FlowIdleTimeout          time.Duration          `internal:"false"  type:"duration"  short:"fit"  long:"flow-idle-timeout"           default:"15s"                   description:"How long a flow must see no packets before its record is exported and the flow is forgotten."                                                               section:"Stats"      name:"Flow Idle Timeout"`
 	StatsAddress             string                 `internal:"false"  type:"string"    short:"sa"   long:"stats-address"               default:"0.0.0.0"               description:"The api server address."                                                                                                                                    section:"Stats"      name:"API Listen IP"`
 	StatsPort                int                    `internal:"false"  type:"int"       short:"sp"   long:"stats-port"                  default:"1099"                  description:"The api server port."                                                                                                                                       section:"Stats"      name:"API Listen Port"`
+	StatsTLSCert             string                 `internal:"false"  type:"string"    short:"stc"  long:"stats-tls-cert"              default:""                      description:"The TLS certificate to serve the api over https with, the api is served over plain http if empty."                                                          section:"Stats"      name:"API TLS Public Certificate Path"`
+	StatsTLSKey              string                 `internal:"false"  type:"string"    short:"stk"  long:"stats-tls-key"               default:""                      description:"The TLS key to serve the api over https with."                                                                                                              section:"Stats"      name:"API TLS Private Key Path"`
+	StatsTLSCA               string                 `internal:"false"  type:"string"    short:"stca" long:"stats-tls-ca-cert"           default:""                      description:"The TLS CA certificate to authenticate api client certificates with, every api client must present a certificate signed by it if set."                      section:"Stats"      name:"API TLS CA Certificate Path"`
+	StatsReadTokens          []string               `internal:"false"  type:"list"      short:"srt"  long:"stats-read-tokens"           default:""                      description:"A comma delimited list of bearer tokens granting read only access to the api."                                                                              section:"Stats"      name:"API Read Only Tokens"`
+	StatsAdminTokens         []string               `internal:"false"  type:"list"      short:"sat"  long:"stats-admin-tokens"          default:""                      description:"A comma delimited list of bearer tokens granting full access to the api, the api requires no tokens if both token lists are empty."                         section:"Stats"      name:"API Admin Tokens"`
 	Network                  string                 `internal:"false"  type:"string"    short:"nw"   long:"network"                     default:"10.99.0.0/16"          description:"The network, in CIDR notation, to use for the entire quantum cluster."                                                                                      section:"Network"    name:"Primary Subnet"`
 	NetworkStaticRange       string                 `internal:"false"  type:"string"    short:"nsr"  long:"network-static-range"        default:"10.99.0.0/23"          description:"The reserved subnet, in CIDR notation, within the network to use for static ip address assignments."                                                        section:"Network"    name:"Reserved Static IP Subnet"`
 	NetworkFloatingRange     string                 `internal:"false"  type:"string"    short:"nfr"  long:"network-floating-range"      default:"10.99.2.0/23"          description:"The reserved subnet, in CIDR notation, within the network to use for floating ip address assignments."                                                      section:"Network"    name:"Reserved Floating IP Subnet"`
@@ -100,18 +130,40 @@ type Config struct {
 	PrivateKey               []byte                 `internal:"true"` // The private key to use with the encryption plugin.
 	PublicSalt               []byte                 `internal:"true"` // The public salt to use with the encryption plugin.
 	PrivateSalt              []byte                 `internal:"true"` // The private salt to use with the encryption plugin.
+	PSK                      []byte                 `internal:"true"` // The pre-shared key to mix into the encryption keys, loaded from the pre-shared key file.
 	Salt                     []byte                 `internal:"true"` // The salt to use with the encryption plugin.
+	DeviceType               string                 `internal:"true"` // The type of network device to create, defaults to a TUN device when left blank
 	RealDeviceName           string                 `internal:"true"` // Used when a rolling restart is triggered to find the correct tun interface
 	ReuseFDS                 bool                   `internal:"true"` // Used when a rolling restart is triggered which forces quantum to reuse the passed in socket/tun fds
+	ListenFDs                []int                  `internal:"true"` // The udp sockets passed in by systemd socket activation, which are used rather than creating new sockets
 	MachineID                string                 `internal:"true"` // The generated machine id for this node
 	AuthEnabled              bool                   `internal:"true"` // Whether or not datastore authentication is enabled (toggled by setting username/password)
 	TLSEnabled               bool                   `internal:"true"` // Whether or not tls with the datastore is enabled (toggled by setting the tls parameters at run time)
 	IsIPv4Enabled            bool                   `internal:"true"` // Whether or not quantum has determined that this node is ipv4 capable
 	IsIPv6Enabled            bool                   `internal:"true"` // Whether or not quantum has determined that this node is ipv6 capable
 	ListenAddr               syscall.Sockaddr       `internal:"true"` // The commputed Sockaddr object to bind the underlying udp sockets to
+	MaxPacketLength          int                    `internal:"true"` // The computed maximum packet size to send via the underlying udp sockets, based on the link MTU
+	MTU                      int                    `internal:"true"` // The computed MTU of the quantum device, based on the link MTU
 	NetworkConfig            *NetworkConfig         `internal:"true"` // The network config detemined by existence of the object in etcd
 	Log                      *Logger                `internal:"true"` // The internal Logger to use
 	fileData                 map[string]interface{} `internal:"true"` // An internal map of data representing a passed in configuration file
+	sources                  map[string]string      `internal:"true"` // The source of each user supplied configuration value, keyed by its long name
+	problems                 []string               `internal:"true"` // Every problem found while parsing and computing the configuration
+	warnings                 []string               `internal:"true"` // Every warning raised while parsing and computing the configuration
+	newMachineID             []byte                 `internal:"true"` // A generated machine id which has not been written to the data directory yet
+	newKeys                  bool                   `internal:"true"` // Whether or not the encryption keys were generated and have not been written to the data directory yet
+	root                     *Config                `internal:"true"` // The configuration quantum started with, which the published snapshots of the running configuration are stored in
+	current                  atomic.Value           `internal:"true"` // The latest published snapshot of the running configuration, only ever stored in the root configuration
+}
+
+// problem records a problem with the configuration, every problem is reported rather than just the first.
+func (cfg *Config) problem(msg string) {
+	cfg.problems = append(cfg.problems, msg)
+}
+
+// warn records a warning about the configuration, which is logged once the configuration is applied.
+func (cfg *Config) warn(msg string) {
+	cfg.warnings = append(cfg.warnings, msg)
 }
 
 func (cfg *Config) cliArg(short, long string, isFlag bool) (string, bool) {
@@ -121,6 +173,10 @@ func (cfg *Config) cliArg(short, long string, isFlag bool) (string, bool) {
 			if isFlag {
 				return "true", true
 			}
+			if i+1 >= len(os.Args) {
+				cfg.problem("no value supplied for '" + arg + "'")
+				return "", false
+			}
 			return os.Args[i+1], true
 		}
 	}
@@ -196,7 +252,7 @@ func (cfg *Config) parseFile() error {
 	if cfg.ConfFile != "" {
 		buf, err := ioutil.ReadFile(cfg.ConfFile)
 		if err != nil {
-			return err
+			return errors.New("error reading the configuration file '" + cfg.ConfFile + "': " + err.Error())
 		}
 
 		data := make(map[string]interface{})
@@ -211,7 +267,7 @@ func (cfg *Config) parseFile() error {
 		}
 
 		if err != nil {
-			return err
+			return errors.New("error parsing the configuration file '" + cfg.ConfFile + "': " + err.Error())
 		}
 
 		cfg.fileData = data
@@ -240,7 +296,7 @@ func (cfg *Config) parseSpecial(exit bool) {
 	}
 }
 
-func (cfg *Config) parseArgs() error {
+func (cfg *Config) parseArgs() {
 	st := reflect.TypeOf(*cfg)
 	sv := reflect.ValueOf(cfg).Elem()
 
@@ -254,40 +310,45 @@ func (cfg *Config) parseArgs() error {
 			continue
 		}
 
-		var raw string
+		var raw, source string
 		if value, ok := cfg.cliArg(short, long, fieldType == "bool"); ok {
-			raw = value
+			raw, source = value, SourceCLI
 		} else if value, ok := cfg.envArg(long); ok {
-			raw = value
+			raw, source = value, SourceEnv
 		} else if value, ok := cfg.fileArg(long); ok {
-			raw = value
+			raw, source = value, SourceFile
 		} else {
-			raw = def
+			raw, source = def, SourceDefault
 		}
+		cfg.sources[long] = source
 
 		switch fieldType {
 		case "int":
 			i, err := strconv.Atoi(raw)
 			if err != nil {
-				return errors.New("error parsing value for '" + long + "' got, '" + raw + "', expected an 'int'")
+				cfg.problem("error parsing value for '" + long + "' got, '" + raw + "', expected an 'int'")
+				continue
 			}
 			fieldValue.Set(reflect.ValueOf(i))
 		case "duration":
 			dur, err := time.ParseDuration(raw)
 			if err != nil {
-				return errors.New("error parsing value for '" + long + "' got, '" + raw + "', expected a 'duration' for example: '10s' or '2d'")
+				cfg.problem("error parsing value for '" + long + "' got, '" + raw + "', expected a 'duration' for example: '10s' or '2d'")
+				continue
 			}
 			fieldValue.Set(reflect.ValueOf(dur))
 		case "ip":
 			ip := net.ParseIP(raw)
 			if ip == nil && raw != "" {
-				return errors.New("error parsing value for '" + long + "' got, '" + raw + "', expected an 'ip' for example: '10.0.0.1' or 'fd42:dead:beef::1'")
+				cfg.problem("error parsing value for '" + long + "' got, '" + raw + "', expected an 'ip' for example: '10.0.0.1' or 'fd42:dead:beef::1'")
+				continue
 			}
 			fieldValue.Set(reflect.ValueOf(ip))
 		case "bool":
 			b, err := strconv.ParseBool(raw)
 			if err != nil {
-				return errors.New("error parsing value for '" + long + "' got, '" + raw + "', expected a 'bool'")
+				cfg.problem("error parsing value for '" + long + "' got, '" + raw + "', expected a 'bool'")
+				continue
 			}
 			fieldValue.Set(reflect.ValueOf(b))
 		case "list":
@@ -304,6 +365,7 @@ func (cfg *Config) parseArgs() error {
 				for i := 0; i < len(list); i++ {
 					ip := net.ParseIP(list[i])
 					if ip == nil {
+						cfg.warn("ignoring the invalid ip address '" + list[i] + "' in '" + long + "'")
 						continue
 					}
 
@@ -319,17 +381,47 @@ func (cfg *Config) parseArgs() error {
 
 		if field.Name == "ConfFile" {
 			if err := cfg.parseFile(); err != nil {
-				return err
+				cfg.problem(err.Error())
 			}
 		}
 	}
-
-	return nil
 }
 
-func (cfg *Config) computeArgs() error {
+func (cfg *Config) computeArgs() {
 	if cfg.Forward && cfg.Gateway == nil {
-		return errors.New("'-f|--forward' specified but no '-g|--gateway' specified to forward traffic to")
+		cfg.problem("'-f|--forward' specified but no '-g|--gateway' specified to forward traffic to")
+	}
+
+	if cfg.LinkMTU < MinLinkMTU || cfg.LinkMTU > MaxLinkMTU {
+		cfg.problem("'-mtu|--link-mtu' must be between " + strconv.Itoa(MinLinkMTU) + " and " + strconv.Itoa(MaxLinkMTU))
+	}
+
+	if cfg.DrainTimeout < 0 {
+		cfg.problem("'-dt|--drain-timeout' must not be negative")
+	}
+
+	if cfg.HandoffTimeout <= 0 {
+		cfg.problem("'-ht|--handoff-timeout' must be greater than zero")
+	}
+
+	if _, err := ParseLoggerType(cfg.LogLevel); err != nil {
+		cfg.problem("'-ll|--log-level' must be one of 'error', 'warn', 'info', or 'debug'")
+	}
+
+	if cfg.LogFormat != LogfmtFormat && cfg.LogFormat != JSONFormat {
+		cfg.problem("'-lf|--log-format' must be either 'logfmt' or 'json'")
+	}
+
+	if cfg.FlowProtocol != "ipfix" && cfg.FlowProtocol != "netflow9" {
+		cfg.problem("'-fp|--flow-protocol' must be either 'ipfix' or 'netflow9'")
+	}
+
+	if (cfg.StatsTLSCert == "") != (cfg.StatsTLSKey == "") {
+		cfg.problem("'-stc|--stats-tls-cert' and '-stk|--stats-tls-key' must be set together")
+	}
+
+	if cfg.StatsTLSCA != "" && cfg.StatsTLSCert == "" {
+		cfg.problem("'-stca|--stats-tls-ca-cert' requires '-stc|--stats-tls-cert' and '-stk|--stats-tls-key' to be set")
 	}
 
 	if !strings.HasPrefix(cfg.DatastorePrefix, "/") {
@@ -344,21 +436,26 @@ func (cfg *Config) computeArgs() error {
 		cfg.AuthEnabled = true
 	}
 
-	if numCPU := runtime.NumCPU(); cfg.NumWorkers == 0 || cfg.NumWorkers > numCPU {
+	// Each socket passed in by systemd socket activation is read by its own worker.
+	cfg.ListenFDs = systemd.ListenFDs()
+	if len(cfg.ListenFDs) > 0 && cfg.NumWorkers == 0 {
+		cfg.NumWorkers = len(cfg.ListenFDs)
+	} else if numCPU := runtime.NumCPU(); cfg.NumWorkers == 0 || cfg.NumWorkers > numCPU {
 		cfg.NumWorkers = numCPU
 	}
 
-	os.MkdirAll(cfg.DataDir, os.ModeDir)
-	os.MkdirAll(path.Dir(cfg.PidFile), os.ModeDir)
+	if len(cfg.ListenFDs) > 0 && len(cfg.ListenFDs) != cfg.NumWorkers {
+		cfg.problem("systemd passed in " + strconv.Itoa(len(cfg.ListenFDs)) + " sockets but '-n|--workers' is set to " + strconv.Itoa(cfg.NumWorkers) + ", socket activation requires one socket per worker")
+	}
 
-	machineID := make([]byte, 32)
-	machineIDPath := path.Join(cfg.DataDir, "machine-id")
-	if _, err := os.Stat(machineIDPath); os.IsNotExist(err) {
+	// A new machine id is only generated here, it is written to the data directory once the configuration is applied.
+	machineID, err := ioutil.ReadFile(path.Join(cfg.DataDir, "machine-id"))
+	if os.IsNotExist(err) {
+		machineID = make([]byte, 32)
 		rand.Read(machineID)
-		ioutil.WriteFile(machineIDPath, machineID, os.ModePerm)
-	} else {
-		buf, _ := ioutil.ReadFile(machineIDPath)
-		machineID = buf
+		cfg.newMachineID = machineID
+	} else if err != nil {
+		cfg.problem("error reading the machine id from the data directory '" + cfg.DataDir + "': " + err.Error())
 	}
 	cfg.MachineID = hex.EncodeToString(machineID)
 
@@ -368,13 +465,10 @@ func (cfg *Config) computeArgs() error {
 	}
 
 	if StringInSlice("encryption", cfg.Plugins) {
-		pub, priv := crypto.GenerateECKeyPair()
-		pubSalt, privSalt := crypto.GenerateECKeyPair()
-
-		cfg.PublicKey = pub
-		cfg.PrivateKey = priv
-		cfg.PublicSalt = pubSalt
-		cfg.PrivateSalt = privSalt
+		cfg.loadKeys()
+		cfg.loadPSK()
+	} else if cfg.EncryptionPSKFile != "" {
+		cfg.warn("the pre-shared key file '" + cfg.EncryptionPSKFile + "' is only used by the encryption plugin, which is not enabled")
 	}
 
 	DefaultNetworkConfig := &NetworkConfig{
@@ -386,63 +480,63 @@ func (cfg *Config) computeArgs() error {
 	}
 
 	if DefaultNetworkConfig.Backend == "" {
-		cfg.Log.Warn.Println("[CONFIG]", "Using default network backend:", defaultBackend)
+		cfg.warn("using default network backend: " + defaultBackend)
 		DefaultNetworkConfig.Backend = defaultBackend
 	}
 
 	if DefaultNetworkConfig.Network == "" {
-		cfg.Log.Warn.Println("[CONFIG]", "Using default network:", defaultNetwork)
-		cfg.Log.Warn.Println("[CONFIG]", "Using default network static range:", defaultStaticRange)
+		cfg.warn("using default network: " + defaultNetwork)
+		cfg.warn("using default network static range: " + defaultStaticRange)
 		DefaultNetworkConfig.Network = defaultNetwork
 		DefaultNetworkConfig.StaticRange = defaultStaticRange
 		DefaultNetworkConfig.FloatingRange = defaultFloatingRange
 	}
 
 	if DefaultNetworkConfig.LeaseTime == 0 {
-		cfg.Log.Warn.Println("[CONFIG]", "Using default network lease time:", defaultLeaseTime.String())
+		cfg.warn("using default network lease time: " + defaultLeaseTime.String())
 		DefaultNetworkConfig.LeaseTime = defaultLeaseTime
 	}
 
+	cfg.NetworkConfig = DefaultNetworkConfig
+
 	baseIP, ipnet, err := net.ParseCIDR(DefaultNetworkConfig.Network)
 	if err != nil {
-		return err
-	}
-
-	DefaultNetworkConfig.BaseIP = baseIP
-	DefaultNetworkConfig.IPNet = ipnet
+		// The ranges can only be checked against a valid network.
+		cfg.problem("error parsing '-nw|--network': " + err.Error())
+	} else {
+		DefaultNetworkConfig.BaseIP = baseIP
+		DefaultNetworkConfig.IPNet = ipnet
 
-	if DefaultNetworkConfig.StaticRange != "" {
-		staticBase, staticNet, err := net.ParseCIDR(DefaultNetworkConfig.StaticRange)
-		if err != nil {
-			return err
-		} else if !ipnet.Contains(staticBase) {
-			return errors.New("network configuration has staticRange defined but the range does not exist in the configured network")
+		if DefaultNetworkConfig.StaticRange != "" {
+			staticBase, staticNet, err := net.ParseCIDR(DefaultNetworkConfig.StaticRange)
+			if err != nil {
+				cfg.problem("error parsing '-nsr|--network-static-range': " + err.Error())
+			} else if !ipnet.Contains(staticBase) {
+				cfg.problem("network configuration has staticRange defined but the range does not exist in the configured network")
+			} else {
+				DefaultNetworkConfig.StaticNet = staticNet
+			}
 		}
 
-		DefaultNetworkConfig.StaticNet = staticNet
-	}
-
-	if DefaultNetworkConfig.FloatingRange != "" {
-		floatingBase, floatingNet, err := net.ParseCIDR(DefaultNetworkConfig.FloatingRange)
-		if err != nil {
-			return err
-		} else if !ipnet.Contains(floatingBase) {
-			return errors.New("network configuration has floatingRange defined but the range does not exist in the configured network")
-		} else if DefaultNetworkConfig.StaticNet != nil && DefaultNetworkConfig.StaticNet.Contains(floatingBase) {
-			return errors.New("network configuration has floatingRange and staticRange defined but the ranges conflict with each other")
+		if DefaultNetworkConfig.FloatingRange != "" {
+			floatingBase, floatingNet, err := net.ParseCIDR(DefaultNetworkConfig.FloatingRange)
+			if err != nil {
+				cfg.problem("error parsing '-nfr|--network-floating-range': " + err.Error())
+			} else if !ipnet.Contains(floatingBase) {
+				cfg.problem("network configuration has floatingRange defined but the range does not exist in the configured network")
+			} else if DefaultNetworkConfig.StaticNet != nil && DefaultNetworkConfig.StaticNet.Contains(floatingBase) {
+				cfg.problem("network configuration has floatingRange and staticRange defined but the ranges conflict with each other")
+			} else {
+				DefaultNetworkConfig.FloatingNet = floatingNet
+			}
 		}
-
-		DefaultNetworkConfig.FloatingNet = floatingNet
 	}
 
-	cfg.NetworkConfig = DefaultNetworkConfig
-
 	if cfg.PublicIPv4 == nil && !cfg.DisableIPv4 {
 		routes, err := netlink.RouteGet(googleV4)
 		if err != nil {
-			return errors.New("error retrieving ipv4 route information, check to ensure valid network configuration exists on at the very least the loopback interface")
-		}
-		if !ArrayEquals(routes[0].Src, loopbackV4) {
+			cfg.problem("error retrieving ipv4 route information, check to ensure valid network configuration exists on at the very least the loopback interface")
+		} else if !ArrayEquals(routes[0].Src, loopbackV4) {
 			cfg.PublicIPv4 = routes[0].Src
 			cfg.IsIPv4Enabled = true
 		}
@@ -453,15 +547,11 @@ func (cfg *Config) computeArgs() error {
 	}
 
 	if cfg.PublicIPv6 == nil && !cfg.DisableIPv6 {
+		_, ipNet, _ := net.ParseCIDR(linkLocal)
 		routes, err := netlink.RouteGet(googleV6)
 		if err != nil {
-			return errors.New("error retrieving ipv6 route information, check to ensure valid network configuration exists on at the very least the loopback interface")
-		}
-		_, ipNet, err := net.ParseCIDR(linkLocal)
-		if err != nil {
-			return errors.New("error parsing ipv6 linkLocal addressing")
-		}
-		if !ArrayEquals(routes[0].Src, loopbackV6) && !ipNet.Contains(routes[0].Src) {
+			cfg.problem("error retrieving ipv6 route information, check to ensure valid network configuration exists on at the very least the loopback interface")
+		} else if !ArrayEquals(routes[0].Src, loopbackV6) && !ipNet.Contains(routes[0].Src) {
 			cfg.PublicIPv6 = routes[0].Src
 			cfg.IsIPv6Enabled = true
 		}
@@ -484,7 +574,7 @@ func (cfg *Config) computeArgs() error {
 			copy(sa.Addr[:], allV4.To4()[:])
 			cfg.ListenAddr = sa
 		default:
-			return errors.New("an impossible situation occurred, neither ipv4 or ipv6 is available, check your networking configuration you must have public internet access to use automatic configuration")
+			cfg.problem("an impossible situation occurred, neither ipv4 or ipv6 is available, check your networking configuration you must have public internet access to use automatic configuration")
 		}
 	} else if addr := cfg.ListenIP.To4(); addr != nil {
 		sa := &syscall.SockaddrInet4{Port: cfg.ListenPort}
@@ -495,31 +585,37 @@ func (cfg *Config) computeArgs() error {
 		copy(sa.Addr[:], addr[:])
 		cfg.ListenAddr = sa
 	} else {
-		return errors.New("an impossible situation occurred, neither ipv4 or ipv6 is available, check your networking configuration you must have public internet access to use automatic configuration")
+		cfg.problem("an impossible situation occurred, neither ipv4 or ipv6 is available, check your networking configuration you must have public internet access to use automatic configuration")
 	}
 
-	pid := os.Getpid()
-	return ioutil.WriteFile(cfg.PidFile, []byte(strconv.Itoa(pid)), os.ModePerm)
+	_, ipv6 := cfg.ListenAddr.(*syscall.SockaddrInet6)
+	cfg.MaxPacketLength, cfg.MTU = PacketLengths(cfg.LinkMTU, ipv6)
 }
 
-// NewConfig creates a new Config struct based on user supplied input.
-func NewConfig(log *Logger) (*Config, error) {
-	cfg := &Config{
-		Log: log,
-	}
-
-	// Handle the help and version commands if they exist
-	cfg.parseSpecial(true)
+// persist writes out the machine id, encryption keys, and pid file, which is the only part of loading the configuration with side effects.
+func (cfg *Config) persist() error {
+	os.MkdirAll(cfg.DataDir, os.ModeDir)
+	os.MkdirAll(path.Dir(cfg.PidFile), os.ModeDir)
 
-	// Handle parsing user supplied configuration data
-	if err := cfg.parseArgs(); err != nil {
-		return nil, err
+	if cfg.newMachineID != nil {
+		if err := ioutil.WriteFile(path.Join(cfg.DataDir, "machine-id"), cfg.newMachineID, os.ModePerm); err != nil {
+			return errors.New("error writing the machine id to the data directory '" + cfg.DataDir + "': " + err.Error())
+		}
+		cfg.newMachineID = nil
 	}
 
-	// Compute internal configuration based on the user supplied configuration data
-	if err := cfg.computeArgs(); err != nil {
-		return nil, err
+	if cfg.newKeys {
+		if err := writeKeys(cfg.keysPath(), cfg.PrivateKey, cfg.PrivateSalt); err != nil {
+			return err
+		}
+		cfg.newKeys = false
 	}
 
-	return cfg, nil
+	pid := os.Getpid()
+	return ioutil.WriteFile(cfg.PidFile, []byte(strconv.Itoa(pid)), os.ModePerm)
+}
+
+// NewConfig creates a new Config struct based on user supplied input, returning every problem found with the configuration as a single error.
+func NewConfig(log *Logger) (*Config, error) {
+	return ValidateConfig(log).Apply()
 }
@@ -0,0 +1,125 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+)
+
+// ControlType represents the type of a quantum control packet.
+type ControlType byte
+
+const (
+	// PMTUProbe control packets are padded probes used to discover the path MTU to a remote peer.
+	PMTUProbe ControlType = iota + 1
+
+	// PMTUAck control packets acknowledge the receipt of a PMTUProbe control packet.
+	PMTUAck
+
+	// LatencyProbe control packets are timestamped probes used to measure the round trip time and packet loss to a remote peer.
+	LatencyProbe
+
+	// LatencyReply control packets echo a LatencyProbe control packet back to its sender.
+	LatencyReply
+
+	// DiagProbe control packets are challenges used to diagnose the overlay path to a remote peer on demand.
+	DiagProbe
+
+	// DiagReply control packets answer a DiagProbe control packet with the remote peer's view of the path back to its sender.
+	DiagReply
+)
+
+const (
+	// ControlTypeStart - The control type position within a control packet.
+	ControlTypeStart = PacketStart
+
+	// ControlIPStart - The sender private ip start position within a control packet.
+	ControlIPStart = ControlTypeStart + 1
+
+	// ControlIPEnd - The sender private ip end position within a control packet.
+	ControlIPEnd = ControlIPStart + IPLength
+
+	// ControlMACLength - The length of the MAC authenticating a control packet.
+	ControlMACLength = 16
+
+	// ControlMACStart - The MAC start position within a control packet.
+	ControlMACStart = ControlIPEnd
+
+	// ControlMACEnd - The MAC end position within a control packet.
+	ControlMACEnd = ControlMACStart + ControlMACLength
+
+	// ControlDataStart - The control data start position within a control packet.
+	ControlDataStart = ControlMACEnd
+
+	// ControlHeaderSize - The size of the data prepended to the control data.
+	ControlHeaderSize = ControlDataStart
+)
+
+/*
+IsControlPayload returns true if the payload is a quantum control packet rather than a tunneled packet.
+
+Control packets are sent between quantum nodes directly, and are never handed to the plugins or the network device. They are identified by an all zero private ip header, which is never a valid private ip address, followed by the ControlType, the private ip address of the sender, and the MAC filled in by SignControlPayload:
+
+	| 0.0.0.0 (4 bytes) | ControlType (1 byte) | Sender Private IP (4 bytes) | MAC (16 bytes) | Control Data |
+*/
+func IsControlPayload(payload *Payload) bool {
+	if payload.Length < ControlHeaderSize {
+		return false
+	}
+
+	for i := IPStart; i < IPEnd; i++ {
+		if payload.Raw[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NewControlPayload is used to generate a control payload of the given type, from the given sender, with room for dataLength bytes of control data.
+func NewControlPayload(raw []byte, controlType ControlType, sender net.IP, dataLength int) *Payload {
+	for i := IPStart; i < IPEnd; i++ {
+		raw[i] = 0
+	}
+	raw[ControlTypeStart] = byte(controlType)
+	copy(raw[ControlIPStart:ControlIPEnd], sender.To4())
+	for i := ControlMACStart; i < ControlMACEnd; i++ {
+		raw[i] = 0
+	}
+
+	return &Payload{
+		Raw:       raw,
+		IPAddress: raw[IPStart:IPEnd],
+		Packet:    raw[PacketStart : ControlDataStart+dataLength],
+		Length:    ControlHeaderSize + dataLength,
+	}
+}
+
+// controlMAC computes the MAC of the control payload over everything following the all zero private ip header but the MAC itself, keyed by a key derived from the pre-shared key rather than the pre-shared key itself.
+func controlMAC(payload *Payload, psk []byte) []byte {
+	derive := hmac.New(sha256.New, psk)
+	derive.Write([]byte("quantum control"))
+
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(payload.Raw[ControlTypeStart:ControlMACStart])
+	mac.Write(payload.Raw[ControlDataStart:payload.Length])
+	return mac.Sum(nil)[:ControlMACLength]
+}
+
+// SignControlPayload fills in the MAC of the control payload, which must be done once the control data has been written. Without a pre-shared key the MAC is left zeroed.
+func SignControlPayload(payload *Payload, psk []byte) {
+	if len(psk) == 0 {
+		return
+	}
+	copy(payload.Raw[ControlMACStart:ControlMACEnd], controlMAC(payload, psk))
+}
+
+// VerifyControlPayload returns true if the control payload was signed with the pre-shared key, so that nodes without the pre-shared key are unable to probe the node or elicit replies from it. Without a pre-shared key every control payload is accepted.
+func VerifyControlPayload(payload *Payload, psk []byte) bool {
+	if len(psk) == 0 {
+		return true
+	}
+	return hmac.Equal(payload.Raw[ControlMACStart:ControlMACEnd], controlMAC(payload, psk))
+}
@@ -69,16 +69,17 @@ func GenerateLocalMapping(cfg *Config, mappings map[uint32]*Mapping) (*Mapping,
 	return NewMapping(cfg), nil
 }
 
-// GenerateFloatingMapping will take in the user defined configuration plus the currently defined mappins, in order to determine the floating mapping.
+// GenerateFloatingMapping will take in the user defined configuration plus the currently defined mappins, in order to determine the floating mapping for the floating ip at the index within the running configuration.
 func GenerateFloatingMapping(cfg *Config, i int, mappings map[uint32]*Mapping) (*Mapping, error) {
-	if nonFloatingIPExists(cfg.FloatingIPs[i], mappings) {
-		return nil, errors.New("the floating ip '" + cfg.FloatingIPs[i].String() + "' is already assigned to a different node as a static or dhcp ip address")
-	} else if cfg.NetworkConfig.StaticNet != nil && cfg.NetworkConfig.StaticNet.Contains(cfg.FloatingIPs[i]) {
-		return nil, errors.New("the floating ip '" + cfg.FloatingIPs[i].String() + "' lies within the reserved static ip range")
-	} else if cfg.NetworkConfig.FloatingNet != nil && !cfg.NetworkConfig.FloatingNet.Contains(cfg.FloatingIPs[i]) {
-		return nil, errors.New("the floating ip '" + cfg.FloatingIPs[i].String() + "' does not lie within the reserved floating ip range")
-	} else if !cfg.NetworkConfig.IPNet.Contains(cfg.FloatingIPs[i]) {
-		return nil, errors.New("the floating ip '" + cfg.FloatingIPs[i].String() + "' does not lie within the overall network range")
+	ip := cfg.Current().FloatingIPs[i]
+	if nonFloatingIPExists(ip, mappings) {
+		return nil, errors.New("the floating ip '" + ip.String() + "' is already assigned to a different node as a static or dhcp ip address")
+	} else if cfg.NetworkConfig.StaticNet != nil && cfg.NetworkConfig.StaticNet.Contains(ip) {
+		return nil, errors.New("the floating ip '" + ip.String() + "' lies within the reserved static ip range")
+	} else if cfg.NetworkConfig.FloatingNet != nil && !cfg.NetworkConfig.FloatingNet.Contains(ip) {
+		return nil, errors.New("the floating ip '" + ip.String() + "' does not lie within the reserved floating ip range")
+	} else if !cfg.NetworkConfig.IPNet.Contains(ip) {
+		return nil, errors.New("the floating ip '" + ip.String() + "' does not lie within the overall network range")
 	}
 
 	return NewFloatingMapping(cfg, i), nil
@@ -0,0 +1,185 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/supernomad/quantum/crypto"
+)
+
+const (
+	// KeysFileName is the name of the file, within the data directory, that the encryption keys are stored in.
+	KeysFileName = "encryption-keys"
+
+	// keyLength is the length of the curve25519 private key and salt.
+	keyLength = 32
+
+	// minPSKLength is the minimum length of the pre-shared key, which is long enough for 32 random hex encoded characters.
+	minPSKLength = 32
+)
+
+// keysFile is the format of the file the encryption keys are stored in, the public key and salt are derived from the private ones.
+type keysFile struct {
+	PrivateKey  string `json:"privateKey"`
+	PrivateSalt string `json:"privateSalt"`
+}
+
+// readSecret reads the file holding the secret, which must only be accessible by the user running quantum.
+func readSecret(file, secret string) ([]byte, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New("error reading the " + secret + " from '" + file + "': " + err.Error())
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return nil, errors.New("error reading the " + secret + " from '" + file + "': the file is accessible by other users, its permissions are " + strconv.FormatUint(uint64(perm), 8) + " rather than 600")
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("error reading the " + secret + " from '" + file + "': " + err.Error())
+	}
+	return buf, nil
+}
+
+// readKeys reads the private key and salt from the file, which must only be accessible by the user running quantum.
+func readKeys(file string) ([]byte, []byte, error) {
+	buf, err := readSecret(file, "encryption keys")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys keysFile
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return nil, nil, errors.New("error parsing the encryption keys in '" + file + "': " + err.Error())
+	}
+
+	priv, err := hex.DecodeString(keys.PrivateKey)
+	if err != nil || len(priv) != keyLength {
+		return nil, nil, errors.New("error parsing the encryption keys in '" + file + "': the private key must be " + strconv.Itoa(keyLength) + " hex encoded bytes")
+	}
+	salt, err := hex.DecodeString(keys.PrivateSalt)
+	if err != nil || len(salt) != keyLength {
+		return nil, nil, errors.New("error parsing the encryption keys in '" + file + "': the private salt must be " + strconv.Itoa(keyLength) + " hex encoded bytes")
+	}
+	return priv, salt, nil
+}
+
+// writeKeys writes the private key and salt to the file, replacing it in one go so that a partially written file is never read back.
+func writeKeys(file string, priv, salt []byte) error {
+	buf, err := json.Marshal(&keysFile{PrivateKey: hex.EncodeToString(priv), PrivateSalt: hex.EncodeToString(salt)})
+	if err != nil {
+		return errors.New("error marshalling the encryption keys: " + err.Error())
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return errors.New("error writing the encryption keys to '" + file + "': " + err.Error())
+	}
+	// WriteFile leaves the permissions of an existing file alone.
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return errors.New("error writing the encryption keys to '" + file + "': " + err.Error())
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return errors.New("error writing the encryption keys to '" + file + "': " + err.Error())
+	}
+	return nil
+}
+
+// keysPath returns the path of the file the encryption keys are loaded from.
+func (cfg *Config) keysPath() string {
+	if cfg.EncryptionKeyFile != "" {
+		return cfg.EncryptionKeyFile
+	}
+	return path.Join(cfg.DataDir, KeysFileName)
+}
+
+// setKeys sets the private key and salt, along with the public key and salt derived from them.
+func (cfg *Config) setKeys(priv, salt []byte) {
+	cfg.PublicKey, cfg.PrivateKey = crypto.GenerateECPublicKey(priv), priv
+	cfg.PublicSalt, cfg.PrivateSalt = crypto.GenerateECPublicKey(salt), salt
+}
+
+// loadKeys loads the encryption keys from the key file, or the data directory. New keys are only generated here if the data directory has none, they are written to the data directory once the configuration is applied.
+func (cfg *Config) loadKeys() {
+	priv, salt, err := readKeys(cfg.keysPath())
+	switch {
+	case err == nil:
+		cfg.setKeys(priv, salt)
+	case os.IsNotExist(err) && cfg.EncryptionKeyFile == "":
+		_, priv = crypto.GenerateECKeyPair()
+		_, salt = crypto.GenerateECKeyPair()
+		cfg.setKeys(priv, salt)
+		cfg.newKeys = true
+	case os.IsNotExist(err):
+		cfg.problem("error reading the encryption keys from '" + cfg.EncryptionKeyFile + "': the file does not exist")
+	default:
+		cfg.problem(err.Error())
+	}
+}
+
+// loadPSK loads the pre-shared key from the pre-shared key file, if one is configured.
+func (cfg *Config) loadPSK() {
+	if cfg.EncryptionPSKFile == "" {
+		return
+	}
+
+	buf, err := readSecret(cfg.EncryptionPSKFile, "pre-shared key")
+	if os.IsNotExist(err) {
+		cfg.problem("error reading the pre-shared key from '" + cfg.EncryptionPSKFile + "': the file does not exist")
+		return
+	} else if err != nil {
+		cfg.problem(err.Error())
+		return
+	}
+
+	psk := bytes.TrimSpace(buf)
+	if len(psk) < minPSKLength {
+		cfg.problem("error reading the pre-shared key from '" + cfg.EncryptionPSKFile + "': the pre-shared key must be at least " + strconv.Itoa(minPSKLength) + " characters long")
+		return
+	}
+	cfg.PSK = psk
+}
+
+/*
+UseKeys replaces the encryption keys with the supplied private key and salt, deriving the public key and salt from them, and writes them to the data directory so that they are used from then on. The new keys are published as part of the running configuration, and are read through Current.
+
+The keys are never written when they are loaded from a key file, or during a dry run, in which case they are only used until quantum is restarted.
+*/
+func (cfg *Config) UseKeys(priv, salt []byte) error {
+	if len(priv) != keyLength || len(salt) != keyLength {
+		return errors.New("error using the encryption keys: the private key and salt must be " + strconv.Itoa(keyLength) + " bytes")
+	}
+
+	running := cfg.Current()
+	if running.EncryptionKeyFile == "" && !running.DryRun {
+		if err := writeKeys(running.keysPath(), priv, salt); err != nil {
+			return err
+		}
+	}
+
+	cfg.publish(func(updated *Config) {
+		updated.setKeys(priv, salt)
+		updated.newKeys = false
+	})
+	return nil
+}
+
+// UsePSK replaces the pre-shared key mixed into the encryption keys, which is published as part of the running configuration and read through Current.
+func (cfg *Config) UsePSK(psk []byte) {
+	cfg.publish(func(updated *Config) {
+		updated.PSK = psk
+	})
+}
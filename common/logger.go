@@ -4,9 +4,19 @@
 package common
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // LoggerType will determine the logging level of the logger object created.
@@ -29,40 +39,250 @@ const (
 	DebugLogger
 )
 
-// Logger struct which allows for a single global point for logging configuration.
+const (
+	// LogfmtFormat writes each log entry as a line of space separated 'key=value' pairs.
+	LogfmtFormat = "logfmt"
+
+	// JSONFormat writes each log entry as a single line json object.
+	JSONFormat = "json"
+
+	logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var loggerTypes = map[LoggerType]string{
+	NoopLogger:  "none",
+	ErrorLogger: "error",
+	WarnLogger:  "warn",
+	InfoLogger:  "info",
+	DebugLogger: "debug",
+}
+
+// String returns the name of the logging level, as it is supplied to '-ll|--log-level'.
+func (loggerType LoggerType) String() string {
+	if name, ok := loggerTypes[loggerType]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseLoggerType returns the logging level with the supplied name, one of 'error', 'warn', 'info', or 'debug'.
+func ParseLoggerType(name string) (LoggerType, error) {
+	for loggerType := ErrorLogger; loggerType <= DebugLogger; loggerType++ {
+		if loggerTypes[loggerType] == name {
+			return loggerType, nil
+		}
+	}
+	return NoopLogger, errors.New("unknown log level '" + name + "', expected one of 'error', 'warn', 'info', or 'debug'")
+}
+
+// logOutput is the state shared between a logger and every logger derived from it, so that changing the level or format applies to all of them.
+type logOutput struct {
+	mux    sync.Mutex
+	level  int32
+	json   int32
+	stdout io.Writer
+	stderr io.Writer
+	now    func() time.Time
+}
+
+/*
+Logger struct which allows for a single global point for logging configuration.
+
+Every log entry is structured, carrying the time, level, component, and message along with any key/value pairs supplied as context. Entries are written either in logfmt or as json, with errors and warnings going to stderr and everything else going to stdout.
+*/
 type Logger struct {
+	// Plain writes unstructured output, such as the usage and version information.
 	Plain *log.Logger
-	Error *log.Logger
-	Info  *log.Logger
-	Warn  *log.Logger
-	Debug *log.Logger
+
+	out    *logOutput
+	fields []interface{}
 }
 
-// NewLogger creates a new logger struct based on the supplied LoggerType.
-func NewLogger(loggerType LoggerType) *Logger {
-	logger := &Logger{
-		Plain: log.New(os.Stdout, "", 0),
-		Error: log.New(os.Stderr, "[ERROR] ", 0),
-		Warn:  log.New(os.Stderr, "[WARN] ", 0),
-		Info:  log.New(os.Stdout, "[INFO] ", 0),
-		Debug: log.New(os.Stdout, "[DEBUG] ", 0),
+// SetLevel changes the logging level of the logger, along with every logger derived from it, while quantum is running.
+func (logger *Logger) SetLevel(loggerType LoggerType) {
+	atomic.StoreInt32(&logger.out.level, int32(loggerType))
+}
+
+// Level returns the current logging level of the logger.
+func (logger *Logger) Level() LoggerType {
+	return LoggerType(atomic.LoadInt32(&logger.out.level))
+}
+
+// Enabled returns whether or not entries at the supplied logging level are written out.
+func (logger *Logger) Enabled(loggerType LoggerType) bool {
+	return loggerType <= logger.Level()
+}
+
+// SetFormat changes the format entries are written in, either 'logfmt' or 'json'.
+func (logger *Logger) SetFormat(format string) error {
+	switch format {
+	case LogfmtFormat:
+		atomic.StoreInt32(&logger.out.json, 0)
+	case JSONFormat:
+		atomic.StoreInt32(&logger.out.json, 1)
+	default:
+		return errors.New("unknown log format '" + format + "', expected either 'logfmt' or 'json'")
 	}
+	return nil
+}
 
-	if ErrorLogger > loggerType {
-		logger.Error.SetOutput(ioutil.Discard)
+// Configure sets the logging level and format by name, as they are supplied to '-ll|--log-level' and '-lf|--log-format'.
+func (logger *Logger) Configure(level, format string) error {
+	loggerType, err := ParseLoggerType(level)
+	if err != nil {
+		return err
 	}
+	if err := logger.SetFormat(format); err != nil {
+		return err
+	}
+
+	logger.SetLevel(loggerType)
+	return nil
+}
 
-	if WarnLogger > loggerType {
-		logger.Warn.SetOutput(ioutil.Discard)
+// With returns a logger which adds the supplied key/value pairs to every entry, sharing the level and format of the logger it is derived from.
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyvals))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{
+		Plain:  logger.Plain,
+		out:    logger.out,
+		fields: fields,
 	}
+}
 
-	if InfoLogger > loggerType {
-		logger.Info.SetOutput(ioutil.Discard)
-		logger.Plain.SetOutput(ioutil.Discard)
+// Error logs the message from the component, along with the key/value pairs, when errors are logged.
+func (logger *Logger) Error(component, msg string, keyvals ...interface{}) {
+	logger.write(ErrorLogger, component, msg, keyvals)
+}
+
+// Warn logs the message from the component, along with the key/value pairs, when warnings are logged.
+func (logger *Logger) Warn(component, msg string, keyvals ...interface{}) {
+	logger.write(WarnLogger, component, msg, keyvals)
+}
+
+// Info logs the message from the component, along with the key/value pairs, when informational messages are logged.
+func (logger *Logger) Info(component, msg string, keyvals ...interface{}) {
+	logger.write(InfoLogger, component, msg, keyvals)
+}
+
+// Debug logs the message from the component, along with the key/value pairs, when debug messages are logged.
+func (logger *Logger) Debug(component, msg string, keyvals ...interface{}) {
+	logger.write(DebugLogger, component, msg, keyvals)
+}
+
+func (logger *Logger) write(loggerType LoggerType, component, msg string, keyvals []interface{}) {
+	if !logger.Enabled(loggerType) {
+		return
+	}
+
+	entry := []interface{}{
+		"time", logger.out.now().Format(logTimeFormat),
+		"level", loggerType.String(),
+		"component", component,
+		"msg", msg,
+	}
+	entry = append(entry, logger.fields...)
+	entry = append(entry, keyvals...)
+	if len(entry)%2 != 0 {
+		entry = append(entry, nil)
+	}
+
+	var buf []byte
+	if atomic.LoadInt32(&logger.out.json) == 1 {
+		buf = encodeJSON(entry)
+	} else {
+		buf = encodeLogfmt(entry)
+	}
+
+	w := logger.out.stdout
+	if loggerType <= WarnLogger {
+		w = logger.out.stderr
+	}
+
+	logger.out.mux.Lock()
+	w.Write(buf)
+	logger.out.mux.Unlock()
+}
+
+// logValue converts a context value into the form it is logged as.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func encodeLogfmt(entry []interface{}) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(entry); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(fmt.Sprint(entry[i]))
+		buf.WriteByte('=')
+
+		value := logValue(entry[i+1])
+		if value == nil {
+			continue
+		}
+
+		str := fmt.Sprint(value)
+		if str == "" || strings.ContainsAny(str, " =\"\t\r\n") {
+			str = strconv.Quote(str)
+		}
+		buf.WriteString(str)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func encodeJSON(entry []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < len(entry); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(entry[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(logValue(entry[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(entry[i+1]))
+		}
+		buf.Write(value)
 	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
 
-	if DebugLogger > loggerType {
-		logger.Debug.SetOutput(ioutil.Discard)
+// NewLogger creates a new logger struct based on the supplied LoggerType, which writes entries in logfmt until told otherwise.
+func NewLogger(loggerType LoggerType) *Logger {
+	logger := &Logger{
+		Plain: log.New(os.Stdout, "", 0),
+		out: &logOutput{
+			level:  int32(loggerType),
+			stdout: os.Stdout,
+			stderr: os.Stderr,
+			now:    time.Now,
+		},
+	}
+
+	if InfoLogger > loggerType {
+		logger.Plain.SetOutput(ioutil.Discard)
 	}
 
 	return logger
@@ -88,10 +88,11 @@ func ParseMapping(str string, cfg *Config) (*Mapping, error) {
 	}
 
 	if mapping.PublicKey != nil && mapping.PublicSalt != nil {
-		secret := crypto.GenerateSharedSecret(mapping.PublicKey, cfg.PrivateKey)
-		salt := crypto.GenerateSharedSecret(mapping.PublicSalt, cfg.PrivateSalt)
+		running := cfg.Current()
+		secret := crypto.GenerateSharedSecret(mapping.PublicKey, running.PrivateKey)
+		salt := crypto.GenerateSharedSecret(mapping.PublicSalt, running.PrivateSalt)
 
-		aes, err := crypto.NewAES(secret, salt)
+		aes, err := crypto.NewAES(secret, salt, running.PSK)
 		if err != nil {
 			return nil, err
 		}
@@ -104,32 +105,34 @@ func ParseMapping(str string, cfg *Config) (*Mapping, error) {
 
 // NewMapping generates a new basic Mapping with no cryptographic metadata.
 func NewMapping(cfg *Config) *Mapping {
+	running := cfg.Current()
 	return &Mapping{
 		MachineID:        cfg.MachineID,
 		IPv4:             cfg.PublicIPv4,
 		IPv6:             cfg.PublicIPv6,
 		Port:             cfg.ListenPort,
 		PrivateIP:        cfg.PrivateIP,
-		SupportedPlugins: cfg.Plugins,
-		PublicKey:        cfg.PublicKey,
-		PublicSalt:       cfg.PublicSalt,
+		SupportedPlugins: running.Plugins,
+		PublicKey:        running.PublicKey,
+		PublicSalt:       running.PublicSalt,
 		Floating:         false,
-		Gateway:          cfg.Gateway,
+		Gateway:          running.Gateway,
 	}
 }
 
-// NewFloatingMapping generates a new basic Mapping with no cryptographic metadata.
+// NewFloatingMapping generates a new basic Mapping with no cryptographic metadata, for the floating ip at the index within the running configuration.
 func NewFloatingMapping(cfg *Config, i int) *Mapping {
+	running := cfg.Current()
 	return &Mapping{
 		MachineID:        cfg.MachineID,
 		IPv4:             cfg.PublicIPv4,
 		IPv6:             cfg.PublicIPv6,
 		Port:             cfg.ListenPort,
-		PrivateIP:        cfg.FloatingIPs[i],
-		SupportedPlugins: cfg.Plugins,
-		PublicKey:        cfg.PublicKey,
-		PublicSalt:       cfg.PublicSalt,
+		PrivateIP:        running.FloatingIPs[i],
+		SupportedPlugins: running.Plugins,
+		PublicKey:        running.PublicKey,
+		PublicSalt:       running.PublicSalt,
 		Floating:         true,
-		Gateway:          cfg.Gateway,
+		Gateway:          running.Gateway,
 	}
 }
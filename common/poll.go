@@ -0,0 +1,127 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+)
+
+// Waker is an eventfd which, once woken, stays readable so that every epoll instance watching it returns straight away.
+type Waker int
+
+// Wake every epoll instance watching the Waker.
+func (waker Waker) Wake() error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 1)
+
+	if _, err := syscall.Write(int(waker), buf); err != nil && err != syscall.EAGAIN {
+		return errors.New("error waking the blocked workers: " + err.Error())
+	}
+	return nil
+}
+
+// Close the underlying eventfd.
+func (waker Waker) Close() error {
+	return syscall.Close(int(waker))
+}
+
+// NewWaker creates a new eventfd based Waker, which is not inherited across a rolling restart.
+func NewWaker() (Waker, error) {
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		return -1, errors.New("error creating the eventfd: " + errno.Error())
+	}
+	return Waker(fd), nil
+}
+
+/*
+Poller waits for the queues of a network device or socket to become readable, so that the workers reading them can be woken when they are stopped rather than blocking in a read forever.
+
+Once woken the poller keeps reporting a queue as readable until there is nothing left to read from it, which lets the workers drain any packets already queued before they exit. The queues are expected to be non-blocking, or read with MSG_DONTWAIT, as during a rolling restart both processes read the same queues and a packet reported as readable may already be gone.
+*/
+type Poller struct {
+	waker  Waker
+	epolls []int
+	events [][]syscall.EpollEvent
+}
+
+// Wait blocks until the queue is readable, returning true, or until the poller has been woken and the queue has nothing left to read, returning false.
+func (poller *Poller) Wait(queue int) bool {
+	for {
+		n, err := syscall.EpollWait(poller.epolls[queue], poller.events[queue], -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return false
+		}
+
+		woken := false
+		for i := 0; i < n; i++ {
+			if poller.events[queue][i].Fd != int32(poller.waker) {
+				return true
+			}
+			woken = true
+		}
+		if woken {
+			return false
+		}
+	}
+}
+
+// Wake every queue blocked in Wait.
+func (poller *Poller) Wake() error {
+	return poller.waker.Wake()
+}
+
+// Close the epoll instances along with the eventfd used to wake them, the queues themselves are left open.
+func (poller *Poller) Close() error {
+	for i := 0; i < len(poller.epolls); i++ {
+		if poller.epolls[i] < 0 {
+			continue
+		}
+		if err := syscall.Close(poller.epolls[i]); err != nil {
+			return errors.New("error closing the epoll instance: " + err.Error())
+		}
+		poller.epolls[i] = -1
+	}
+	return poller.waker.Close()
+}
+
+// NewPoller creates a Poller watching the supplied queue file descriptors, one epoll instance per queue so that each worker waits on its own queue.
+func NewPoller(queues []int) (*Poller, error) {
+	waker, err := NewWaker()
+	if err != nil {
+		return nil, err
+	}
+
+	poller := &Poller{
+		waker:  waker,
+		epolls: make([]int, len(queues)),
+		events: make([][]syscall.EpollEvent, len(queues)),
+	}
+	for i := 0; i < len(queues); i++ {
+		poller.epolls[i] = -1
+	}
+
+	for i := 0; i < len(queues); i++ {
+		epoll, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			poller.Close()
+			return nil, errors.New("error creating the epoll instance: " + err.Error())
+		}
+		poller.epolls[i] = epoll
+		poller.events[i] = make([]syscall.EpollEvent, 2)
+
+		for _, fd := range []int{queues[i], int(waker)} {
+			event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+			if err := syscall.EpollCtl(epoll, syscall.EPOLL_CTL_ADD, fd, event); err != nil {
+				poller.Close()
+				return nil, errors.New("error watching the queue: " + err.Error())
+			}
+		}
+	}
+	return poller, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Diff returns the long names of the user supplied options which differ between the running and the updated configuration, in the order they are defined.
+
+Options left at their defaults in both configurations are never reported, as quantum may have resolved them since it started, for instance by assigning a private ip address.
+*/
+func Diff(running, updated *Config) []string {
+	st := reflect.TypeOf(*running)
+	rv := reflect.ValueOf(running).Elem()
+	uv := reflect.ValueOf(updated).Elem()
+
+	var changes []string
+	for i := 0; i < st.NumField(); i++ {
+		internal, _, _, long, _, _ := running.parseField(st.Field(i).Tag)
+		if internal == "true" {
+			continue
+		}
+
+		if running.sources[long] == SourceDefault && updated.sources[long] == SourceDefault {
+			continue
+		}
+
+		if formatValue(rv.Field(i)) != formatValue(uv.Field(i)) {
+			changes = append(changes, long)
+		}
+	}
+	return changes
+}
+
+// publishMux serializes the changes to the running configuration, so that no change is lost to a concurrent one.
+var publishMux sync.Mutex
+
+/*
+Current returns the running configuration, including every change applied in place since quantum started. Every component shares the configuration quantum started with, and reads the options which can change while quantum is running through Current.
+
+The running configuration is an immutable snapshot, which is replaced rather than modified when a change is applied, so it must never be modified.
+*/
+func (cfg *Config) Current() *Config {
+	root := cfg
+	if cfg.root != nil {
+		root = cfg.root
+	}
+
+	if current, ok := root.current.Load().(*Config); ok {
+		return current
+	}
+	return root
+}
+
+// publish applies the change to a copy of the running configuration, and publishes the copy as the new running configuration.
+func (cfg *Config) publish(change func(updated *Config)) {
+	publishMux.Lock()
+	defer publishMux.Unlock()
+
+	root := cfg
+	if cfg.root != nil {
+		root = cfg.root
+	}
+
+	running := root.Current()
+	updated := new(Config)
+	*updated = *running
+	updated.root = root
+	updated.current = atomic.Value{}
+
+	if running.sources != nil {
+		updated.sources = make(map[string]string, len(running.sources))
+		for long, source := range running.sources {
+			updated.sources[long] = source
+		}
+	}
+
+	change(updated)
+	root.current.Store(updated)
+}
+
+// Restore publishes a running configuration previously returned by Current again, undoing every change published since.
+func (cfg *Config) Restore(running *Config) {
+	publishMux.Lock()
+	defer publishMux.Unlock()
+
+	root := cfg
+	if cfg.root != nil {
+		root = cfg.root
+	}
+	root.current.Store(running)
+}
+
+// Update publishes a new running configuration, with the supplied options, by long name, copied from the updated configuration. The new values are picked up the next time the running configuration is read with Current.
+func (cfg *Config) Update(updated *Config, options []string) {
+	cfg.publish(func(running *Config) {
+		st := reflect.TypeOf(*running)
+		rv := reflect.ValueOf(running).Elem()
+		uv := reflect.ValueOf(updated).Elem()
+
+		for i := 0; i < st.NumField(); i++ {
+			internal, _, _, long, _, _ := running.parseField(st.Field(i).Tag)
+			if internal == "true" || !StringInSlice(long, options) {
+				continue
+			}
+
+			rv.Field(i).Set(uv.Field(i))
+			if running.sources != nil {
+				running.sources[long] = updated.sources[long]
+			}
+		}
+	})
+}
@@ -10,6 +10,8 @@ import (
 	"os/signal"
 	"strconv"
 	"syscall"
+
+	"github.com/supernomad/quantum/systemd"
 )
 
 // Signaler struct used to manage os and user signals to the quantum process.
@@ -19,6 +21,8 @@ type Signaler struct {
 
 	fds     []int
 	env     map[string]string
+	hot     func() (bool, error)
+	handoff func(conn *os.File) error
 	signals chan os.Signal
 }
 
@@ -29,8 +33,18 @@ func (sig *Signaler) fork(exec bool, files []uintptr) (int, error) {
 	return -1, nil
 }
 
-func (sig *Signaler) reload(exec bool) error {
-	sig.log.Info.Println("[MAIN]", "Received reload signal from user. Reloading process...")
+// handoffSocket creates the unix socket pair the running state is handed off over, returning the end kept by this process and the end passed to the new process.
+func handoffSocket() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, errors.New("error creating the handoff socket: " + err.Error())
+	}
+	return os.NewFile(uintptr(fds[0]), "handoff"), os.NewFile(uintptr(fds[1]), "handoff"), nil
+}
+
+// reload the process with a rolling restart, returning whether or not the new process has taken over and this process should exit.
+func (sig *Signaler) reload(exec bool) (bool, error) {
+	sig.log.Info("main", "Received reload signal from user. Reloading process...")
 
 	files := make([]uintptr, 3+len(sig.fds))
 	files[0] = os.Stdin.Fd()
@@ -41,50 +55,156 @@ func (sig *Signaler) reload(exec bool) error {
 		files[3+i] = uintptr(sig.fds[i])
 	}
 
+	var running, next *os.File
+	if exec && sig.handoff != nil {
+		var err error
+		if running, next, err = handoffSocket(); err != nil {
+			return false, err
+		}
+
+		files = append(files, next.Fd())
+		os.Setenv(HandoffFDEnv, strconv.Itoa(len(files)-1))
+	}
+
 	for k, v := range sig.env {
 		os.Setenv(k, v)
 	}
 
+	// The new process takes over pinging the systemd watchdog, which it would otherwise ignore as meant for this process.
+	os.Unsetenv(systemd.WatchdogPIDEnv)
+
 	pid, err := sig.fork(exec, files)
+	if next != nil {
+		next.Close()
+		os.Unsetenv(HandoffFDEnv)
+	}
 	if err != nil {
-		return errors.New("error execing new instance of quantum during reload: " + err.Error())
+		if running != nil {
+			running.Close()
+		}
+		return false, errors.New("error execing new instance of quantum during reload: " + err.Error())
+	}
+
+	// The new process only takes over once it reports that it has started, otherwise it is stopped and this process carries on.
+	if running != nil {
+		if err := sig.handoff(running); err != nil {
+			sig.log.Error("main", "Error handing off to the new instance of quantum, stopping it and continuing to run", "pid", pid, "error", err)
+			syscall.Kill(pid, syscall.SIGTERM)
+			go syscall.Wait4(pid, nil, 0, nil)
+
+			sig.notify(systemd.Ready, systemd.Status("Reloading failed, running the previous process: "+err.Error()))
+			return false, nil
+		}
 	}
 
 	err = ioutil.WriteFile(sig.cfg.PidFile, []byte(strconv.Itoa(pid)), 0644)
 	if err != nil {
-		return errors.New("error the new pid for the new instance of quantum during reload: " + err.Error())
+		return false, errors.New("error the new pid for the new instance of quantum during reload: " + err.Error())
 	}
-	return nil
+
+	// Hand the service over to the new process, which has already started unless there is no handoff.
+	if exec {
+		sig.notify(systemd.MainPID(pid), systemd.Ready)
+	}
+	return true, nil
 }
 
 func (sig *Signaler) terminate(exec bool) error {
-	sig.log.Info.Println("[MAIN]", "Received termination signal from user. Terminating process.")
+	sig.log.Info("main", "Received termination signal from user. Terminating process.")
+	sig.notify(systemd.Stopping, systemd.Status("Stopping"))
 	return nil
 }
 
-// Wait for a configured os or user signal to be passed to the quantum process.
+// notify sends the states to systemd, logging rather than returning any failure.
+func (sig *Signaler) notify(states ...string) {
+	if _, err := systemd.Notify(states...); err != nil {
+		sig.log.Warn("main", "Error notifying systemd", "error", err)
+	}
+}
+
+// reloadInPlace attempts to apply the configuration without restarting the process, returning whether or not it was applied and the process should keep running as is.
+func (sig *Signaler) reloadInPlace() (bool, error) {
+	if sig.hot == nil {
+		return false, nil
+	}
+
+	sig.log.Info("main", "Received reload signal from user. Reloading configuration...")
+	return sig.hot()
+}
+
+// toggleDebug switches the logger to the debug level, or back to the configured level if it is already logging at the debug level.
+func (sig *Signaler) toggleDebug() {
+	level := DebugLogger
+	if sig.log.Level() == DebugLogger {
+		var err error
+		if level, err = ParseLoggerType(sig.cfg.Current().LogLevel); err != nil || level == DebugLogger {
+			level = InfoLogger
+		}
+	}
+
+	sig.log.SetLevel(level)
+	sig.log.Info("main", "Received log level signal from user. Changed the log level.", "level", level)
+}
+
+// Wait for a configured os or user signal to be passed to the quantum process. Reload signals that are applied in place, and log level signals, are handled without returning.
 func (sig *Signaler) Wait(exec bool) error {
-	s := <-sig.signals
-	switch s {
-	case syscall.SIGHUP:
-		return sig.reload(exec)
-	case syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT:
-		return sig.terminate(exec)
+	for {
+		s := <-sig.signals
+		switch s {
+		case syscall.SIGHUP:
+			sig.notify(systemd.Reloading, systemd.Status("Reloading"))
+			applied, err := sig.reloadInPlace()
+			if err != nil {
+				sig.log.Error("main", "Error reloading the configuration, the running configuration is left as is", "error", err)
+				sig.notify(systemd.Ready, systemd.Status("Reloading failed, running the previous configuration: "+err.Error()))
+				continue
+			} else if applied {
+				sig.notify(systemd.Ready, systemd.Status("Reloaded the configuration in place"))
+				continue
+			}
+			if handedOff, err := sig.reload(exec); err != nil || handedOff {
+				return err
+			}
+		case syscall.SIGUSR1:
+			sig.toggleDebug()
+		case syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT:
+			return sig.terminate(exec)
+		default:
+			return errors.New("build error received undefined signal")
+		}
+	}
+}
+
+// Reload the quantum process in the same way as a reload signal, without signalling the process itself, so that reloads requested through the api never reach other signal handlers. Only one reload can be pending at a time.
+func (sig *Signaler) Reload() error {
+	select {
+	case sig.signals <- syscall.SIGHUP:
+		return nil
 	default:
-		return errors.New("build error received undefined signal")
+		return errors.New("a reload is already pending")
 	}
 }
 
 // NewSignaler generates a new Signaler object, which will watch for new os and user signals passed to the quantum process.
-func NewSignaler(log *Logger, cfg *Config, fds []int, env map[string]string) *Signaler {
-	signals := make(chan os.Signal)
-	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+//
+// A SIGUSR1 toggles debug logging on and off, turning it off restores the configured log level.
+//
+// When run by systemd, reloads and termination are reported to it. A rolling restart hands the service over to the new process, which reports itself ready once started.
+//
+// On a reload signal the hot function, if supplied, is called first to apply the configuration in place. It returns whether or not the configuration was applied, if it was not the process is reloaded with a rolling restart, and if it returns an error the reload is abandoned.
+//
+// During a rolling restart the handoff function, if supplied, is called with this end of a unix socket passed to the new process, taking ownership of it. It hands the running state off and waits for the new process to start, if it returns an error the new process is stopped and this process keeps running.
+func NewSignaler(log *Logger, cfg *Config, fds []int, env map[string]string, hot func() (bool, error), handoff func(conn *os.File) error) *Signaler {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
 	return &Signaler{
 		log:     log,
 		cfg:     cfg,
 		fds:     fds,
 		env:     env,
+		hot:     hot,
+		handoff: handoff,
 		signals: signals,
 	}
 }
@@ -0,0 +1,266 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// SourceCLI marks a configuration value supplied as a cli argument.
+	SourceCLI = "cli"
+
+	// SourceEnv marks a configuration value supplied as an environment variable.
+	SourceEnv = "env"
+
+	// SourceFile marks a configuration value supplied in the configuration file.
+	SourceFile = "file"
+
+	// SourceDefault marks a configuration value left at its built in default.
+	SourceDefault = "default"
+
+	// SourceComputed marks a configuration value that quantum derives rather than reads from user supplied input.
+	SourceComputed = "computed"
+
+	redacted = "<redacted>"
+)
+
+// Setting is a single resolved configuration value along with where it came from.
+type Setting struct {
+	// The section of the configuration reference the value is documented in.
+	Section string `json:"section"`
+
+	// The long name of the option, which is also its configuration file key.
+	Name string `json:"name"`
+
+	// The effective value, secrets are redacted.
+	Value string `json:"value"`
+
+	// Where the value came from, one of 'cli', 'env', 'file', 'default', or 'computed'.
+	Source string `json:"source"`
+
+	// Whether or not quantum changed the user supplied value while computing the configuration, for instance resolving the public ip addresses.
+	Resolved bool `json:"resolved"`
+}
+
+// Validation is the result of loading the configuration without any side effects.
+type Validation struct {
+	// The effective configuration, which is only usable if there are no problems.
+	Config *Config `json:"-"`
+
+	// Every user supplied option, followed by the values quantum computes from them.
+	Settings []*Setting `json:"settings"`
+
+	// Every problem found with the configuration, any of which stops quantum from starting.
+	Problems []string `json:"problems"`
+
+	// Every warning raised about the configuration, none of which stops quantum from starting.
+	Warnings []string `json:"warnings"`
+}
+
+// Err returns every problem found with the configuration as a single error, or nil if there are none.
+func (validation *Validation) Err() error {
+	switch len(validation.Problems) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(validation.Problems[0])
+	}
+	return errors.New("found " + strconv.Itoa(len(validation.Problems)) + " problems with the configuration: " + strings.Join(validation.Problems, "; "))
+}
+
+// Apply the configuration, which sets the log level and format, and writes out the machine id, encryption keys, and pid file unless this is a dry run, returning an error if any problem was found.
+func (validation *Validation) Apply() (*Config, error) {
+	if err := validation.Err(); err != nil {
+		return nil, err
+	}
+
+	cfg := validation.Config
+	if err := cfg.Log.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return nil, err
+	}
+	for _, warning := range validation.Warnings {
+		cfg.Log.Warn("config", warning)
+	}
+
+	if cfg.DryRun {
+		return cfg, nil
+	}
+	if err := cfg.persist(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Write out the effective configuration as a table marking the source of each value, followed by every warning and problem.
+func (validation *Validation) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SECTION\tOPTION\tVALUE\tSOURCE")
+	for _, setting := range validation.Settings {
+		value, source := setting.Value, setting.Source
+		if value == "" {
+			value = "-"
+		}
+		if setting.Resolved {
+			source += " (resolved)"
+		}
+		fmt.Fprintln(tw, setting.Section+"\t"+setting.Name+"\t"+value+"\t"+source)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, warning := range validation.Warnings {
+		fmt.Fprintln(w, "warning:", warning)
+	}
+	for _, problem := range validation.Problems {
+		fmt.Fprintln(w, "problem:", problem)
+	}
+
+	if len(validation.Problems) == 0 {
+		_, err := fmt.Fprintln(w, "The configuration is valid.")
+		return err
+	}
+	_, err := fmt.Fprintln(w, "Found", len(validation.Problems), "problem(s) with the configuration.")
+	return err
+}
+
+// formatValue formats a configuration field in the same notation it is supplied in.
+func formatValue(value reflect.Value) string {
+	switch v := value.Interface().(type) {
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Duration:
+		return v.String()
+	case net.IP:
+		if v == nil {
+			return ""
+		}
+		return v.String()
+	case []net.IP:
+		strs := make([]string, len(v))
+		for i := 0; i < len(v); i++ {
+			strs[i] = v[i].String()
+		}
+		return strings.Join(strs, ",")
+	case []string:
+		return strings.Join(v, ",")
+	case string:
+		return v
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// settings returns the formatted values of the user supplied options along with their sources, redacting secrets.
+func (cfg *Config) settings() []*Setting {
+	st := reflect.TypeOf(*cfg)
+	sv := reflect.ValueOf(cfg).Elem()
+
+	settings := make([]*Setting, 0, st.NumField())
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		internal, _, _, long, _, _ := cfg.parseField(field.Tag)
+		if internal == "true" {
+			continue
+		}
+
+		value := formatValue(sv.Field(i))
+		if value != "" && (strings.Contains(long, "password") || strings.Contains(long, "token")) {
+			value = redacted
+		}
+
+		settings = append(settings, &Setting{
+			Section: field.Tag.Get("section"),
+			Name:    long,
+			Value:   value,
+			Source:  cfg.sources[long],
+		})
+	}
+	return settings
+}
+
+// computed returns the values quantum derives from the user supplied options.
+func (cfg *Config) computed() []*Setting {
+	machineID := cfg.MachineID
+	if cfg.newMachineID != nil {
+		machineID += " (generated, not yet written)"
+	}
+
+	var keys string
+	if cfg.PrivateKey != nil {
+		keys = cfg.keysPath()
+		if cfg.newKeys {
+			keys += " (generated, not yet written)"
+		}
+	}
+
+	var listenAddr string
+	switch sa := cfg.ListenAddr.(type) {
+	case *syscall.SockaddrInet4:
+		listenAddr = net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		listenAddr = net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	}
+
+	values := [][2]string{
+		{"machine-id", machineID},
+		{"encryption-keys", keys},
+		{"listen-address", listenAddr},
+		{"ipv4-enabled", strconv.FormatBool(cfg.IsIPv4Enabled)},
+		{"ipv6-enabled", strconv.FormatBool(cfg.IsIPv6Enabled)},
+		{"mtu", strconv.Itoa(cfg.MTU)},
+		{"max-packet-length", strconv.Itoa(cfg.MaxPacketLength)},
+	}
+
+	settings := make([]*Setting, len(values))
+	for i := 0; i < len(values); i++ {
+		settings[i] = &Setting{Section: "Computed", Name: values[i][0], Value: values[i][1], Source: SourceComputed}
+	}
+	return settings
+}
+
+/*
+ValidateConfig parses and checks the user supplied configuration in exactly the same way as NewConfig, including resolving the public ip addresses, but without creating any directories, writing the pid file, or writing a new machine id or encryption keys. Every problem is reported rather than just the first, so that the configuration can be checked ahead of time, for instance in CI.
+
+Calling Apply on the returned Validation finishes loading the configuration, which is what NewConfig does.
+*/
+func ValidateConfig(log *Logger) *Validation {
+	cfg := &Config{
+		Log:     log,
+		sources: make(map[string]string),
+	}
+
+	// Handle the help and version commands if they exist
+	cfg.parseSpecial(true)
+
+	// Handle parsing user supplied configuration data
+	cfg.parseArgs()
+	parsed := cfg.settings()
+
+	// Compute internal configuration based on the user supplied configuration data
+	cfg.computeArgs()
+
+	settings := cfg.settings()
+	for i := 0; i < len(settings); i++ {
+		settings[i].Resolved = settings[i].Value != parsed[i].Value
+	}
+
+	return &Validation{
+		Config:   cfg,
+		Settings: append(settings, cfg.computed()...),
+		Problems: append([]string{}, cfg.problems...),
+		Warnings: append([]string{}, cfg.warnings...),
+	}
+}
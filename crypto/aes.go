@@ -6,6 +6,7 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha512"
 
@@ -62,7 +63,15 @@ func (crypt *AES) Decrypt(data []byte, additional []byte) (int, error) {
 }
 
 // NewAES returns a new AEAD based cipher object based on the passed in secret and salt.
-func NewAES(secret, salt []byte) (*AES, error) {
+//
+// psk may be nil, otherwise the pre-shared key is mixed into the secret with hmac-sha512 before the key is derived, so that only peers holding the same pre-shared key derive the same key.
+func NewAES(secret, salt, psk []byte) (*AES, error) {
+	if psk != nil {
+		mac := hmac.New(sha512.New, psk)
+		mac.Write(secret)
+		secret = mac.Sum(nil)
+	}
+
 	key := pbkdf2.Key(secret, salt, iterations, keyLength, sha512.New)
 
 	block, err := aes.NewCipher(key)
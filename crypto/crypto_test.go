@@ -60,7 +60,7 @@ func TestAES(t *testing.T) {
 		t.Fatalf("Unable to random salt: %s", err.Error())
 	}
 
-	aes, err := NewAES(key, salt)
+	aes, err := NewAES(key, salt, nil)
 	if err != nil {
 		t.Fatalf("Unable to create the AES object: %s", err.Error())
 	}
@@ -98,6 +98,31 @@ func TestAES(t *testing.T) {
 	if !testEq(buf[:dataLen], expected) || dataLen != aes.DecryptedSize(buf) {
 		t.Fatal("Decrypted output does not match plaintext.")
 	}
+
+	psk, err := NewAES(key, salt, []byte("PreSharedKey-32Characters1234567"))
+	if err != nil {
+		t.Fatalf("Unable to create the AES object with a pre-shared key: %s", err.Error())
+	}
+	other, err := NewAES(key, salt, []byte("PreSharedKey-32Characters7654321"))
+	if err != nil {
+		t.Fatalf("Unable to create the AES object with a pre-shared key: %s", err.Error())
+	}
+
+	length, err = psk.Encrypt(buf, dataLen, nil)
+	if err != nil {
+		t.Fatalf("Errored trying to encrypt buffer: %s", err.Error())
+	}
+
+	// A failed decryption may overwrite the buffer, so each cipher decrypts its own copy.
+	for _, crypt := range []*AES{aes, other} {
+		encrypted := append([]byte{}, buf[:length]...)
+		if _, err := crypt.Decrypt(encrypted, nil); err == nil {
+			t.Fatal("Decrypted a buffer encrypted with a pre-shared key without the same pre-shared key.")
+		}
+	}
+	if _, err := psk.Decrypt(buf[:length], nil); err != nil || !testEq(buf[:dataLen], expected) {
+		t.Fatal("Decrypted output with a pre-shared key does not match plaintext.")
+	}
 }
 
 func BenchmarkAES(b *testing.B) {
@@ -109,7 +134,7 @@ func BenchmarkAES(b *testing.B) {
 		b.Fatalf("Unable to random salt: %s", err.Error())
 	}
 
-	aes, err := NewAES(key, salt)
+	aes, err := NewAES(key, salt, nil)
 	if err != nil {
 		b.Fatalf("Unable to create the AES object: %s", err.Error())
 	}
@@ -148,6 +173,9 @@ func TestEcdh(t *testing.T) {
 	if testEq(secret, pub) || testEq(secret, priv) {
 		t.Fatalf("GenerateECKeyPair returned identical secret and pub/priv keys this can't possibly happen:\npub: %v, priv: %v, secret: %v", pub, priv, secret)
 	}
+	if derived := GenerateECPublicKey(priv); !testEq(derived, pub) {
+		t.Fatalf("GenerateECPublicKey did not derive the public key of the pair:\nactual: %v, expected: %v", derived, pub)
+	}
 }
 
 func testBadCaCert(t *testing.T) {
@@ -273,7 +301,7 @@ func testEndToEndV4(t *testing.T) {
 	}()
 
 	go func() {
-		session, err := cdtls.Connect("127.0.0.1", 9999)
+		session, err := cdtls.Connect("127.0.0.1", 9999, nil)
 		if err != nil {
 			errorstr = err.Error()
 			done <- true
@@ -391,7 +419,7 @@ func testEndToEndV6(t *testing.T) {
 	}()
 
 	go func() {
-		session, err := cdtls.Connect("::1", 9999)
+		session, err := cdtls.Connect("::1", 9999, nil)
 		if err != nil {
 			errorstr = err.Error()
 			done <- true
@@ -434,6 +462,120 @@ func testEndToEndV6(t *testing.T) {
 	cdtls.Close()
 }
 
+func testServerContext(t *testing.T, port int) *DTLSContext {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal("error creating the DTLS socket: " + err.Error())
+	}
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		t.Fatal("error setting the DTLS socket parameters: " + err.Error())
+	}
+
+	sa := &syscall.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], net.ParseIP("0.0.0.0").To4()[:])
+
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		t.Fatal("error binding the DTLS socket to the configured listen address: " + err.Error())
+	}
+
+	dtls, err := NewServerDTLSContext(fd, "0.0.0.0", port, false, true, caFile, serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return dtls
+}
+
+func testHandshake(t *testing.T, server, client *DTLSContext, port int, resume []byte) (*DTLSSession, *DTLSSession) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	var accepted *DTLSSession
+	var acceptErr error
+	go func() {
+		defer wg.Done()
+		accepted, acceptErr = server.Accept()
+	}()
+
+	connected, err := client.Connect("127.0.0.1", port, resume)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if acceptErr != nil {
+		t.Fatal(acceptErr.Error())
+	}
+	return accepted, connected
+}
+
+func testResume(t *testing.T) {
+	client, err := NewClientDTLSContext("0.0.0.0", false, true, caFile, clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	// The previous process negotiates a full session with the remote node.
+	previous := testServerContext(t, 9998)
+	accepted, connected := testHandshake(t, previous, client, 9998, nil)
+	if accepted.Resumed() || connected.Resumed() {
+		t.Fatal("A session was resumed without any session to resume.")
+	}
+
+	exported, err := connected.Export()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keys, err := previous.TicketKeys()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	accepted.Close()
+	connected.Close()
+	previous.Close()
+
+	// A server without the session ticket keys of the previous process falls back to a full handshake.
+	other := testServerContext(t, 9998)
+	accepted, connected = testHandshake(t, other, client, 9998, exported)
+	if accepted.Resumed() || connected.Resumed() {
+		t.Fatal("A session was resumed by a server without the session ticket keys it was negotiated with.")
+	}
+	accepted.Close()
+	connected.Close()
+	other.Close()
+
+	// The new process takes over the session ticket keys, and resumes the session.
+	next := testServerContext(t, 9998)
+	defer next.Close()
+
+	if err := next.SetTicketKeys(keys[1:]); err == nil {
+		t.Fatal("SetTicketKeys accepted session ticket keys of the wrong length.")
+	}
+	if err := next.SetTicketKeys(keys); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	accepted, connected = testHandshake(t, next, client, 9998, exported)
+	defer accepted.Close()
+	defer connected.Close()
+
+	if !accepted.Resumed() || !connected.Resumed() {
+		t.Fatal("The exported session was not resumed by a server with the session ticket keys it was negotiated with.")
+	}
+
+	sendbuf := []byte("hello")
+	if n, ok := connected.Write(sendbuf); !ok || n != len(sendbuf) {
+		t.Fatal("Failed to write to the resumed session.")
+	}
+	readbuf := make([]byte, len(sendbuf))
+	if n, ok := accepted.Read(readbuf); !ok || string(readbuf[:n]) != string(sendbuf) {
+		t.Fatal("Failed to read from the resumed session.")
+	}
+}
+
 func TestDTLS(t *testing.T) {
 	InitDTLS()
 
@@ -449,6 +591,8 @@ func TestDTLS(t *testing.T) {
 		t.Run("IPv6", testEndToEndV6)
 	})
 
+	t.Run("resume", testResume)
+
 	DestroyDTLS()
 }
 
@@ -532,7 +676,7 @@ func BenchmarkDTLS(b *testing.B) {
 
 	go func() {
 		defer wg.Done()
-		client, err = cdtls.Connect("::1", 9999)
+		client, err = cdtls.Connect("::1", 9999, nil)
 		if err != nil {
 			b.Error(err.Error())
 			return
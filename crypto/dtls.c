@@ -279,6 +279,13 @@ Context* init_server_dtls_context(int fd, const char* addr, int port, int use_v6
     SSL_CTX_set_cookie_generate_cb(ctx->ssl_ctx, _generate_cookie_cb);
     SSL_CTX_set_cookie_verify_cb(ctx->ssl_ctx, _verify_cookie_cb);
 
+    // Set the session id context, without which openssl refuses to resume sessions when the peer certificates are verified.
+    if (!SSL_CTX_set_session_id_context(ctx->ssl_ctx, (const unsigned char*)SESSION_ID_CONTEXT, strlen(SESSION_ID_CONTEXT))) {
+        strcpy(error, "unable to set the session id context");
+        free_dtls_context(ctx);
+        return NULL;
+    }
+
     // Set the common DTLS parameters.
     if (!_set_common_ssl_parameters(ctx->ssl_ctx, verify_peer, error)) {
         free_dtls_context(ctx);
@@ -347,6 +354,14 @@ void free_dtls_context(Context* ctx) {
     }
 }
 
+int get_dtls_ticket_keys(Context* ctx, unsigned char* keys) {
+    return SSL_CTX_get_tlsext_ticket_keys(ctx->ssl_ctx, keys, DTLS_TICKET_KEYS_LENGTH);
+}
+
+int set_dtls_ticket_keys(Context* ctx, unsigned char* keys) {
+    return SSL_CTX_set_tlsext_ticket_keys(ctx->ssl_ctx, keys, DTLS_TICKET_KEYS_LENGTH);
+}
+
 Session* accept_dtls(Context* ctx, char* error) {
     Session* session = (Session*)malloc(sizeof(Session));
 
@@ -458,7 +473,7 @@ Session* accept_dtls(Context* ctx, char* error) {
     return session;
 }
 
-Session* connect_dtls(Context* ctx, const char* addr, int port, char* error) {
+Session* connect_dtls(Context* ctx, const char* addr, int port, const unsigned char* resume, int resume_len, char* error) {
     Session* session = (Session*)malloc(sizeof(Session));
 
     if (ctx->use_v6) {
@@ -496,6 +511,15 @@ Session* connect_dtls(Context* ctx, const char* addr, int port, char* error) {
     SSL_set_bio(session->ssl, bio, bio);
     SSL_set_connect_state(session->ssl);
 
+    // Offer the previous session to the remote peer, which falls back to a full handshake if it is unable to resume it.
+    if (resume_len > 0) {
+        SSL_SESSION* previous = d2i_SSL_SESSION(NULL, &resume, resume_len);
+        if (previous != NULL) {
+            SSL_set_session(session->ssl, previous);
+            SSL_SESSION_free(previous);
+        }
+    }
+
     union BIO_sock_info_u peer_info;
     if ((peer_info.addr = BIO_ADDR_new()) == NULL) {
         strcpy(error, "unable to set the MTU on the SSL object for the new connection");
@@ -560,10 +584,34 @@ int get_dtls_fd(Session* session) {
     return session->fd;
 }
 
+int export_dtls_session(Session* session, unsigned char* buf, int length) {
+    SSL_SESSION* current = SSL_get1_session(session->ssl);
+    if (current == NULL) {
+        return -1;
+    }
+
+    // Return the required length when the buffer is too small to hold the session.
+    int size = i2d_SSL_SESSION(current, NULL);
+    if (size > 0 && buf != NULL && length >= size) {
+        size = i2d_SSL_SESSION(current, &buf);
+    }
+
+    SSL_SESSION_free(current);
+    return size;
+}
+
+int resumed_dtls(Session* session) {
+    return SSL_session_reused(session->ssl);
+}
+
 int read_dtls(Session* session, void* buf, int length) {
     return SSL_read(session->ssl, buf, length);
 }
 
+int pending_dtls(Session* session) {
+    return SSL_pending(session->ssl);
+}
+
 int write_dtls(Session* session, void* buf, int length) {
     return SSL_write(session->ssl, buf, length);
 }
@@ -15,11 +15,15 @@ import "C"
 
 import (
 	"errors"
+	"strconv"
 	"sync/atomic"
 	"unsafe"
 )
 
 const (
+	// TicketKeysLength is the length of the keys a DTLS server context encrypts its session tickets with.
+	TicketKeysLength = C.DTLS_TICKET_KEYS_LENGTH
+
 	errorLen             = 120
 	initialized    int32 = 1
 	notInitialized int32 = 0
@@ -81,8 +85,8 @@ func (dtls *DTLSContext) Accept() (*DTLSSession, error) {
 	}, nil
 }
 
-// Connect will handle opening a new DTLS session with a remote node.
-func (dtls *DTLSContext) Connect(addr string, port int) (*DTLSSession, error) {
+// Connect will handle opening a new DTLS session with a remote node, resuming the exported session if one is supplied and the remote node is able to resume it.
+func (dtls *DTLSContext) Connect(addr string, port int, resume []byte) (*DTLSSession, error) {
 	// Get the various converted strings.
 	err := generateErrorStr()
 	addrstr := C.CString(addr)
@@ -91,7 +95,12 @@ func (dtls *DTLSContext) Connect(addr string, port int) (*DTLSSession, error) {
 	defer C.free(unsafe.Pointer(err))
 	defer C.free(unsafe.Pointer(addrstr))
 
-	session := C.connect_dtls(dtls.ctx, addrstr, C.int(port), err)
+	var resumeptr *C.uchar
+	if len(resume) > 0 {
+		resumeptr = (*C.uchar)(unsafe.Pointer(&resume[0]))
+	}
+
+	session := C.connect_dtls(dtls.ctx, addrstr, C.int(port), resumeptr, C.int(len(resume)), err)
 
 	if session == nil {
 		return nil, errors.New(C.GoString(err))
@@ -103,6 +112,26 @@ func (dtls *DTLSContext) Connect(addr string, port int) (*DTLSSession, error) {
 	}, nil
 }
 
+// TicketKeys returns the keys the server context encrypts its session tickets with, which remote nodes resume their sessions with.
+func (dtls *DTLSContext) TicketKeys() ([]byte, error) {
+	keys := make([]byte, TicketKeysLength)
+	if C.get_dtls_ticket_keys(dtls.ctx, (*C.uchar)(unsafe.Pointer(&keys[0]))) != 1 {
+		return nil, errors.New("unable to get the session ticket keys")
+	}
+	return keys, nil
+}
+
+// SetTicketKeys replaces the keys the server context encrypts its session tickets with, so that it resumes the sessions of another server context using the same keys.
+func (dtls *DTLSContext) SetTicketKeys(keys []byte) error {
+	if len(keys) != TicketKeysLength {
+		return errors.New("the session ticket keys must be " + strconv.Itoa(TicketKeysLength) + " bytes long")
+	}
+	if C.set_dtls_ticket_keys(dtls.ctx, (*C.uchar)(unsafe.Pointer(&keys[0]))) != 1 {
+		return errors.New("unable to set the session ticket keys")
+	}
+	return nil
+}
+
 // Close destroys all traces of the DTLS struct.
 func (dtls *DTLSContext) Close() {
 	// Call into cgo to destroy the context using the openssl free/shutdown functions.
@@ -181,6 +210,11 @@ func (session *DTLSSession) Read(buf []byte) (int, bool) {
 	return int(read), true
 }
 
+// Pending returns whether or not the session holds records which have already been received and decrypted, but not yet read. Such records never make the underlying socket readable.
+func (session *DTLSSession) Pending() bool {
+	return C.pending_dtls(session.session) > 0
+}
+
 // Write will write the bytes from the provided buffer to the session.
 func (session *DTLSSession) Write(buf []byte) (int, bool) {
 	// Write the supplied buffer on to the underlying SSL BIO.
@@ -192,6 +226,25 @@ func (session *DTLSSession) Write(buf []byte) (int, bool) {
 	return int(wrote), true
 }
 
+// Export serializes the negotiated session, so that it can be resumed by a later call to Connect.
+func (session *DTLSSession) Export() ([]byte, error) {
+	size := C.export_dtls_session(session.session, nil, 0)
+	if size <= 0 {
+		return nil, errors.New("unable to export the DTLS session")
+	}
+
+	buf := make([]byte, int(size))
+	if C.export_dtls_session(session.session, (*C.uchar)(unsafe.Pointer(&buf[0])), size) != size {
+		return nil, errors.New("unable to export the DTLS session")
+	}
+	return buf, nil
+}
+
+// Resumed returns whether or not the session was resumed rather than negotiated from scratch.
+func (session *DTLSSession) Resumed() bool {
+	return C.resumed_dtls(session.session) == 1
+}
+
 // Close destroys all traces of the DTLSSession struct.
 func (session *DTLSSession) Close() {
 	// Call into cgo to destroy the session using the openssl free/shutdown functions/
@@ -19,6 +19,8 @@
 #define SSL_CIPHER "ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384"
 #define CLIENT_CTX_PORT 0
 #define DTLS_MAX_MTU 1000
+#define DTLS_TICKET_KEYS_LENGTH 80
+#define SESSION_ID_CONTEXT "quantum"
 
 typedef struct {
 	int fd;
@@ -44,12 +46,18 @@ Context* init_server_dtls_context(int fd, const char* addr, int port, int use_v6
 Context* init_client_dtls_context(const char* addr, int use_v6, int verify_peer, const char* ca, const char* cert, const char* key, char* error);
 void free_dtls_context(Context* ctx);
 
+int get_dtls_ticket_keys(Context* ctx, unsigned char* keys);
+int set_dtls_ticket_keys(Context* ctx, unsigned char* keys);
+
 Session* accept_dtls(Context* ctx, char* error);
-Session* connect_dtls(Context* ctx, const char* addr, int port, char* error);
+Session* connect_dtls(Context* ctx, const char* addr, int port, const unsigned char* resume, int resume_len, char* error);
 
 int get_dtls_fd(Session* session);
+int export_dtls_session(Session* session, unsigned char* buf, int length);
+int resumed_dtls(Session* session);
 
 int read_dtls(Session* session, void* buf, int length);
+int pending_dtls(Session* session);
 int write_dtls(Session* session, void* buf, int length);
 void free_dtls_session(Session* session);
 #endif
@@ -29,3 +29,13 @@ func GenerateSharedSecret(pubkey, privkey []byte) []byte {
 	curve25519.ScalarMult(&secret, &priv, &pub)
 	return secret[:]
 }
+
+// GenerateECPublicKey - Generates the curve25519 eliptical curve public key belonging to the supplied private key.
+func GenerateECPublicKey(privkey []byte) []byte {
+	var pub, priv [keyLength]byte
+
+	copy(priv[:], privkey)
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	return pub[:]
+}
@@ -0,0 +1,453 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/rest"
+)
+
+// table writes out tab aligned rows.
+type table struct {
+	w *tabwriter.Writer
+}
+
+func (t *table) row(columns ...interface{}) {
+	strs := make([]string, len(columns))
+	for i := 0; i < len(columns); i++ {
+		strs[i] = fmt.Sprint(columns[i])
+	}
+	fmt.Fprintln(t.w, strings.Join(strs, "\t"))
+}
+
+func (t *table) flush() {
+	t.w.Flush()
+}
+
+func newTable(out io.Writer) *table {
+	return &table{w: tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)}
+}
+
+// orNone returns the string, or a dash if it is empty.
+func orNone(str string) string {
+	if str == "" {
+		return "-"
+	}
+	return str
+}
+
+func ipOrNone(ip net.IP) string {
+	if ip == nil {
+		return "-"
+	}
+	return ip.String()
+}
+
+func status(c *client, args []string, out io.Writer) error {
+	info := &rest.NodeInfo{}
+	if err := c.get(rest.V1Prefix+"node", info); err != nil {
+		return err
+	}
+
+	health := &rest.Health{}
+	if err := c.get(rest.V1Prefix+"health", health); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(out, map[string]interface{}{"node": info, "health": health})
+	}
+
+	t := newTable(out)
+	t.row("Machine ID:", info.MachineID)
+	t.row("Version:", info.Version)
+	t.row("Status:", health.Status)
+	t.row("Uptime:", info.Uptime)
+	t.row("Device:", orNone(info.Device))
+	t.row("Network:", orNone(info.Network))
+	t.row("Private IP:", ipOrNone(info.PrivateIP))
+	t.row("Public IPv4:", ipOrNone(info.PublicIPv4))
+	t.row("Public IPv6:", ipOrNone(info.PublicIPv6))
+	t.row("Listen Port:", info.ListenPort)
+	t.row("Datastore:", info.Datastore)
+	t.row("Backend:", orNone(info.Backend))
+	t.row("Plugins:", orNone(strings.Join(info.Plugins, ", ")))
+	t.row("Peers:", health.Peers)
+	t.flush()
+
+	fmt.Fprintln(out)
+	t = newTable(out)
+	t.row("CHECK", "OK", "DETAIL")
+	for _, report := range []*rest.Report{health.Liveness, health.Readiness} {
+		if report == nil {
+			continue
+		}
+		for _, check := range report.Checks {
+			t.row(check.Name, check.OK, orNone(check.Detail))
+		}
+	}
+	t.flush()
+	return nil
+}
+
+func peers(c *client, args []string, out io.Writer) error {
+	var peers []*rest.Peer
+	if err := c.get(rest.V1Prefix+"peers", &peers); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(out, map[string]interface{}{"peers": peers})
+	}
+
+	t := newTable(out)
+	t.row("MACHINE ID", "PRIVATE IP", "ENDPOINT", "PLUGINS", "FLOATING", "LOCAL")
+	for _, peer := range peers {
+		t.row(peer.MachineID, ipOrNone(peer.PrivateIP), orNone(peer.Endpoint), orNone(strings.Join(peer.Plugins, ",")), peer.Floating, peer.Local)
+	}
+	t.flush()
+	return nil
+}
+
+func routes(c *client, args []string, out io.Writer) error {
+	var peers []*rest.Peer
+	if err := c.get(rest.V1Prefix+"peers", &peers); err != nil {
+		return err
+	}
+
+	route := &rest.Route{}
+	if err := c.get(rest.V1Prefix+"route", route); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(out, map[string]interface{}{"peers": peers, "route": route})
+	}
+
+	t := newTable(out)
+	t.row("DESTINATION", "VIA", "ENDPOINT")
+	for _, peer := range peers {
+		if peer.Local {
+			continue
+		}
+		t.row(ipOrNone(peer.PrivateIP), peer.MachineID, orNone(peer.Endpoint))
+	}
+
+	// Traffic destined outside of the quantum network is routed to the gateway, if there is one.
+	if route.Gateway != nil {
+		t.row("default", route.Gateway.MachineID, orNone(route.Gateway.Endpoint))
+	} else {
+		t.row("default", "-", "-")
+	}
+	t.flush()
+	return nil
+}
+
+// diagnose asks the local node to probe the path to the target given in the arguments, followed by an optional probe count.
+func diagnose(c *client, name string, args []string) (*diag.Result, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, errors.New("usage: quantum ctl " + name + " <target> [count]")
+	}
+
+	route := rest.V1Prefix + "ping/" + url.PathEscape(args[0])
+	if len(args) == 2 {
+		if count, err := strconv.Atoi(args[1]); err != nil || count <= 0 {
+			return nil, errors.New("'" + args[1] + "' is not a valid probe count")
+		}
+		route += "?count=" + args[1]
+	}
+
+	result := &diag.Result{}
+	if err := c.get(route, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// diagnosed returns the diagnosis as an error if a problem was found, so that the command exits with a failure.
+func diagnosed(result *diag.Result) error {
+	if result.Problem != "" {
+		return errors.New(result.Problem + " problem: " + result.Diagnosis)
+	}
+	return nil
+}
+
+func milliseconds(ms float64) string {
+	return strconv.FormatFloat(ms, 'f', 3, 64) + " ms"
+}
+
+func loss(hop *diag.Hop) string {
+	if hop.Sent == 0 {
+		return "-"
+	}
+	return strconv.Itoa((hop.Sent-hop.Received)*100/hop.Sent) + "%"
+}
+
+// plugins formats the plugins negotiated in each direction, the remote plugins are unknown if the node never replied.
+func plugins(hop *diag.Hop) string {
+	local := orNone(strings.Join(hop.Plugins, ","))
+	if hop.Received == 0 {
+		return local
+	}
+	return local + " (remote: " + orNone(strings.Join(hop.RemotePlugins, ",")) + ")"
+}
+
+func mtu(hop *diag.Hop) string {
+	if hop.Received == 0 {
+		return strconv.Itoa(hop.MTU)
+	}
+	return strconv.Itoa(hop.MTU) + " (remote: " + strconv.Itoa(hop.RemoteMTU) + ")"
+}
+
+func ping(c *client, args []string, out io.Writer) error {
+	result, err := diagnose(c, "ping", args)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		if err := printJSON(out, map[string]interface{}{"result": result}); err != nil {
+			return err
+		}
+		return diagnosed(result)
+	}
+
+	// The last hop is the node traffic to the destination is handed to, which is either the destination itself or the gateway.
+	hop := result.Hops[len(result.Hops)-1]
+	if hop.Role == diag.RoleLocal {
+		fmt.Fprintln(out, "PING", result.Target, "("+result.Destination.String()+")")
+		return diagnosed(result)
+	}
+
+	fmt.Fprintln(out, "PING", result.Target, "("+result.Destination.String()+") via", hop.MachineID, "at", orNone(hop.Endpoint))
+	for i, rtt := range hop.RTTs {
+		fmt.Fprintln(out, "reply", i+1, "from", hop.MachineID+":", "rtt="+milliseconds(rtt))
+	}
+	fmt.Fprintln(out)
+
+	relays := "none"
+	if hop.Role == diag.RoleGateway {
+		relays = hop.MachineID + " (gateway)"
+	}
+
+	t := newTable(out)
+	t.row("Probes:", strconv.Itoa(hop.Sent)+" sent, "+strconv.Itoa(hop.Received)+" received, "+loss(hop)+" lost")
+	if hop.Received > 0 {
+		t.row("RTT min/mean/max:", milliseconds(hop.MinRTT)+" / "+milliseconds(hop.MeanRTT)+" / "+milliseconds(hop.MaxRTT))
+	}
+	t.row("Endpoint:", orNone(hop.Endpoint))
+	t.row("Plugins:", plugins(hop))
+	t.row("MTU:", mtu(hop))
+	t.row("Crypto:", hop.Crypto)
+	t.row("Relay hops:", relays)
+	t.row("Diagnosis:", result.Diagnosis)
+	t.flush()
+	return diagnosed(result)
+}
+
+func traceroute(c *client, args []string, out io.Writer) error {
+	result, err := diagnose(c, "traceroute", args)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		if err := printJSON(out, map[string]interface{}{"result": result}); err != nil {
+			return err
+		}
+		return diagnosed(result)
+	}
+
+	fmt.Fprintln(out, "TRACEROUTE", result.Target, "("+result.Destination.String()+")")
+	fmt.Fprintln(out)
+
+	t := newTable(out)
+	t.row("HOP", "ROLE", "MACHINE ID", "PRIVATE IP", "ENDPOINT", "RTT", "LOSS", "PLUGINS", "MTU", "CRYPTO")
+	for i, hop := range result.Hops {
+		rtt := "-"
+		if hop.Received > 0 {
+			rtt = milliseconds(hop.MeanRTT)
+		}
+		t.row(i+1, hop.Role, hop.MachineID, ipOrNone(hop.PrivateIP), orNone(hop.Endpoint), rtt, loss(hop), plugins(hop), mtu(hop), orNone(hop.Crypto))
+	}
+
+	// Traffic leaves the quantum network at the gateway, so the destination itself is never probed.
+	if result.Outside && len(result.Hops) > 1 {
+		t.row(len(result.Hops)+1, "destination", "-", result.Destination, "-", "-", "-", "-", "-", "-")
+	}
+	t.flush()
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Diagnosis:", result.Diagnosis)
+	return diagnosed(result)
+}
+
+// metricsRow writes out the counts of the metrics following the supplied leading columns.
+func metricsRow(t *table, metrics *metric.Metrics, columns ...interface{}) {
+	if metrics == nil {
+		return
+	}
+	t.row(append(columns, metrics.Packets, metrics.Bytes, metrics.DroppedPackets, metrics.DroppedBytes)...)
+}
+
+func metrics(c *client, args []string, out io.Writer) error {
+	log := &metric.MetricsLog{}
+	if err := c.get(rest.V1Prefix+"metrics", log); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(out, map[string]interface{}{"metrics": log})
+	}
+
+	t := newTable(out)
+	t.row("DIRECTION", "PACKETS", "BYTES", "DROPPED PACKETS", "DROPPED BYTES")
+	metricsRow(t, log.TxMetrics, "tx")
+	metricsRow(t, log.RxMetrics, "rx")
+	t.flush()
+
+	links := make(map[string]bool)
+	for _, m := range []*metric.Metrics{log.TxMetrics, log.RxMetrics} {
+		if m == nil {
+			continue
+		}
+		for ip := range m.Links {
+			links[ip] = true
+		}
+	}
+
+	if len(links) > 0 {
+		ips := make([]string, 0, len(links))
+		for ip := range links {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+
+		fmt.Fprintln(out)
+		t = newTable(out)
+		t.row("PEER", "DIRECTION", "PACKETS", "BYTES", "DROPPED PACKETS", "DROPPED BYTES")
+		for _, ip := range ips {
+			if log.TxMetrics != nil {
+				metricsRow(t, log.TxMetrics.Links[ip], ip, "tx")
+			}
+			if log.RxMetrics != nil {
+				metricsRow(t, log.RxMetrics.Links[ip], ip, "rx")
+			}
+		}
+		t.flush()
+	}
+
+	if len(log.Counters)+len(log.Gauges) > 0 {
+		names := make([]string, 0, len(log.Counters)+len(log.Gauges))
+		values := make(map[string]uint64, len(log.Counters)+len(log.Gauges))
+		for name, value := range log.Counters {
+			names, values[name] = append(names, name), value
+		}
+		for name, value := range log.Gauges {
+			names, values[name] = append(names, name), value
+		}
+		sort.Strings(names)
+
+		fmt.Fprintln(out)
+		t = newTable(out)
+		t.row("NAME", "VALUE")
+		for _, name := range names {
+			t.row(name, strconv.FormatUint(values[name], 10))
+		}
+		t.flush()
+	}
+	return nil
+}
+
+func floating(c *client, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "list" {
+		var ips []*rest.FloatingIP
+		if err := c.get(rest.V1Prefix+"floating", &ips); err != nil {
+			return err
+		}
+
+		if c.json {
+			return printJSON(out, map[string]interface{}{"floating": ips})
+		}
+
+		t := newTable(out)
+		t.row("FLOATING IP", "OWNER", "OWNER IP", "ENDPOINT", "LOCAL")
+		for _, ip := range ips {
+			t.row(ipOrNone(ip.IP), ip.OwnerID, ipOrNone(ip.OwnerIP), orNone(ip.Endpoint), ip.OwnedLocally)
+		}
+		t.flush()
+		return nil
+	}
+
+	move := args[0] == "move" && len(args) == 3
+	if !move && (args[0] != "release" || len(args) != 2) {
+		return errors.New("usage: quantum ctl floating list|move <ip> <node>|release <ip>")
+	}
+	if net.ParseIP(args[1]) == nil {
+		return errors.New("'" + args[1] + "' is not a valid ip address")
+	}
+
+	if move {
+		return action(c, rest.V1Prefix+"floating/"+args[1]+"/move/"+url.PathEscape(args[2]), out)
+	}
+	return action(c, rest.V1Prefix+"floating/"+args[1]+"/release", out)
+}
+
+func logLevel(c *client, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("usage: quantum ctl log-level [error|warn|info|debug]")
+	}
+	if len(args) == 1 {
+		return action(c, rest.V1Prefix+"log-level/"+args[0], out)
+	}
+
+	level := &rest.LogLevel{}
+	if err := c.get(rest.V1Prefix+"log-level", level); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(out, map[string]interface{}{"logLevel": level})
+	}
+
+	_, err := fmt.Fprintln(out, "Logging at the '"+level.Level+"' level in the '"+level.Format+"' format.")
+	return err
+}
+
+func reload(c *client, args []string, out io.Writer) error {
+	return action(c, rest.V1Prefix+"reload", out)
+}
+
+func drain(c *client, args []string, out io.Writer) error {
+	return action(c, rest.V1Prefix+"drain", out)
+}
+
+func rotateKeys(c *client, args []string, out io.Writer) error {
+	return action(c, rest.V1Prefix+"rotate-keys", out)
+}
+
+func action(c *client, route string, out io.Writer) error {
+	result := &rest.Result{}
+	if err := c.post(route, result); err != nil {
+		return err
+	}
+
+	if c.json {
+		return printJSON(out, map[string]interface{}{"result": result})
+	}
+
+	_, err := fmt.Fprintln(out, result.Message)
+	return err
+}
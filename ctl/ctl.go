@@ -0,0 +1,251 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package ctl
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/supernomad/quantum/rest"
+)
+
+const (
+	// Command is the subcommand of the quantum binary that runs the ctl client rather than the quantum daemon.
+	Command = "ctl"
+
+	defaultDataDir = "/var/lib/quantum"
+	requestTimeout = 10 * time.Second
+)
+
+// Shortcuts are the ctl commands that can also be run directly as subcommands of the quantum binary, such as 'quantum ping'.
+var Shortcuts = []string{"ping", "traceroute"}
+
+// command is a single ctl command, which writes its output to the supplied writer.
+type command struct {
+	usage       string
+	description string
+	run         func(c *client, args []string, out io.Writer) error
+}
+
+var commands = map[string]*command{
+	"status": {
+		usage:       "status",
+		description: "Show the configuration and health of the local node.",
+		run:         status,
+	},
+	"peers": {
+		usage:       "peers",
+		description: "List every node in the quantum network.",
+		run:         peers,
+	},
+	"routes": {
+		usage:       "routes",
+		description: "Show where the local node routes traffic to.",
+		run:         routes,
+	},
+	"metrics": {
+		usage:       "metrics",
+		description: "Show the transmission and reception statistics of the local node.",
+		run:         metrics,
+	},
+	"floating": {
+		usage:       "floating list|move <ip> <node>|release <ip>",
+		description: "List the floating ips, move a floating ip claimed by the local node to another node, or release it so that any other node claims it.",
+		run:         floating,
+	},
+	"ping": {
+		usage:       "ping <target> [count]",
+		description: "Probe the node that traffic to an ip, machine id, or hostname is sent to, and diagnose why it is unreachable.",
+		run:         ping,
+	},
+	"traceroute": {
+		usage:       "traceroute <target> [count]",
+		description: "Show and probe every quantum node that traffic to an ip, machine id, or hostname traverses.",
+		run:         traceroute,
+	},
+	"log-level": {
+		usage:       "log-level [error|warn|info|debug]",
+		description: "Show the level the local node logs at, or change it until quantum is reloaded.",
+		run:         logLevel,
+	},
+	"reload": {
+		usage:       "reload",
+		description: "Reload the quantum process.",
+		run:         reload,
+	},
+	"drain": {
+		usage:       "drain",
+		description: "Release every floating ip claimed by the local node, and mark it as not ready ahead of maintenance.",
+		run:         drain,
+	},
+	"rotate-keys": {
+		usage:       "rotate-keys",
+		description: "Replace the encryption keys of the local node with newly generated ones.",
+		run:         rotateKeys,
+	},
+}
+
+// client talks to the administrative api of the local node over its unix socket.
+type client struct {
+	http *http.Client
+	json bool
+}
+
+// do sends the request to the local node and decodes the response into v, or returns the error reported by the api.
+func (c *client) do(method, route string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://quantum"+route, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("error connecting to the local quantum node: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("error reading the response from the local quantum node: " + err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &struct {
+			Message string `json:"error"`
+		}{}
+		if json.Unmarshal(body, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(body))
+		}
+		return errors.New(apiErr.Message)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (c *client) get(route string, v interface{}) error {
+	return c.do(http.MethodGet, route, v)
+}
+
+func (c *client) post(route string, v interface{}) error {
+	return c.do(http.MethodPost, route, v)
+}
+
+// printJSON writes the values out as indented json, a single value is written as is and multiple values are written as an object.
+func printJSON(out io.Writer, values map[string]interface{}) error {
+	var value interface{} = values
+	if len(values) == 1 {
+		for _, v := range values {
+			value = v
+		}
+	}
+
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+func newClient(socketPath string, asJSON bool) *client {
+	return &client{
+		http: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+			},
+		},
+		json: asJSON,
+	}
+}
+
+func usage(fs *flag.FlagSet, out io.Writer) {
+	fmt.Fprintln(out, "Usage: quantum ctl [options] <command> [arguments]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := newTable(out)
+	for _, name := range names {
+		table.row("  "+commands[name].usage, commands[name].description)
+	}
+	table.flush()
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Options:")
+	fs.SetOutput(out)
+	fs.PrintDefaults()
+}
+
+// Run the ctl client with the supplied arguments, which follow the ctl subcommand, returning the exit code of the client.
+func Run(args []string, stdout, stderr io.Writer) int {
+	dataDir := os.Getenv("QUANTUM_DATA_DIR")
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+
+	fs := flag.NewFlagSet(Command, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&dataDir, "data-dir", dataDir, "The data directory of the local quantum node, which holds its api socket.")
+	fs.StringVar(&dataDir, "d", dataDir, "Shorthand for --data-dir.")
+	socketPath := fs.String("socket", "", "The path of the api socket of the local quantum node, which overrides the socket in the data directory.")
+	asJSON := fs.Bool("json", false, "Write the output as json rather than human readable tables.")
+
+	// Options are accepted both before and after the command.
+	err := fs.Parse(args)
+	args = fs.Args()
+	if err == nil && len(args) > 0 {
+		name, remaining := args[0], args[1:]
+		if err = fs.Parse(remaining); err == nil {
+			args = append([]string{name}, fs.Args()...)
+		}
+	}
+
+	if err == nil && len(args) > 0 && args[0] == "help" {
+		err = flag.ErrHelp
+	}
+	if err == flag.ErrHelp {
+		usage(fs, stdout)
+		return 0
+	}
+	if err == nil && len(args) == 0 {
+		err = errors.New("a command is required")
+	}
+	if err == nil && commands[args[0]] == nil {
+		err = errors.New("unknown command '" + args[0] + "'")
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err.Error())
+		usage(fs, stderr)
+		return 2
+	}
+
+	if *socketPath == "" {
+		*socketPath = rest.SocketPath(dataDir)
+	}
+
+	c := newClient(*socketPath, *asJSON)
+	if err := commands[args[0]].run(c, args[1:], stdout); err != nil {
+		fmt.Fprintln(stderr, "Error:", err.Error())
+		return 1
+	}
+	return 0
+}
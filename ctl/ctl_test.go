@@ -0,0 +1,173 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package ctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/rest"
+)
+
+// testServer serves canned administrative api responses on a unix socket in a temporary data directory.
+func testServer(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "quantum-ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]interface{}{
+		"GET /v1/node":   &rest.NodeInfo{MachineID: "local", Version: "1.0.0", Network: "10.99.0.0/16", Plugins: []string{}},
+		"GET /v1/health": &rest.Health{Status: rest.StatusFailing, Peers: 2, Readiness: &rest.Report{Status: rest.StatusFailing, Checks: []rest.Check{{Name: "watch", Detail: "the datastore is not being watched for changes"}}}},
+		"GET /v1/peers": []*rest.Peer{
+			{MachineID: "local", PrivateIP: net.ParseIP("10.99.0.1"), Local: true},
+			{MachineID: "remote", PrivateIP: net.ParseIP("10.99.0.2"), Endpoint: "1.1.1.1:1099", Plugins: []string{"encryption"}},
+		},
+		"GET /v1/route":    &rest.Route{Network: "10.99.0.0/16", Gateway: &rest.Peer{MachineID: "remote", Endpoint: "1.1.1.1:1099"}},
+		"GET /v1/floating": []*rest.FloatingIP{{IP: net.ParseIP("10.99.100.1"), OwnerID: "remote", OwnerIP: net.ParseIP("10.99.0.2")}},
+		"GET /v1/metrics": &metric.MetricsLog{
+			TxMetrics: &metric.Metrics{Packets: 10, Bytes: 1000, Links: map[string]*metric.Metrics{"10.99.0.2": {Packets: 10, Bytes: 1000}}},
+			RxMetrics: &metric.Metrics{Packets: 5, Bytes: 500},
+			Counters:  map[string]uint64{"datastoreSyncErrors": 3},
+		},
+		"POST /v1/floating/10.99.100.1/release":     &rest.Result{Action: "release", Message: "released the floating ip '10.99.100.1'"},
+		"POST /v1/floating/10.99.100.1/move/remote": &rest.Result{Action: "move", Message: "moved the floating ip '10.99.100.1' to 'remote'"},
+		"POST /v1/drain":           &rest.Result{Action: "drain", Message: "drained"},
+		"POST /v1/rotate-keys":     &rest.Result{Action: "rotate-keys", Message: "rotated the encryption keys"},
+		"GET /v1/log-level":        &rest.LogLevel{Level: "info", Format: "logfmt"},
+		"POST /v1/log-level/debug": &rest.Result{Action: "log-level", Message: "logging at the 'debug' level"},
+		"GET /v1/ping/192.168.1.1": &diag.Result{
+			Target:      "192.168.1.1",
+			Destination: net.ParseIP("192.168.1.1"),
+			Outside:     true,
+			Hops: []*diag.Hop{
+				{Role: diag.RoleLocal, MachineID: "local", PrivateIP: net.ParseIP("10.99.0.1"), Plugins: []string{"encryption"}, MTU: 1500},
+				{Role: diag.RoleGateway, MachineID: "remote", PrivateIP: net.ParseIP("10.99.0.2"), Endpoint: "1.1.1.1:1099", Plugins: []string{"encryption"}, RemotePlugins: []string{"encryption"}, MTU: 1400, RemoteMTU: 1400, Crypto: diag.CryptoOK, Sent: 2, Received: 2, RTTs: []float64{1.5, 2.5}, MinRTT: 1.5, MeanRTT: 2, MaxRTT: 2.5},
+			},
+			Diagnosis: "remote is reachable",
+		},
+		"GET /v1/ping/remote": &diag.Result{
+			Target:      "remote",
+			Destination: net.ParseIP("10.99.0.2"),
+			Hops: []*diag.Hop{
+				{Role: diag.RoleLocal, MachineID: "local"},
+				{Role: diag.RolePeer, MachineID: "remote", Endpoint: "1.1.1.1:1099", Crypto: diag.CryptoUnverified, Sent: 4},
+			},
+			Problem:   diag.ProblemFirewall,
+			Diagnosis: "no replies were received from remote",
+		},
+	}
+
+	listener, err := net.Listen("unix", rest.SocketPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			response = map[string]interface{}{"status": http.StatusNotFound, "error": "the api route '" + r.URL.Path + "' does not exist"}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	return dir, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testRun(t *testing.T, code int, args ...string) (string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if actual := Run(args, stdout, stderr); actual != code {
+		t.Fatal("Run", args, "returned the wrong exit code:", actual, stdout.String(), stderr.String())
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	dir, cleanup := testServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"status"}, []string{"local", "failing", "watch", "the datastore is not being watched for changes"}},
+		{[]string{"peers"}, []string{"MACHINE ID", "remote", "1.1.1.1:1099", "encryption"}},
+		{[]string{"routes"}, []string{"10.99.0.2", "default"}},
+		{[]string{"metrics"}, []string{"tx", "1000", "10.99.0.2", "datastoreSyncErrors"}},
+		{[]string{"floating", "list"}, []string{"10.99.100.1", "remote"}},
+		{[]string{"floating", "release", "10.99.100.1"}, []string{"released the floating ip"}},
+		{[]string{"floating", "move", "10.99.100.1", "remote"}, []string{"moved the floating ip '10.99.100.1' to 'remote'"}},
+		{[]string{"drain"}, []string{"drained"}},
+		{[]string{"rotate-keys"}, []string{"rotated the encryption keys"}},
+		{[]string{"log-level"}, []string{"'info' level", "'logfmt' format"}},
+		{[]string{"log-level", "debug"}, []string{"logging at the 'debug' level"}},
+		{[]string{"ping", "192.168.1.1", "2"}, []string{"via remote at 1.1.1.1:1099", "rtt=2.500 ms", "2 sent, 2 received, 0% lost", "1400 (remote: 1400)", "remote (gateway)", "remote is reachable"}},
+		{[]string{"traceroute", "192.168.1.1"}, []string{"gateway", "2.000 ms", "destination", "192.168.1.1"}},
+	}
+	for _, test := range tests {
+		stdout, _ := testRun(t, 0, append([]string{"--data-dir", dir}, test.args...)...)
+		for _, expected := range test.expected {
+			if !strings.Contains(stdout, expected) {
+				t.Fatal("Run", test.args, "did not output", expected, "in:", stdout)
+			}
+		}
+	}
+
+	// Options are accepted after the command as well.
+	stdout, _ := testRun(t, 0, "peers", "--json", "-d", dir)
+	var peers []*rest.Peer
+	if err := json.Unmarshal([]byte(stdout), &peers); err != nil || len(peers) != 2 {
+		t.Fatal("Run did not output the peers as json:", err, stdout)
+	}
+
+	stdout, _ = testRun(t, 0, "--json", "--socket", rest.SocketPath(dir), "status")
+	status := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(stdout), &status); err != nil || status["node"] == nil || status["health"] == nil {
+		t.Fatal("Run did not output the status as json:", err, stdout)
+	}
+
+	if _, stderr := testRun(t, 1, "-d", dir, "reload"); !strings.Contains(stderr, "does not exist") {
+		t.Fatal("Run did not output the api error:", stderr)
+	}
+	if _, stderr := testRun(t, 1, "-d", path.Join(dir, "missing"), "status"); !strings.Contains(stderr, "error connecting") {
+		t.Fatal("Run did not output the connection error:", stderr)
+	}
+	if _, stderr := testRun(t, 1, "-d", dir, "floating", "release", "woot"); !strings.Contains(stderr, "not a valid ip") {
+		t.Fatal("Run did not validate the floating ip:", stderr)
+	}
+	if _, stderr := testRun(t, 1, "-d", dir, "floating", "move", "10.99.100.1"); !strings.Contains(stderr, "usage") {
+		t.Fatal("Run did not require the node to move the floating ip to:", stderr)
+	}
+
+	// Both commands exit with a failure when a problem is diagnosed, after writing out what they found.
+	for _, command := range []string{"ping", "traceroute"} {
+		stdout, stderr := testRun(t, 1, "-d", dir, command, "remote")
+		if !strings.Contains(stdout, "100%") || !strings.Contains(stderr, "firewall problem: no replies were received from remote") {
+			t.Fatal("Run did not output the diagnosed problem:", stdout, stderr)
+		}
+	}
+	if _, stderr := testRun(t, 1, "-d", dir, "ping", "remote", "woot"); !strings.Contains(stderr, "not a valid probe count") {
+		t.Fatal("Run did not validate the probe count:", stderr)
+	}
+
+	testRun(t, 2)
+	testRun(t, 2, "woot")
+	testRun(t, 2, "--woot", "status")
+	if stdout, _ := testRun(t, 0, "help"); !strings.Contains(stdout, "floating list|move <ip> <node>|release <ip>") {
+		t.Fatal("Run did not output the usage:", stdout)
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package ctl contains the command line client operators use to inspect and administer the local quantum node, run as 'quantum ctl <command>'.
+
+The client talks to the administrative api of the local node over the unix socket the node serves in its data directory, '/var/lib/quantum/quantum.sock' by default. The socket is only accessible to the owner of the quantum process, and is granted full access to the api without a bearer token. The following commands are supported:
+    - 'status' the configuration of the node along with its liveness and readiness checks.
+    - 'peers' every node in the quantum network.
+    - 'routes' the node each destination is routed to, including the gateway for traffic destined outside of the quantum network.
+    - 'metrics' the transmission and reception statistics of the node, overall and per peer.
+    - 'floating list' the floating ips along with their owners, 'floating move <ip> <node>' hands a floating ip claimed by the local node to another node configured with it, identified by its private ip or machine id, and 'floating release <ip>' releases a floating ip claimed by the local node so that any other node configured with it claims it.
+    - 'ping <target> [count]' probes the node that traffic to an ip, machine id, or hostname is sent to, reporting the endpoint used, the round trip times, the negotiated plugins, the MTU, and whether both nodes derived the same encryption key, see the diag package for details.
+    - 'traceroute <target> [count]' lists and probes every quantum node that traffic to an ip, machine id, or hostname traverses, including the gateway for destinations outside of the quantum network.
+    - 'log-level' the level and format the node logs with, and 'log-level <level>' changes the level until quantum is reloaded, in the same way as sending it a SIGUSR1 toggles debug logging.
+    - 'reload' reloads the quantum process, in the same way as sending it a SIGHUP.
+    - 'drain' releases every floating ip claimed by the local node and marks it as not ready ahead of maintenance.
+    - 'rotate-keys' replaces the encryption keys of the local node with newly generated ones, which every peer derives new encryption state from once it picks up the change.
+
+The ping and traceroute commands can also be run directly as 'quantum ping' and 'quantum traceroute', and exit with a failure if they diagnose a problem along the path.
+
+Output is written as human readable tables by default, or as json with '--json'. The data directory is set with '--data-dir', or the 'QUANTUM_DATA_DIR' environment variable, and '--socket' overrides the path of the socket entirely.
+*/
+package ctl
@@ -0,0 +1,93 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of floating ip ttls the local node refrains from claiming a floating ip for after releasing it, which gives the other nodes time to claim it.
+	releaseHoldTTLs = 3
+)
+
+// claims tracks the floating ips claimed by the local node, so that they can be released on request.
+type claims struct {
+	mux      sync.Mutex
+	released map[string]chan struct{}
+	holdOff  map[string]time.Time
+	draining bool
+}
+
+// claim records that the local node holds the floating ip stored at the key, returning a channel that is closed once the claim is released.
+func (c *claims) claim(key string) <-chan struct{} {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	released := make(chan struct{})
+	c.released[key] = released
+	return released
+}
+
+// lost records that the local node no longer holds the floating ip stored at the key.
+func (c *claims) lost(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.released, key)
+}
+
+// claimed returns whether or not the local node holds the floating ip stored at the key.
+func (c *claims) claimed(key string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	_, ok := c.released[key]
+	return ok
+}
+
+// held returns whether or not the local node should refrain from claiming the floating ip stored at the key, either because it recently released it or because it is draining.
+func (c *claims) held(key string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.draining || time.Now().Before(c.holdOff[key])
+}
+
+// release the local node's claim on the floating ip stored at the key, and refrain from claiming it again for the hold duration so that another node can claim it.
+func (c *claims) release(key string, hold time.Duration) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	released, ok := c.released[key]
+	if !ok {
+		return errors.New("the floating ip is not claimed by the local node")
+	}
+
+	c.holdOff[key] = time.Now().Add(hold)
+	delete(c.released, key)
+	close(released)
+	return nil
+}
+
+// drain releases every claim held by the local node, and refrains from claiming any floating ip from then on.
+func (c *claims) drain() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.draining = true
+	for key, released := range c.released {
+		delete(c.released, key)
+		close(released)
+	}
+}
+
+func newClaims() *claims {
+	return &claims{
+		released: make(map[string]chan struct{}),
+		holdOff:  make(map[string]time.Time),
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaims(t *testing.T) {
+	c := newClaims()
+
+	if err := c.release("first", time.Hour); err == nil {
+		t.Fatal("release should have returned an error for a floating ip that was never claimed.")
+	}
+
+	first := c.claim("first")
+	second := c.claim("second")
+	if c.held("first") {
+		t.Fatal("held returned true for a floating ip that was never released.")
+	}
+	if !c.claimed("first") || c.claimed("third") {
+		t.Fatal("claimed returned the wrong result.")
+	}
+
+	if err := c.release("first", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first:
+	default:
+		t.Fatal("release did not close the released channel.")
+	}
+	if !c.held("first") || c.held("second") || c.claimed("first") {
+		t.Fatal("held or claimed returned the wrong result after a release.")
+	}
+
+	c.lost("second")
+	if err := c.release("second", time.Hour); err == nil {
+		t.Fatal("release should have returned an error for a floating ip that was lost.")
+	}
+
+	second = c.claim("second")
+	c.drain()
+	select {
+	case <-second:
+	default:
+		t.Fatal("drain did not release every claim.")
+	}
+	if !c.held("third") {
+		t.Fatal("held returned false while draining.")
+	}
+}
@@ -5,9 +5,11 @@ package datastore
 
 import (
 	"errors"
+	"net"
 	"time"
 
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
 )
 
 // Type represents the datastore backend to use for synchronizing mapping objects over the quantum network.
@@ -31,26 +33,88 @@ type Datastore interface {
 	// Init should handle setting up the datastore connections, and initializing the mappings/local mapping.
 	Init() error
 
+	// Resume should initialize the datastore from the mappings handed off by the previous process during a rolling restart, which were last synchronized at the supplied time, taking over the local mapping without locking the datastore or waiting on a full sync.
+	Resume(mappings []*common.Mapping, synced time.Time) error
+
 	// Mapping should return the mapping and true if it exists, if not the mapping should be nil and false should be returned along with it.
 	Mapping(ip uint32) (*common.Mapping, bool)
 
 	// GatewayMapping should retun the mapping and true if it exists specifically for destinations outside of the quantum network, if the mapping doesn't exist it will return nil and false.
 	GatewayMapping() (*common.Mapping, bool)
 
+	// Mappings should return all of the mappings currently known to the datastore.
+	Mappings() []*common.Mapping
+
+	// Stats should return the counters tracking the health of the synchronization with the backend datastore.
+	Stats() Stats
+
+	// PublishReport should publish the local node's report of the given kind to the backend datastore, where it should expire after the ttl unless it is published again.
+	PublishReport(kind string, report []byte, ttl time.Duration) error
+
+	// Reports should return the unexpired reports of the given kind published by every node, indexed by the private ip of the publishing node.
+	Reports(kind string) (map[string][]byte, error)
+
+	// ReleaseFloatingIP should give up the local node's claim on the floating ip, and refrain from claiming it again for long enough that another node can claim it.
+	ReleaseFloatingIP(ip net.IP) error
+
+	// MoveFloatingIP should hand the local node's claim on the floating ip to the target node, identified by its private ip, so that no other node claims the floating ip until the target node has claimed it or the move expires.
+	MoveFloatingIP(ip, target net.IP) error
+
+	// Drain should give up every floating ip claimed by the local node, and refrain from claiming any floating ip from then on.
+	Drain()
+
+	// Reload should pick up the live changes to the configuration, republishing the local mapping and claiming or releasing floating ips to match the configured floating ips.
+	Reload() error
+
 	// Start should kick off any routines that need to run in the background to groom the mappings and manage the datastore state.
 	Start()
 
-	// Stop should fully shutdown all operation and ensure that all connections are terminated gracefully.
+	// Stop should fully shutdown all operation and ensure that all connections are terminated gracefully, including when the datastore was initialized but never started.
 	Stop()
 }
 
-// New generates a datastore object based on the passed in Type and user configuration.
-func New(datastoreType string, cfg *common.Config) (Datastore, error) {
+// Stats represents the counters tracking the health of the synchronization between quantum and the backend datastore.
+type Stats struct {
+	// The number of periodic syncs with the backend datastore that have failed.
+	SyncErrors uint64 `json:"syncErrors"`
+
+	// The number of errors encountered while watching the backend datastore for changes, including mappings that could not be parsed.
+	WatchErrors uint64 `json:"watchErrors"`
+
+	// Whether or not the initial sync with the backend datastore has completed and the local mapping has been defined.
+	Initialized bool `json:"initialized"`
+
+	// Whether or not the backend datastore is currently being watched for changes.
+	Watching bool `json:"watching"`
+
+	// When the mappings were last successfully synchronized with the backend datastore, which is the zero time if they never have been.
+	LastSync time.Time `json:"lastSync"`
+}
+
+// lastSync converts the unix nano timestamp of the last successful sync to a time, leaving the time zero if no sync has succeeded.
+func lastSync(nano int64) time.Time {
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+// indexMappings indexes the mappings by private ip, the way the datastores hold them.
+func indexMappings(mappings []*common.Mapping) map[uint32]*common.Mapping {
+	indexed := make(map[uint32]*common.Mapping, len(mappings))
+	for _, mapping := range mappings {
+		indexed[common.IPtoInt(mapping.PrivateIP)] = mapping
+	}
+	return indexed
+}
+
+// New generates a datastore object based on the passed in Type and user configuration, the changes seen while watching the datastore are published on the supplied bus.
+func New(datastoreType string, cfg *common.Config, bus *event.Bus) (Datastore, error) {
 	switch datastoreType {
 	case ETCDV2Datastore:
-		return newEtcdV2(cfg)
+		return newEtcdV2(cfg, bus)
 	case ETCDV3Datastore:
-		return newEtcdV3(cfg)
+		return newEtcdV3(cfg, bus)
 	case MOCKDatastore:
 		return newMock(cfg)
 	default:
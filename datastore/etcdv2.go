@@ -9,12 +9,16 @@ import (
 	"encoding/binary"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/client"
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
 	"golang.org/x/net/context"
 )
 
@@ -22,12 +26,24 @@ import (
 type EtcdV2 struct {
 	cfg                 *common.Config
 	mappings            map[uint32]*common.Mapping
+	mappingsMux         sync.RWMutex
+	syncErrors          uint64
+	watchErrors         uint64
+	lastSync            int64
+	initialized         int32
+	watching            int32
 	gateway             uint32
+	local               string
+	refreshInterval     time.Duration
+	events              *publisher
+	claims              *claims
+	floating            *floatingIPs
 	ctx                 context.Context
 	cli                 client.Client
 	kapi                client.KeysAPI
 	watchIndex          uint64
 	cancelWatch         context.CancelFunc
+	reschedule          chan struct{}
 	stopSyncing         chan struct{}
 	stopRefreshingLock  chan struct{}
 	stopRefreshingLease chan struct{}
@@ -93,47 +109,159 @@ func (etcd *EtcdV2) handleLocalMapping() error {
 		return errors.New("error setting the local network mapping in etcd: " + err.Error())
 	}
 
-	go etcd.refresh(key, "", etcd.cfg.NetworkConfig.LeaseTime, etcd.cfg.DatastoreRefreshInterval, etcd.stopRefreshingLease)
+	etcd.refreshInterval = etcd.cfg.Current().DatastoreRefreshInterval
+	go etcd.refresh(key, "", etcd.cfg.NetworkConfig.LeaseTime, etcd.refreshInterval, etcd.stopRefreshingLease)
 
-	if mapping.Gateway != nil {
-		etcd.gateway = binary.LittleEndian.Uint32(mapping.Gateway.To4())
-	}
+	etcd.local = mapping.String()
+	etcd.setGateway(mapping)
 	return nil
 }
 
-func (etcd *EtcdV2) lockFloatingIP(key, value string) {
+// republishLocalMapping updates the local mapping in etcd if it has changed, for instance because the plugins or gateway of the local node changed.
+func (etcd *EtcdV2) republishLocalMapping() error {
+	etcd.mappingsMux.RLock()
+	mapping, err := common.GenerateLocalMapping(etcd.cfg, etcd.mappings)
+	etcd.mappingsMux.RUnlock()
+	if err != nil {
+		return errors.New("error generating the local network mapping: " + err.Error())
+	}
+
+	if mapping.String() == etcd.local {
+		return nil
+	}
+
+	key := etcd.key("nodes", etcd.cfg.PrivateIP.String())
 	opts := &client.SetOptions{
-		PrevExist: client.PrevNoExist,
-		TTL:       etcd.cfg.DatastoreFloatingIPTTL,
+		PrevExist: client.PrevExist,
+		TTL:       etcd.cfg.NetworkConfig.LeaseTime,
+	}
+
+	_, err = etcd.kapi.Set(etcd.ctx, key, mapping.String(), opts)
+	if err != nil {
+		return errors.New("error updating the local network mapping in etcd: " + err.Error())
 	}
 
-	stop := make(chan struct{})
+	etcd.local = mapping.String()
+	etcd.setGateway(mapping)
+	return nil
+}
+
+func (etcd *EtcdV2) setGateway(mapping *common.Mapping) {
+	var gateway uint32
+	if mapping.Gateway != nil {
+		gateway = binary.LittleEndian.Uint32(mapping.Gateway.To4())
+	}
+	atomic.StoreUint32(&etcd.gateway, gateway)
+}
+
+func (etcd *EtcdV2) lockFloatingIP(key, value string, quit <-chan struct{}) {
 	for {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		moved, ok := etcd.moved(key)
+		if etcd.claims.held(key) || !ok {
+			if !sleep(etcd.cfg.Current().DatastoreFloatingIPTTL, quit) {
+				return
+			}
+			continue
+		}
+
+		opts := &client.SetOptions{
+			PrevExist: client.PrevNoExist,
+			TTL:       etcd.cfg.Current().DatastoreFloatingIPTTL,
+		}
 		_, err := etcd.kapi.Set(etcd.ctx, key, value, opts)
 
 		if err != nil && !isError(err, client.ErrorCodeNodeExist) {
-			etcd.cfg.Log.Error.Println("[ETCD]", "Error attempting to set floating mapping in etcd: "+err.Error())
-			time.Sleep(etcd.cfg.DatastoreFloatingIPTTL)
+			etcd.cfg.Log.Error("etcd", "Error attempting to set floating mapping in etcd", "key", key, "error", err)
+			if !sleep(etcd.cfg.Current().DatastoreFloatingIPTTL, quit) {
+				return
+			}
 			continue
 		} else if isError(err, client.ErrorCodeNodeExist) {
-			time.Sleep(etcd.cfg.DatastoreFloatingIPTTL)
+			if !sleep(etcd.cfg.Current().DatastoreFloatingIPTTL, quit) {
+				return
+			}
 			continue
 		}
 
-		etcd.refresh(key, value, etcd.cfg.DatastoreFloatingIPTTL, etcd.cfg.DatastoreFloatingIPTTL/2, stop)
+		// The move is complete once the local node claims the floating ip.
+		if moved {
+			local := etcd.cfg.PrivateIP.String()
+			if _, err := etcd.kapi.Delete(etcd.ctx, etcd.moveKey(key), &client.DeleteOptions{PrevValue: local}); err != nil && !isError(err, client.ErrorCodeKeyNotFound, client.ErrorCodeTestFailed) {
+				etcd.cfg.Log.Error("etcd", "Error completing the move of a floating ip in etcd", "key", etcd.moveKey(key), "error", err)
+			}
+		}
+
+		released := etcd.claims.claim(key)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		ttl := etcd.cfg.Current().DatastoreFloatingIPTTL
+		go func() {
+			etcd.refresh(key, value, ttl, ttl/2, stop)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			etcd.claims.lost(key)
+		case <-released:
+			close(stop)
+			<-done
+
+			// Only delete the floating mapping if it is still owned by the local node.
+			_, err := etcd.kapi.Delete(etcd.ctx, key, &client.DeleteOptions{PrevValue: value})
+			if err != nil {
+				etcd.cfg.Log.Error("etcd", "Error releasing floating mapping in etcd", "key", key, "error", err)
+			}
+		}
 	}
 }
 
+// moveKey returns the key recording the node that the floating ip, whose floating mapping is stored at the key, is being moved to.
+func (etcd *EtcdV2) moveKey(key string) string {
+	return etcd.key("moves", path.Base(key))
+}
+
+// moved returns whether or not the floating ip stored at the key is being moved to the local node, and false if it is being moved to another node and must not be claimed.
+func (etcd *EtcdV2) moved(key string) (bool, bool) {
+	resp, err := etcd.kapi.Get(etcd.ctx, etcd.moveKey(key), nil)
+	if isError(err, client.ErrorCodeKeyNotFound) {
+		return false, true
+	} else if err != nil {
+		etcd.cfg.Log.Error("etcd", "Error retrieving the move of a floating ip from etcd", "key", etcd.moveKey(key), "error", err)
+		return false, false
+	}
+
+	if resp.Node.Value != etcd.cfg.PrivateIP.String() {
+		return false, false
+	}
+	return true, true
+}
+
 func (etcd *EtcdV2) handleFloatingMappings() error {
-	for i := 0; i < len(etcd.cfg.FloatingIPs); i++ {
+	wanted := make(map[string]string)
+
+	etcd.mappingsMux.RLock()
+	for i := 0; i < len(etcd.cfg.Current().FloatingIPs); i++ {
 		mapping, err := common.GenerateFloatingMapping(etcd.cfg, i, etcd.mappings)
 		if err != nil {
+			etcd.mappingsMux.RUnlock()
 			return err
 		}
 
-		go etcd.lockFloatingIP(etcd.key("nodes", mapping.PrivateIP.String()), mapping.String())
+		wanted[etcd.key("nodes", mapping.PrivateIP.String())] = mapping.String()
 	}
+	etcd.mappingsMux.RUnlock()
 
+	// Floating ips which are no longer configured are released straight away, as the local node will never claim them again.
+	for _, key := range etcd.floating.update(wanted, etcd.lockFloatingIP) {
+		etcd.claims.release(key, 0)
+	}
 	return nil
 }
 
@@ -155,7 +283,7 @@ func (etcd *EtcdV2) refresh(key, value string, ttl, refreshInterval time.Duratio
 		case <-ticker.C:
 			_, err := etcd.kapi.Set(etcd.ctx, key, "", opts)
 			if err != nil {
-				etcd.cfg.Log.Error.Println("[ETCD]", "Error refreshing key in etcd: "+err.Error())
+				etcd.cfg.Log.Error("etcd", "Error refreshing key in etcd", "key", key, "error", err)
 				if isError(err, client.ErrorCodeKeyNotFound, client.ErrorCodePrevValueRequired, client.ErrorCodeTestFailed) {
 					stopRefreshing = true
 				}
@@ -229,7 +357,11 @@ func (etcd *EtcdV2) sync() error {
 		mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
 	}
 
+	etcd.mappingsMux.Lock()
 	etcd.mappings = mappings
+	etcd.mappingsMux.Unlock()
+
+	atomic.StoreInt64(&etcd.lastSync, time.Now().UnixNano())
 	return nil
 }
 
@@ -239,18 +371,22 @@ func (etcd *EtcdV2) watch() {
 		Recursive:  true,
 	}
 	watcher := etcd.kapi.Watcher(etcd.key("nodes"), opts)
+	atomic.StoreInt32(&etcd.watching, 1)
 
 	for {
 		ctx, cancel := context.WithCancel(etcd.ctx)
 		etcd.cancelWatch = cancel
 		resp, err := watcher.Next(ctx)
 		if ctx.Err() != context.Canceled && err != nil {
-			etcd.cfg.Log.Error.Println("[ETCD]", "Error during watch on the etcd cluster: "+err.Error())
+			atomic.AddUint64(&etcd.watchErrors, 1)
+			atomic.StoreInt32(&etcd.watching, 0)
+			etcd.cfg.Log.Error("etcd", "Error during watch on the etcd cluster", "error", err)
 			time.Sleep(5 * time.Second)
 
 			go etcd.watch()
 			return
 		} else if ctx.Err() == context.Canceled {
+			atomic.StoreInt32(&etcd.watching, 0)
 			break
 		}
 
@@ -260,17 +396,34 @@ func (etcd *EtcdV2) watch() {
 		case "set", "update", "create":
 			mapping, err := common.ParseMapping(resp.Node.Value, etcd.cfg)
 			if err != nil {
-				etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing mapping: "+err.Error())
+				atomic.AddUint64(&etcd.watchErrors, 1)
+				etcd.cfg.Log.Error("etcd", "Error parsing mapping", "key", resp.Node.Key, "error", err)
 				continue
 			}
-			etcd.mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
+			ip := common.IPtoInt(mapping.PrivateIP)
+			etcd.mappingsMux.Lock()
+			previous := etcd.mappings[ip]
+			etcd.mappings[ip] = mapping
+			etcd.events.changed(ip, previous, mapping, ip == atomic.LoadUint32(&etcd.gateway))
+			etcd.mappingsMux.Unlock()
 		case "delete", "expire":
-			mapping, err := common.ParseMapping(resp.Node.Value, etcd.cfg)
+			// The value of a deleted or expired key is only carried by the previous node.
+			node := resp.Node
+			if resp.PrevNode != nil {
+				node = resp.PrevNode
+			}
+			mapping, err := common.ParseMapping(node.Value, etcd.cfg)
 			if err != nil {
-				etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing mapping: "+err.Error())
+				atomic.AddUint64(&etcd.watchErrors, 1)
+				etcd.cfg.Log.Error("etcd", "Error parsing mapping", "key", node.Key, "error", err)
 				continue
 			}
-			delete(etcd.mappings, common.IPtoInt(mapping.PrivateIP))
+			ip := common.IPtoInt(mapping.PrivateIP)
+			etcd.mappingsMux.Lock()
+			previous := etcd.mappings[ip]
+			delete(etcd.mappings, ip)
+			etcd.events.changed(ip, previous, nil, ip == atomic.LoadUint32(&etcd.gateway))
+			etcd.mappingsMux.Unlock()
 		}
 	}
 }
@@ -283,10 +436,115 @@ func (etcd *EtcdV2) Mapping(ip uint32) (*common.Mapping, bool) {
 
 // GatewayMapping should retun the mapping and true if it exists specifically for destinations outside of the quantum network, if the mapping doesn't exist it will return nil and false.
 func (etcd *EtcdV2) GatewayMapping() (*common.Mapping, bool) {
-	mapping, exists := etcd.mappings[etcd.gateway]
+	mapping, exists := etcd.mappings[atomic.LoadUint32(&etcd.gateway)]
 	return mapping, exists
 }
 
+// Mappings returns a copy of all of the mappings currently known to the datastore.
+func (etcd *EtcdV2) Mappings() []*common.Mapping {
+	etcd.mappingsMux.RLock()
+	defer etcd.mappingsMux.RUnlock()
+
+	mappings := make([]*common.Mapping, 0, len(etcd.mappings))
+	for _, mapping := range etcd.mappings {
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// Stats returns the counters tracking the health of the synchronization with the etcd cluster.
+func (etcd *EtcdV2) Stats() Stats {
+	return Stats{
+		SyncErrors:  atomic.LoadUint64(&etcd.syncErrors),
+		WatchErrors: atomic.LoadUint64(&etcd.watchErrors),
+		Initialized: atomic.LoadInt32(&etcd.initialized) == 1,
+		Watching:    atomic.LoadInt32(&etcd.watching) == 1,
+		LastSync:    lastSync(atomic.LoadInt64(&etcd.lastSync)),
+	}
+}
+
+// PublishReport publishes the local node's report of the given kind to etcd, where it will expire after the ttl unless it is published again.
+func (etcd *EtcdV2) PublishReport(kind string, report []byte, ttl time.Duration) error {
+	key := etcd.key("reports", kind, etcd.cfg.PrivateIP.String())
+	opts := &client.SetOptions{
+		TTL: ttl,
+	}
+
+	_, err := etcd.kapi.Set(etcd.ctx, key, string(report), opts)
+	if err != nil {
+		return errors.New("error publishing the " + kind + " report to etcd: " + err.Error())
+	}
+	return nil
+}
+
+// Reports returns the unexpired reports of the given kind published by every node, indexed by the private ip of the publishing node.
+func (etcd *EtcdV2) Reports(kind string) (map[string][]byte, error) {
+	reports := make(map[string][]byte)
+
+	resp, err := etcd.kapi.Get(etcd.ctx, etcd.key("reports", kind), &client.GetOptions{Recursive: true})
+	if err != nil {
+		if isError(err, client.ErrorCodeKeyNotFound) {
+			return reports, nil
+		}
+		return nil, errors.New("error retrieving the " + kind + " reports from etcd: " + err.Error())
+	}
+
+	for _, node := range resp.Node.Nodes {
+		reports[path.Base(node.Key)] = []byte(node.Value)
+	}
+	return reports, nil
+}
+
+// ReleaseFloatingIP gives up the local node's claim on the floating ip, and refrains from claiming it again for long enough that another node can claim it.
+func (etcd *EtcdV2) ReleaseFloatingIP(ip net.IP) error {
+	return etcd.claims.release(etcd.key("nodes", ip.String()), releaseHoldTTLs*etcd.cfg.Current().DatastoreFloatingIPTTL)
+}
+
+// MoveFloatingIP hands the local node's claim on the floating ip to the target node. The move is recorded in etcd before the claim is released, and every other node refrains from claiming the floating ip until the target node claims it, or the move expires after a few floating ip ttls.
+func (etcd *EtcdV2) MoveFloatingIP(ip, target net.IP) error {
+	key := etcd.key("nodes", ip.String())
+	if !etcd.claims.claimed(key) {
+		return errors.New("the floating ip is not claimed by the local node")
+	}
+
+	hold := releaseHoldTTLs * etcd.cfg.Current().DatastoreFloatingIPTTL
+	if _, err := etcd.kapi.Set(etcd.ctx, etcd.moveKey(key), target.String(), &client.SetOptions{TTL: hold}); err != nil {
+		return errors.New("error recording the move of the floating ip in etcd: " + err.Error())
+	}
+	return etcd.claims.release(key, hold)
+}
+
+// Drain gives up every floating ip claimed by the local node, and refrains from claiming any floating ip from then on.
+func (etcd *EtcdV2) Drain() {
+	etcd.claims.drain()
+}
+
+// Reload picks up the live changes to the configuration, resynchronizing the mappings, republishing the local mapping, and claiming or releasing floating ips to match the configured floating ips.
+func (etcd *EtcdV2) Reload() error {
+	// The mappings are parsed again so that they use the encryption keys generated if encryption was just enabled.
+	if err := etcd.sync(); err != nil {
+		return err
+	}
+
+	if err := etcd.republishLocalMapping(); err != nil {
+		return err
+	}
+
+	if etcd.refreshInterval != etcd.cfg.Current().DatastoreRefreshInterval {
+		close(etcd.stopRefreshingLease)
+		etcd.stopRefreshingLease = make(chan struct{})
+		etcd.refreshInterval = etcd.cfg.Current().DatastoreRefreshInterval
+		go etcd.refresh(etcd.key("nodes", etcd.cfg.PrivateIP.String()), "", etcd.cfg.NetworkConfig.LeaseTime, etcd.refreshInterval, etcd.stopRefreshingLease)
+	}
+
+	select {
+	case etcd.reschedule <- struct{}{}:
+	default:
+	}
+
+	return etcd.handleFloatingMappings()
+}
+
 // Init the Etcd datastore which will open any necessary connections, preform an initial sync of the datastore, and define the local mapping in the datastore.
 func (etcd *EtcdV2) Init() error {
 	err := etcd.lock()
@@ -318,24 +576,56 @@ func (etcd *EtcdV2) Init() error {
 		return err
 	}
 
-	return etcd.unlock()
+	err = etcd.unlock()
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&etcd.initialized, 1)
+	return nil
+}
+
+// Resume initializes the datastore from the mappings handed off by the previous process during a rolling restart. The local mapping is taken over without locking etcd, as the private ip already belongs to this node, and any changes since the mappings were last synchronized are picked up by the watch and the periodic sync.
+func (etcd *EtcdV2) Resume(mappings []*common.Mapping, synced time.Time) error {
+	etcd.mappingsMux.Lock()
+	etcd.mappings = indexMappings(mappings)
+	etcd.mappingsMux.Unlock()
+
+	if !synced.IsZero() {
+		atomic.StoreInt64(&etcd.lastSync, synced.UnixNano())
+	}
+
+	if err := etcd.handleLocalMapping(); err != nil {
+		return err
+	}
+
+	if err := etcd.handleFloatingMappings(); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&etcd.initialized, 1)
+	return nil
 }
 
 // Start periodic synchronization, and DHCP lease refresh with the datastore, as well as start watching for changes in network topology.
 func (etcd *EtcdV2) Start() {
 	go etcd.watch()
 
-	ticker := time.NewTicker(etcd.cfg.DatastoreSyncInterval)
+	ticker := time.NewTicker(etcd.cfg.Current().DatastoreSyncInterval)
 	go func() {
 	loop:
 		for {
 			select {
 			case <-etcd.stopSyncing:
 				break loop
+			case <-etcd.reschedule:
+				ticker.Stop()
+				ticker = time.NewTicker(etcd.cfg.Current().DatastoreSyncInterval)
 			case <-ticker.C:
 				err := etcd.sync()
 				if err != nil {
-					etcd.cfg.Log.Error.Println("[ETCD]", "Error synchronizing mappings with the backend: "+err.Error())
+					atomic.AddUint64(&etcd.syncErrors, 1)
+					etcd.cfg.Log.Error("etcd", "Error synchronizing mappings with the backend", "error", err)
 				}
 			}
 		}
@@ -344,11 +634,8 @@ func (etcd *EtcdV2) Start() {
 	}()
 }
 
-// Stop synchronizing with the backend and shutdown open connections.
+// Stop synchronizing with the backend and shutdown open connections. The stop channels are closed rather than sent on, so that a datastore which was initialized but never started can be stopped as well.
 func (etcd *EtcdV2) Stop() {
-	etcd.stopSyncing <- struct{}{}
-	etcd.stopRefreshingLease <- struct{}{}
-
 	if etcd.cancelWatch != nil {
 		etcd.cancelWatch()
 	}
@@ -405,8 +692,8 @@ func generateV2Config(cfg *common.Config) (client.Config, error) {
 	return etcdCfg, nil
 }
 
-func newEtcdV2(cfg *common.Config) (Datastore, error) {
-	cfg.Log.Warn.Println("[ETCD]", "The 'etcdv2' backend is deprecated and will be removed in a future release.")
+func newEtcdV2(cfg *common.Config, bus *event.Bus) (Datastore, error) {
+	cfg.Log.Warn("etcd", "The 'etcdv2' backend is deprecated and will be removed in a future release.")
 	etcdCfg, err := generateV2Config(cfg)
 	if err != nil {
 		return nil, err
@@ -422,8 +709,12 @@ func newEtcdV2(cfg *common.Config) (Datastore, error) {
 		ctx:                 context.TODO(),
 		cfg:                 cfg,
 		mappings:            make(map[uint32]*common.Mapping),
+		events:              newPublisher(bus),
+		claims:              newClaims(),
+		floating:            newFloatingIPs(),
 		cli:                 cli,
 		kapi:                kapi,
+		reschedule:          make(chan struct{}, 1),
 		stopSyncing:         make(chan struct{}),
 		stopRefreshingLock:  make(chan struct{}),
 		stopRefreshingLease: make(chan struct{}),
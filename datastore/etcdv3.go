@@ -9,13 +9,17 @@ import (
 	"encoding/binary"
 	"errors"
 	"io/ioutil"
+	"net"
 	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/clientv3util"
 	"github.com/coreos/etcd/clientv3/concurrency"
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
 	"golang.org/x/net/context"
 )
 
@@ -24,7 +28,21 @@ type EtcdV3 struct {
 	cfg         *common.Config
 	etcdCfg     clientv3.Config
 	mappings    map[uint32]*common.Mapping
+	mappingsMux sync.RWMutex
+	syncErrors  uint64
+	watchErrors uint64
+	lastSync    int64
+	initialized int32
+	watching    int32
 	gateway     uint32
+	local       string
+	localLease  clientv3.LeaseID
+	reports     map[string]clientv3.LeaseID
+	reportsMux  sync.Mutex
+	events      *publisher
+	claims      *claims
+	floating    *floatingIPs
+	reschedule  chan struct{}
 	stopSyncing chan struct{}
 	cli         *clientv3.Client
 	cliCtx      context.Context
@@ -81,7 +99,11 @@ func (etcd *EtcdV3) sync() error {
 		mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
 	}
 
+	etcd.mappingsMux.Lock()
 	etcd.mappings = mappings
+	etcd.mappingsMux.Unlock()
+
+	atomic.StoreInt64(&etcd.lastSync, time.Now().UnixNano())
 
 	return nil
 }
@@ -109,51 +131,167 @@ func (etcd *EtcdV3) handleLocalMapping() error {
 		return errors.New("coult not refresh local mapping in etcd: " + err.Error())
 	}
 
-	if mapping.Gateway != nil {
-		etcd.gateway = binary.LittleEndian.Uint32(mapping.Gateway.To4())
+	etcd.local = mapping.String()
+	etcd.localLease = lease
+	etcd.setGateway(mapping)
+	return nil
+}
+
+// republishLocalMapping updates the local mapping in etcd if it has changed, for instance because the plugins or gateway of the local node changed.
+func (etcd *EtcdV3) republishLocalMapping() error {
+	etcd.mappingsMux.RLock()
+	mapping, err := common.GenerateLocalMapping(etcd.cfg, etcd.mappings)
+	etcd.mappingsMux.RUnlock()
+	if err != nil {
+		return errors.New("could not generate the local network mapping: " + err.Error())
+	}
+
+	if mapping.String() == etcd.local {
+		return nil
 	}
 
+	key := etcd.key("nodes", etcd.cfg.PrivateIP.String())
+	_, err = etcd.cli.Put(etcd.cliCtx, key, mapping.String(), clientv3.WithLease(etcd.localLease))
+	if err != nil {
+		return errors.New("could not update etcd with the local network mapping: " + err.Error())
+	}
+
+	etcd.local = mapping.String()
+	etcd.setGateway(mapping)
 	return nil
 }
 
-func (etcd *EtcdV3) lockFloatingIP(key, value string) {
+func (etcd *EtcdV3) setGateway(mapping *common.Mapping) {
+	var gateway uint32
+	if mapping.Gateway != nil {
+		gateway = binary.LittleEndian.Uint32(mapping.Gateway.To4())
+	}
+	atomic.StoreUint32(&etcd.gateway, gateway)
+}
+
+func (etcd *EtcdV3) lockFloatingIP(key, value string, quit <-chan struct{}) {
 	first := true
 	for {
-		if !first {
-			time.Sleep(etcd.cfg.DatastoreFloatingIPTTL)
+		if !first && !sleep(etcd.cfg.Current().DatastoreFloatingIPTTL, quit) {
+			return
 		}
 		first = false
 
-		lease, err := etcd.lease(etcd.cfg.DatastoreFloatingIPTTL / time.Second)
-		if err != nil {
-			etcd.cfg.Log.Error.Println("[ETCD]", "Error attempting to lock floating mapping in etcd: "+err.Error())
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		if etcd.claims.held(key) {
 			continue
 		}
 
-		_, err = etcd.cli.Put(etcd.cliCtx, key, value)
+		moved, moves, ok := etcd.moved(key)
+		if !ok {
+			continue
+		}
+
+		lease, err := etcd.lease(etcd.cfg.Current().DatastoreFloatingIPTTL / time.Second)
 		if err != nil {
-			etcd.cfg.Log.Error.Println("[ETCD]", "Error attempting to set floating mapping in etcd: "+err.Error())
+			etcd.cfg.Log.Error("etcd", "Error attempting to lock floating mapping in etcd", "key", key, "error", err)
 			continue
 		}
 
-		err = etcd.keepalive(lease)
+		// Only claim the floating ip if no other node currently owns it, and it is not being moved to another node.
+		resp, err := etcd.cli.Txn(etcd.cliCtx).
+			If(append([]clientv3.Cmp{clientv3util.KeyMissing(key)}, moved)...).
+			Then(append([]clientv3.Op{clientv3.OpPut(key, value, clientv3.WithLease(lease))}, moves...)...).
+			Commit()
+		if err != nil || !resp.Succeeded {
+			if err != nil {
+				etcd.cfg.Log.Error("etcd", "Error attempting to set floating mapping in etcd", "key", key, "error", err)
+			}
+			etcd.cli.Revoke(etcd.cliCtx, lease)
+			continue
+		}
+
+		released := etcd.claims.claim(key)
+		ctx, cancel := context.WithCancel(etcd.cliCtx)
+		keepalives, err := etcd.cli.KeepAlive(ctx, lease)
 		if err != nil {
-			etcd.cfg.Log.Error.Println("[ETCD]", "Error attempting to refresh floating mapping in etcd: "+err.Error())
+			etcd.cfg.Log.Error("etcd", "Error attempting to refresh floating mapping in etcd", "key", key, "error", err)
+			etcd.claims.lost(key)
+			etcd.cli.Revoke(etcd.cliCtx, lease)
+			cancel()
 			continue
 		}
+
+		etcd.holdFloatingIP(key, lease, keepalives, released)
+		cancel()
+	}
+}
+
+// moveKey returns the key recording the node that the floating ip, whose floating mapping is stored at the key, is being moved to.
+func (etcd *EtcdV3) moveKey(key string) string {
+	return etcd.key("moves", path.Base(key))
+}
+
+// moved returns the comparison that must hold for the local node to claim the floating ip stored at the key, along with the operations to carry out once it is claimed, or false if the floating ip is being moved to another node.
+func (etcd *EtcdV3) moved(key string) (clientv3.Cmp, []clientv3.Op, bool) {
+	moveKey := etcd.moveKey(key)
+	resp, err := etcd.cli.Get(etcd.cliCtx, moveKey)
+	if err != nil {
+		etcd.cfg.Log.Error("etcd", "Error retrieving the move of a floating ip from etcd", "key", moveKey, "error", err)
+		return clientv3.Cmp{}, nil, false
+	}
+
+	if len(resp.Kvs) == 0 {
+		return clientv3util.KeyMissing(moveKey), nil, true
+	}
+
+	local := etcd.cfg.PrivateIP.String()
+	if string(resp.Kvs[0].Value) != local {
+		return clientv3.Cmp{}, nil, false
+	}
+
+	// The move is complete once the local node claims the floating ip.
+	return clientv3.Compare(clientv3.Value(moveKey), "=", local), []clientv3.Op{clientv3.OpDelete(moveKey)}, true
+}
+
+// holdFloatingIP blocks while the local node holds the floating ip, until either the lease is lost or the claim is released.
+func (etcd *EtcdV3) holdFloatingIP(key string, lease clientv3.LeaseID, keepalives <-chan *clientv3.LeaseKeepAliveResponse, released <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-keepalives:
+			if !ok {
+				etcd.claims.lost(key)
+				return
+			}
+		case <-released:
+			// Revoking the lease deletes the floating mapping, so that another node can claim it straight away.
+			if _, err := etcd.cli.Revoke(etcd.cliCtx, lease); err != nil {
+				etcd.cfg.Log.Error("etcd", "Error releasing floating mapping in etcd", "key", key, "error", err)
+			}
+			return
+		}
 	}
 }
 
 func (etcd *EtcdV3) handleFloatingMappings() error {
-	for i := 0; i < len(etcd.cfg.FloatingIPs); i++ {
+	wanted := make(map[string]string)
+
+	etcd.mappingsMux.RLock()
+	for i := 0; i < len(etcd.cfg.Current().FloatingIPs); i++ {
 		mapping, err := common.GenerateFloatingMapping(etcd.cfg, i, etcd.mappings)
 		if err != nil {
+			etcd.mappingsMux.RUnlock()
 			return err
 		}
 
-		go etcd.lockFloatingIP(etcd.key("nodes", mapping.PrivateIP.String()), mapping.String())
+		wanted[etcd.key("nodes", mapping.PrivateIP.String())] = mapping.String()
 	}
+	etcd.mappingsMux.RUnlock()
 
+	// Floating ips which are no longer configured are released straight away, as the local node will never claim them again.
+	for _, key := range etcd.floating.update(wanted, etcd.lockFloatingIP) {
+		etcd.claims.release(key, 0)
+	}
 	return nil
 }
 
@@ -222,12 +360,15 @@ func (etcd *EtcdV3) watch() {
 	key := etcd.key("nodes")
 	for {
 		ctx, cancel := context.WithTimeout(etcd.cliCtx, 30*time.Second)
-		watch := etcd.cli.Watch(ctx, key, clientv3.WithPrefix())
+		watch := etcd.cli.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithPrevKV())
+		atomic.StoreInt32(&etcd.watching, 1)
 
 		for resp := range watch {
 			if resp.Canceled {
 				if err := resp.Err(); err != nil {
-					etcd.cfg.Log.Error.Println("[ETCD]", "Error during watch operation: "+err.Error())
+					atomic.AddUint64(&etcd.watchErrors, 1)
+					atomic.StoreInt32(&etcd.watching, 0)
+					etcd.cfg.Log.Error("etcd", "Error during watch operation", "error", err)
 				}
 				break
 			}
@@ -237,17 +378,34 @@ func (etcd *EtcdV3) watch() {
 				case "PUT":
 					mapping, err := common.ParseMapping(string(ev.Kv.Value), etcd.cfg)
 					if err != nil {
-						etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing mapping: "+err.Error())
+						atomic.AddUint64(&etcd.watchErrors, 1)
+						etcd.cfg.Log.Error("etcd", "Error parsing mapping", "key", string(ev.Kv.Key), "error", err)
 						continue
 					}
-					etcd.mappings[common.IPtoInt(mapping.PrivateIP)] = mapping
+					ip := common.IPtoInt(mapping.PrivateIP)
+					etcd.mappingsMux.Lock()
+					previous := etcd.mappings[ip]
+					etcd.mappings[ip] = mapping
+					etcd.events.changed(ip, previous, mapping, ip == atomic.LoadUint32(&etcd.gateway))
+					etcd.mappingsMux.Unlock()
 				case "DELETE":
-					mapping, err := common.ParseMapping(string(ev.Kv.Value), etcd.cfg)
+					// The value of a deleted key is only carried by the previous key value.
+					kv := ev.Kv
+					if ev.PrevKv != nil {
+						kv = ev.PrevKv
+					}
+					mapping, err := common.ParseMapping(string(kv.Value), etcd.cfg)
 					if err != nil {
-						etcd.cfg.Log.Error.Println("[ETCD]", "Error parsing mapping: "+err.Error())
+						atomic.AddUint64(&etcd.watchErrors, 1)
+						etcd.cfg.Log.Error("etcd", "Error parsing mapping", "key", string(kv.Key), "error", err)
 						continue
 					}
-					delete(etcd.mappings, common.IPtoInt(mapping.PrivateIP))
+					ip := common.IPtoInt(mapping.PrivateIP)
+					etcd.mappingsMux.Lock()
+					previous := etcd.mappings[ip]
+					delete(etcd.mappings, ip)
+					etcd.events.changed(ip, previous, nil, ip == atomic.LoadUint32(&etcd.gateway))
+					etcd.mappingsMux.Unlock()
 				}
 			}
 		}
@@ -264,10 +422,153 @@ func (etcd *EtcdV3) Mapping(ip uint32) (*common.Mapping, bool) {
 
 // GatewayMapping should retun the mapping and true if it exists specifically for destinations outside of the quantum network, if the mapping doesn't exist it will return nil and false.
 func (etcd *EtcdV3) GatewayMapping() (*common.Mapping, bool) {
-	mapping, exists := etcd.mappings[etcd.gateway]
+	mapping, exists := etcd.mappings[atomic.LoadUint32(&etcd.gateway)]
 	return mapping, exists
 }
 
+// Mappings returns a copy of all of the mappings currently known to the datastore.
+func (etcd *EtcdV3) Mappings() []*common.Mapping {
+	etcd.mappingsMux.RLock()
+	defer etcd.mappingsMux.RUnlock()
+
+	mappings := make([]*common.Mapping, 0, len(etcd.mappings))
+	for _, mapping := range etcd.mappings {
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// Stats returns the counters tracking the health of the synchronization with the etcd cluster.
+func (etcd *EtcdV3) Stats() Stats {
+	return Stats{
+		SyncErrors:  atomic.LoadUint64(&etcd.syncErrors),
+		WatchErrors: atomic.LoadUint64(&etcd.watchErrors),
+		Initialized: atomic.LoadInt32(&etcd.initialized) == 1,
+		Watching:    atomic.LoadInt32(&etcd.watching) == 1,
+		LastSync:    lastSync(atomic.LoadInt64(&etcd.lastSync)),
+	}
+}
+
+// PublishReport publishes the local node's report of the given kind to etcd, where it will expire after the ttl once the local node stops publishing it. Every report of a kind shares a single lease, which is kept alive until the datastore is stopped.
+func (etcd *EtcdV3) PublishReport(kind string, report []byte, ttl time.Duration) error {
+	key := etcd.key("reports", kind, etcd.cfg.PrivateIP.String())
+
+	lease, err := etcd.reportLease(kind, ttl)
+	if err != nil {
+		return errors.New("error publishing the " + kind + " report to etcd: " + err.Error())
+	}
+
+	_, err = etcd.cli.Put(etcd.cliCtx, key, string(report), clientv3.WithLease(lease))
+	if err != nil {
+		// The lease may have expired while etcd was unreachable, so a new one is granted on the next publish.
+		etcd.reportsMux.Lock()
+		if etcd.reports[kind] == lease {
+			delete(etcd.reports, kind)
+		}
+		etcd.reportsMux.Unlock()
+		return errors.New("error publishing the " + kind + " report to etcd: " + err.Error())
+	}
+	return nil
+}
+
+// reportLease returns the lease the reports of the given kind are published with, granting the lease and keeping it alive the first time the kind is published.
+func (etcd *EtcdV3) reportLease(kind string, ttl time.Duration) (clientv3.LeaseID, error) {
+	etcd.reportsMux.Lock()
+	defer etcd.reportsMux.Unlock()
+
+	if lease, ok := etcd.reports[kind]; ok {
+		return lease, nil
+	}
+
+	lease, err := etcd.lease(ttl / time.Second)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := etcd.keepalive(lease); err != nil {
+		etcd.cli.Revoke(etcd.cliCtx, lease)
+		return -1, err
+	}
+
+	etcd.reports[kind] = lease
+	return lease, nil
+}
+
+// revokeReports revokes the leases of the published reports, which deletes the reports straight away rather than once they expire.
+func (etcd *EtcdV3) revokeReports() {
+	etcd.reportsMux.Lock()
+	defer etcd.reportsMux.Unlock()
+
+	for kind, lease := range etcd.reports {
+		if _, err := etcd.cli.Revoke(etcd.cliCtx, lease); err != nil {
+			etcd.cfg.Log.Warn("etcd", "Error revoking the lease of a published report", "kind", kind, "error", err)
+		}
+		delete(etcd.reports, kind)
+	}
+}
+
+// Reports returns the unexpired reports of the given kind published by every node, indexed by the private ip of the publishing node.
+func (etcd *EtcdV3) Reports(kind string) (map[string][]byte, error) {
+	resp, err := etcd.cli.Get(etcd.cliCtx, etcd.key("reports", kind), clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.New("error retrieving the " + kind + " reports from etcd: " + err.Error())
+	}
+
+	reports := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		reports[path.Base(string(kv.Key))] = kv.Value
+	}
+	return reports, nil
+}
+
+// ReleaseFloatingIP gives up the local node's claim on the floating ip, and refrains from claiming it again for long enough that another node can claim it.
+func (etcd *EtcdV3) ReleaseFloatingIP(ip net.IP) error {
+	return etcd.claims.release(etcd.key("nodes", ip.String()), releaseHoldTTLs*etcd.cfg.Current().DatastoreFloatingIPTTL)
+}
+
+// MoveFloatingIP hands the local node's claim on the floating ip to the target node. The move is recorded in etcd before the claim is released, and every other node refrains from claiming the floating ip until the target node claims it, or the move expires after a few floating ip ttls.
+func (etcd *EtcdV3) MoveFloatingIP(ip, target net.IP) error {
+	key := etcd.key("nodes", ip.String())
+	if !etcd.claims.claimed(key) {
+		return errors.New("the floating ip is not claimed by the local node")
+	}
+
+	hold := releaseHoldTTLs * etcd.cfg.Current().DatastoreFloatingIPTTL
+	lease, err := etcd.lease(hold / time.Second)
+	if err != nil {
+		return errors.New("error recording the move of the floating ip in etcd: " + err.Error())
+	}
+
+	if _, err := etcd.cli.Put(etcd.cliCtx, etcd.moveKey(key), target.String(), clientv3.WithLease(lease)); err != nil {
+		return errors.New("error recording the move of the floating ip in etcd: " + err.Error())
+	}
+	return etcd.claims.release(key, hold)
+}
+
+// Drain gives up every floating ip claimed by the local node, and refrains from claiming any floating ip from then on.
+func (etcd *EtcdV3) Drain() {
+	etcd.claims.drain()
+}
+
+// Reload picks up the live changes to the configuration, resynchronizing the mappings, republishing the local mapping, and claiming or releasing floating ips to match the configured floating ips.
+func (etcd *EtcdV3) Reload() error {
+	// The mappings are parsed again so that they use the encryption keys generated if encryption was just enabled.
+	if err := etcd.sync(); err != nil {
+		return err
+	}
+
+	if err := etcd.republishLocalMapping(); err != nil {
+		return err
+	}
+
+	select {
+	case etcd.reschedule <- struct{}{}:
+	default:
+	}
+
+	return etcd.handleFloatingMappings()
+}
+
 // Init the Etcd datastore which will open any necessary connections, preform an initial sync of the datastore, and define the local mapping in the datastore.
 func (etcd *EtcdV3) Init() error {
 	mutex, err := etcd.lock()
@@ -299,24 +600,56 @@ func (etcd *EtcdV3) Init() error {
 		return err
 	}
 
-	return etcd.unlock(mutex)
+	err = etcd.unlock(mutex)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&etcd.initialized, 1)
+	return nil
+}
+
+// Resume initializes the datastore from the mappings handed off by the previous process during a rolling restart. The local mapping is taken over without locking etcd, as the private ip already belongs to this node, and any changes since the mappings were last synchronized are picked up by the watch and the periodic sync.
+func (etcd *EtcdV3) Resume(mappings []*common.Mapping, synced time.Time) error {
+	etcd.mappingsMux.Lock()
+	etcd.mappings = indexMappings(mappings)
+	etcd.mappingsMux.Unlock()
+
+	if !synced.IsZero() {
+		atomic.StoreInt64(&etcd.lastSync, synced.UnixNano())
+	}
+
+	if err := etcd.handleLocalMapping(); err != nil {
+		return err
+	}
+
+	if err := etcd.handleFloatingMappings(); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&etcd.initialized, 1)
+	return nil
 }
 
 // Start periodic synchronization, and DHCP lease refresh with the datastore, as well as start watching for changes in network topology.
 func (etcd *EtcdV3) Start() {
 	go etcd.watch()
 
-	ticker := time.NewTicker(etcd.cfg.DatastoreSyncInterval)
+	ticker := time.NewTicker(etcd.cfg.Current().DatastoreSyncInterval)
 	go func() {
 	loop:
 		for {
 			select {
 			case <-etcd.stopSyncing:
 				break loop
+			case <-etcd.reschedule:
+				ticker.Stop()
+				ticker = time.NewTicker(etcd.cfg.Current().DatastoreSyncInterval)
 			case <-ticker.C:
 				err := etcd.sync()
 				if err != nil {
-					etcd.cfg.Log.Error.Println("[ETCD]", "Error synchronizing mappings with the backend: "+err.Error())
+					atomic.AddUint64(&etcd.syncErrors, 1)
+					etcd.cfg.Log.Error("etcd", "Error synchronizing mappings with the backend", "error", err)
 				}
 			}
 		}
@@ -325,15 +658,14 @@ func (etcd *EtcdV3) Start() {
 	}()
 }
 
-// Stop synchronizing with the backend and shutdown open connections.
+// Stop synchronizing with the backend and shutdown open connections. The stop channel is closed rather than sent on, so that a datastore which was initialized but never started can be stopped as well.
 func (etcd *EtcdV3) Stop() {
-	etcd.stopSyncing <- struct{}{}
+	close(etcd.stopSyncing)
+	etcd.revokeReports()
 
 	// Cancel all outstanding contexts and close the main client.
 	etcd.cliCancel()
 	etcd.cli.Close()
-
-	close(etcd.stopSyncing)
 }
 
 func generateV3Config(ctx context.Context, cfg *common.Config) (clientv3.Config, error) {
@@ -385,7 +717,7 @@ func generateV3Config(ctx context.Context, cfg *common.Config) (clientv3.Config,
 	return etcdCfg, nil
 }
 
-func newEtcdV3(cfg *common.Config) (Datastore, error) {
+func newEtcdV3(cfg *common.Config, bus *event.Bus) (Datastore, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	etcdCfg, err := generateV3Config(ctx, cfg)
@@ -402,6 +734,11 @@ func newEtcdV3(cfg *common.Config) (Datastore, error) {
 		cfg:         cfg,
 		etcdCfg:     etcdCfg,
 		mappings:    make(map[uint32]*common.Mapping),
+		reports:     make(map[string]clientv3.LeaseID),
+		events:      newPublisher(bus),
+		claims:      newClaims(),
+		floating:    newFloatingIPs(),
+		reschedule:  make(chan struct{}, 1),
 		stopSyncing: make(chan struct{}),
 		cli:         cli,
 		cliCtx:      ctx,
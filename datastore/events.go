@@ -0,0 +1,71 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package datastore
+
+import (
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
+)
+
+// publisher translates the changes seen by the datastore watch into events published on the bus.
+type publisher struct {
+	bus *event.Bus
+
+	// The last known owner of each floating ip, which is remembered after the floating mapping expires so that a move can be detected when it is claimed again.
+	owners map[uint32]string
+}
+
+// changed publishes the events describing the change from the previous mapping to the current mapping of the private ip, either of which may be nil.
+//
+// The publisher is not safe for concurrent use, so changed should be called while holding the mappings lock.
+func (p *publisher) changed(ip uint32, previous, current *common.Mapping, gateway bool) {
+	switch {
+	case previous == nil && current == nil:
+		return
+	case current == nil:
+		p.bus.Publish(event.New(event.MappingDeleted, previous.PrivateIP, previous))
+		if gateway {
+			// The gateway is gone, so the event only carries the previous gateway.
+			changed := event.New(event.GatewayChanged, previous.PrivateIP, nil)
+			changed.PreviousMachineID = previous.MachineID
+			p.bus.Publish(changed)
+		}
+		return
+	case previous == nil:
+		p.bus.Publish(event.New(event.MappingAdded, current.PrivateIP, current))
+	case previous.String() == current.String():
+		return
+	default:
+		p.bus.Publish(event.New(event.MappingUpdated, current.PrivateIP, current))
+	}
+
+	owner, known := p.owners[ip]
+	if previous != nil {
+		owner, known = previous.MachineID, true
+	}
+
+	if current.Floating {
+		p.owners[ip] = current.MachineID
+		if known && owner != current.MachineID {
+			moved := event.New(event.FloatingMoved, current.PrivateIP, current)
+			moved.PreviousMachineID = owner
+			p.bus.Publish(moved)
+		}
+	}
+
+	if gateway && (previous == nil || previous.MachineID != current.MachineID) {
+		changed := event.New(event.GatewayChanged, current.PrivateIP, current)
+		if previous != nil {
+			changed.PreviousMachineID = previous.MachineID
+		}
+		p.bus.Publish(changed)
+	}
+}
+
+func newPublisher(bus *event.Bus) *publisher {
+	return &publisher{
+		bus:    bus,
+		owners: make(map[uint32]string),
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package datastore
+
+import (
+	"net"
+	"testing"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
+)
+
+func testEvents(t *testing.T, sub *event.Subscription, kinds ...event.Kind) []*event.Event {
+	events := make([]*event.Event, 0, len(kinds))
+	for i := 0; i < len(kinds); i++ {
+		select {
+		case e := <-sub.Events():
+			if e.Kind != kinds[i] {
+				t.Fatal("changed published the wrong event, expected", kinds[i], "got:", e)
+			}
+			events = append(events, e)
+		default:
+			t.Fatal("changed did not publish the", kinds[i], "event.")
+		}
+	}
+
+	if len(sub.Events()) != 0 {
+		t.Fatal("changed published an unexpected event:", <-sub.Events())
+	}
+	return events
+}
+
+func TestPublisher(t *testing.T) {
+	bus := event.NewBus()
+	sub := bus.Subscribe()
+	defer sub.Close()
+
+	p := newPublisher(bus)
+	ip := net.ParseIP("10.99.0.2")
+	first := &common.Mapping{MachineID: "first", PrivateIP: ip, Port: 1099}
+	second := &common.Mapping{MachineID: "second", PrivateIP: ip, Port: 1099}
+
+	p.changed(1, nil, nil, false)
+	testEvents(t, sub)
+
+	p.changed(1, nil, first, false)
+	testEvents(t, sub, event.MappingAdded)
+
+	p.changed(1, first, first, false)
+	testEvents(t, sub)
+
+	p.changed(1, first, &common.Mapping{MachineID: "first", PrivateIP: ip, Port: 1100}, false)
+	testEvents(t, sub, event.MappingUpdated)
+
+	p.changed(1, first, nil, false)
+	testEvents(t, sub, event.MappingDeleted)
+
+	// A floating ip that expires and is claimed by another node has moved.
+	first.Floating, second.Floating = true, true
+	p.changed(2, nil, first, false)
+	testEvents(t, sub, event.MappingAdded)
+	p.changed(2, first, nil, false)
+	testEvents(t, sub, event.MappingDeleted)
+	p.changed(2, nil, second, false)
+	if moved := testEvents(t, sub, event.MappingAdded, event.FloatingMoved)[1]; moved.MachineID != "second" || moved.PreviousMachineID != "first" {
+		t.Fatal("changed published the wrong floating ip move:", moved)
+	}
+
+	// The gateway changes whenever its owner does.
+	p.changed(3, nil, first, true)
+	testEvents(t, sub, event.MappingAdded, event.GatewayChanged)
+	p.changed(3, first, second, true)
+	if changed := testEvents(t, sub, event.MappingUpdated, event.FloatingMoved, event.GatewayChanged)[2]; changed.MachineID != "second" || changed.PreviousMachineID != "first" {
+		t.Fatal("changed published the wrong gateway change:", changed)
+	}
+	p.changed(3, second, nil, true)
+	if changed := testEvents(t, sub, event.MappingDeleted, event.GatewayChanged)[1]; changed.MachineID != "" || changed.PreviousMachineID != "second" {
+		t.Fatal("changed published the wrong gateway removal:", changed)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// claimer is a routine attempting to claim a floating ip for the local node, which returns once quit is closed.
+type claimer struct {
+	value string
+	quit  chan struct{}
+}
+
+// floatingIPs tracks the routine claiming each floating ip configured on the local node, so that floating ips can be added or removed while quantum is running.
+type floatingIPs struct {
+	mux      sync.Mutex
+	claimers map[string]*claimer
+}
+
+/*
+update starts a claimer, using the supplied function, for every wanted floating mapping keyed by its datastore key, unless the same mapping is already being claimed. Every other claimer is told to quit, and their keys are returned so that any claim they hold can be released.
+
+A floating mapping which has changed, for instance because the plugins of the local node changed, is released and then claimed again with the new mapping.
+*/
+func (f *floatingIPs) update(wanted map[string]string, claim func(key, value string, quit <-chan struct{})) []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	var abandoned []string
+	for key, c := range f.claimers {
+		if value, ok := wanted[key]; !ok || value != c.value {
+			close(c.quit)
+			delete(f.claimers, key)
+			abandoned = append(abandoned, key)
+		}
+	}
+
+	for key, value := range wanted {
+		if _, ok := f.claimers[key]; ok {
+			continue
+		}
+
+		c := &claimer{value: value, quit: make(chan struct{})}
+		f.claimers[key] = c
+		go claim(key, value, c.quit)
+	}
+
+	return abandoned
+}
+
+// sleep for the duration, returning false straight away if quit is closed in the meantime.
+func sleep(d time.Duration, quit <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-quit:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func newFloatingIPs() *floatingIPs {
+	return &floatingIPs{
+		claimers: make(map[string]*claimer),
+	}
+}
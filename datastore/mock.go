@@ -4,6 +4,11 @@
 package datastore
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/supernomad/quantum/common"
 )
 
@@ -11,6 +16,11 @@ import (
 type Mock struct {
 	InternalMapping        *common.Mapping
 	InternalGatewayMapping *common.Mapping
+
+	reportsMux  sync.Mutex
+	reports     map[string]map[string][]byte
+	initialized int32
+	watching    int32
 }
 
 // Mapping always returns the internal mapping and true.
@@ -23,17 +33,97 @@ func (mock *Mock) GatewayMapping() (*common.Mapping, bool) {
 	return mock.InternalGatewayMapping, true
 }
 
-// Init which is a noop.
+// Mappings returns the internal mapping if it is defined.
+func (mock *Mock) Mappings() []*common.Mapping {
+	if mock.InternalMapping == nil {
+		return []*common.Mapping{}
+	}
+	return []*common.Mapping{mock.InternalMapping}
+}
+
+// Stats returns empty counters, the mock is always in sync once Init has been called and is watching once Start has been called.
+func (mock *Mock) Stats() Stats {
+	stats := Stats{
+		Initialized: atomic.LoadInt32(&mock.initialized) == 1,
+		Watching:    atomic.LoadInt32(&mock.watching) == 1,
+	}
+	if stats.Initialized {
+		stats.LastSync = time.Now()
+	}
+	return stats
+}
+
+// PublishReport stores the report in memory under the private ip of the internal mapping, the ttl is ignored.
+func (mock *Mock) PublishReport(kind string, report []byte, ttl time.Duration) error {
+	mock.reportsMux.Lock()
+	defer mock.reportsMux.Unlock()
+
+	if mock.reports == nil {
+		mock.reports = make(map[string]map[string][]byte)
+	}
+	if mock.reports[kind] == nil {
+		mock.reports[kind] = make(map[string][]byte)
+	}
+
+	var ip string
+	if mock.InternalMapping != nil {
+		ip = mock.InternalMapping.PrivateIP.String()
+	}
+	mock.reports[kind][ip] = report
+	return nil
+}
+
+// Reports returns a copy of the reports stored in memory.
+func (mock *Mock) Reports(kind string) (map[string][]byte, error) {
+	mock.reportsMux.Lock()
+	defer mock.reportsMux.Unlock()
+
+	reports := make(map[string][]byte, len(mock.reports[kind]))
+	for ip, report := range mock.reports[kind] {
+		reports[ip] = report
+	}
+	return reports, nil
+}
+
+// Init which only marks the mock as initialized.
 func (mock *Mock) Init() error {
+	atomic.StoreInt32(&mock.initialized, 1)
+	return nil
+}
+
+// Resume which only marks the mock as initialized, the handed off mappings are ignored.
+func (mock *Mock) Resume(mappings []*common.Mapping, synced time.Time) error {
+	atomic.StoreInt32(&mock.initialized, 1)
+	return nil
+}
+
+// ReleaseFloatingIP which is a noop.
+func (mock *Mock) ReleaseFloatingIP(ip net.IP) error {
+	return nil
+}
+
+// MoveFloatingIP which is a noop.
+func (mock *Mock) MoveFloatingIP(ip, target net.IP) error {
+	return nil
+}
+
+// Drain which is a noop.
+func (mock *Mock) Drain() {
+}
+
+// Reload which is a noop.
+func (mock *Mock) Reload() error {
 	return nil
 }
 
-// Start which is a noop.
+// Start which only marks the mock as watching.
 func (mock *Mock) Start() {
+	atomic.StoreInt32(&mock.watching, 1)
 }
 
-// Stop which is a noop.
+// Stop which only marks the mock as no longer watching.
 func (mock *Mock) Stop() {
+	atomic.StoreInt32(&mock.watching, 0)
 }
 
 func newMock(cfg *common.Config) (Datastore, error) {
@@ -5,6 +5,7 @@ package device
 
 import (
 	"errors"
+	"net"
 
 	"github.com/supernomad/quantum/common"
 )
@@ -13,6 +14,9 @@ const (
 	// TUNDevice creates and manages a TUN based network device.
 	TUNDevice = "tun"
 
+	// NetstackDevice creates and manages a userspace TCP/IP stack based network device.
+	NetstackDevice = "netstack"
+
 	// MOCKDevice creates and manages a mocked out network device for testing.
 	MOCKDevice = "mock"
 )
@@ -43,8 +47,52 @@ type Device interface {
 	// Close should gracefully destroy the virtual network device.
 	Close() error
 
+	// Release should close the process's handle on the virtual network device once the new process of a rolling restart has taken it over, leaving the device and its network configuration in place.
+	Release() error
+
 	// Queues should return all underlying queue file descriptors to pass along during a rolling restart.
 	Queues() []int
+
+	// Unblock should wake any worker blocked in Read, after which Read only returns packets already queued on the device and then returns false.
+	Unblock() error
+
+	// SetFloatingIPs should assign the supplied floating ip addresses to the virtual network device, removing any floating ip address that is no longer supplied. When an error is returned the addresses changed so far should stay tracked, so that calling it again with the previous addresses undoes them.
+	SetFloatingIPs(ips []net.IP) error
+}
+
+// diffIPs returns the addresses in wanted missing from current, and the addresses in current missing from wanted.
+func diffIPs(current, wanted []net.IP) (added, removed []net.IP) {
+	contains := func(ips []net.IP, ip net.IP) bool {
+		for i := 0; i < len(ips); i++ {
+			if ips[i].Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < len(wanted); i++ {
+		if !contains(current, wanted[i]) {
+			added = append(added, wanted[i])
+		}
+	}
+	for i := 0; i < len(current); i++ {
+		if !contains(wanted, current[i]) {
+			removed = append(removed, current[i])
+		}
+	}
+	return added, removed
+}
+
+// withoutIP returns a copy of the addresses without the supplied address.
+func withoutIP(ips []net.IP, ip net.IP) []net.IP {
+	remaining := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(ips); i++ {
+		if !ips[i].Equal(ip) {
+			remaining = append(remaining, ips[i])
+		}
+	}
+	return remaining
 }
 
 // New will generate a new Device struct based on the supplied device deviceType and user configuration
@@ -52,6 +100,8 @@ func New(deviceType string, cfg *common.Config) (Device, error) {
 	switch deviceType {
 	case TUNDevice:
 		return newTUN(cfg)
+	case NetstackDevice:
+		return newNetstack(cfg)
 	case MOCKDevice:
 		return newMock(cfg)
 	}
@@ -4,6 +4,8 @@
 package device
 
 import (
+	"context"
+	"io"
 	"net"
 	"syscall"
 	"testing"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/supernomad/quantum/common"
 	"golang.org/x/net/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 func TestMock(t *testing.T) {
@@ -59,6 +62,7 @@ func TestTUN(t *testing.T) {
 		NumWorkers:    1,
 		DeviceName:    "quantum%d",
 		PrivateIP:     net.ParseIP("10.99.0.1"),
+		MTU:           common.MTU,
 		NetworkConfig: DefaultNetworkConfig,
 		ReuseFDS:      false,
 	})
@@ -111,3 +115,116 @@ func TestTUN(t *testing.T) {
 		t.Fatalf("Failed to close the TUN device: %s", err.Error())
 	}
 }
+
+func testNetstackConfig(privateIP string) *common.Config {
+	base, ipnet, _ := net.ParseCIDR("10.99.0.0/16")
+
+	return &common.Config{
+		NumWorkers:    1,
+		PrivateIP:     net.ParseIP(privateIP),
+		MTU:           common.MTU,
+		NetworkConfig: &common.NetworkConfig{BaseIP: base, IPNet: ipnet},
+	}
+}
+
+func pumpNetstack(from, to Device) {
+	buf := make([]byte, common.MaxPacketLength)
+	for {
+		payload, ok := from.Read(0, buf)
+		if !ok {
+			return
+		}
+		to.Write(0, payload)
+	}
+}
+
+func TestNetstack(t *testing.T) {
+	server, err := New(NetstackDevice, testNetstackConfig("10.99.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to create the server netstack device: %s", err.Error())
+	}
+
+	client, err := New(NetstackDevice, testNetstackConfig("10.99.0.2"))
+	if err != nil {
+		t.Fatalf("Failed to create the client netstack device: %s", err.Error())
+	}
+
+	if server.Name() != NetstackDevice {
+		t.Fatal("Failed to properly set the netstack device name.")
+	}
+
+	if server.Queues() != nil {
+		t.Fatal("Netstack Queues should always return nil.")
+	}
+
+	go pumpNetstack(server, client)
+	go pumpNetstack(client, server)
+
+	listener, err := server.(*Netstack).Listen("tcp", "10.99.0.1:8080")
+	if err != nil {
+		t.Fatalf("Failed to listen on the server netstack device: %s", err.Error())
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.(*Netstack).DialContext(ctx, "tcp", "10.99.0.1:8080")
+	if err != nil {
+		t.Fatalf("Failed to dial the server through the client netstack device: %s", err.Error())
+	}
+
+	expected := []byte("quantum")
+	if _, err := conn.Write(expected); err != nil {
+		t.Fatalf("Failed to write to the netstack connection: %s", err.Error())
+	}
+
+	actual := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, actual); err != nil {
+		t.Fatalf("Failed to read from the netstack connection: %s", err.Error())
+	}
+
+	if !common.ArrayEquals(expected, actual) {
+		t.Fatalf("Netstack connection returned the wrong data, got: %s, expected: %s", actual, expected)
+	}
+
+	if _, err := client.(*Netstack).DialContext(ctx, "unix", "10.99.0.1:8080"); err == nil {
+		t.Fatal("Netstack DialContext should have returned an error for an unsupported network.")
+	}
+
+	conn.Close()
+	listener.Close()
+
+	// Floating ip addresses can be assigned and removed while the device is running.
+	floating := tcpip.AddrFrom4Slice(net.ParseIP("10.99.2.1").To4())
+	assigned := func() bool {
+		for _, addr := range server.(*Netstack).stack.AllAddresses()[netstackNIC] {
+			if addr.AddressWithPrefix.Address == floating {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := server.SetFloatingIPs([]net.IP{net.ParseIP("10.99.2.1")}); err != nil || !assigned() {
+		t.Fatal("Failed to assign a floating ip to the server netstack device:", err)
+	}
+	if err := server.SetFloatingIPs(nil); err != nil || assigned() {
+		t.Fatal("Failed to remove the floating ip from the server netstack device:", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("Failed to close the client netstack device: %s", err.Error())
+	}
+	if err := server.Close(); err != nil {
+		t.Fatalf("Failed to close the server netstack device: %s", err.Error())
+	}
+}
@@ -6,5 +6,6 @@ Package device contains the structs and logic to create, configure, and maintain
 
 Currently supported devices:
 	- TUN device
+	- Netstack device, a userspace TCP/IP stack which needs no special privileges and is reachable through the Go net.Conn/net.Listener API
 */
 package device
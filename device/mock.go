@@ -4,11 +4,14 @@
 package device
 
 import (
+	"net"
+
 	"github.com/supernomad/quantum/common"
 )
 
 // Mock device struct to use for testing.
 type Mock struct {
+	mtu int
 }
 
 // Name of the mock device.
@@ -16,9 +19,9 @@ func (mock *Mock) Name() string {
 	return "Mocked Device"
 }
 
-// Read which just returns the supplied buffer in the form of a *common.Payload.
+// Read which just returns the supplied buffer in the form of a *common.Payload, sized to the MTU of the device.
 func (mock *Mock) Read(queue int, buf []byte) (*common.Payload, bool) {
-	return common.NewTunPayload(buf, common.MTU), true
+	return common.NewTunPayload(buf, mock.mtu), true
 }
 
 // Write which is a noop.
@@ -31,11 +34,30 @@ func (mock *Mock) Close() error {
 	return nil
 }
 
+// Release which is a noop.
+func (mock *Mock) Release() error {
+	return nil
+}
+
+// Unblock which is a noop.
+func (mock *Mock) Unblock() error {
+	return nil
+}
+
 // Queues which is a noop.
 func (mock *Mock) Queues() []int {
 	return nil
 }
 
+// SetFloatingIPs which is a noop.
+func (mock *Mock) SetFloatingIPs(ips []net.IP) error {
+	return nil
+}
+
 func newMock(cfg *common.Config) (Device, error) {
-	return &Mock{}, nil
+	mtu := common.MTU
+	if cfg != nil && cfg.MTU > 0 {
+		mtu = cfg.MTU
+	}
+	return &Mock{mtu: mtu}, nil
 }
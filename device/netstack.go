@@ -0,0 +1,289 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/supernomad/quantum/common"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	netstackNIC       tcpip.NICID = 1
+	netstackQueueSize             = 1024
+)
+
+// Netstack device struct for managing a userspace TCP/IP stack, which requires neither '/dev/net/tun' nor CAP_NET_ADMIN.
+//
+// Unlike the Tun device the local network traffic does not flow through the kernel, instead it is only reachable through the DialContext, Listen, and ListenPacket methods.
+type Netstack struct {
+	name     string
+	cfg      *common.Config
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	floating []net.IP
+	cancel   context.CancelFunc
+	wake     context.Context
+	unblock  context.CancelFunc
+}
+
+// Name of the Netstack device.
+func (ns *Netstack) Name() string {
+	return ns.name
+}
+
+// Close the Netstack device and tear down the userspace stack.
+func (ns *Netstack) Close() error {
+	ns.cancel()
+	ns.endpoint.Close()
+	ns.stack.Close()
+	ns.stack.Wait()
+	return nil
+}
+
+// Release tears down the userspace stack the same as Close, as the Netstack device has no state shared with the new process of a rolling restart.
+func (ns *Netstack) Release() error {
+	return ns.Close()
+}
+
+// Queues returns nil as the Netstack device has no underlying file descriptors to hand off during a rolling restart.
+func (ns *Netstack) Queues() []int {
+	return nil
+}
+
+// SetFloatingIPs assigns the supplied floating ip addresses to the userspace stack, removing any floating ip address that is no longer supplied.
+func (ns *Netstack) SetFloatingIPs(ips []net.IP) error {
+	added, removed := diffIPs(ns.floating, ips)
+	for i := 0; i < len(added); i++ {
+		if err := ns.addAddress(added[i]); err != nil {
+			return err
+		}
+		ns.floating = append(ns.floating, added[i])
+	}
+	for i := 0; i < len(removed); i++ {
+		if tcpErr := ns.stack.RemoveAddress(netstackNIC, tcpip.AddrFrom4Slice(removed[i].To4())); tcpErr != nil {
+			return errors.New("error removing the netstack virtual network device address: " + tcpErr.String())
+		}
+		ns.floating = withoutIP(ns.floating, removed[i])
+	}
+
+	ns.floating = append([]net.IP{}, ips...)
+	return nil
+}
+
+// Read a packet emitted by the userspace stack and return a *common.Payload representation of the packet.
+//
+// All queues share the same underlying packet channel, so the queue argument is ignored.
+func (ns *Netstack) Read(queue int, buf []byte) (*common.Payload, bool) {
+	pkt := ns.endpoint.ReadContext(ns.wake)
+	if pkt.IsNil() {
+		// Once unblocked the packets already emitted by the stack are still drained.
+		if pkt = ns.endpoint.Read(); pkt.IsNil() {
+			return nil, false
+		}
+	}
+	defer pkt.DecRef()
+
+	view := pkt.ToView()
+	defer view.Release()
+
+	if view.Size() > len(buf)-common.PacketStart {
+		return nil, false
+	}
+
+	n := copy(buf[common.PacketStart:], view.AsSlice())
+	return common.NewTunPayload(buf, n), true
+}
+
+// Unblock any worker waiting for the userspace stack to emit a packet.
+func (ns *Netstack) Unblock() error {
+	ns.unblock()
+	return nil
+}
+
+// Write a *common.Payload into the userspace stack.
+func (ns *Netstack) Write(queue int, payload *common.Payload) bool {
+	if len(payload.Packet) == 0 || payload.Packet[0]>>4 != 4 {
+		return false
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(payload.Packet),
+	})
+	defer pkt.DecRef()
+
+	ns.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkt)
+	return true
+}
+
+// DialContext connects to the address on the named network through the userspace stack, the supported networks are 'tcp', 'tcp4', 'udp', and 'udp4'.
+//
+// The signature matches net.Dialer.DialContext so that the Netstack device can be dropped into an http.Transport or similar.
+func (ns *Netstack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, err := parseNetstackAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch network {
+	case "tcp", "tcp4":
+		conn, err := gonet.DialContextTCP(ctx, ns.stack, addr, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case "udp", "udp4":
+		conn, err := gonet.DialUDP(ns.stack, nil, &addr, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, errors.New("netstack device does not support the network: " + network)
+}
+
+// Listen announces on the local address through the userspace stack, the supported networks are 'tcp' and 'tcp4'.
+func (ns *Netstack) Listen(network, address string) (net.Listener, error) {
+	addr, err := parseNetstackAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch network {
+	case "tcp", "tcp4":
+		listener, err := gonet.ListenTCP(ns.stack, addr, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+	return nil, errors.New("netstack device does not support listening on the network: " + network)
+}
+
+// ListenPacket announces on the local address through the userspace stack, the supported networks are 'udp' and 'udp4'.
+func (ns *Netstack) ListenPacket(network, address string) (net.PacketConn, error) {
+	addr, err := parseNetstackAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch network {
+	case "udp", "udp4":
+		conn, err := gonet.DialUDP(ns.stack, &addr, nil, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, errors.New("netstack device does not support listening on the network: " + network)
+}
+
+func parseNetstackAddress(address string) (tcpip.FullAddress, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, errors.New("error parsing the netstack address: " + err.Error())
+	}
+
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, errors.New("error parsing the netstack address port: " + err.Error())
+	}
+
+	addr := tcpip.FullAddress{NIC: netstackNIC, Port: uint16(port)}
+	if host == "" {
+		return addr, nil
+	}
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return tcpip.FullAddress{}, errors.New("error parsing the netstack address, only ipv4 addresses are supported: " + host)
+	}
+
+	addr.Addr = tcpip.AddrFrom4Slice(ip)
+	return addr, nil
+}
+
+func (ns *Netstack) addAddress(addr net.IP) error {
+	ip := addr.To4()
+	if ip == nil {
+		return errors.New("error setting the netstack virtual network device address, only ipv4 addresses are supported")
+	}
+
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4Slice(ip).WithPrefix(),
+	}
+	if tcpErr := ns.stack.AddProtocolAddress(netstackNIC, protocolAddr, stack.AddressProperties{}); tcpErr != nil {
+		return errors.New("error setting the netstack virtual network device address: " + tcpErr.String())
+	}
+	return nil
+}
+
+func netstackSubnet(ipnet *net.IPNet) (tcpip.Subnet, error) {
+	return tcpip.NewSubnet(tcpip.AddrFrom4Slice(ipnet.IP.To4()), tcpip.MaskFromBytes(ipnet.Mask))
+}
+
+func newNetstack(cfg *common.Config) (Device, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wake, unblock := context.WithCancel(ctx)
+
+	ns := &Netstack{
+		name: NetstackDevice,
+		cfg:  cfg,
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+			HandleLocal:        true,
+		}),
+		endpoint: channel.New(netstackQueueSize, uint32(cfg.MTU), ""),
+		cancel:   cancel,
+		wake:     wake,
+		unblock:  unblock,
+	}
+
+	if err := ns.initNetstack(); err != nil {
+		ns.Close()
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+func (ns *Netstack) initNetstack() error {
+	if tcpErr := ns.stack.CreateNIC(netstackNIC, ns.endpoint); tcpErr != nil {
+		return errors.New("error creating the netstack virtual network device: " + tcpErr.String())
+	}
+
+	if err := ns.addAddress(ns.cfg.PrivateIP); err != nil {
+		return err
+	}
+	if err := ns.SetFloatingIPs(ns.cfg.Current().FloatingIPs); err != nil {
+		return err
+	}
+
+	subnet, err := netstackSubnet(ns.cfg.NetworkConfig.IPNet)
+	if err != nil {
+		return errors.New("error setting the netstack virtual network device network routes: " + err.Error())
+	}
+	ns.stack.AddRoute(tcpip.Route{Destination: subnet, NIC: netstackNIC})
+
+	if ns.cfg.Forward {
+		ns.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: netstackNIC})
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ package device
 
 import (
 	"errors"
+	"net"
 	"strings"
 	"syscall"
 	"unsafe"
@@ -18,6 +19,8 @@ type Tun struct {
 	name            string
 	queues          []int
 	oldDefaultRoute *netlink.Route
+	floating        []net.IP
+	poller          *common.Poller
 	cfg             *common.Config
 }
 
@@ -28,10 +31,8 @@ func (tun *Tun) Name() string {
 
 // Close the Tun device and remove associated network configuration.
 func (tun *Tun) Close() error {
-	for i := 0; i < len(tun.queues); i++ {
-		if err := syscall.Close(tun.queues[i]); err != nil {
-			return errors.New("error closing the device queues: " + err.Error())
-		}
+	if err := tun.Release(); err != nil {
+		return err
 	}
 
 	if tun.cfg.Forward {
@@ -42,18 +43,81 @@ func (tun *Tun) Close() error {
 	return nil
 }
 
+// Release closes the Tun device queues, leaving the device and the default route to the new process of a rolling restart.
+func (tun *Tun) Release() error {
+	if tun.poller != nil {
+		if err := tun.poller.Close(); err != nil {
+			return err
+		}
+		tun.poller = nil
+	}
+
+	for i := 0; i < len(tun.queues); i++ {
+		if err := syscall.Close(tun.queues[i]); err != nil {
+			return errors.New("error closing the device queues: " + err.Error())
+		}
+	}
+	tun.queues = nil
+	return nil
+}
+
 // Queues returns the underlying device queue file descriptors.
 func (tun *Tun) Queues() []int {
 	return tun.queues
 }
 
-// Read a packet off the specified device queue and return a *common.Payload representation of the packet.
-func (tun *Tun) Read(queue int, buf []byte) (*common.Payload, bool) {
-	n, err := syscall.Read(tun.queues[queue], buf[common.PacketStart:])
+// SetFloatingIPs assigns the supplied floating ip addresses to the Tun device, removing any floating ip address that is no longer supplied.
+func (tun *Tun) SetFloatingIPs(ips []net.IP) error {
+	link, err := netlink.LinkByName(tun.name)
 	if err != nil {
-		return nil, false
+		return errors.New("error getting the virtual network device from the kernel: " + err.Error())
+	}
+
+	added, removed := diffIPs(tun.floating, ips)
+	for i := 0; i < len(added); i++ {
+		addr, err := netlink.ParseAddr(added[i].String() + "/32")
+		if err != nil {
+			return errors.New("error parsing the virtual network device address: " + err.Error())
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return errors.New("error setting the virtual network device address: " + err.Error())
+		}
+		tun.floating = append(tun.floating, added[i])
+	}
+	for i := 0; i < len(removed); i++ {
+		addr, err := netlink.ParseAddr(removed[i].String() + "/32")
+		if err != nil {
+			return errors.New("error parsing the virtual network device address: " + err.Error())
+		}
+		if err := netlink.AddrDel(link, addr); err != nil {
+			return errors.New("error removing the virtual network device address: " + err.Error())
+		}
+		tun.floating = withoutIP(tun.floating, removed[i])
+	}
+
+	tun.floating = append([]net.IP{}, ips...)
+	return nil
+}
+
+// Read a packet off the specified device queue and return a *common.Payload representation of the packet. The queue is only waited on once it has nothing left to read.
+func (tun *Tun) Read(queue int, buf []byte) (*common.Payload, bool) {
+	for {
+		n, err := syscall.Read(tun.queues[queue], buf[common.PacketStart:])
+		if err == nil {
+			return common.NewTunPayload(buf, n), true
+		} else if err != syscall.EAGAIN {
+			return nil, false
+		}
+
+		if !tun.poller.Wait(queue) {
+			return nil, false
+		}
 	}
-	return common.NewTunPayload(buf, n), true
+}
+
+// Unblock any worker waiting on a device queue.
+func (tun *Tun) Unblock() error {
+	return tun.poller.Wake()
 }
 
 // Write a *common.Payload to the specified device queue.
@@ -65,7 +129,8 @@ func (tun *Tun) Write(queue int, payload *common.Payload) bool {
 func newTUN(cfg *common.Config) (Device, error) {
 	queues := make([]int, cfg.NumWorkers)
 	name := cfg.DeviceName
-	tun := &Tun{name: name, cfg: cfg, queues: queues}
+	// During a rolling restart the floating ip addresses are already assigned to the reused device.
+	tun := &Tun{name: name, cfg: cfg, queues: queues, floating: append([]net.IP{}, cfg.Current().FloatingIPs...)}
 
 	for i := 0; i < tun.cfg.NumWorkers; i++ {
 		if !tun.cfg.ReuseFDS {
@@ -81,6 +146,19 @@ func newTUN(cfg *common.Config) (Device, error) {
 		}
 	}
 
+	// The queues are read without blocking, so that a worker waiting on a queue can be woken when it is stopped.
+	for i := 0; i < len(tun.queues); i++ {
+		if err := syscall.SetNonblock(tun.queues[i], true); err != nil {
+			return nil, errors.New("error setting the device queues to non-blocking: " + err.Error())
+		}
+	}
+
+	poller, err := common.NewPoller(tun.queues)
+	if err != nil {
+		return nil, err
+	}
+	tun.poller = poller
+
 	if !tun.cfg.ReuseFDS {
 		err := tun.initTun()
 		if err != nil {
@@ -121,7 +199,7 @@ func (tun *Tun) initTun() error {
 	if err != nil {
 		return errors.New("error upping the virtual network device: " + err.Error())
 	}
-	err = netlink.LinkSetMTU(link, common.MTU)
+	err = netlink.LinkSetMTU(link, tun.cfg.MTU)
 	if err != nil {
 		return errors.New("error setting the virtual network device MTU: " + err.Error())
 	}
@@ -171,8 +249,8 @@ func (tun *Tun) initTun() error {
 		}
 	}
 
-	for i := 0; i < len(tun.cfg.FloatingIPs); i++ {
-		additional, err := netlink.ParseAddr(tun.cfg.FloatingIPs[i].String() + "/32")
+	for i := 0; i < len(tun.floating); i++ {
+		additional, err := netlink.ParseAddr(tun.floating[i].String() + "/32")
 		if err != nil {
 			return errors.New("error parsing the virtual network device address: " + err.Error())
 		}
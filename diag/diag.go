@@ -0,0 +1,528 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package diag
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/pmtu"
+	"github.com/supernomad/quantum/router"
+	"github.com/supernomad/quantum/socket"
+)
+
+const (
+	// DefaultCount is the number of probes sent to each hop when no count is requested.
+	DefaultCount = 4
+
+	// MaxCount is the largest number of probes that can be sent to each hop in a single diagnosis.
+	MaxCount = 20
+
+	challengeSize = 16
+
+	// The sealed challenge includes the gcm tag and nonce.
+	proofSize = challengeSize + 16 + 12
+
+	probeDataSize = 4 + challengeSize
+	replyDataSize = 4 + 1 + proofSize + 2
+)
+
+const (
+	// RoleLocal is the role of the local node, which is always the first hop.
+	RoleLocal = "local"
+
+	// RolePeer is the role of the node that owns the destination private ip.
+	RolePeer = "peer"
+
+	// RoleGateway is the role of the node that traffic destined outside of the quantum network is routed through.
+	RoleGateway = "gateway"
+)
+
+const (
+	// CryptoOK means both nodes derived the same encryption key for each other.
+	CryptoOK = "ok"
+
+	// CryptoMismatch means the nodes derived different encryption keys for each other, so every encrypted packet between them is dropped.
+	CryptoMismatch = "mismatch"
+
+	// CryptoDisabled means the encryption plugin is not negotiated between the nodes.
+	CryptoDisabled = "disabled"
+
+	// CryptoUnverified means the encryption keys could not be compared, because the remote node never replied.
+	CryptoUnverified = "unverified"
+)
+
+const (
+	// ProblemRouting means the local node does not know where to send traffic for the destination.
+	ProblemRouting = "routing"
+
+	// ProblemFirewall means the remote node never replied to the probes sent to its public endpoint.
+	ProblemFirewall = "firewall"
+
+	// ProblemPlugins means the nodes disagree about which plugins are negotiated between them.
+	ProblemPlugins = "plugins"
+
+	// ProblemCrypto means the nodes derived different encryption keys for each other.
+	ProblemCrypto = "crypto"
+)
+
+var (
+	probeInterval = 200 * time.Millisecond
+	replyTimeout  = 2 * time.Second
+)
+
+// Hop is a single quantum node that traffic to the destination traverses, along with the result of probing it.
+type Hop struct {
+	// The role the node plays in reaching the destination.
+	Role string `json:"role"`
+
+	// The unique machine id of the node.
+	MachineID string `json:"machineID"`
+
+	// The private ip address of the node.
+	PrivateIP net.IP `json:"privateIP"`
+
+	// The public endpoint the probes were sent to.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// The plugins the local node applies to traffic sent to the node.
+	Plugins []string `json:"plugins"`
+
+	// The plugins the node applies to traffic sent to the local node, as reported by the node itself.
+	RemotePlugins []string `json:"remotePlugins"`
+
+	// The MTU the local node uses for traffic sent to the node.
+	MTU int `json:"mtu"`
+
+	// The MTU the node uses for traffic sent to the local node, as reported by the node itself.
+	RemoteMTU int `json:"remoteMTU"`
+
+	// Whether or not the nodes derived the same encryption key for each other, which is empty for the local node.
+	Crypto string `json:"crypto,omitempty"`
+
+	// The number of probes sent to, and replies received from, the node.
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+
+	// The round trip time of each reply in milliseconds, in the order the probes were sent.
+	RTTs []float64 `json:"rtts"`
+
+	// The minimum, mean, and maximum round trip times in milliseconds.
+	MinRTT  float64 `json:"minRTT"`
+	MeanRTT float64 `json:"meanRTT"`
+	MaxRTT  float64 `json:"maxRTT"`
+}
+
+// Result of diagnosing the overlay path from the local node to a destination.
+type Result struct {
+	// The target as requested, either an ip address, machine id, or hostname.
+	Target string `json:"target"`
+
+	// The ip address the target resolved to.
+	Destination net.IP `json:"destination"`
+
+	// Whether or not the destination is outside of the quantum network, in which case the last hop is the gateway rather than the destination itself.
+	Outside bool `json:"outside"`
+
+	// The quantum nodes that traffic to the destination traverses, starting with the local node.
+	Hops []*Hop `json:"hops"`
+
+	// The kind of problem found along the path, or an empty string if there is none.
+	Problem string `json:"problem"`
+
+	// A human readable description of the problem, or of the healthy path.
+	Diagnosis string `json:"diagnosis"`
+}
+
+// reply holds the contents of a DiagReply control packet, and when it was received.
+type reply struct {
+	received time.Time
+	sealed   bool
+	proof    []byte
+	mtu      int
+	plugins  []string
+}
+
+// Prober struct for diagnosing the overlay path to remote nodes on demand, by sending them DiagProbe control packets.
+type Prober struct {
+	cfg       *common.Config
+	store     datastore.Datastore
+	router    *router.Router
+	discovery *pmtu.Discovery
+
+	mux     sync.Mutex
+	sock    socket.Socket
+	pending map[uint32]chan *reply
+	stop    chan struct{}
+}
+
+// Handle a control payload received from a remote node, returning the reply to send back to that node and true if a reply is required.
+//
+// The reply is written in place over the received payload.
+func (p *Prober) Handle(payload *common.Payload) (*common.Payload, *common.Mapping, bool) {
+	if payload.Length < common.ControlHeaderSize+probeDataSize {
+		return nil, nil, false
+	}
+
+	data := payload.Raw[common.ControlDataStart:payload.Length]
+
+	switch common.ControlType(payload.Raw[common.ControlTypeStart]) {
+	case common.DiagProbe:
+		mapping, ok := p.store.Mapping(common.IPtoInt(payload.Raw[common.ControlIPStart:common.ControlIPEnd]))
+		if !ok || mapping == nil {
+			return nil, nil, false
+		}
+
+		plugins := strings.Join(negotiated(p.cfg.Current().Plugins, mapping.SupportedPlugins), ",")
+		if len(payload.Raw) < common.ControlHeaderSize+replyDataSize+len(plugins) {
+			return nil, nil, false
+		}
+
+		// Seal the challenge with the key derived for the sender, which proves to the sender that both nodes derived the same key.
+		proof := make([]byte, proofSize)
+		copy(proof, data[4:4+challengeSize])
+		sealed := mapping.AES != nil
+		if sealed {
+			if _, err := mapping.AES.Encrypt(proof, challengeSize, nil); err != nil {
+				sealed = false
+			}
+		}
+
+		data = payload.Raw[common.ControlDataStart:]
+		data[4] = 0
+		if sealed {
+			data[4] = 1
+			copy(data[5:5+proofSize], proof)
+		}
+		binary.BigEndian.PutUint16(data[5+proofSize:], uint16(p.discovery.MTU(mapping)))
+		copy(data[replyDataSize:], plugins)
+
+		return common.NewControlPayload(payload.Raw, common.DiagReply, p.cfg.PrivateIP, replyDataSize+len(plugins)), mapping, true
+	case common.DiagReply:
+		if len(data) < replyDataSize {
+			return nil, nil, false
+		}
+
+		r := &reply{
+			received: time.Now(),
+			sealed:   data[4] == 1,
+			proof:    append([]byte(nil), data[5:5+proofSize]...),
+			mtu:      int(binary.BigEndian.Uint16(data[5+proofSize:])),
+			plugins:  []string{},
+		}
+		if plugins := string(data[replyDataSize:]); plugins != "" {
+			r.plugins = strings.Split(plugins, ",")
+		}
+
+		p.mux.Lock()
+		if replies, ok := p.pending[binary.BigEndian.Uint32(data[0:4])]; ok {
+			select {
+			case replies <- r:
+			default:
+			}
+		}
+		p.mux.Unlock()
+	}
+
+	return nil, nil, false
+}
+
+// Start allowing diagnoses to be run over the supplied socket.
+func (p *Prober) Start(sock socket.Socket) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.sock = sock
+}
+
+// Stop any running diagnoses, and refuse any new ones.
+func (p *Prober) Stop() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.sock == nil {
+		return
+	}
+	p.sock = nil
+	close(p.stop)
+}
+
+// Diagnose the overlay path to the target, which is either an ip address, the machine id of a node, or a hostname, sending count probes to each quantum node along the path.
+func (p *Prober) Diagnose(target string, count int) (*Result, error) {
+	p.mux.Lock()
+	sock := p.sock
+	p.mux.Unlock()
+
+	if sock == nil {
+		return nil, errors.New("the quantum node has not been started")
+	}
+
+	if count <= 0 {
+		count = DefaultCount
+	}
+	if count > MaxCount {
+		return nil, errors.New("at most " + strconv.Itoa(MaxCount) + " probes can be sent to each hop")
+	}
+
+	destination, err := p.resolve(target)
+	if err != nil {
+		return nil, errors.New("error resolving the target '" + target + "': " + err.Error())
+	}
+	if destination.Equal(p.cfg.PrivateIP) {
+		return nil, errors.New("the target '" + target + "' is the local node")
+	}
+
+	result := &Result{
+		Target:      target,
+		Destination: destination,
+		Outside:     !p.cfg.NetworkConfig.IPNet.Contains(destination),
+		Hops: []*Hop{{
+			Role:      RoleLocal,
+			MachineID: p.cfg.MachineID,
+			PrivateIP: p.cfg.PrivateIP,
+			Plugins:   orEmpty(p.cfg.Current().Plugins),
+			MTU:       p.cfg.MTU,
+			RTTs:      []float64{},
+		}},
+	}
+
+	// The quantum network is a full mesh, so traffic is sent straight to the node owning the destination, or to the gateway if the destination is outside of the quantum network.
+	mapping, ok := p.router.Resolve(destination.To4())
+	if !ok || mapping == nil {
+		result.Problem = ProblemRouting
+		result.Diagnosis = "no quantum node owns the private ip " + destination.String() + ", check that the node is running and registered in the datastore"
+		if result.Outside {
+			result.Diagnosis = destination.String() + " is outside of the quantum network " + p.cfg.NetworkConfig.Network + " and no gateway is configured"
+		}
+		return result, nil
+	}
+	if mapping.MachineID == p.cfg.MachineID {
+		return nil, errors.New("the target '" + target + "' is owned by the local node")
+	}
+
+	role := RolePeer
+	if result.Outside {
+		role = RoleGateway
+	}
+
+	hop := p.probe(sock, mapping, role, count)
+	result.Hops = append(result.Hops, hop)
+	result.Problem, result.Diagnosis = diagnose(hop)
+	return result, nil
+}
+
+// resolve the target to an ip address, trying an ip address, then the machine id of a node, and finally a hostname.
+func (p *Prober) resolve(target string) (net.IP, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		if ip.To4() == nil {
+			return nil, errors.New("only ipv4 addresses are supported within the quantum network")
+		}
+		return ip.To4(), nil
+	}
+
+	mappings := p.store.Mappings()
+	for i := 0; i < len(mappings); i++ {
+		if !mappings[i].Floating && mappings[i].MachineID == target {
+			return mappings[i].PrivateIP.To4(), nil
+		}
+	}
+
+	ips, err := net.LookupIP(target)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(ips); i++ {
+		if ip := ips[i].To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("the hostname has no ipv4 address")
+}
+
+// probe the node represented by the mapping count times, waiting for the replies until the reply timeout passes after the last probe is sent.
+func (p *Prober) probe(sock socket.Socket, mapping *common.Mapping, role string, count int) *Hop {
+	hop := &Hop{
+		Role:      role,
+		MachineID: mapping.MachineID,
+		PrivateIP: mapping.PrivateIP,
+		Plugins:   negotiated(p.cfg.Current().Plugins, mapping.SupportedPlugins),
+		MTU:       p.discovery.MTU(mapping),
+		Crypto:    CryptoUnverified,
+		RTTs:      []float64{},
+	}
+	if mapping.Address != "" {
+		hop.Endpoint = net.JoinHostPort(mapping.Address, strconv.Itoa(mapping.Port))
+	}
+
+	nonces := make([]uint32, count)
+	challenges := make([][]byte, count)
+	sent := make([]time.Time, count)
+	replies := make([]chan *reply, count)
+
+	defer func() {
+		p.mux.Lock()
+		for i := 0; i < count; i++ {
+			delete(p.pending, nonces[i])
+		}
+		p.mux.Unlock()
+	}()
+
+	for i := 0; i < count; i++ {
+		if i > 0 && !p.wait(time.After(probeInterval)) {
+			break
+		}
+
+		buf := make([]byte, common.ControlHeaderSize+probeDataSize)
+		payload := common.NewControlPayload(buf, common.DiagProbe, p.cfg.PrivateIP, probeDataSize)
+		rand.Read(buf[common.ControlDataStart:])
+		common.SignControlPayload(payload, p.cfg.Current().PSK)
+
+		nonces[i] = binary.BigEndian.Uint32(buf[common.ControlDataStart:])
+		challenges[i] = buf[common.ControlDataStart+4:]
+		replies[i] = make(chan *reply, 1)
+
+		p.mux.Lock()
+		p.pending[nonces[i]] = replies[i]
+		p.mux.Unlock()
+
+		sent[i] = time.Now()
+		if !sock.Write(0, payload, mapping) {
+			sent[i] = time.Time{}
+			continue
+		}
+		hop.Sent++
+	}
+
+	deadline := time.Now().Add(replyTimeout)
+	var sum float64
+	for i := 0; i < count; i++ {
+		if sent[i].IsZero() {
+			continue
+		}
+
+		r := p.await(replies[i], deadline)
+		if r == nil {
+			continue
+		}
+
+		rtt := float64(r.received.Sub(sent[i])) / float64(time.Millisecond)
+		if hop.Received == 0 || rtt < hop.MinRTT {
+			hop.MinRTT = rtt
+		}
+		if rtt > hop.MaxRTT {
+			hop.MaxRTT = rtt
+		}
+		sum += rtt
+		hop.Received++
+		hop.RTTs = append(hop.RTTs, rtt)
+
+		hop.RemotePlugins, hop.RemoteMTU = r.plugins, r.mtu
+		hop.Crypto = verify(mapping, hop, r, challenges[i])
+	}
+	if hop.Received > 0 {
+		hop.MeanRTT = sum / float64(hop.Received)
+	}
+	return hop
+}
+
+// await the reply to a single probe until the deadline passes, returning nil if it never arrives.
+func (p *Prober) await(replies <-chan *reply, deadline time.Time) *reply {
+	select {
+	case r := <-replies:
+		return r
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case r := <-replies:
+		return r
+	case <-timer.C:
+	case <-p.stop:
+	}
+	return nil
+}
+
+func (p *Prober) wait(after <-chan time.Time) bool {
+	select {
+	case <-after:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+// verify whether or not both nodes derived the same encryption key for each other, by opening the challenge sealed by the remote node.
+func verify(mapping *common.Mapping, hop *Hop, r *reply, challenge []byte) string {
+	if !common.StringInSlice(plugin.EncryptionPlugin, hop.Plugins) && !common.StringInSlice(plugin.EncryptionPlugin, hop.RemotePlugins) {
+		return CryptoDisabled
+	}
+	if !r.sealed || mapping.AES == nil {
+		return CryptoMismatch
+	}
+
+	if _, err := mapping.AES.Decrypt(r.proof, nil); err != nil || !bytes.Equal(r.proof[:challengeSize], challenge) {
+		return CryptoMismatch
+	}
+	return CryptoOK
+}
+
+// diagnose the problem with the probed hop, if there is one.
+func diagnose(hop *Hop) (string, string) {
+	switch {
+	case hop.Received == 0:
+		return ProblemFirewall, "no replies were received from " + hop.MachineID + " at " + hop.Endpoint + ", check that udp traffic to the endpoint is allowed by every firewall along the path, that the remote node knows about the local node, and that both nodes hold the same pre-shared key"
+	case strings.Join(hop.Plugins, ",") != strings.Join(hop.RemotePlugins, ","):
+		return ProblemPlugins, "the local node applies the plugins [" + strings.Join(hop.Plugins, ",") + "] while " + hop.MachineID + " applies [" + strings.Join(hop.RemotePlugins, ",") + "], one of the nodes has stale datastore state or a mismatched plugin configuration"
+	case hop.Crypto == CryptoMismatch:
+		return ProblemCrypto, "the local node and " + hop.MachineID + " derived different encryption keys for each other, check that both nodes have synced each other's current public key and salt, and hold the same pre-shared key"
+	case hop.Received < hop.Sent:
+		return "", hop.MachineID + " is reachable, but " + strconv.Itoa(hop.Sent-hop.Received) + " of " + strconv.Itoa(hop.Sent) + " probes were lost"
+	}
+	return "", hop.MachineID + " is reachable"
+}
+
+// negotiated returns the sorted plugins enabled locally that the remote node also supports, which are the plugins applied to traffic between the nodes.
+func negotiated(local, remote []string) []string {
+	plugins := []string{}
+	for i := 0; i < len(local); i++ {
+		if common.StringInSlice(local[i], remote) {
+			plugins = append(plugins, local[i])
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
+
+func orEmpty(strs []string) []string {
+	if strs == nil {
+		return []string{}
+	}
+	return strs
+}
+
+// New generates a Prober struct based on the passed in configuration, key/value store, router, and path MTU discovery. No diagnoses can be run until Start is called.
+func New(cfg *common.Config, store datastore.Datastore, rt *router.Router, discovery *pmtu.Discovery) *Prober {
+	return &Prober{
+		cfg:       cfg,
+		store:     store,
+		router:    rt,
+		discovery: discovery,
+		pending:   make(map[uint32]chan *reply),
+		stop:      make(chan struct{}),
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package diag
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/pmtu"
+	"github.com/supernomad/quantum/router"
+)
+
+// loopback is a socket which hands each probe straight to the remote prober, and its reply straight back to the local prober.
+type loopback struct {
+	local  *Prober
+	remote *Prober
+	drop   bool
+}
+
+func (l *loopback) Read(queue int, buf []byte) (*common.Payload, bool) {
+	return nil, false
+}
+
+func (l *loopback) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	if l.drop {
+		return true
+	}
+
+	raw := make([]byte, common.MaxPacketLength)
+	copy(raw, payload.Raw[:payload.Length])
+
+	reply, _, ok := l.remote.Handle(common.NewSockPayload(raw, payload.Length))
+	if ok {
+		l.local.Handle(reply)
+	}
+	return true
+}
+
+func (l *loopback) Unblock() error {
+	return nil
+}
+
+func (l *loopback) Close() error {
+	return nil
+}
+
+func (l *loopback) Queues() []int {
+	return nil
+}
+
+func testConfig(machineID, privateIP string, plugins ...string) *common.Config {
+	_, ipnet, _ := net.ParseCIDR("10.99.0.0/16")
+	return &common.Config{
+		Log:           common.NewLogger(common.NoopLogger),
+		MachineID:     machineID,
+		PrivateIP:     net.ParseIP(privateIP).To4(),
+		Plugins:       plugins,
+		MTU:           common.MTU,
+		NetworkConfig: &common.NetworkConfig{Network: "10.99.0.0/16", IPNet: ipnet},
+	}
+}
+
+func testMapping(cfg *common.Config, aes *crypto.AES) *common.Mapping {
+	return &common.Mapping{
+		MachineID:        cfg.MachineID,
+		PrivateIP:        cfg.PrivateIP,
+		Port:             1099,
+		SupportedPlugins: cfg.Plugins,
+		Sockaddr:         &syscall.SockaddrInet4{Port: 1099},
+		Address:          "1.1.1.1",
+		AES:              aes,
+	}
+}
+
+func testAES(t *testing.T, secret byte) *crypto.AES {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = secret
+	}
+
+	aes, err := crypto.NewAES(key, make([]byte, crypto.SaltLength), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aes
+}
+
+// testProbers returns a started local prober connected to a remote prober, each knowing the other through its datastore.
+func testProbers(localCfg, remoteCfg *common.Config, localAES, remoteAES *crypto.AES) (*Prober, *loopback) {
+	localStore := &datastore.Mock{InternalMapping: testMapping(remoteCfg, localAES)}
+	remoteStore := &datastore.Mock{InternalMapping: testMapping(localCfg, remoteAES)}
+
+	local := New(localCfg, localStore, router.New(localCfg, localStore), pmtu.New(localCfg, localStore))
+	remote := New(remoteCfg, remoteStore, router.New(remoteCfg, remoteStore), pmtu.New(remoteCfg, remoteStore))
+
+	sock := &loopback{local: local, remote: remote}
+	local.Start(sock)
+	return local, sock
+}
+
+func TestDiagnose(t *testing.T) {
+	probeInterval, replyTimeout = time.Millisecond, 50*time.Millisecond
+
+	localCfg := testConfig("local", "10.99.0.1", plugin.EncryptionPlugin, plugin.CompressionPlugin)
+	remoteCfg := testConfig("remote", "10.99.0.2", plugin.CompressionPlugin, plugin.EncryptionPlugin)
+
+	p, sock := testProbers(localCfg, remoteCfg, testAES(t, 1), testAES(t, 1))
+	defer p.Stop()
+
+	result, err := p.Diagnose("10.99.0.2", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Problem != "" || result.Outside || len(result.Hops) != 2 || result.Hops[0].Role != RoleLocal {
+		t.Fatal("Diagnose returned the wrong result for a healthy path:", result)
+	}
+
+	hop := result.Hops[1]
+	if hop.Role != RolePeer || hop.MachineID != "remote" || hop.Endpoint != "1.1.1.1:1099" || hop.Sent != 3 || hop.Received != 3 || len(hop.RTTs) != 3 {
+		t.Fatal("Diagnose did not probe the remote node:", hop)
+	}
+	if hop.Crypto != CryptoOK || len(hop.RemotePlugins) != 2 || hop.RemotePlugins[0] != hop.Plugins[0] || hop.RemoteMTU != common.MTU {
+		t.Fatal("Diagnose did not verify the path:", hop)
+	}
+
+	// The remote node is resolved by its machine id as well.
+	if result, err := p.Diagnose("remote", 1); err != nil || !result.Destination.Equal(remoteCfg.PrivateIP) {
+		t.Fatal("Diagnose did not resolve the machine id:", result, err)
+	}
+
+	sock.drop = true
+	if result, err := p.Diagnose("10.99.0.2", 1); err != nil || result.Problem != ProblemFirewall || result.Hops[1].Crypto != CryptoUnverified {
+		t.Fatal("Diagnose did not report the lost probes:", result, err)
+	}
+	sock.drop = false
+
+	// A destination outside of the quantum network is reached through the gateway.
+	p.store.(*datastore.Mock).InternalGatewayMapping = p.store.(*datastore.Mock).InternalMapping
+	if result, err := p.Diagnose("192.168.1.1", 1); err != nil || !result.Outside || result.Hops[1].Role != RoleGateway || result.Problem != "" {
+		t.Fatal("Diagnose did not route through the gateway:", result, err)
+	}
+	p.store.(*datastore.Mock).InternalGatewayMapping = nil
+	if result, err := p.Diagnose("192.168.1.1", 1); err != nil || result.Problem != ProblemRouting || len(result.Hops) != 1 {
+		t.Fatal("Diagnose did not report the missing gateway:", result, err)
+	}
+
+	for _, target := range []string{"10.99.0.1", "fd00::1", "woot.invalid"} {
+		if _, err := p.Diagnose(target, 1); err == nil {
+			t.Fatal("Diagnose should have failed for:", target)
+		}
+	}
+	if _, err := p.Diagnose("10.99.0.2", MaxCount+1); err == nil {
+		t.Fatal("Diagnose should have refused to send too many probes.")
+	}
+}
+
+func TestDiagnoseProblems(t *testing.T) {
+	probeInterval, replyTimeout = time.Millisecond, 50*time.Millisecond
+
+	localCfg := testConfig("local", "10.99.0.1", plugin.EncryptionPlugin)
+	remoteCfg := testConfig("remote", "10.99.0.2", plugin.EncryptionPlugin)
+
+	p, _ := testProbers(localCfg, remoteCfg, testAES(t, 1), testAES(t, 2))
+	if result, err := p.Diagnose("10.99.0.2", 1); err != nil || result.Problem != ProblemCrypto || result.Hops[1].Crypto != CryptoMismatch {
+		t.Fatal("Diagnose did not report the mismatched keys:", result, err)
+	}
+
+	// The remote node has a stale view of the local node's plugins.
+	p, sock := testProbers(localCfg, remoteCfg, testAES(t, 1), testAES(t, 1))
+	sock.remote.store.(*datastore.Mock).InternalMapping.SupportedPlugins = nil
+	if result, err := p.Diagnose("10.99.0.2", 1); err != nil || result.Problem != ProblemPlugins || len(result.Hops[1].RemotePlugins) != 0 {
+		t.Fatal("Diagnose did not report the mismatched plugins:", result, err)
+	}
+
+	localCfg.Plugins, remoteCfg.Plugins = nil, nil
+	p, _ = testProbers(localCfg, remoteCfg, nil, nil)
+	if result, err := p.Diagnose("10.99.0.2", 1); err != nil || result.Problem != "" || result.Hops[1].Crypto != CryptoDisabled {
+		t.Fatal("Diagnose did not report the disabled encryption:", result, err)
+	}
+
+	p.Stop()
+	if _, err := p.Diagnose("10.99.0.2", 1); err == nil {
+		t.Fatal("Diagnose should fail once the prober is stopped.")
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package diag contains the structs and logic to diagnose the overlay path between quantum nodes on demand, which backs the 'quantum ping' and 'quantum traceroute' commands.
+
+Diagnosis is handled by sending DiagProbe control packets to the node that traffic to the destination is handed to, over the same socket as the tunneled traffic so that the probes take the same path. The probes never pass through the network device, so they work whether or not the remote host would answer ICMP. Each probe carries a random challenge, and the remote node answers with a DiagReply containing:
+    - the challenge sealed with the encryption key it derived for the local node, which the local node opens with the key it derived for the remote node.
+    - the plugins it applies to traffic sent to the local node.
+    - the MTU it uses for traffic sent to the local node.
+
+The result reports the endpoint the probes were sent to, the round trip time of each reply, and both nodes' view of the negotiated plugins and MTU. The first problem found along the path is diagnosed as one of:
+    - 'routing' no node owns the destination, or the destination is outside of the quantum network and there is no gateway.
+    - 'firewall' no probe was answered, either udp traffic to the endpoint is blocked or the remote node does not know about the local node.
+    - 'plugins' the nodes disagree about which plugins are applied between them, which drops every packet.
+    - 'crypto' the nodes derived different encryption keys for each other, which drops every encrypted packet.
+
+The quantum network is a full mesh, so traffic is never relayed between quantum nodes. The only intermediate hop is the gateway, for destinations outside of the quantum network, and the destination behind it is never probed.
+
+Note that every node will answer probes regardless of its configuration, but only from nodes it knows about.
+*/
+package diag
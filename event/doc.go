@@ -0,0 +1,18 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package event contains the structs and logic to publish the changes to the quantum network seen by the local node, so that tooling can react to them as they happen rather than polling.
+
+The following kinds of events are published:
+    - 'mapping-added', 'mapping-updated', and 'mapping-deleted' when the datastore watch sees a node or floating ip mapping change.
+    - 'floating-moved' when a floating ip is claimed by a different node than the one that last owned it.
+    - 'gateway-changed' when the node that traffic destined outside of the quantum network is routed to changes.
+    - 'peer-up' and 'peer-down' when a remote node starts or stops replying to latency probes, which requires latency monitoring to be enabled.
+
+Events are buffered per subscription, and are dropped rather than stall the publisher if the subscription falls behind.
+
+The rest api streams the events as server-sent events at 'http://127.0.0.1:1099/events' by default, optionally filtered by the 'kind' query parameter, for example:
+    curl -sN 'http://127.0.0.1:1099/events?kind=peer-up,peer-down'
+*/
+package event
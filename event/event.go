@@ -0,0 +1,191 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package event
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+)
+
+const (
+	// MappingAdded is published when a node joins the quantum network, or a floating ip is claimed.
+	MappingAdded Kind = "mapping-added"
+
+	// MappingUpdated is published when the mapping of an existing node changes.
+	MappingUpdated Kind = "mapping-updated"
+
+	// MappingDeleted is published when a node leaves the quantum network, or a floating ip is released.
+	MappingDeleted Kind = "mapping-deleted"
+
+	// FloatingMoved is published when a floating ip is claimed by a different node than the one that last owned it.
+	FloatingMoved Kind = "floating-moved"
+
+	// GatewayChanged is published when the node that traffic destined outside of the quantum network is routed to changes.
+	GatewayChanged Kind = "gateway-changed"
+
+	// PeerUp is published when a remote node starts replying to latency probes.
+	PeerUp Kind = "peer-up"
+
+	// PeerDown is published when a remote node stops replying to latency probes.
+	PeerDown Kind = "peer-down"
+)
+
+const (
+	// The number of events buffered for each subscription, events are dropped from the subscription if it falls further behind.
+	subscriptionBuffer = 256
+)
+
+// Kinds lists every kind of event published on the bus.
+var Kinds = []Kind{MappingAdded, MappingUpdated, MappingDeleted, FloatingMoved, GatewayChanged, PeerUp, PeerDown}
+
+// Kind of change an event describes.
+type Kind string
+
+// Event describes a single change to the quantum network, as seen by the local node.
+type Event struct {
+	// The kind of change.
+	Kind Kind `json:"kind"`
+
+	// The time the change was seen.
+	Time time.Time `json:"time"`
+
+	// The private ip of the node or floating ip the change applies to.
+	PrivateIP net.IP `json:"privateIP"`
+
+	// The machine id of the node the change applies to, which for floating ips is the current owner.
+	MachineID string `json:"machineID,omitempty"`
+
+	// The machine id of the previous owner of a floating ip that moved, or of the previous gateway.
+	PreviousMachineID string `json:"previousMachineID,omitempty"`
+
+	// The public endpoint of the node the change applies to.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Whether or not the change applies to a floating ip.
+	Floating bool `json:"floating"`
+}
+
+// New generates an Event of the given kind for the supplied mapping, which may be nil if the node is no longer known.
+func New(kind Kind, privateIP net.IP, mapping *common.Mapping) *Event {
+	event := &Event{
+		Kind:      kind,
+		Time:      time.Now(),
+		PrivateIP: privateIP,
+	}
+
+	if mapping != nil {
+		event.MachineID = mapping.MachineID
+		event.Floating = mapping.Floating
+		if mapping.Address != "" {
+			event.Endpoint = net.JoinHostPort(mapping.Address, strconv.Itoa(mapping.Port))
+		}
+	}
+	return event
+}
+
+// Bytes returns the json representation of the event.
+func (event *Event) Bytes() []byte {
+	data, _ := json.Marshal(event)
+	return data
+}
+
+// Subscription receives the published events of the subscribed kinds until it is closed.
+type Subscription struct {
+	bus     *Bus
+	kinds   map[Kind]bool
+	events  chan *Event
+	dropped uint64
+}
+
+// Events returns the channel the published events are delivered on.
+func (sub *Subscription) Events() <-chan *Event {
+	return sub.events
+}
+
+// Dropped returns the number of events that were dropped because the subscription fell behind.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Close the subscription, no further events are delivered to it.
+func (sub *Subscription) Close() {
+	sub.bus.remove(sub)
+}
+
+// Bus struct for publishing the changes seen by the datastore and the latency monitor to any number of subscribers.
+type Bus struct {
+	mux           sync.Mutex
+	subscriptions atomic.Value
+}
+
+// Publish the events to every subscription of the matching kind. Publishing never blocks, and is effectively free when there are no subscriptions.
+func (bus *Bus) Publish(events ...*Event) {
+	subscriptions := bus.subscriptions.Load().([]*Subscription)
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	for _, event := range events {
+		for _, sub := range subscriptions {
+			if len(sub.kinds) > 0 && !sub.kinds[event.Kind] {
+				continue
+			}
+
+			select {
+			case sub.events <- event:
+			default:
+				atomic.AddUint64(&sub.dropped, 1)
+			}
+		}
+	}
+}
+
+// Subscribe to the events of the given kinds, or every event if no kinds are given.
+func (bus *Bus) Subscribe(kinds ...Kind) *Subscription {
+	sub := &Subscription{
+		bus:    bus,
+		kinds:  make(map[Kind]bool, len(kinds)),
+		events: make(chan *Event, subscriptionBuffer),
+	}
+	for i := 0; i < len(kinds); i++ {
+		sub.kinds[kinds[i]] = true
+	}
+
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	current := bus.subscriptions.Load().([]*Subscription)
+	subscriptions := make([]*Subscription, len(current), len(current)+1)
+	copy(subscriptions, current)
+	bus.subscriptions.Store(append(subscriptions, sub))
+
+	return sub
+}
+
+func (bus *Bus) remove(sub *Subscription) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+
+	current := bus.subscriptions.Load().([]*Subscription)
+	subscriptions := make([]*Subscription, 0, len(current))
+	for i := 0; i < len(current); i++ {
+		if current[i] != sub {
+			subscriptions = append(subscriptions, current[i])
+		}
+	}
+	bus.subscriptions.Store(subscriptions)
+}
+
+// NewBus generates a Bus struct, events are discarded until a subscription is made.
+func NewBus() *Bus {
+	bus := &Bus{}
+	bus.subscriptions.Store([]*Subscription{})
+	return bus
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package event
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/supernomad/quantum/common"
+)
+
+func TestEvent(t *testing.T) {
+	mapping := &common.Mapping{MachineID: "remote", PrivateIP: net.ParseIP("10.99.0.2"), Address: "dead::beef", Port: 1099, Floating: true}
+
+	e := New(MappingAdded, mapping.PrivateIP, mapping)
+	if e.MachineID != "remote" || e.Endpoint != "[dead::beef]:1099" || !e.Floating || e.Time.IsZero() {
+		t.Fatal("New returned the wrong event:", e)
+	}
+
+	decoded := &Event{}
+	if err := json.Unmarshal(e.Bytes(), decoded); err != nil || decoded.Kind != MappingAdded || !decoded.PrivateIP.Equal(mapping.PrivateIP) {
+		t.Fatal("Bytes returned the wrong json:", string(e.Bytes()), err)
+	}
+
+	if e := New(MappingDeleted, mapping.PrivateIP, nil); e.MachineID != "" || e.Endpoint != "" {
+		t.Fatal("New returned the wrong event without a mapping:", e)
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	// Publishing without any subscriptions is a noop.
+	bus.Publish(New(PeerUp, nil, nil))
+
+	all := bus.Subscribe()
+	peers := bus.Subscribe(PeerUp, PeerDown)
+
+	bus.Publish(New(PeerUp, nil, nil), New(MappingAdded, nil, nil))
+	if len(all.Events()) != 2 || len(peers.Events()) != 1 {
+		t.Fatal("Publish delivered the wrong events:", len(all.Events()), len(peers.Events()))
+	}
+	if e := <-peers.Events(); e.Kind != PeerUp {
+		t.Fatal("Publish delivered the wrong event:", e)
+	}
+
+	for i := 0; i < subscriptionBuffer; i++ {
+		bus.Publish(New(PeerDown, nil, nil))
+	}
+	if all.Dropped() != 2 || peers.Dropped() != 0 {
+		t.Fatal("Publish dropped the wrong number of events:", all.Dropped(), peers.Dropped())
+	}
+
+	all.Close()
+	peers.Close()
+	if subscriptions := bus.subscriptions.Load().([]*Subscription); len(subscriptions) != 0 {
+		t.Fatal("Close did not remove the subscriptions from the bus.")
+	}
+}
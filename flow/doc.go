@@ -0,0 +1,18 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package flow contains the structs and logic to track the flows of traffic crossing the quantum network, and export them to a flow collector as either IPFIX or NetFlow v9 records.
+
+A flow is identified by its source and destination addresses, its transport protocol and ports, and its direction. Outgoing packets are tracked before the plugins are applied, and incoming packets are tracked after the plugins are applied, so that the records always describe the plaintext traffic rather than the encrypted tunnel. ICMP flows report the type and code of the packet as the destination port.
+
+Each worker queue tracks its own flows, and every second the flows are swept and exported:
+    - Flows that have seen no packets for the idle timeout, 15 seconds by default, are exported and forgotten.
+    - Flows that have been active for longer than the active timeout, 1 minute by default, are exported and their counters are reset.
+    - All remaining flows are exported when the node shuts down.
+
+Records are exported over udp to the configured flow collector, and every message carries the templates that describe the records so that a collector can decode any message it receives. The observation domain, or source id for NetFlow v9, is the private ip of the node.
+
+Flow export is disabled unless a flow collector is configured.
+*/
+package flow
@@ -0,0 +1,258 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package flow
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// IPFIXProtocol exports flows as IPFIX, as defined by RFC 7011.
+	IPFIXProtocol = "ipfix"
+
+	// NetFlow9Protocol exports flows as NetFlow v9, as defined by RFC 3954.
+	NetFlow9Protocol = "netflow9"
+
+	ipfixVersion    = 10
+	ipfixHeaderSize = 16
+	ipfixTemplateID = 2
+
+	netflow9Version    = 9
+	netflow9HeaderSize = 20
+	netflow9TemplateID = 0
+
+	ipv4TemplateID = 256
+	ipv6TemplateID = 257
+
+	setHeaderSize      = 4
+	templateHeaderSize = 4
+	fieldSpecSize      = 4
+
+	// Keep the messages within the MTU of a typical collector path, so that they are never fragmented.
+	maxMessageSize = 1400
+)
+
+// Information elements shared by IPFIX and NetFlow v9, along with the elements specific to each.
+const (
+	octetDeltaCount          = 1
+	packetDeltaCount         = 2
+	protocolIdentifier       = 4
+	sourceTransportPort      = 7
+	sourceIPv4Address        = 8
+	destinationTransportPort = 11
+	destinationIPv4Address   = 12
+	lastSwitched             = 21
+	firstSwitched            = 22
+	sourceIPv6Address        = 27
+	destinationIPv6Address   = 28
+	flowDirection            = 61
+	flowStartMilliseconds    = 152
+	flowEndMilliseconds      = 153
+)
+
+type field struct {
+	id     uint16
+	length uint16
+}
+
+type template struct {
+	id     uint16
+	fields []field
+	size   int
+}
+
+func newTemplate(id uint16, fields ...field) *template {
+	t := &template{id: id, fields: fields}
+	for i := 0; i < len(fields); i++ {
+		t.size += int(fields[i].length)
+	}
+	return t
+}
+
+// encoder encodes flow records as IPFIX or NetFlow v9 messages.
+type encoder struct {
+	protocol  string
+	domain    uint32
+	boot      time.Time
+	sequence  uint32
+	templates []byte
+	ipv4      *template
+	ipv6      *template
+}
+
+func (e *encoder) headerSize() int {
+	if e.protocol == NetFlow9Protocol {
+		return netflow9HeaderSize
+	}
+	return ipfixHeaderSize
+}
+
+// encode the records into as many messages as necessary, each message carries the templates so that a collector can decode any message it receives.
+func (e *encoder) encode(records []*record, now time.Time) [][]byte {
+	var v4, v6 []*record
+	for i := 0; i < len(records); i++ {
+		if records[i].key.ipv6 {
+			v6 = append(v6, records[i])
+		} else {
+			v4 = append(v4, records[i])
+		}
+	}
+
+	var messages [][]byte
+	for len(v4)+len(v6) > 0 {
+		msg := make([]byte, e.headerSize(), maxMessageSize)
+		msg = append(msg, e.templates...)
+
+		var n4, n6 int
+		msg, n4 = e.appendDataSet(msg, e.ipv4, v4)
+		msg, n6 = e.appendDataSet(msg, e.ipv6, v6)
+		v4, v6 = v4[n4:], v6[n6:]
+
+		e.putHeader(msg, n4+n6, now)
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func (e *encoder) putHeader(msg []byte, records int, now time.Time) {
+	if e.protocol == NetFlow9Protocol {
+		binary.BigEndian.PutUint16(msg[0:2], netflow9Version)
+		// The count includes the two template records carried by every message.
+		binary.BigEndian.PutUint16(msg[2:4], uint16(records+2))
+		binary.BigEndian.PutUint32(msg[4:8], e.uptime(now))
+		binary.BigEndian.PutUint32(msg[8:12], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[12:16], e.sequence)
+		binary.BigEndian.PutUint32(msg[16:20], e.domain)
+		e.sequence++
+		return
+	}
+
+	binary.BigEndian.PutUint16(msg[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:8], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:12], e.sequence)
+	binary.BigEndian.PutUint32(msg[12:16], e.domain)
+	e.sequence += uint32(records)
+}
+
+// appendDataSet appends as many of the records as fit within the message, returning the number of records appended.
+func (e *encoder) appendDataSet(msg []byte, t *template, records []*record) ([]byte, int) {
+	n := (maxMessageSize - len(msg) - setHeaderSize - 3) / t.size
+	if n > len(records) {
+		n = len(records)
+	}
+	if n <= 0 {
+		return msg, 0
+	}
+
+	start := len(msg)
+	msg = append(msg, make([]byte, setHeaderSize+n*t.size)...)
+
+	offset := start + setHeaderSize
+	for i := 0; i < n; i++ {
+		for _, f := range t.fields {
+			e.putField(msg[offset:offset+int(f.length)], f.id, records[i])
+			offset += int(f.length)
+		}
+	}
+
+	// Pad the set out to a 4 byte boundary.
+	for (len(msg)-start)%4 != 0 {
+		msg = append(msg, 0)
+	}
+
+	binary.BigEndian.PutUint16(msg[start:start+2], t.id)
+	binary.BigEndian.PutUint16(msg[start+2:start+4], uint16(len(msg)-start))
+	return msg, n
+}
+
+func (e *encoder) putField(buf []byte, id uint16, r *record) {
+	switch id {
+	case sourceIPv4Address:
+		copy(buf, r.key.src[:4])
+	case destinationIPv4Address:
+		copy(buf, r.key.dst[:4])
+	case sourceIPv6Address:
+		copy(buf, r.key.src[:])
+	case destinationIPv6Address:
+		copy(buf, r.key.dst[:])
+	case sourceTransportPort:
+		binary.BigEndian.PutUint16(buf, r.key.srcPort)
+	case destinationTransportPort:
+		binary.BigEndian.PutUint16(buf, r.key.dstPort)
+	case protocolIdentifier:
+		buf[0] = r.key.protocol
+	case flowDirection:
+		buf[0] = r.key.direction
+	case packetDeltaCount:
+		binary.BigEndian.PutUint64(buf, r.packets)
+	case octetDeltaCount:
+		binary.BigEndian.PutUint64(buf, r.bytes)
+	case flowStartMilliseconds:
+		binary.BigEndian.PutUint64(buf, uint64(r.start.UnixNano()/int64(time.Millisecond)))
+	case flowEndMilliseconds:
+		binary.BigEndian.PutUint64(buf, uint64(r.end.UnixNano()/int64(time.Millisecond)))
+	case firstSwitched:
+		binary.BigEndian.PutUint32(buf, e.uptime(r.start))
+	case lastSwitched:
+		binary.BigEndian.PutUint32(buf, e.uptime(r.end))
+	}
+}
+
+// uptime returns the milliseconds since the encoder was created, which NetFlow v9 uses as the time base for flow timestamps.
+func (e *encoder) uptime(t time.Time) uint32 {
+	return uint32(t.Sub(e.boot) / time.Millisecond)
+}
+
+func (e *encoder) encodeTemplates() []byte {
+	setID := uint16(ipfixTemplateID)
+	if e.protocol == NetFlow9Protocol {
+		setID = netflow9TemplateID
+	}
+
+	buf := make([]byte, setHeaderSize)
+	for _, t := range []*template{e.ipv4, e.ipv6} {
+		record := make([]byte, templateHeaderSize+len(t.fields)*fieldSpecSize)
+		binary.BigEndian.PutUint16(record[0:2], t.id)
+		binary.BigEndian.PutUint16(record[2:4], uint16(len(t.fields)))
+		for i, f := range t.fields {
+			binary.BigEndian.PutUint16(record[templateHeaderSize+i*fieldSpecSize:], f.id)
+			binary.BigEndian.PutUint16(record[templateHeaderSize+i*fieldSpecSize+2:], f.length)
+		}
+		buf = append(buf, record...)
+	}
+
+	binary.BigEndian.PutUint16(buf[0:2], setID)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	return buf
+}
+
+func newEncoder(protocol string, domain uint32) *encoder {
+	start, end := field{flowStartMilliseconds, 8}, field{flowEndMilliseconds, 8}
+	if protocol == NetFlow9Protocol {
+		start, end = field{firstSwitched, 4}, field{lastSwitched, 4}
+	}
+
+	shared := []field{
+		{sourceTransportPort, 2},
+		{destinationTransportPort, 2},
+		{protocolIdentifier, 1},
+		{flowDirection, 1},
+		{packetDeltaCount, 8},
+		{octetDeltaCount, 8},
+		start,
+		end,
+	}
+
+	e := &encoder{
+		protocol: protocol,
+		domain:   domain,
+		boot:     time.Now(),
+		ipv4:     newTemplate(ipv4TemplateID, append([]field{{sourceIPv4Address, 4}, {destinationIPv4Address, 4}}, shared...)...),
+		ipv6:     newTemplate(ipv6TemplateID, append([]field{{sourceIPv6Address, 16}, {destinationIPv6Address, 16}}, shared...)...),
+	}
+	e.templates = e.encodeTemplates()
+	return e
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package flow
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	// The max number of flows tracked per queue, packets of new flows are not tracked until older flows expire.
+	maxFlows = 65536
+)
+
+var (
+	sweepInterval = 1 * time.Second
+)
+
+// table holds the active flows for a single worker queue.
+type table struct {
+	mux   sync.Mutex
+	flows map[key]*record
+}
+
+// Tracker struct for tracking the flows crossing the quantum network, and exporting them to a flow collector.
+type Tracker struct {
+	cfg     *common.Config
+	enabled int32
+	tables  []*table
+	encoder *encoder
+	conn    net.Conn
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Flow identifies the flow a packet belongs to, along with the size of the packet, so that the packet can be tracked once it has been handled.
+type Flow struct {
+	key   key
+	bytes uint64
+	ok    bool
+}
+
+// Classify returns the flow the packet belongs to, in the given direction, either metric.Rx or metric.Tx. The packet is only parsed if a flow collector is configured, and the flow is ignored by Record if the packet is malformed.
+func (t *Tracker) Classify(direction int, packet []byte) Flow {
+	if atomic.LoadInt32(&t.enabled) == 0 {
+		return Flow{}
+	}
+
+	dir := uint8(ingress)
+	if direction == metric.Tx {
+		dir = egress
+	}
+
+	k, ok := parse(packet, dir)
+	return Flow{key: k, bytes: uint64(len(packet)), ok: ok}
+}
+
+// Record accounts for a single packet of the flow, handled by the given queue. This is a noop unless a flow collector is configured.
+func (t *Tracker) Record(queue int, f Flow) {
+	if !f.ok || atomic.LoadInt32(&t.enabled) == 0 || queue < 0 || queue >= len(t.tables) {
+		return
+	}
+
+	now := time.Now()
+	tbl := t.tables[queue]
+
+	tbl.mux.Lock()
+	r, ok := tbl.flows[f.key]
+	if !ok {
+		if len(tbl.flows) >= maxFlows {
+			tbl.mux.Unlock()
+			return
+		}
+		r = &record{key: f.key, start: now}
+		tbl.flows[f.key] = r
+	}
+	r.packets++
+	r.bytes += f.bytes
+	r.end = now
+	tbl.mux.Unlock()
+}
+
+// Track accounts for a single packet handled by the given queue, in the given direction, either metric.Rx or metric.Tx. This is a noop unless a flow collector is configured.
+func (t *Tracker) Track(direction int, queue int, packet []byte) {
+	t.Record(queue, t.Classify(direction, packet))
+}
+
+// expire removes the flows that have been idle for longer than the idle timeout, and splits off the flows that have been active for longer than the active timeout, returning the records to export. All flows are expired if flush is true.
+func (t *Tracker) expire(now time.Time, flush bool) []*record {
+	var expired []*record
+	for _, tbl := range t.tables {
+		tbl.mux.Lock()
+		for k, r := range tbl.flows {
+			switch {
+			case flush || now.Sub(r.end) >= t.cfg.FlowIdleTimeout:
+				delete(tbl.flows, k)
+				expired = append(expired, r)
+			case now.Sub(r.start) >= t.cfg.FlowActiveTimeout:
+				cp := *r
+				expired = append(expired, &cp)
+
+				r.packets, r.bytes = 0, 0
+				r.start, r.end = now, now
+			}
+		}
+		tbl.mux.Unlock()
+	}
+	return expired
+}
+
+func (t *Tracker) export(records []*record, now time.Time) {
+	// Long running flows that saw no packets since they were last split off have nothing to report.
+	filtered := records[:0]
+	for i := 0; i < len(records); i++ {
+		if records[i].packets > 0 {
+			filtered = append(filtered, records[i])
+		}
+	}
+
+	for _, msg := range t.encoder.encode(filtered, now) {
+		if _, err := t.conn.Write(msg); err != nil {
+			t.cfg.Log.Warn("flow", "Error exporting flow records to the collector", "collector", t.cfg.FlowCollector, "error", err)
+			return
+		}
+	}
+}
+
+// Start tracking flows and periodically exporting them to the configured flow collector, this is a noop if no flow collector is configured.
+func (t *Tracker) Start() error {
+	if t.cfg.FlowCollector == "" {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", t.cfg.FlowCollector)
+	if err != nil {
+		return errors.New("error connecting to the flow collector: " + err.Error())
+	}
+	t.conn = conn
+
+	// The private ip of the node, which is only known once the datastore is initialized, identifies the node to the collector.
+	var domain uint32
+	if t.cfg.PrivateIP.To4() != nil {
+		domain = common.IPtoInt(t.cfg.PrivateIP)
+	}
+	t.encoder = newEncoder(t.cfg.FlowProtocol, domain)
+	atomic.StoreInt32(&t.enabled, 1)
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.stop:
+				now := time.Now()
+				t.export(t.expire(now, true), now)
+				return
+			case now := <-ticker.C:
+				t.export(t.expire(now, false), now)
+			}
+		}
+	}()
+
+	t.cfg.Log.Info("flow", "Exporting flow records.", "protocol", t.cfg.FlowProtocol, "collector", t.cfg.FlowCollector)
+	return nil
+}
+
+// Stop tracking flows, exporting any flows that are still active, and close the connection to the flow collector.
+func (t *Tracker) Stop() error {
+	if !atomic.CompareAndSwapInt32(&t.enabled, 1, 0) {
+		return nil
+	}
+
+	close(t.stop)
+	<-t.done
+	return t.conn.Close()
+}
+
+// New generates a Tracker struct based on the passed in configuration, nothing is tracked until Start is called.
+func New(cfg *common.Config) *Tracker {
+	tables := make([]*table, cfg.NumWorkers)
+	for i := 0; i < len(tables); i++ {
+		tables[i] = &table{flows: make(map[key]*record)}
+	}
+
+	return &Tracker{
+		cfg:    cfg,
+		tables: tables,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
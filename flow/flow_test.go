@@ -0,0 +1,233 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+func testIPv4Packet(protocol byte, src, dst string, transport []byte) []byte {
+	packet := make([]byte, common.IPv4HeaderSize+len(transport))
+	packet[0] = 0x45
+	packet[9] = protocol
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	copy(packet[common.IPv4HeaderSize:], transport)
+	return packet
+}
+
+func testIPv6Packet(protocol byte, src, dst string, transport []byte) []byte {
+	packet := make([]byte, common.IPv6HeaderSize+len(transport))
+	packet[0] = 0x60
+	packet[6] = protocol
+	copy(packet[8:24], net.ParseIP(src).To16())
+	copy(packet[24:40], net.ParseIP(dst).To16())
+	copy(packet[common.IPv6HeaderSize:], transport)
+	return packet
+}
+
+func testConfig() *common.Config {
+	return &common.Config{
+		Log:               common.NewLogger(common.NoopLogger),
+		NumWorkers:        2,
+		PrivateIP:         net.ParseIP("10.99.0.1"),
+		FlowProtocol:      IPFIXProtocol,
+		FlowActiveTimeout: time.Minute,
+		FlowIdleTimeout:   15 * time.Second,
+	}
+}
+
+func TestParse(t *testing.T) {
+	udp := testIPv4Packet(protocolUDP, "10.99.0.1", "10.99.0.2", []byte{0x04, 0xd2, 0x00, 0x35})
+	k, ok := parse(udp, egress)
+	if !ok || k.ipv6 || k.protocol != protocolUDP || k.srcPort != 1234 || k.dstPort != 53 || k.direction != egress {
+		t.Fatal("parse returned the wrong key for an ipv4 udp packet:", k)
+	}
+	if !net.IP(k.src[:4]).Equal(net.ParseIP("10.99.0.1")) || !net.IP(k.dst[:4]).Equal(net.ParseIP("10.99.0.2")) {
+		t.Fatal("parse returned the wrong addresses for an ipv4 udp packet:", k)
+	}
+
+	// Later fragments carry no transport header.
+	binary.BigEndian.PutUint16(udp[6:8], 100)
+	if k, ok := parse(udp, egress); !ok || k.srcPort != 0 || k.dstPort != 0 {
+		t.Fatal("parse read the ports of a later fragment:", k)
+	}
+
+	icmp := testIPv4Packet(protocolICMP, "10.99.0.1", "10.99.0.2", []byte{8, 0})
+	if k, ok := parse(icmp, ingress); !ok || k.srcPort != 0 || k.dstPort != 8<<8 || k.direction != ingress {
+		t.Fatal("parse returned the wrong key for an ipv4 icmp packet:", k)
+	}
+
+	tcp := testIPv6Packet(protocolTCP, "fd00::1", "fd00::2", []byte{0x00, 0x50, 0x1f, 0x90})
+	k, ok = parse(tcp, ingress)
+	if !ok || !k.ipv6 || k.protocol != protocolTCP || k.srcPort != 80 || k.dstPort != 8080 {
+		t.Fatal("parse returned the wrong key for an ipv6 tcp packet:", k)
+	}
+	if !net.IP(k.src[:]).Equal(net.ParseIP("fd00::1")) || !net.IP(k.dst[:]).Equal(net.ParseIP("fd00::2")) {
+		t.Fatal("parse returned the wrong addresses for an ipv6 tcp packet:", k)
+	}
+
+	for _, packet := range [][]byte{nil, {0x45, 0, 0}, {0x4f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, {0x60, 0}, {0x20}} {
+		if _, ok := parse(packet, egress); ok {
+			t.Fatal("parse accepted a malformed packet:", packet)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	now := time.Now()
+	records := []*record{
+		{key: key{protocol: protocolUDP}, packets: 1, bytes: 100, start: now, end: now},
+		{key: key{protocol: protocolTCP, ipv6: true}, packets: 2, bytes: 200, start: now, end: now},
+	}
+
+	ipfix := newEncoder(IPFIXProtocol, 1)
+	msgs := ipfix.encode(records, now)
+	if len(msgs) != 1 {
+		t.Fatal("encode split two records across messages:", len(msgs))
+	}
+
+	// header + templates + padded ipv4 set + ipv6 set
+	expected := ipfixHeaderSize + len(ipfix.templates) + 52 + 76
+	msg := msgs[0]
+	if len(msg) != expected || int(binary.BigEndian.Uint16(msg[2:4])) != expected || binary.BigEndian.Uint16(msg[0:2]) != ipfixVersion {
+		t.Fatal("encode returned the wrong ipfix header:", len(msg), expected, msg[:ipfixHeaderSize])
+	}
+	if binary.BigEndian.Uint32(msg[12:16]) != 1 || ipfix.sequence != 2 {
+		t.Fatal("encode returned the wrong ipfix domain or sequence:", binary.BigEndian.Uint32(msg[12:16]), ipfix.sequence)
+	}
+	if binary.BigEndian.Uint16(msg[ipfixHeaderSize:]) != ipfixTemplateID || binary.BigEndian.Uint16(msg[ipfixHeaderSize+4:]) != ipv4TemplateID {
+		t.Fatal("encode did not include the ipfix templates.")
+	}
+
+	netflow := newEncoder(NetFlow9Protocol, 1)
+	msg = netflow.encode(records, now)[0]
+	if binary.BigEndian.Uint16(msg[0:2]) != netflow9Version || binary.BigEndian.Uint16(msg[2:4]) != 4 {
+		t.Fatal("encode returned the wrong netflow v9 header:", msg[:netflow9HeaderSize])
+	}
+	if binary.BigEndian.Uint16(msg[netflow9HeaderSize:]) != netflow9TemplateID {
+		t.Fatal("encode did not include the netflow v9 templates.")
+	}
+
+	// Many records are split across messages which never exceed the max message size.
+	many := make([]*record, 100)
+	for i := 0; i < len(many); i++ {
+		many[i] = records[0]
+	}
+	ipfix = newEncoder(IPFIXProtocol, 1)
+	msgs = ipfix.encode(many, now)
+	if len(msgs) < 2 || ipfix.sequence != 100 {
+		t.Fatal("encode did not split the records across messages:", len(msgs), ipfix.sequence)
+	}
+	for i := 0; i < len(msgs); i++ {
+		if len(msgs[i]) > maxMessageSize || len(msgs[i])%4 != 0 {
+			t.Fatal("encode returned a message with the wrong size:", len(msgs[i]))
+		}
+	}
+
+	if msgs := ipfix.encode(nil, now); len(msgs) != 0 {
+		t.Fatal("encode returned messages without any records.")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	cfg := testConfig()
+	tracker := New(cfg)
+
+	udp := testIPv4Packet(protocolUDP, "10.99.0.1", "10.99.0.2", []byte{0x04, 0xd2, 0x00, 0x35})
+	tracker.Track(metric.Tx, 0, udp)
+	if len(tracker.tables[0].flows) != 0 {
+		t.Fatal("Track tracked a flow before the tracker was started.")
+	}
+
+	tracker.enabled = 1
+	tracker.Track(metric.Tx, 0, udp)
+	tracker.Track(metric.Tx, 0, udp)
+	tracker.Track(metric.Rx, 1, udp)
+	tracker.Track(metric.Tx, 5, udp)
+
+	if len(tracker.tables[0].flows) != 1 || len(tracker.tables[1].flows) != 1 {
+		t.Fatal("Track did not track the flows per queue.")
+	}
+
+	// A flow classified before the packet is transformed is recorded with the size of the original packet.
+	tracked := tracker.Classify(metric.Tx, udp)
+	udp[0] = 0
+	tracker.Record(0, tracked)
+	tracker.Record(0, tracker.Classify(metric.Tx, udp))
+	if r := tracker.tables[0].flows[tracked.key]; r == nil || r.packets != 3 || r.bytes != uint64(3*len(udp)) {
+		t.Fatal("Record did not record the classified flow.")
+	}
+	udp[0] = 0x45
+
+	now := time.Now()
+	if expired := tracker.expire(now, false); len(expired) != 0 {
+		t.Fatal("expire expired flows that are neither idle nor long lived.")
+	}
+
+	expired := tracker.expire(now.Add(cfg.FlowIdleTimeout+time.Second), false)
+	if len(expired) != 2 || expired[0].packets+expired[1].packets != 4 || len(tracker.tables[0].flows) != 0 || len(tracker.tables[1].flows) != 0 {
+		t.Fatal("expire did not forget the idle flows.")
+	}
+
+	cfg.FlowIdleTimeout = time.Hour
+	tracker.Track(metric.Tx, 0, udp)
+	expired = tracker.expire(now.Add(cfg.FlowActiveTimeout+time.Second), false)
+	if len(expired) != 1 || expired[0].packets != 1 || len(tracker.tables[0].flows) != 1 || tracker.tables[0].flows[expired[0].key].packets != 0 {
+		t.Fatal("expire did not split off the long lived flow.")
+	}
+
+	if expired := tracker.expire(now, true); len(expired) != 1 || len(tracker.tables[0].flows) != 0 {
+		t.Fatal("expire did not flush the remaining flows.")
+	}
+}
+
+func TestTrackerStartStop(t *testing.T) {
+	cfg := testConfig()
+	tracker := New(cfg)
+	if err := tracker.Start(); err != nil || tracker.enabled != 0 {
+		t.Fatal("Start should be a noop when no flow collector is configured.")
+	}
+	if err := tracker.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	cfg.FlowCollector = collector.LocalAddr().String()
+	tracker = New(cfg)
+	if err := tracker.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.Track(metric.Tx, 0, testIPv4Packet(protocolUDP, "10.99.0.1", "10.99.0.2", []byte{0x04, 0xd2, 0x00, 0x35}))
+	if err := tracker.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, maxMessageSize)
+	collector.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := collector.Read(buf)
+	if err != nil {
+		t.Fatal("Stop did not export the remaining flows:", err)
+	}
+	if binary.BigEndian.Uint16(buf[0:2]) != ipfixVersion || binary.BigEndian.Uint32(buf[12:16]) != common.IPtoInt(cfg.PrivateIP) || n != ipfixHeaderSize+len(tracker.encoder.templates)+52 {
+		t.Fatal("Stop exported the wrong message:", buf[:n])
+	}
+
+	tracker.Track(metric.Tx, 0, testIPv4Packet(protocolUDP, "10.99.0.1", "10.99.0.2", nil))
+	if len(tracker.tables[0].flows) != 0 {
+		t.Fatal("Track tracked a flow after the tracker was stopped.")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package flow
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+)
+
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+	protocolSCTP   = 132
+
+	// Directions as defined by the IPFIX flowDirection information element.
+	ingress = 0
+	egress  = 1
+)
+
+// key is the 5-tuple, along with the direction, that identifies a flow.
+type key struct {
+	src       [16]byte
+	dst       [16]byte
+	srcPort   uint16
+	dstPort   uint16
+	protocol  uint8
+	ipv6      bool
+	direction uint8
+}
+
+// record holds the counters for a single flow.
+type record struct {
+	key     key
+	packets uint64
+	bytes   uint64
+	start   time.Time
+	end     time.Time
+}
+
+// parse extracts the flow key from an ipv4 or ipv6 packet, returning false if the packet is malformed.
+//
+// ICMP packets have no ports, so the type and code are reported as the destination port as is customary for flow exporters.
+func parse(packet []byte, direction uint8) (key, bool) {
+	k := key{direction: direction}
+	if len(packet) < 1 {
+		return k, false
+	}
+
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < common.IPv4HeaderSize {
+			return k, false
+		}
+
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < common.IPv4HeaderSize || len(packet) < ihl {
+			return k, false
+		}
+
+		k.protocol = packet[9]
+		copy(k.src[:], packet[12:16])
+		copy(k.dst[:], packet[16:20])
+
+		// Only the first fragment of a packet contains the transport header.
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			transport = packet[ihl:]
+		}
+	case 6:
+		if len(packet) < common.IPv6HeaderSize {
+			return k, false
+		}
+
+		k.ipv6 = true
+		k.protocol = packet[6]
+		copy(k.src[:], packet[8:24])
+		copy(k.dst[:], packet[24:40])
+		transport = packet[common.IPv6HeaderSize:]
+	default:
+		return k, false
+	}
+
+	switch k.protocol {
+	case protocolTCP, protocolUDP, protocolSCTP:
+		if len(transport) >= 4 {
+			k.srcPort = binary.BigEndian.Uint16(transport[0:2])
+			k.dstPort = binary.BigEndian.Uint16(transport[2:4])
+		}
+	case protocolICMP, protocolICMPv6:
+		if len(transport) >= 2 {
+			k.dstPort = uint16(transport[0])<<8 | uint16(transport[1])
+		}
+	}
+	return k, true
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package handoff contains the structs and logic to hand the runtime state of quantum off to the new process during a rolling restart, so that the new process carries on where the running process leaves off rather than starting from scratch.
+
+The running process creates a unix socket pair and passes one end to the new process, after which the two exchange the following messages:
+    - 'state' from the running process, carrying the encryption keys, private ip, network configuration, mapping cache, and DTLS sessions.
+    - 'ready' or 'failed' from the new process, once it has started passing traffic or failed to start.
+    - 'metrics' from the running process, carrying its final packet and byte counts once its workers have drained.
+
+The running process keeps running if the new process fails to start, exits, or does not report ready within the handoff timeout. Once the new process reports ready the running process stops without removing the kernel state the two share, that is the 'quantum' nftables table, ipv4 forwarding, and the default route, which are left for the new process to remove when it stops.
+
+DTLS sessions are handed off as the session ticket keys of the running process along with the serialized session it negotiated with each remote address. Passing the session file descriptors alone would be of no use, as the session keys and sequence numbers live within openssl in the memory of the running process, so instead the new process resumes the sessions it is handed with an abbreviated handshake, and the other nodes resume theirs with the new process using tickets it is able to decrypt, rather than every session being negotiated from scratch.
+*/
+package handoff
@@ -0,0 +1,208 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package handoff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
+)
+
+const (
+	stateMessage   = "state"
+	readyMessage   = "ready"
+	failedMessage  = "failed"
+	metricsMessage = "metrics"
+)
+
+// State is the runtime state handed off to the new process during a rolling restart.
+type State struct {
+	// The key pair and salt used with the encryption plugin, which peers derive the encryption state for this node from.
+	PublicKey   []byte `json:"publicKey,omitempty"`
+	PrivateKey  []byte `json:"privateKey,omitempty"`
+	PublicSalt  []byte `json:"publicSalt,omitempty"`
+	PrivateSalt []byte `json:"privateSalt,omitempty"`
+
+	// The private ip assigned to this node.
+	PrivateIP net.IP `json:"privateIP"`
+
+	// The network configuration retrieved from the datastore.
+	NetworkConfig string `json:"networkConfig"`
+
+	// The mappings of every node known to the datastore.
+	Mappings []string `json:"mappings"`
+
+	// When the mappings were last synchronized with the datastore.
+	LastSync time.Time `json:"lastSync"`
+
+	// The keys the DTLS session tickets are encrypted with, along with the DTLS session negotiated with each remote address, which are resumed by the new process rather than negotiated from scratch.
+	DTLSTicketKeys []byte            `json:"dtlsTicketKeys,omitempty"`
+	DTLSSessions   map[string][]byte `json:"dtlsSessions,omitempty"`
+}
+
+// Apply the state to the configuration of the new process, before the node is created, so that its local mapping and encryption keys are unchanged. The keys are only taken over when the encryption plugin is enabled in both processes and the new process does not load them from a key file, and the private ip only when it is not statically assigned.
+func (state *State) Apply(cfg *common.Config) error {
+	networkConfig, err := common.ParseNetworkConfig([]byte(state.NetworkConfig))
+	if err != nil {
+		return errors.New("error parsing the network configuration handed off by the previous process: " + err.Error())
+	}
+
+	// The keys are published as a new running configuration, so everything else is applied first in order to be part of it.
+	if cfg.PrivateIP == nil {
+		cfg.PrivateIP = state.PrivateIP
+	}
+	cfg.NetworkConfig = networkConfig
+
+	running := cfg.Current()
+	if running.PrivateKey != nil && state.PrivateKey != nil && running.EncryptionKeyFile == "" && !bytes.Equal(running.PrivateKey, state.PrivateKey) {
+		if err := cfg.UseKeys(state.PrivateKey, state.PrivateSalt); err != nil {
+			return errors.New("error taking over the encryption keys handed off by the previous process: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// message is a single message exchanged during the handoff, only the fields for its kind are set.
+type message struct {
+	Kind    string             `json:"kind"`
+	State   *State             `json:"state,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	Metrics *metric.MetricsLog `json:"metrics,omitempty"`
+}
+
+// Conn is one end of the unix socket the state is handed off over.
+type Conn struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func (conn *Conn) send(msg *message) error {
+	if err := conn.enc.Encode(msg); err != nil {
+		return errors.New("error sending the " + msg.Kind + " handoff message: " + err.Error())
+	}
+	return nil
+}
+
+// receive the next message, which must be one of the kinds, waiting until the timeout expires or forever if the timeout is zero.
+func (conn *Conn) receive(timeout time.Duration, kinds ...string) (*message, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.conn.SetReadDeadline(deadline)
+
+	msg := &message{}
+	if err := conn.dec.Decode(msg); err != nil {
+		return nil, errors.New("error receiving the handoff message: " + err.Error())
+	}
+
+	if !common.StringInSlice(msg.Kind, kinds) {
+		return nil, errors.New("error receiving the handoff message: unexpected '" + msg.Kind + "' message")
+	}
+	return msg, nil
+}
+
+// SendState sends the state of the running process to the new process.
+func (conn *Conn) SendState(state *State) error {
+	return conn.send(&message{Kind: stateMessage, State: state})
+}
+
+// WaitReady waits for the new process to report that it has started, returning an error if it failed to start, exited, or did not report ready within the timeout.
+func (conn *Conn) WaitReady(timeout time.Duration) error {
+	msg, err := conn.receive(timeout, readyMessage, failedMessage)
+	if err != nil {
+		return err
+	}
+
+	if msg.Kind == failedMessage {
+		return errors.New("the new process failed to start: " + msg.Error)
+	}
+	return nil
+}
+
+// SendMetrics sends the final metrics of the running process to the new process, once the workers of the running process have drained.
+func (conn *Conn) SendMetrics(metrics *metric.MetricsLog) error {
+	return conn.send(&message{Kind: metricsMessage, Metrics: metrics})
+}
+
+// ReceiveState waits for the state of the previous process until the timeout expires.
+func (conn *Conn) ReceiveState(timeout time.Duration) (*State, error) {
+	msg, err := conn.receive(timeout, stateMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.State == nil {
+		return nil, errors.New("error receiving the handoff message: the state message is empty")
+	}
+	return msg.State, nil
+}
+
+// Ready reports to the previous process that the new process has started, or that it failed to start if the error is not nil.
+func (conn *Conn) Ready(err error) error {
+	if err != nil {
+		return conn.send(&message{Kind: failedMessage, Error: err.Error()})
+	}
+	return conn.send(&message{Kind: readyMessage})
+}
+
+// ReceiveMetrics waits for the final metrics of the previous process, which are sent once its workers have drained.
+func (conn *Conn) ReceiveMetrics() (*metric.MetricsLog, error) {
+	msg, err := conn.receive(0, metricsMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Metrics == nil {
+		return nil, errors.New("error receiving the handoff message: the metrics message is empty")
+	}
+	return msg.Metrics, nil
+}
+
+// Close the unix socket.
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
+
+// NewConn creates a Conn from one end of the unix socket pair, taking ownership of the file.
+func NewConn(file *os.File) (*Conn, error) {
+	defer file.Close()
+
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, errors.New("error opening the handoff socket: " + err.Error())
+	}
+
+	return &Conn{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+// Inherited returns the end of the unix socket passed in by the previous process during a rolling restart, or nil if there is none.
+func Inherited() (*Conn, error) {
+	value := os.Getenv(common.HandoffFDEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(common.HandoffFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errors.New("error parsing the handoff socket file descriptor '" + value + "': " + err.Error())
+	}
+	syscall.CloseOnExec(fd)
+
+	return NewConn(os.NewFile(uintptr(fd), "handoff"))
+}
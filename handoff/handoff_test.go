@@ -0,0 +1,166 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package handoff
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/metric"
+)
+
+// testPair returns both ends of a handoff socket, the first as it is held by the running process and the second as it is inherited by the new process.
+func testPair(t *testing.T) (*Conn, *Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, err := NewConn(os.NewFile(uintptr(fds[0]), "handoff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(common.HandoffFDEnv, strconv.Itoa(fds[1]))
+	next, err := Inherited()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv(common.HandoffFDEnv) != "" {
+		t.Fatal("Inherited did not clear the handoff socket from the environment.")
+	}
+	return running, next
+}
+
+func TestHandoff(t *testing.T) {
+	if conn, err := Inherited(); conn != nil || err != nil {
+		t.Fatal("Inherited returned a handoff socket when none was passed in:", err)
+	}
+
+	running, next := testPair(t)
+	defer running.Close()
+	defer next.Close()
+
+	pub, priv := crypto.GenerateECKeyPair()
+	pubSalt, privSalt := crypto.GenerateECKeyPair()
+	state := &State{
+		PublicKey:      pub,
+		PrivateKey:     priv,
+		PublicSalt:     pubSalt,
+		PrivateSalt:    privSalt,
+		PrivateIP:      net.ParseIP("10.99.0.1"),
+		NetworkConfig:  `{"backend":"udp","network":"10.99.0.0/16","staticRange":"10.99.0.0/23","floatingRange":"10.99.2.0/23","leaseTime":172800000000000}`,
+		Mappings:       []string{`{"privateIP":"10.99.0.2"}`},
+		LastSync:       time.Now().Round(0),
+		DTLSTicketKeys: make([]byte, crypto.TicketKeysLength),
+		DTLSSessions:   map[string][]byte{"10.0.0.2": []byte("session")},
+	}
+	if err := running.SendState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := next.ReceiveState(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received.PrivateKey, priv) || !received.PrivateIP.Equal(state.PrivateIP) || len(received.Mappings) != 1 || !received.LastSync.Equal(state.LastSync) ||
+		len(received.DTLSTicketKeys) != crypto.TicketKeysLength || string(received.DTLSSessions["10.0.0.2"]) != "session" {
+		t.Fatal("ReceiveState returned a different state than the one sent:", received)
+	}
+
+	dir, err := ioutil.TempDir("", "quantum-handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, generated := crypto.GenerateECKeyPair()
+	cfg := &common.Config{DataDir: dir, PrivateKey: generated}
+	if err := received.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if running := cfg.Current(); !bytes.Equal(running.PublicKey, pub) || !bytes.Equal(running.PrivateKey, priv) || !bytes.Equal(running.PublicSalt, pubSalt) || !running.PrivateIP.Equal(state.PrivateIP) || running.NetworkConfig.IPNet == nil {
+		t.Fatal("Apply did not take over the state of the previous process:", cfg)
+	}
+	if _, err := os.Stat(path.Join(dir, common.KeysFileName)); err != nil {
+		t.Fatal("Apply did not write the encryption keys it took over to the data directory:", err)
+	}
+
+	cfg = &common.Config{EncryptionKeyFile: path.Join(dir, "external"), PrivateKey: generated}
+	if err := received.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cfg.Current().PrivateKey, generated) {
+		t.Fatal("Apply overrode the encryption keys loaded from the key file of the new process.")
+	}
+
+	cfg = &common.Config{PrivateIP: net.ParseIP("10.99.0.5")}
+	if err := received.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PrivateKey != nil || !cfg.PrivateIP.Equal(net.ParseIP("10.99.0.5")) {
+		t.Fatal("Apply overrode the encryption keys or statically assigned private ip of the new process:", cfg)
+	}
+
+	if err := next.Ready(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := running.WaitReady(time.Second); err != nil {
+		t.Fatal("WaitReady returned an error for a started process:", err)
+	}
+
+	aggregator := metric.New(&common.Config{NumWorkers: 1})
+	aggregator.Record(metric.Tx, 0, metric.NotDropped, 20, nil)
+	if err := running.SendMetrics(aggregator.MetricsLog()); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := next.ReceiveMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.TxMetrics.Packets != 1 || metrics.TxMetrics.Bytes != 20 {
+		t.Fatal("ReceiveMetrics returned different metrics than the ones sent:", metrics.TxMetrics)
+	}
+}
+
+func TestHandoffFailure(t *testing.T) {
+	running, next := testPair(t)
+	if err := running.WaitReady(10 * time.Millisecond); err == nil {
+		t.Fatal("WaitReady did not time out waiting for the new process.")
+	}
+	if _, err := next.ReceiveState(10 * time.Millisecond); err == nil {
+		t.Fatal("ReceiveState did not time out waiting for the state.")
+	}
+	running.Close()
+	next.Close()
+
+	running, next = testPair(t)
+	if err := next.Ready(errors.New("error initializing the datastore")); err != nil {
+		t.Fatal(err)
+	}
+	if err := running.WaitReady(time.Second); err == nil || !strings.Contains(err.Error(), "error initializing the datastore") {
+		t.Fatal("WaitReady did not return the error of a process that failed to start:", err)
+	}
+	running.Close()
+	next.Close()
+
+	running, next = testPair(t)
+	next.Close()
+	if err := running.WaitReady(time.Second); err == nil {
+		t.Fatal("WaitReady did not return an error for a process that exited.")
+	}
+	running.Close()
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package latency contains the structs and logic to measure the round trip time, jitter, and packet loss between quantum nodes.
+
+Measurement is handled by periodically sending timestamped LatencyProbe control packets to every remote node in the quantum network, over the same socket as the tunneled traffic so that the probes take the same path. The remote node echoes each probe back as a LatencyReply, and the round trip time is the difference between the time the reply is received and the timestamp within it. A probe that goes unanswered for two seconds is counted as lost.
+
+The stats for each remote node are computed over a rolling window of the last 100 probes, and include the min, mean, max, and percentile round trip times, the jitter, the loss percentage, and a histogram of the round trip times.
+
+Each node periodically publishes its stats to the datastore, and collects the stats published by every other node, which together form a full mesh matrix of the latency between every pair of nodes. The matrix is exposed by the rest api at 'http://127.0.0.1:1099/latency' by default.
+
+Note that measurement is only supported by the udp backend, however every node will reply to probes regardless of whether or not it has latency monitoring enabled.
+*/
+package latency
@@ -0,0 +1,267 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package latency
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/socket"
+)
+
+const (
+	probeDataSize = 12
+	publishEvery  = 10
+	reportKind    = "latency"
+)
+
+var (
+	replyTimeout = 2 * time.Second
+)
+
+// Monitor struct for measuring the round trip time, jitter, and packet loss to each remote node in the quantum network.
+type Monitor struct {
+	cfg   *common.Config
+	store datastore.Datastore
+	bus   *event.Bus
+	sock  socket.Socket
+	epoch time.Time
+
+	mux     sync.Mutex
+	peers   map[uint32]*window
+	remote  map[string]map[string]*Stats
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Handle a control payload received from a remote node, returning the reply to send back to that node and true if a reply is required.
+//
+// The reply is written in place over the received payload.
+func (m *Monitor) Handle(payload *common.Payload) (*common.Payload, *common.Mapping, bool) {
+	if payload.Length < common.ControlHeaderSize+probeDataSize {
+		return nil, nil, false
+	}
+
+	sender := payload.Raw[common.ControlIPStart:common.ControlIPEnd]
+
+	switch common.ControlType(payload.Raw[common.ControlTypeStart]) {
+	case common.LatencyProbe:
+		mapping, ok := m.store.Mapping(common.IPtoInt(sender))
+		if !ok || mapping == nil {
+			return nil, nil, false
+		}
+
+		return common.NewControlPayload(payload.Raw, common.LatencyReply, m.cfg.PrivateIP, probeDataSize), mapping, true
+	case common.LatencyReply:
+		data := payload.Raw[common.ControlDataStart:payload.Length]
+		seq := binary.BigEndian.Uint32(data[0:4])
+		rtt := time.Since(m.epoch) - time.Duration(binary.BigEndian.Uint64(data[4:12]))
+
+		m.mux.Lock()
+		if w, ok := m.peers[common.IPtoInt(sender)]; ok {
+			w.acked(seq, rtt)
+		}
+		m.mux.Unlock()
+	}
+
+	return nil, nil, false
+}
+
+// Local returns the latency stats from the local node to each remote node, indexed by the private ip of the remote node.
+func (m *Monitor) Local() map[string]*Stats {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.local()
+}
+
+func (m *Monitor) local() map[string]*Stats {
+	now := time.Now()
+	local := make(map[string]*Stats, len(m.peers))
+	for _, w := range m.peers {
+		local[w.ip] = w.stats(now, replyTimeout)
+	}
+	return local
+}
+
+// Matrix returns the latency stats between every pair of nodes in the quantum network, built from the local stats along with the stats the remote nodes have published to the datastore.
+func (m *Monitor) Matrix() *Matrix {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	matrix := &Matrix{
+		Buckets: Buckets,
+		Nodes:   make(map[string]map[string]*Stats, len(m.remote)+1),
+	}
+	for ip, stats := range m.remote {
+		matrix.Nodes[ip] = stats
+	}
+	matrix.Nodes[m.cfg.PrivateIP.String()] = m.local()
+	return matrix
+}
+
+// Start periodically probing each remote node over the supplied socket, if latency monitoring is enabled.
+func (m *Monitor) Start(sock socket.Socket) error {
+	if !m.cfg.LatencyMonitoring {
+		return nil
+	}
+
+	if m.cfg.NetworkConfig.Backend != socket.UDPSocket {
+		m.cfg.Log.Warn("latency", "Latency monitoring is only supported by the udp backend, disabling latency monitoring.")
+		return nil
+	}
+
+	m.mux.Lock()
+	m.sock = sock
+	m.started = true
+	m.mux.Unlock()
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(m.cfg.LatencyInterval)
+		defer ticker.Stop()
+
+		for tick := 0; ; tick++ {
+			m.probeAll()
+			if tick%publishEvery == 0 {
+				m.publish()
+				m.collect()
+			}
+
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop probing the remote nodes.
+func (m *Monitor) Stop() {
+	m.mux.Lock()
+	started := m.started
+	m.started = false
+	m.mux.Unlock()
+
+	if !started {
+		return
+	}
+
+	close(m.stop)
+	<-m.done
+}
+
+func (m *Monitor) probeAll() {
+	mappings := m.store.Mappings()
+	now := time.Now()
+
+	m.mux.Lock()
+	peers := make(map[uint32]*window, len(mappings))
+	probes := make([]*common.Mapping, 0, len(mappings))
+	seqs := make([]uint32, 0, len(mappings))
+	events := make([]*event.Event, 0)
+	for i := 0; i < len(mappings); i++ {
+		mapping := mappings[i]
+		if mapping.PrivateIP.Equal(m.cfg.PrivateIP) || mapping.Sockaddr == nil {
+			continue
+		}
+
+		ip := common.IPtoInt(mapping.PrivateIP)
+		w, ok := m.peers[ip]
+		if !ok {
+			w = &window{ip: mapping.PrivateIP.String()}
+		}
+		peers[ip] = w
+
+		if w.changed(now, replyTimeout) {
+			kind := event.PeerDown
+			if w.up {
+				kind = event.PeerUp
+			}
+			events = append(events, event.New(kind, mapping.PrivateIP, mapping))
+		}
+
+		seqs = append(seqs, w.next(now))
+		probes = append(probes, mapping)
+	}
+	m.peers = peers
+	m.mux.Unlock()
+
+	m.bus.Publish(events...)
+
+	buf := make([]byte, common.ControlHeaderSize+probeDataSize)
+	for i := 0; i < len(probes); i++ {
+		payload := common.NewControlPayload(buf, common.LatencyProbe, m.cfg.PrivateIP, probeDataSize)
+		binary.BigEndian.PutUint32(buf[common.ControlDataStart:], seqs[i])
+		binary.BigEndian.PutUint64(buf[common.ControlDataStart+4:], uint64(time.Since(m.epoch)))
+		common.SignControlPayload(payload, m.cfg.Current().PSK)
+
+		// The probes are written to the first socket queue, alongside the tunneled packets, so that they measure the same path.
+		m.sock.Write(0, payload, probes[i])
+	}
+}
+
+func (m *Monitor) publish() {
+	data, err := json.Marshal(m.Local())
+	if err != nil {
+		m.cfg.Log.Warn("latency", "Error marshalling the local latency stats", "error", err)
+		return
+	}
+
+	// The published stats expire if this node stops publishing them, so that the matrix only contains live nodes.
+	ttl := 3 * publishEvery * m.cfg.LatencyInterval
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	if err := m.store.PublishReport(reportKind, data, ttl); err != nil {
+		m.cfg.Log.Warn("latency", "Error publishing the local latency stats", "error", err)
+	}
+}
+
+func (m *Monitor) collect() {
+	reports, err := m.store.Reports(reportKind)
+	if err != nil {
+		m.cfg.Log.Warn("latency", "Error collecting the remote latency stats", "error", err)
+		return
+	}
+
+	remote := make(map[string]map[string]*Stats, len(reports))
+	for ip, report := range reports {
+		var stats map[string]*Stats
+		if err := json.Unmarshal(report, &stats); err != nil {
+			m.cfg.Log.Warn("latency", "Error parsing the latency stats published by a peer", "peer", ip, "error", err)
+			continue
+		}
+		remote[ip] = stats
+	}
+
+	m.mux.Lock()
+	m.remote = remote
+	m.mux.Unlock()
+}
+
+// New generates a Monitor struct based on the passed in configuration and key/value store, publishing changes in the liveness of the remote nodes on the supplied bus. Nothing is probed until Start is called.
+func New(cfg *common.Config, store datastore.Datastore, bus *event.Bus) *Monitor {
+	return &Monitor{
+		cfg:    cfg,
+		store:  store,
+		bus:    bus,
+		epoch:  time.Now(),
+		peers:  make(map[uint32]*window),
+		remote: make(map[string]map[string]*Stats),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package latency
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/socket"
+)
+
+// recorder is a socket which records the payloads written to it.
+type recorder struct {
+	written []*common.Payload
+}
+
+func (r *recorder) Read(queue int, buf []byte) (*common.Payload, bool) {
+	return nil, false
+}
+
+func (r *recorder) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	raw := make([]byte, payload.Length)
+	copy(raw, payload.Raw[:payload.Length])
+	r.written = append(r.written, common.NewSockPayload(raw, payload.Length))
+	return true
+}
+
+func (r *recorder) Unblock() error {
+	return nil
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+func (r *recorder) Queues() []int {
+	return nil
+}
+
+func testConfig(privateIP string) *common.Config {
+	return &common.Config{
+		Log:               common.NewLogger(common.NoopLogger),
+		PrivateIP:         net.ParseIP(privateIP),
+		LatencyMonitoring: true,
+		LatencyInterval:   time.Hour,
+		NetworkConfig:     &common.NetworkConfig{Backend: socket.UDPSocket},
+	}
+}
+
+func testMapping(privateIP string) *common.Mapping {
+	return &common.Mapping{PrivateIP: net.ParseIP(privateIP), Sockaddr: &syscall.SockaddrInet4{}}
+}
+
+func TestWindowStats(t *testing.T) {
+	w := &window{}
+	now := time.Now()
+
+	rtts := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 0, 10 * time.Millisecond, 2 * time.Second}
+	for i := 0; i < len(rtts); i++ {
+		seq := w.next(now.Add(-time.Minute))
+		if rtts[i] > 0 {
+			w.acked(seq, rtts[i])
+		}
+	}
+
+	// An unanswered probe that has not timed out yet is ignored.
+	w.next(now)
+
+	stats := w.stats(now, replyTimeout)
+	if stats.Sent != 5 || stats.Received != 4 || stats.Loss != 20 {
+		t.Fatal("stats returned the wrong loss:", stats.Sent, stats.Received, stats.Loss)
+	}
+	if stats.MinRTT != 10 || stats.MaxRTT != 2000 || stats.MeanRTT != 510 || stats.P50RTT != 10 || stats.P99RTT != 2000 {
+		t.Fatal("stats returned the wrong round trip times:", stats)
+	}
+	if stats.Jitter != 1000 {
+		// The only consecutive replies are 10ms -> 20ms and 10ms -> 2000ms.
+		t.Fatal("stats returned the wrong jitter:", stats.Jitter)
+	}
+	if stats.Histogram[3] != 2 || stats.Histogram[4] != 1 || stats.Histogram[len(Buckets)] != 1 {
+		t.Fatal("stats returned the wrong histogram:", stats.Histogram)
+	}
+
+	// The window only keeps the most recent probes.
+	for i := 0; i < windowSize*2; i++ {
+		w.acked(w.next(now.Add(-time.Minute)), time.Millisecond)
+	}
+	if stats := w.stats(now, replyTimeout); stats.Sent != windowSize || stats.Loss != 0 {
+		t.Fatal("stats did not roll over the oldest probes:", stats.Sent, stats.Loss)
+	}
+}
+
+func TestWindowAlive(t *testing.T) {
+	w := &window{}
+	now := time.Now()
+
+	if _, ok := w.alive(now, replyTimeout); ok || w.changed(now, replyTimeout) {
+		t.Fatal("alive determined the liveness of a node that was never probed.")
+	}
+
+	w.acked(w.next(now.Add(-time.Minute)), time.Millisecond)
+	w.next(now)
+	if up, ok := w.alive(now, replyTimeout); !up || !ok || !w.changed(now, replyTimeout) || w.changed(now, replyTimeout) {
+		t.Fatal("alive did not report a node that replied as up.")
+	}
+
+	for i := 0; i < downAfter-1; i++ {
+		w.next(now.Add(-time.Minute))
+	}
+	if up, ok := w.alive(now, replyTimeout); !up || !ok {
+		t.Fatal("alive reported a node as down before enough probes timed out.")
+	}
+
+	w.next(now.Add(-time.Minute))
+	if up, ok := w.alive(now, replyTimeout); up || !ok || !w.changed(now, replyTimeout) || w.up {
+		t.Fatal("alive did not report a node that stopped replying as down.")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	local, remote := testConfig("10.8.0.1"), testConfig("10.8.0.2")
+
+	localStore := &datastore.Mock{InternalMapping: testMapping("10.8.0.2")}
+	remoteStore := &datastore.Mock{InternalMapping: testMapping("10.8.0.1")}
+
+	bus := event.NewBus()
+	sub := bus.Subscribe()
+	defer sub.Close()
+
+	sock := &recorder{}
+	m := New(local, localStore, bus)
+	r := New(remote, remoteStore, event.NewBus())
+
+	m.sock = sock
+	m.probeAll()
+	if len(sock.written) != 1 {
+		t.Fatal("probeAll did not probe the remote node.")
+	}
+
+	reply, mapping, ok := r.Handle(sock.written[0])
+	if !ok || mapping != remoteStore.InternalMapping || common.ControlType(reply.Raw[common.ControlTypeStart]) != common.LatencyReply {
+		t.Fatal("Handle did not reply to a latency probe.")
+	}
+
+	if _, _, ok := m.Handle(reply); ok {
+		t.Fatal("Handle replied to a latency reply.")
+	}
+
+	stats := m.Local()["10.8.0.2"]
+	if stats == nil || stats.Sent != 1 || stats.Received != 1 || stats.Loss != 0 {
+		t.Fatal("Local returned the wrong stats after a reply:", stats)
+	}
+
+	// The reply marks the remote node as up the next time it is probed.
+	m.probeAll()
+	select {
+	case e := <-sub.Events():
+		if e.Kind != event.PeerUp || !e.PrivateIP.Equal(net.ParseIP("10.8.0.2")) {
+			t.Fatal("probeAll published the wrong event:", e)
+		}
+	default:
+		t.Fatal("probeAll did not publish the remote node coming up.")
+	}
+
+	// Publish the stats of both nodes to a shared datastore, and collect them to build the full matrix.
+	m.store, r.store = localStore, localStore
+	localStore.InternalMapping = testMapping("10.8.0.2")
+	r.publish()
+	m.collect()
+
+	matrix := m.Matrix()
+	if len(matrix.Nodes) != 2 || matrix.Nodes["10.8.0.1"]["10.8.0.2"].Received != 1 || matrix.Nodes["10.8.0.2"] == nil {
+		t.Fatal("Matrix did not include the local and remote stats:", matrix.Nodes)
+	}
+	if matrix.Bytes(true) == nil || matrix.Bytes(false) == nil {
+		t.Fatal("Bytes returned a nil slice.")
+	}
+}
+
+func TestMonitorStartStop(t *testing.T) {
+	cfg := testConfig("10.8.0.1")
+	cfg.LatencyMonitoring = false
+
+	m := New(cfg, &datastore.Mock{}, event.NewBus())
+	if err := m.Start(&recorder{}); err != nil || m.started {
+		t.Fatal("Start should be a noop when latency monitoring is disabled.")
+	}
+	m.Stop()
+
+	cfg.LatencyMonitoring = true
+	sock := &recorder{}
+	m = New(cfg, &datastore.Mock{InternalMapping: testMapping("10.8.0.2")}, event.NewBus())
+	if err := m.Start(sock); err != nil {
+		t.Fatal(err)
+	}
+	m.Stop()
+
+	if len(sock.written) != 1 {
+		t.Fatal("Start did not probe the remote node.")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package latency
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	windowSize = 100
+
+	// The number of consecutive probes that must time out before a remote node is considered down.
+	downAfter = 3
+)
+
+// Buckets holds the upper bounds, in milliseconds, of the round trip time histogram buckets.
+var Buckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// Stats struct which summarizes the round trip times and packet loss to a single remote node, over the most recent probes.
+type Stats struct {
+	// The number of probes sent which have either been replied to or timed out.
+	Sent uint64 `json:"sent"`
+
+	// The number of probes which have been replied to.
+	Received uint64 `json:"received"`
+
+	// The percentage of probes which timed out.
+	Loss float64 `json:"loss"`
+
+	// The minimum round trip time in milliseconds.
+	MinRTT float64 `json:"minRTT"`
+
+	// The mean round trip time in milliseconds.
+	MeanRTT float64 `json:"meanRTT"`
+
+	// The maximum round trip time in milliseconds.
+	MaxRTT float64 `json:"maxRTT"`
+
+	// The 50th percentile round trip time in milliseconds.
+	P50RTT float64 `json:"p50RTT"`
+
+	// The 90th percentile round trip time in milliseconds.
+	P90RTT float64 `json:"p90RTT"`
+
+	// The 99th percentile round trip time in milliseconds.
+	P99RTT float64 `json:"p99RTT"`
+
+	// The mean difference between consecutive round trip times in milliseconds.
+	Jitter float64 `json:"jitter"`
+
+	// The number of round trip times that fall within each of the Buckets, the final entry counts the round trip times larger than the last bucket.
+	Histogram []uint64 `json:"histogram"`
+}
+
+// Matrix struct which holds the latency stats between every pair of nodes in the quantum network that have reported them.
+type Matrix struct {
+	// The upper bounds, in milliseconds, of the round trip time histogram buckets.
+	Buckets []float64 `json:"buckets"`
+
+	// The stats indexed by the private ip of the measuring node, and then by the private ip of the remote node.
+	Nodes map[string]map[string]*Stats `json:"nodes"`
+}
+
+// Bytes returns a byte slice json representation of the Matrix struct in either flat or prettified notation, if there is an error while marshalling data a nil slice is returned.
+func (matrix *Matrix) Bytes(pretty bool) []byte {
+	var data []byte
+	if pretty {
+		data, _ = json.MarshalIndent(matrix, "", "    ")
+	} else {
+		data, _ = json.Marshal(matrix)
+	}
+	return data
+}
+
+type probe struct {
+	seq   uint32
+	sent  time.Time
+	rtt   time.Duration
+	acked bool
+}
+
+// window is a ring of the most recent probes sent to a single remote node.
+type window struct {
+	ip     string
+	seq    uint32
+	probes [windowSize]probe
+
+	// Whether the remote node was up when its liveness last changed, and whether its liveness has been determined at all.
+	up    bool
+	known bool
+}
+
+// next records a probe sent at now, returning its sequence number.
+func (w *window) next(now time.Time) uint32 {
+	w.seq++
+	w.probes[w.seq%windowSize] = probe{seq: w.seq, sent: now}
+	return w.seq
+}
+
+func (w *window) acked(seq uint32, rtt time.Duration) {
+	p := &w.probes[seq%windowSize]
+	if p.seq != seq || p.sent.IsZero() || p.acked {
+		return
+	}
+	p.rtt = rtt
+	p.acked = true
+}
+
+// alive returns whether or not the remote node is replying to probes based on the most recent probes that have either been replied to or timed out, and false if there are not yet enough of them to tell.
+func (w *window) alive(now time.Time, timeout time.Duration) (bool, bool) {
+	timedOut := 0
+	for i := uint32(0); i < windowSize && i < w.seq; i++ {
+		p := w.probes[(w.seq-i)%windowSize]
+		switch {
+		case p.seq != w.seq-i || p.sent.IsZero():
+			return false, false
+		case p.acked:
+			return true, true
+		case now.Sub(p.sent) < timeout:
+			continue
+		}
+
+		timedOut++
+		if timedOut >= downAfter {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// changed returns true if the liveness of the remote node has changed since the last time it was determined, recording the new liveness.
+func (w *window) changed(now time.Time, timeout time.Duration) bool {
+	up, ok := w.alive(now, timeout)
+	if !ok || (w.known && up == w.up) {
+		return false
+	}
+
+	w.up, w.known = up, true
+	return true
+}
+
+// stats summarizes the window, probes which have neither been replied to nor timed out are ignored.
+func (w *window) stats(now time.Time, timeout time.Duration) *Stats {
+	stats := &Stats{Histogram: make([]uint64, len(Buckets)+1)}
+
+	probes := make([]probe, 0, windowSize)
+	for i := 0; i < windowSize; i++ {
+		p := w.probes[i]
+		if p.sent.IsZero() || (!p.acked && now.Sub(p.sent) < timeout) {
+			continue
+		}
+		probes = append(probes, p)
+	}
+	if len(probes) == 0 {
+		return stats
+	}
+
+	sort.Slice(probes, func(i, j int) bool { return probes[i].seq < probes[j].seq })
+
+	var rtts []float64
+	var jitter float64
+	var jitterSamples int
+	for i := 0; i < len(probes); i++ {
+		if !probes[i].acked {
+			continue
+		}
+
+		rtt := milliseconds(probes[i].rtt)
+		if len(rtts) > 0 && probes[i-1].acked {
+			jitter += math.Abs(rtt - rtts[len(rtts)-1])
+			jitterSamples++
+		}
+		rtts = append(rtts, rtt)
+
+		bucket := sort.SearchFloat64s(Buckets, rtt)
+		stats.Histogram[bucket]++
+	}
+
+	stats.Sent = uint64(len(probes))
+	stats.Received = uint64(len(rtts))
+	stats.Loss = float64(stats.Sent-stats.Received) / float64(stats.Sent) * 100
+	if len(rtts) == 0 {
+		return stats
+	}
+
+	if jitterSamples > 0 {
+		stats.Jitter = jitter / float64(jitterSamples)
+	}
+
+	var sum float64
+	for i := 0; i < len(rtts); i++ {
+		sum += rtts[i]
+	}
+	stats.MeanRTT = sum / float64(len(rtts))
+
+	sort.Float64s(rtts)
+	stats.MinRTT = rtts[0]
+	stats.MaxRTT = rtts[len(rtts)-1]
+	stats.P50RTT = percentile(rtts, 50)
+	stats.P90RTT = percentile(rtts, 90)
+	stats.P99RTT = percentile(rtts, 99)
+
+	return stats
+}
+
+// percentile returns the nearest rank percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
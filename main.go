@@ -4,111 +4,169 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"sort"
 	"strings"
 
 	"github.com/supernomad/quantum/common"
-	"github.com/supernomad/quantum/datastore"
-	"github.com/supernomad/quantum/device"
-	"github.com/supernomad/quantum/metric"
-	"github.com/supernomad/quantum/plugin"
-	"github.com/supernomad/quantum/rest"
-	"github.com/supernomad/quantum/router"
-	"github.com/supernomad/quantum/socket"
-	"github.com/supernomad/quantum/worker"
+	"github.com/supernomad/quantum/ctl"
+	"github.com/supernomad/quantum/handoff"
+	"github.com/supernomad/quantum/node"
 )
 
 func handleError(log *common.Logger, err error) {
 	if err != nil {
-		log.Error.Println(err.Error())
+		log.Error("main", err.Error())
 		os.Exit(1)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == ctl.Command {
+		os.Exit(ctl.Run(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && common.StringInSlice(os.Args[1], ctl.Shortcuts) {
+		os.Exit(ctl.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	validate := len(os.Args) > 1 && os.Args[1] == "config"
+	if validate && (len(os.Args) < 3 || os.Args[2] != "validate") {
+		fmt.Fprintln(os.Stderr, "Usage: quantum config validate [options]")
+		os.Exit(2)
+	}
+
 	log := common.NewLogger(common.InfoLogger)
 
-	cfg, err := common.NewConfig(log)
-	handleError(log, err)
+	// Validating the configuration has no side effects, a dry run stops after printing the effective configuration and every problem with it.
+	validation := common.ValidateConfig(log)
+	if validate || validation.Config.DryRun {
+		validation.Write(os.Stdout)
+		if validation.Err() != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	store, err := datastore.New(cfg.Datastore, cfg)
+	cfg, err := validation.Apply()
 	handleError(log, err)
 
-	err = store.Init()
+	// A process started by a rolling restart takes over the runtime state of the previous process, which keeps running until it is told the new process has started.
+	previous, err := handoff.Inherited()
 	handleError(log, err)
 
-	incomingPlugins := make([]plugin.Plugin, len(cfg.Plugins))
-	outgoingPlugins := make([]plugin.Plugin, len(cfg.Plugins))
-	for i := 0; i < len(cfg.Plugins); i++ {
-		plugin, err := plugin.New(cfg.Plugins[i], cfg)
+	var state *handoff.State
+	if previous != nil {
+		state, err = previous.ReceiveState(cfg.HandoffTimeout)
 		handleError(log, err)
-		outgoingPlugins[i] = plugin
-		incomingPlugins[i] = plugin
-	}
-
-	sort.Sort(plugin.Sorter{Plugins: outgoingPlugins})
-	sort.Sort(sort.Reverse(plugin.Sorter{Plugins: incomingPlugins}))
 
-	dev, err := device.New(device.TUNDevice, cfg)
-	handleError(log, err)
+		err = state.Apply(cfg)
+		handleError(log, err)
+	}
 
-	sock, err := socket.New(cfg.NetworkConfig.Backend, cfg)
+	n, err := node.New(cfg)
 	handleError(log, err)
 
-	aggregator := metric.New(cfg)
-
-	api := rest.New(cfg, aggregator)
+	if state != nil {
+		err = n.Resume(state)
+		handleError(log, err)
+	}
 
-	rt := router.New(cfg, store)
+	err = n.Start(context.Background())
+	if previous != nil {
+		if readyErr := previous.Ready(err); readyErr != nil {
+			log.Error("main", "Error reporting to the previous process", "error", readyErr)
+		}
+	}
+	handleError(log, err)
 
-	outgoing := worker.NewOutgoing(cfg, aggregator, rt, outgoingPlugins, dev, sock)
-	incoming := worker.NewIncoming(cfg, aggregator, rt, incomingPlugins, dev, sock)
+	if previous != nil {
+		go func() {
+			defer previous.Close()
+
+			metrics, err := previous.ReceiveMetrics()
+			if err != nil {
+				log.Warn("main", "Error receiving the metrics of the previous process, the metrics start from zero", "error", err)
+				return
+			}
+			n.RestoreMetrics(metrics)
+		}()
+	}
 
-	api.Start()
-	aggregator.Start()
-	store.Start()
+	// Reloads are applied in place where possible, falling back to a rolling restart otherwise.
+	hot := func() (bool, error) {
+		validation := common.ValidateConfig(log)
+		if err := validation.Err(); err != nil {
+			return false, err
+		}
+
+		applied, err := n.Reconfigure(validation.Config)
+		if err != nil {
+			log.Error("main", "Error applying the configuration in place, falling back to a rolling restart", "error", err)
+			return false, nil
+		}
+		return applied, nil
+	}
 
-	for i := 0; i < cfg.NumWorkers; i++ {
-		incoming.Start(i)
-		outgoing.Start(i)
+	// The new process started by a rolling restart is handed the runtime state, and receives the final metrics once this process has stopped.
+	var next *handoff.Conn
+	transfer := func(file *os.File) error {
+		conn, err := handoff.NewConn(file)
+		if err != nil {
+			return err
+		}
+
+		if err := conn.SendState(n.HandoffState()); err != nil {
+			conn.Close()
+			return err
+		}
+
+		if err := conn.WaitReady(cfg.Current().HandoffTimeout); err != nil {
+			conn.Close()
+			return err
+		}
+
+		next = conn
+		return nil
 	}
 
-	fds := make([]int, cfg.NumWorkers*2)
-	copy(fds[0:cfg.NumWorkers], dev.Queues())
-	copy(fds[cfg.NumWorkers:cfg.NumWorkers*2], sock.Queues())
-
-	signaler := common.NewSignaler(log, cfg, fds, map[string]string{common.RealDeviceNameEnv: dev.Name()})
-
-	log.Info.Printf("[MAIN] Listening on device:                 %s", dev.Name())
-	log.Info.Printf("[MAIN] Network space:                       %s", cfg.NetworkConfig.Network)
-	log.Info.Printf("[MAIN] Private IP address:                  %s", cfg.PrivateIP)
-	log.Info.Printf("[MAIN] Public IPv4 address:                 %s", cfg.PublicIPv4)
-	log.Info.Printf("[MAIN] Public IPv6 address:                 %s", cfg.PublicIPv6)
-	log.Info.Printf("[MAIN] Listening on port:                   %d", cfg.ListenPort)
-	log.Info.Printf("[MAIN] Using datastore:                     %s", cfg.Datastore)
-	log.Info.Printf("[MAIN] Using backend:                       %s", cfg.NetworkConfig.Backend)
-	log.Info.Printf("[MAIN] Using plugins:                       %s", strings.Join(cfg.Plugins, ", "))
-	log.Info.Printf("[MAIN] Forwarding network traffic:          %t", cfg.Forward)
+	signaler := common.NewSignaler(log, cfg, n.Queues(), map[string]string{common.RealDeviceNameEnv: n.DeviceName()}, hot, transfer)
+	n.OnReload(signaler.Reload)
+
+	started := log.With(
+		"device", n.DeviceName(),
+		"network", cfg.NetworkConfig.Network,
+		"private_ip", cfg.PrivateIP,
+		"public_ipv4", cfg.PublicIPv4,
+		"public_ipv6", cfg.PublicIPv6,
+		"listen_port", cfg.ListenPort,
+		"datastore", cfg.Datastore,
+		"backend", cfg.NetworkConfig.Backend,
+		"plugins", strings.Join(cfg.Plugins, ","),
+		"forward", cfg.Forward,
+	)
 	if cfg.Forward {
-		log.Info.Printf("[MAIN] Gateway IP:                          %s", cfg.Gateway)
+		started = started.With("gateway", cfg.Gateway)
 	}
+	started.Info("main", "Started the quantum node.")
 
 	os.Setenv("QUANTUM_IP", cfg.PrivateIP.String())
 
 	err = signaler.Wait(true)
 	handleError(log, err)
 
-	api.Stop()
-	aggregator.Stop()
-	store.Stop()
-
-	incoming.Stop()
-	outgoing.Stop()
-
-	err = sock.Close()
+	// Once the new process has taken over, the kernel state shared with it is left in place for the new process to remove.
+	if next != nil {
+		err = n.HandOff()
+	} else {
+		err = n.Stop()
+	}
 	handleError(log, err)
 
-	err = dev.Close()
-	handleError(log, err)
+	if next != nil {
+		if err := next.SendMetrics(n.Metrics()); err != nil {
+			log.Warn("main", "Error handing off the final metrics", "error", err)
+		}
+		next.Close()
+	}
 }
@@ -4,102 +4,288 @@
 package metric
 
 import (
-	"github.com/supernomad/quantum/common"
-)
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
 
-const (
-	metricsBackLog = 1000
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
 )
 
-// Aggregator is a struct for monitoring and aggregating quantum metrics via an embedded channel.
+// Aggregator is a struct for aggregating quantum metrics via per-queue and per-peer atomic counters, which are snapshotted on demand.
 type Aggregator struct {
-	cfg        *common.Config
-	stop       chan struct{}
-	metricsLog *MetricsLog
+	cfg *common.Config
+
+	// queues holds a []*counters per direction, indexed by queue, and peers holds a map[uint32]*peerCounters keyed by private ip address. Both are replaced rather than modified so that Record can read them without locking.
+	queues    [2]atomic.Value
+	peers     atomic.Value
+	tablesMux sync.Mutex
+
+	valuesMux sync.Mutex
+	counters  map[string]func() uint64
+	gauges    map[string]func() uint64
 
-	// Metrics is the channel Metric structs are sent to for aggregation and export via the rest api
-	Metrics chan *Metric
+	sub  *event.Subscription
+	stop chan struct{}
+	done chan struct{}
 }
 
-func handleMetric(metrics *Metrics, metric *Metric) {
-	if metric.Dropped {
-		metrics.DroppedBytes += metric.Bytes
-		metrics.DroppedPackets++
-	} else {
-		metrics.Bytes += metric.Bytes
-		metrics.Packets++
+// Record accounts for a single packet of the given size, handled by the given queue in the given direction, either Rx or Tx, and dropped for the given reason or NotDropped. The mapping represents the remote peer involved and may be nil if the peer is unknown.
+//
+// Record never blocks or allocates once a queue and peer have been seen, and is safe to call from any number of workers concurrently. The queues are sized from the number of workers, and grow if more workers record packets later on.
+func (aggregator *Aggregator) Record(direction int, queue int, reason DropReason, bytes int, mapping *common.Mapping) {
+	if queue < 0 {
+		return
+	}
+
+	queues := aggregator.queues[direction].Load().([]*counters)
+	if queue >= len(queues) {
+		queues = aggregator.addQueues(direction, queue+1)
 	}
+	queues[queue].add(reason, uint64(bytes))
+
+	if mapping == nil {
+		return
+	}
+
+	ip := mapping.PrivateIP.To4()
+	if ip == nil {
+		return
+	}
+
+	key := binary.BigEndian.Uint32(ip)
+	peer, ok := aggregator.peers.Load().(map[uint32]*peerCounters)[key]
+	if !ok {
+		peer = aggregator.addPeer(key)
+	}
+	peer[direction].add(reason, uint64(bytes))
 }
 
-func (aggregator *Aggregator) pipeline(metric *Metric) {
-	aggregator.cfg.Log.Debug.Println("[AGGREGATOR]", "Metric data received:", metric)
+// addQueues grows the copy on write queue table of the direction to hold at least the number of queues, so that the table can be read by Record without taking a lock.
+func (aggregator *Aggregator) addQueues(direction int, length int) []*counters {
+	aggregator.tablesMux.Lock()
+	defer aggregator.tablesMux.Unlock()
 
-	var metrics *Metrics
-	switch metric.Type {
-	case Rx:
-		metrics = aggregator.metricsLog.RxMetrics
-	case Tx:
-		metrics = aggregator.metricsLog.TxMetrics
+	queues := aggregator.queues[direction].Load().([]*counters)
+	if length <= len(queues) {
+		return queues
 	}
 
-	handleMetric(metrics, metric)
+	updated := make([]*counters, length)
+	copy(updated, queues)
+	for i := len(queues); i < length; i++ {
+		updated[i] = &counters{}
+	}
+	aggregator.queues[direction].Store(updated)
+	return updated
+}
 
-	if queueMetrics, ok := metrics.Queues[metric.Queue]; ok {
-		handleMetric(queueMetrics, metric)
-	} else {
-		queueMetrics = &Metrics{}
-		handleMetric(queueMetrics, metric)
+// addPeer adds a peer to the copy on write peer table, so that the table can be read by Record without taking a lock.
+func (aggregator *Aggregator) addPeer(key uint32) *peerCounters {
+	aggregator.tablesMux.Lock()
+	defer aggregator.tablesMux.Unlock()
 
-		metrics.Queues[metric.Queue] = queueMetrics
+	peers := aggregator.peers.Load().(map[uint32]*peerCounters)
+	if peer, ok := peers[key]; ok {
+		return peer
 	}
 
-	if metric.PrivateIP == "" {
+	updated := make(map[uint32]*peerCounters, len(peers)+1)
+	for k, v := range peers {
+		updated[k] = v
+	}
+
+	peer := &peerCounters{}
+	updated[key] = peer
+	aggregator.peers.Store(updated)
+	return peer
+}
+
+// Forget removes the counters of the peer with the private ip, which no longer appears in the exported statistics until it is seen again.
+func (aggregator *Aggregator) Forget(ip net.IP) {
+	ip = ip.To4()
+	if ip == nil {
 		return
 	}
+	key := binary.BigEndian.Uint32(ip)
 
-	if linkMetrics, ok := metrics.Links[metric.PrivateIP]; ok {
-		handleMetric(linkMetrics, metric)
-	} else {
-		linkMetrics = &Metrics{}
-		handleMetric(linkMetrics, metric)
+	aggregator.tablesMux.Lock()
+	defer aggregator.tablesMux.Unlock()
 
-		metrics.Links[metric.PrivateIP] = linkMetrics
+	peers := aggregator.peers.Load().(map[uint32]*peerCounters)
+	if _, ok := peers[key]; !ok {
+		return
 	}
+
+	updated := make(map[uint32]*peerCounters, len(peers))
+	for k, v := range peers {
+		if k != key {
+			updated[k] = v
+		}
+	}
+	aggregator.peers.Store(updated)
 }
 
-// Start aggregating and serving requests for statistics data.
-func (aggregator *Aggregator) Start() {
+// Start forgetting the counters of each peer once its mapping is deleted from the datastore, so that the peer table only tracks the peers in the quantum network.
+func (aggregator *Aggregator) Start(bus *event.Bus) {
+	aggregator.sub = bus.Subscribe(event.MappingDeleted)
 	go func() {
-	loop:
+		defer close(aggregator.done)
+
 		for {
 			select {
 			case <-aggregator.stop:
-				break loop
-			case metric := <-aggregator.Metrics:
-				aggregator.pipeline(metric)
+				return
+			case deleted := <-aggregator.sub.Events():
+				aggregator.Forget(deleted.PrivateIP)
 			}
 		}
-		close(aggregator.stop)
-		close(aggregator.Metrics)
 	}()
 }
 
-// Stop aggregating and receiving requests for statistics data.
+// Stop forgetting the counters of deleted peers, the counters themselves are kept.
 func (aggregator *Aggregator) Stop() {
-	aggregator.stop <- struct{}{}
+	if aggregator.sub == nil {
+		return
+	}
+
+	aggregator.sub.Close()
+	close(aggregator.stop)
+	<-aggregator.done
+	aggregator.sub = nil
+}
+
+// Counter registers a named function which is called to report a monotonically incrementing value every time the statistics data is exported.
+func (aggregator *Aggregator) Counter(name string, counter func() uint64) {
+	aggregator.valuesMux.Lock()
+	defer aggregator.valuesMux.Unlock()
+
+	aggregator.counters[name] = counter
 }
 
-// Bytes returns a byte slice json representation of the underlying MetricsLog struct in either flat or prettified notation, if there is an error while marshalling data a nil slice is returned.
+// Gauge registers a named function which is called to report a point in time value every time the statistics data is exported.
+func (aggregator *Aggregator) Gauge(name string, gauge func() uint64) {
+	aggregator.valuesMux.Lock()
+	defer aggregator.valuesMux.Unlock()
+
+	aggregator.gauges[name] = gauge
+}
+
+func (aggregator *Aggregator) readValues(funcs map[string]func() uint64) map[string]uint64 {
+	aggregator.valuesMux.Lock()
+	defer aggregator.valuesMux.Unlock()
+
+	if len(funcs) == 0 {
+		return nil
+	}
+
+	values := make(map[string]uint64, len(funcs))
+	for name, value := range funcs {
+		values[name] = value()
+	}
+	return values
+}
+
+func (aggregator *Aggregator) snapshot(direction int) *Metrics {
+	metrics := &Metrics{
+		Links:  make(map[string]*Metrics),
+		Queues: make(map[int]*Metrics),
+	}
+
+	queues := aggregator.queues[direction].Load().([]*counters)
+	for i := 0; i < len(queues); i++ {
+		queueMetrics := queues[i].snapshot()
+		if queueMetrics.Packets == 0 && queueMetrics.DroppedPackets == 0 {
+			continue
+		}
+
+		metrics.Packets += queueMetrics.Packets
+		metrics.Bytes += queueMetrics.Bytes
+		metrics.DroppedPackets += queueMetrics.DroppedPackets
+		metrics.DroppedBytes += queueMetrics.DroppedBytes
+		for reason, count := range queueMetrics.DroppedReasons {
+			if metrics.DroppedReasons == nil {
+				metrics.DroppedReasons = make(map[string]uint64)
+			}
+			metrics.DroppedReasons[reason] += count
+		}
+		metrics.Queues[i] = queueMetrics
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	for key, peer := range aggregator.peers.Load().(map[uint32]*peerCounters) {
+		linkMetrics := peer[direction].snapshot()
+		if linkMetrics.Packets == 0 && linkMetrics.DroppedPackets == 0 {
+			continue
+		}
+
+		binary.BigEndian.PutUint32(ip, key)
+		metrics.Links[ip.String()] = linkMetrics
+	}
+
+	return metrics
+}
+
+// Bytes returns a byte slice json representation of a snapshot of the current statistics in either flat or prettified notation, if there is an error while marshalling data a nil slice is returned.
 func (aggregator *Aggregator) Bytes(pretty bool) []byte {
-	return aggregator.metricsLog.Bytes(pretty)
+	return aggregator.MetricsLog().Bytes(pretty)
+}
+
+// MetricsLog returns a snapshot of the current statistics.
+func (aggregator *Aggregator) MetricsLog() *MetricsLog {
+	return &MetricsLog{
+		TxMetrics: aggregator.snapshot(Tx),
+		RxMetrics: aggregator.snapshot(Rx),
+		Counters:  aggregator.readValues(aggregator.counters),
+		Gauges:    aggregator.readValues(aggregator.gauges),
+	}
+}
+
+// Restore adds the packet and byte counts from a snapshot taken by the previous process during a rolling restart, so that the exported statistics carry on from where it left off. The counts of queues the aggregator does not have are added to the queue with the same index modulo the number of queues, and the counters and gauges reported by other components are left as is.
+func (aggregator *Aggregator) Restore(metricsLog *MetricsLog) {
+	var snapshots [2]*Metrics
+	snapshots[Tx], snapshots[Rx] = metricsLog.TxMetrics, metricsLog.RxMetrics
+
+	for direction, metrics := range snapshots {
+		if metrics == nil {
+			continue
+		}
+
+		queues := aggregator.queues[direction].Load().([]*counters)
+		for queue, queueMetrics := range metrics.Queues {
+			if len(queues) > 0 && queue >= 0 {
+				queues[queue%len(queues)].restore(queueMetrics)
+			}
+		}
+
+		for link, linkMetrics := range metrics.Links {
+			ip := net.ParseIP(link).To4()
+			if ip == nil {
+				continue
+			}
+
+			peer := aggregator.addPeer(binary.BigEndian.Uint32(ip))
+			peer[direction].restore(linkMetrics)
+		}
+	}
 }
 
 // New generates an Aggregator instance for aggregating statistics data for quantum.
 func New(cfg *common.Config) *Aggregator {
-	return &Aggregator{
-		cfg:        cfg,
-		stop:       make(chan struct{}),
-		metricsLog: newMetricsLog(cfg.NumWorkers),
-		Metrics:    make(chan *Metric, metricsBackLog),
+	aggregator := &Aggregator{
+		cfg:      cfg,
+		counters: make(map[string]func() uint64),
+		gauges:   make(map[string]func() uint64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 	}
+
+	aggregator.queues[Rx].Store(make([]*counters, 0))
+	aggregator.queues[Tx].Store(make([]*counters, 0))
+	aggregator.addQueues(Rx, cfg.NumWorkers)
+	aggregator.addQueues(Tx, cfg.NumWorkers)
+	aggregator.peers.Store(make(map[uint32]*peerCounters))
+
+	return aggregator
 }
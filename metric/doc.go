@@ -11,7 +11,10 @@ The currently collected metrics are as follows:
     - Dropped Packets
     - Bytes
     - Dropped Bytes
+    - Dropped Packets per drop reason, such as 'unknownDestination' or 'authentication'
 
 The metrics are split out based on the queue and the link that handled the transmission, as well as generally over all queues/links. Where a link represents the remote peer involved in the transmission, and a queue represents the internal packet queue.
+
+Each queue owns a cache line padded set of atomic counters, and the peers share a copy on write table of atomic counters, so the workers never block or contend on a lock when recording a packet. The counters are only summed up into a MetricsLog when a snapshot is requested, for instance by the rest api.
 */
 package metric
@@ -0,0 +1,75 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package metric
+
+// DropReason represents why a packet was dropped by quantum.
+type DropReason int
+
+const (
+	// NotDropped means the packet was successfully handled.
+	NotDropped DropReason = iota
+
+	// SocketReadError means the packet could not be read off of the socket.
+	SocketReadError
+
+	// SocketWriteError means the packet could not be written to the socket.
+	SocketWriteError
+
+	// DeviceReadError means the packet could not be read off of the network device.
+	DeviceReadError
+
+	// DeviceWriteError means the packet could not be written to the network device.
+	DeviceWriteError
+
+	// UnknownDestination means there is no mapping for the private ip the packet is addressed to, or was sent from.
+	UnknownDestination
+
+	// PacketTooBig means the packet was larger than the path MTU to the remote peer and could not be fragmented.
+	PacketTooBig
+
+	// CompressionEncodeError means the packet could not be compressed.
+	CompressionEncodeError
+
+	// CompressionDecodeError means the packet could not be decompressed.
+	CompressionDecodeError
+
+	// EncryptionError means the packet could not be encrypted.
+	EncryptionError
+
+	// AuthenticationError means the packet could not be decrypted, either because it was tampered with or because it was encrypted with a different key.
+	AuthenticationError
+
+	// PluginError means a plugin dropped the packet without a more specific reason.
+	PluginError
+
+	numDropReasons = iota
+)
+
+var dropReasonNames = [numDropReasons]string{
+	NotDropped:             "notDropped",
+	SocketReadError:        "socketRead",
+	SocketWriteError:       "socketWrite",
+	DeviceReadError:        "deviceRead",
+	DeviceWriteError:       "deviceWrite",
+	UnknownDestination:     "unknownDestination",
+	PacketTooBig:           "packetTooBig",
+	CompressionEncodeError: "compressionEncode",
+	CompressionDecodeError: "compressionDecode",
+	EncryptionError:        "encryption",
+	AuthenticationError:    "authentication",
+	PluginError:            "plugin",
+}
+
+// Dropped returns true if the reason represents a dropped packet.
+func (reason DropReason) Dropped() bool {
+	return reason != NotDropped
+}
+
+// String returns the name of the drop reason as it appears in the exported statistics.
+func (reason DropReason) String() string {
+	if reason < 0 || reason >= numDropReasons {
+		return "unknown"
+	}
+	return dropReasonNames[reason]
+}
@@ -5,6 +5,7 @@ package metric
 
 import (
 	"encoding/json"
+	"sync/atomic"
 )
 
 const (
@@ -15,23 +16,10 @@ const (
 	Tx
 )
 
-// Metric is used to represent a single incoming or outgoing packet's metric.
-type Metric struct {
-	// The remote private ip associated with the packet.
-	PrivateIP string
-
-	// The queue handling the packet.
-	Queue int
-
-	// The size of the packet in bytes.
-	Bytes uint64
-
-	// The type of the packet, either Rx or Tx.
-	Type int
-
-	// Whether or not the packet was dropped.
-	Dropped bool
-}
+const (
+	// The size of a cpu cache line, counters are padded out to this size so that counters updated by different workers never share a cache line.
+	cacheLineSize = 64
+)
 
 // Metrics struct for storing aggregated incoming or outgoing statistics.
 type Metrics struct {
@@ -47,6 +35,9 @@ type Metrics struct {
 	// The number of bytes successfully handled by quantum.
 	Bytes uint64 `json:"bytes"`
 
+	// The number of packets quantum has dropped broken down by the reason they were dropped.
+	DroppedReasons map[string]uint64 `json:"droppedReasons,omitempty"`
+
 	// The stats for individual links that represent the network traffic of this node in relation to remote nodes.
 	Links map[string]*Metrics `json:"links,omitempty"`
 
@@ -61,6 +52,12 @@ type MetricsLog struct {
 
 	// RxMetrics holds the packet and byte counts for packet reception.
 	RxMetrics *Metrics `json:"rx"`
+
+	// Counters holds monotonically incrementing values reported by other components of quantum, such as the number of datastore sync errors.
+	Counters map[string]uint64 `json:"counters,omitempty"`
+
+	// Gauges holds point in time values reported by other components of quantum, such as the size of the NAT translation table.
+	Gauges map[string]uint64 `json:"gauges,omitempty"`
 }
 
 // Bytes returns a byte slice json representation of the MetricsLog struct in either flat or prettified notation, if there is an error while marshalling data a nil slice is returned.
@@ -74,17 +71,59 @@ func (metricsLog *MetricsLog) Bytes(pretty bool) []byte {
 	return data
 }
 
-func newMetricsLog(numWorkers int) *MetricsLog {
-	metricsLog := &MetricsLog{
-		TxMetrics: &Metrics{
-			Links:  make(map[string]*Metrics),
-			Queues: make(map[int]*Metrics),
-		},
-		RxMetrics: &Metrics{
-			Links:  make(map[string]*Metrics),
-			Queues: make(map[int]*Metrics),
-		},
+// counters holds the raw packet and byte counts for a single queue or peer, which are updated atomically.
+type counters struct {
+	packets        uint64
+	bytes          uint64
+	droppedPackets uint64
+	droppedBytes   uint64
+	reasons        [numDropReasons]uint64
+	_              [cacheLineSize - (4+numDropReasons)*8%cacheLineSize]byte
+}
+
+// peerCounters holds the counters for a single remote peer indexed by direction, either Rx or Tx.
+type peerCounters [2]counters
+
+func (c *counters) add(reason DropReason, bytes uint64) {
+	if reason.Dropped() {
+		atomic.AddUint64(&c.droppedPackets, 1)
+		atomic.AddUint64(&c.droppedBytes, bytes)
+		atomic.AddUint64(&c.reasons[reason], 1)
+	} else {
+		atomic.AddUint64(&c.packets, 1)
+		atomic.AddUint64(&c.bytes, bytes)
+	}
+}
+
+func (c *counters) snapshot() *Metrics {
+	metrics := &Metrics{
+		DroppedPackets: atomic.LoadUint64(&c.droppedPackets),
+		Packets:        atomic.LoadUint64(&c.packets),
+		DroppedBytes:   atomic.LoadUint64(&c.droppedBytes),
+		Bytes:          atomic.LoadUint64(&c.bytes),
 	}
 
-	return metricsLog
+	for reason := NotDropped + 1; reason < numDropReasons; reason++ {
+		if count := atomic.LoadUint64(&c.reasons[reason]); count > 0 {
+			if metrics.DroppedReasons == nil {
+				metrics.DroppedReasons = make(map[string]uint64)
+			}
+			metrics.DroppedReasons[reason.String()] = count
+		}
+	}
+	return metrics
+}
+
+// restore adds the counts from a snapshot taken by another process to the counters.
+func (c *counters) restore(metrics *Metrics) {
+	atomic.AddUint64(&c.packets, metrics.Packets)
+	atomic.AddUint64(&c.bytes, metrics.Bytes)
+	atomic.AddUint64(&c.droppedPackets, metrics.DroppedPackets)
+	atomic.AddUint64(&c.droppedBytes, metrics.DroppedBytes)
+
+	for reason := NotDropped + 1; reason < numDropReasons; reason++ {
+		if count, ok := metrics.DroppedReasons[reason.String()]; ok {
+			atomic.AddUint64(&c.reasons[reason], count)
+		}
+	}
 }
@@ -4,47 +4,61 @@
 package metric
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
 )
 
-func TestAggregator(t *testing.T) {
-	cfg := &common.Config{
+var (
+	testCfg = &common.Config{
 		Log:        common.NewLogger(common.NoopLogger),
-		NumWorkers: 1,
+		NumWorkers: 4,
 	}
+	testMapping = &common.Mapping{PrivateIP: net.ParseIP("10.99.0.1")}
+)
 
-	aggregator := New(cfg)
+func TestAggregator(t *testing.T) {
+	aggregator := New(testCfg)
 
-	aggregator.Start()
+	aggregator.Record(Tx, 0, NotDropped, 20, testMapping)
+	aggregator.Record(Tx, 1, NotDropped, 20, testMapping)
+	aggregator.Record(Rx, 0, SocketReadError, 20, nil)
+	aggregator.Record(Rx, 0, NotDropped, 20, testMapping)
 
-	aggregator.Metrics <- &Metric{
-		Type:      Tx,
-		Dropped:   false,
-		PrivateIP: "10.99.0.1",
-		Bytes:     20,
+	// Negative queues are ignored rather than panicking the worker, while queues beyond the number of workers are added.
+	aggregator.Record(Rx, -1, NotDropped, 20, testMapping)
+	aggregator.Record(Rx, testCfg.NumWorkers, NotDropped, 20, testMapping)
+
+	metricsLog := aggregator.MetricsLog()
+	if metricsLog.TxMetrics.Packets != 2 || metricsLog.TxMetrics.Bytes != 40 {
+		t.Fatal("MetricsLog returned the wrong tx totals:", metricsLog.TxMetrics)
 	}
-	aggregator.Metrics <- &Metric{
-		Type:      Tx,
-		Dropped:   false,
-		PrivateIP: "10.99.0.1",
-		Bytes:     20,
+	if len(metricsLog.TxMetrics.Queues) != 2 || metricsLog.TxMetrics.Queues[1].Packets != 1 {
+		t.Fatal("MetricsLog returned the wrong tx queue metrics:", metricsLog.TxMetrics.Queues)
 	}
-	aggregator.Metrics <- &Metric{
-		Type:    Rx,
-		Dropped: true,
-		Bytes:   20,
+	if link := metricsLog.TxMetrics.Links["10.99.0.1"]; link == nil || link.Packets != 2 || link.Bytes != 40 {
+		t.Fatal("MetricsLog returned the wrong tx link metrics:", metricsLog.TxMetrics.Links)
 	}
-	aggregator.Metrics <- &Metric{
-		Type:      Rx,
-		Dropped:   false,
-		PrivateIP: "10.99.0.1",
-		Bytes:     20,
+	if metricsLog.RxMetrics.Packets != 2 || metricsLog.RxMetrics.DroppedPackets != 1 || metricsLog.RxMetrics.DroppedBytes != 20 {
+		t.Fatal("MetricsLog returned the wrong rx totals:", metricsLog.RxMetrics)
+	}
+	if metricsLog.RxMetrics.DroppedReasons[SocketReadError.String()] != 1 || metricsLog.RxMetrics.Queues[0].DroppedReasons["socketRead"] != 1 {
+		t.Fatal("MetricsLog returned the wrong rx drop reasons:", metricsLog.RxMetrics.DroppedReasons)
+	}
+	if metricsLog.TxMetrics.DroppedReasons != nil {
+		t.Fatal("MetricsLog returned drop reasons when nothing was dropped:", metricsLog.TxMetrics.DroppedReasons)
+	}
+	if queue := metricsLog.RxMetrics.Queues[testCfg.NumWorkers]; queue == nil || queue.Packets != 1 {
+		t.Fatal("MetricsLog did not include the queue added beyond the number of workers:", metricsLog.RxMetrics.Queues)
+	}
+	if link := metricsLog.RxMetrics.Links["10.99.0.1"]; link == nil || link.Packets != 2 || link.DroppedPackets != 0 {
+		t.Fatal("MetricsLog returned the wrong rx link metrics:", metricsLog.RxMetrics.Links)
 	}
-
-	time.Sleep(1 * time.Millisecond)
 
 	buf := aggregator.Bytes(true)
 	if buf == nil {
@@ -56,5 +70,228 @@ func TestAggregator(t *testing.T) {
 		t.Fatal("Bytes returned a nil slice when asking for a flattened version.")
 	}
 
-	aggregator.Stop()
+	aggregator.Gauge("test", func() uint64 { return 42 })
+	if metricsLog := aggregator.MetricsLog(); metricsLog.Gauges["test"] != 42 {
+		t.Fatal("MetricsLog did not include the registered gauge.")
+	}
+
+	aggregator.Counter("test", func() uint64 { return 7 })
+	if metricsLog := aggregator.MetricsLog(); metricsLog.Counters["test"] != 7 {
+		t.Fatal("MetricsLog did not include the registered counter.")
+	}
+}
+
+func TestAggregatorRestore(t *testing.T) {
+	previous := New(&common.Config{NumWorkers: 8})
+	previous.Record(Tx, 6, NotDropped, 20, testMapping)
+	previous.Record(Tx, 1, PacketTooBig, 30, testMapping)
+	previous.Record(Rx, 0, NotDropped, 20, nil)
+
+	aggregator := New(testCfg)
+	aggregator.Record(Tx, 2, NotDropped, 10, testMapping)
+	aggregator.Restore(previous.MetricsLog())
+
+	metrics := aggregator.MetricsLog()
+	if metrics.TxMetrics.Packets != 2 || metrics.TxMetrics.Bytes != 30 || metrics.TxMetrics.DroppedReasons[PacketTooBig.String()] != 1 {
+		t.Fatal("Restore did not add the transmitted counts:", metrics.TxMetrics)
+	}
+	if queue := metrics.TxMetrics.Queues[2]; queue == nil || queue.Packets != 2 {
+		t.Fatal("Restore did not fold the queues beyond the number of workers into the existing queues:", metrics.TxMetrics.Queues)
+	}
+	if link := metrics.TxMetrics.Links["10.99.0.1"]; link == nil || link.Packets != 2 || link.DroppedPackets != 1 {
+		t.Fatal("Restore did not add the link counts:", metrics.TxMetrics.Links)
+	}
+	if metrics.RxMetrics.Packets != 1 || len(metrics.RxMetrics.Links) != 0 {
+		t.Fatal("Restore did not add the received counts:", metrics.RxMetrics)
+	}
+}
+
+func TestAggregatorForget(t *testing.T) {
+	aggregator := New(testCfg)
+	bus := event.NewBus()
+	aggregator.Start(bus)
+	defer aggregator.Stop()
+
+	other := &common.Mapping{PrivateIP: net.ParseIP("10.99.0.2")}
+	aggregator.Record(Tx, 0, NotDropped, 20, testMapping)
+	aggregator.Record(Tx, 0, NotDropped, 20, other)
+
+	bus.Publish(event.New(event.MappingDeleted, other.PrivateIP, nil))
+	for i := 0; i < 100; i++ {
+		if _, ok := aggregator.MetricsLog().TxMetrics.Links["10.99.0.2"]; !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	metrics := aggregator.MetricsLog()
+	if _, ok := metrics.TxMetrics.Links["10.99.0.2"]; ok {
+		t.Fatal("The aggregator did not forget the peer whose mapping was deleted:", metrics.TxMetrics.Links)
+	}
+	if _, ok := metrics.TxMetrics.Links["10.99.0.1"]; !ok || metrics.TxMetrics.Packets != 2 {
+		t.Fatal("The aggregator forgot more than the deleted peer:", metrics.TxMetrics)
+	}
+}
+
+func TestDropReason(t *testing.T) {
+	if NotDropped.Dropped() || !AuthenticationError.Dropped() {
+		t.Fatal("Dropped returned the wrong value.")
+	}
+	if AuthenticationError.String() != "authentication" || DropReason(-1).String() != "unknown" || DropReason(numDropReasons).String() != "unknown" {
+		t.Fatal("String returned the wrong name.")
+	}
+	for reason := NotDropped; reason < numDropReasons; reason++ {
+		if reason.String() == "" {
+			t.Fatal("Drop reason is missing a name:", int(reason))
+		}
+	}
+}
+
+func TestAggregatorConcurrent(t *testing.T) {
+	aggregator := New(testCfg)
+
+	var wg sync.WaitGroup
+	for queue := 0; queue < testCfg.NumWorkers; queue++ {
+		wg.Add(1)
+		go func(queue int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				aggregator.Record(Tx, queue, NotDropped, 1, &common.Mapping{PrivateIP: net.IPv4(10, 99, 0, byte(i%10))})
+			}
+		}(queue)
+	}
+	wg.Wait()
+
+	metricsLog := aggregator.MetricsLog()
+	if metricsLog.TxMetrics.Packets != uint64(testCfg.NumWorkers*1000) {
+		t.Fatal("Concurrent records were lost:", metricsLog.TxMetrics.Packets)
+	}
+	if len(metricsLog.TxMetrics.Links) != 10 || metricsLog.TxMetrics.Links["10.99.0.9"].Packets != uint64(testCfg.NumWorkers*100) {
+		t.Fatal("Concurrent records were lost for a peer:", metricsLog.TxMetrics.Links)
+	}
+}
+
+func BenchmarkRecord(b *testing.B) {
+	aggregator := New(testCfg)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		aggregator.Record(Tx, 0, NotDropped, 1500, testMapping)
+	}
+}
+
+func BenchmarkRecordParallel(b *testing.B) {
+	aggregator := New(testCfg)
+
+	var next int32 = -1
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		queue := int(atomic.AddInt32(&next, 1)) % testCfg.NumWorkers
+		for pb.Next() {
+			aggregator.Record(Tx, queue, NotDropped, 1500, testMapping)
+		}
+	})
+}
+
+// channelMetric and channelAggregator replicate the previous design, where every packet allocated a metric which was sent over a channel to a single aggregating goroutine, for comparison.
+type channelMetric struct {
+	PrivateIP string
+	Queue     int
+	Bytes     uint64
+	Type      int
+	Dropped   bool
+}
+
+type channelAggregator struct {
+	metrics    chan *channelMetric
+	stop       chan struct{}
+	metricsLog *MetricsLog
+}
+
+func newChannelAggregator() *channelAggregator {
+	aggregator := &channelAggregator{
+		metrics: make(chan *channelMetric, 1000),
+		stop:    make(chan struct{}),
+		metricsLog: &MetricsLog{
+			TxMetrics: &Metrics{Links: make(map[string]*Metrics), Queues: make(map[int]*Metrics)},
+			RxMetrics: &Metrics{Links: make(map[string]*Metrics), Queues: make(map[int]*Metrics)},
+		},
+	}
+
+	go func() {
+		for {
+			select {
+			case <-aggregator.stop:
+				return
+			case metric := <-aggregator.metrics:
+				aggregator.pipeline(metric)
+			}
+		}
+	}()
+	return aggregator
+}
+
+func (aggregator *channelAggregator) pipeline(metric *channelMetric) {
+	metrics := aggregator.metricsLog.RxMetrics
+	if metric.Type == Tx {
+		metrics = aggregator.metricsLog.TxMetrics
+	}
+
+	handle := func(metrics *Metrics) {
+		if metric.Dropped {
+			metrics.DroppedBytes += metric.Bytes
+			metrics.DroppedPackets++
+		} else {
+			metrics.Bytes += metric.Bytes
+			metrics.Packets++
+		}
+	}
+
+	handle(metrics)
+
+	queueMetrics, ok := metrics.Queues[metric.Queue]
+	if !ok {
+		queueMetrics = &Metrics{}
+		metrics.Queues[metric.Queue] = queueMetrics
+	}
+	handle(queueMetrics)
+
+	if metric.PrivateIP == "" {
+		return
+	}
+
+	linkMetrics, ok := metrics.Links[metric.PrivateIP]
+	if !ok {
+		linkMetrics = &Metrics{}
+		metrics.Links[metric.PrivateIP] = linkMetrics
+	}
+	handle(linkMetrics)
+}
+
+func BenchmarkChannel(b *testing.B) {
+	aggregator := newChannelAggregator()
+	defer close(aggregator.stop)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		aggregator.metrics <- &channelMetric{Queue: 0, Type: Tx, Bytes: 1500, PrivateIP: testMapping.PrivateIP.String()}
+	}
+}
+
+func BenchmarkChannelParallel(b *testing.B) {
+	aggregator := newChannelAggregator()
+	defer close(aggregator.stop)
+
+	var next int32 = -1
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		queue := int(atomic.AddInt32(&next, 1)) % testCfg.NumWorkers
+		for pb.Next() {
+			aggregator.metrics <- &channelMetric{Queue: queue, Type: Tx, Bytes: 1500, PrivateIP: testMapping.PrivateIP.String()}
+		}
+	})
 }
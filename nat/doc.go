@@ -0,0 +1,14 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package nat contains the structs and logic to masquerade traffic from the quantum network on gateway nodes.
+
+Nodes started with '-f|--forward' route all of their traffic to their gateway node, which in turn needs to source NAT that traffic before it leaves the gateway for the wider network. When one or more egress interfaces are configured via '-mi|--masquerade-interfaces' quantum will:
+    - Enable ipv4 forwarding.
+    - Create a 'quantum' nftables table, via netlink, containing a nat postrouting chain which masquerades traffic from the quantum network leaving through the configured egress interfaces.
+    - Periodically count the connection tracking entries that have been translated, which is exported as the 'natTranslations' gauge by the metric package.
+
+The 'quantum' nftables table is removed when quantum shuts down, except when the process is replaced by a rolling restart, in which case the table and ipv4 forwarding are left to the new process. Note that masquerading requires the TUN device, as traffic handled by the netstack device never reaches the kernel.
+*/
+package nat
@@ -0,0 +1,224 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package nat
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/supernomad/quantum/common"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	tableName       = "quantum"
+	chainName       = "postrouting"
+	refreshInterval = 10 * time.Second
+
+	// The source address offset within an ipv4 header.
+	srcOffset = 12
+)
+
+var (
+	ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// Masquerade struct for source NATing traffic from the quantum network out of the configured egress interfaces.
+type Masquerade struct {
+	cfg          *common.Config
+	conn         *nftables.Conn
+	table        *nftables.Table
+	translations uint64
+	forwarding   []byte
+	started      bool
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// Translations returns the number of connections from the quantum network that are currently being translated, as of the last refresh.
+func (masq *Masquerade) Translations() uint64 {
+	return atomic.LoadUint64(&masq.translations)
+}
+
+// Start masquerading traffic out of the configured egress interfaces, this is a noop if no egress interfaces are configured.
+func (masq *Masquerade) Start() error {
+	if len(masq.cfg.MasqueradeInterfaces) == 0 {
+		return nil
+	}
+
+	if err := masq.enableForwarding(); err != nil {
+		return err
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		masq.restoreForwarding()
+		return errors.New("error connecting to nftables: " + err.Error())
+	}
+	masq.conn = conn
+
+	// Adding an existing table is a noop, so the table is flushed to remove any rules left behind by a previous instance of quantum.
+	masq.conn.AddTable(masq.table)
+	masq.conn.FlushTable(masq.table)
+
+	chain := masq.conn.AddChain(&nftables.Chain{
+		Name:     chainName,
+		Table:    masq.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	for i := 0; i < len(masq.cfg.MasqueradeInterfaces); i++ {
+		masq.conn.AddRule(&nftables.Rule{
+			Table: masq.table,
+			Chain: chain,
+			Exprs: masqueradeExprs(masq.cfg.NetworkConfig.IPNet, masq.cfg.MasqueradeInterfaces[i]),
+		})
+	}
+
+	if err := masq.conn.Flush(); err != nil {
+		masq.restoreForwarding()
+		return errors.New("error adding the nftables masquerade rules: " + err.Error())
+	}
+
+	masq.started = true
+	masq.refresh()
+
+	go func() {
+		defer close(masq.done)
+
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-masq.stop:
+				return
+			case <-ticker.C:
+				masq.refresh()
+			}
+		}
+	}()
+
+	masq.cfg.Log.Info("nat", "Masquerading traffic from the quantum network", "network", masq.cfg.NetworkConfig.IPNet.String(), "interfaces", strings.Join(masq.cfg.MasqueradeInterfaces, ","))
+	return nil
+}
+
+// Stop masquerading traffic, remove the 'quantum' nftables table, and restore ipv4 forwarding to its setting from before quantum started masquerading.
+func (masq *Masquerade) Stop() error {
+	if !masq.started {
+		return nil
+	}
+
+	masq.started = false
+	close(masq.stop)
+	<-masq.done
+
+	masq.conn.DelTable(masq.table)
+	if err := masq.conn.Flush(); err != nil {
+		masq.restoreForwarding()
+		return errors.New("error removing the nftables masquerade rules: " + err.Error())
+	}
+	return masq.restoreForwarding()
+}
+
+// Release stops counting translations once the new process of a rolling restart has taken over masquerading, leaving the 'quantum' nftables table and ipv4 forwarding in place for the new process.
+func (masq *Masquerade) Release() {
+	if !masq.started {
+		return
+	}
+
+	masq.started = false
+	close(masq.stop)
+	<-masq.done
+
+	masq.forwarding = nil
+}
+
+// enableForwarding turns on ipv4 forwarding, saving the previous setting so that it can be restored.
+func (masq *Masquerade) enableForwarding() error {
+	previous, err := ioutil.ReadFile(ipForwardPath)
+	if err != nil {
+		return errors.New("error reading the ipv4 forwarding setting: " + err.Error())
+	}
+
+	if err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return errors.New("error enabling ipv4 forwarding: " + err.Error())
+	}
+	masq.forwarding = previous
+	return nil
+}
+
+// restoreForwarding sets ipv4 forwarding back to the setting saved by enableForwarding.
+func (masq *Masquerade) restoreForwarding() error {
+	if masq.forwarding == nil {
+		return nil
+	}
+
+	previous := masq.forwarding
+	masq.forwarding = nil
+	if err := ioutil.WriteFile(ipForwardPath, previous, 0644); err != nil {
+		return errors.New("error restoring the ipv4 forwarding setting: " + err.Error())
+	}
+	return nil
+}
+
+func (masq *Masquerade) refresh() {
+	flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, syscall.AF_INET)
+	if err != nil {
+		masq.cfg.Log.Warn("nat", "Error listing the connection tracking table", "error", err)
+		return
+	}
+
+	atomic.StoreUint64(&masq.translations, countTranslations(masq.cfg.NetworkConfig.IPNet, flows))
+}
+
+// countTranslations returns the number of flows originating in the network whose reply is addressed to a different address, meaning the flow was source NATed.
+func countTranslations(network *net.IPNet, flows []*netlink.ConntrackFlow) uint64 {
+	var count uint64
+	for i := 0; i < len(flows); i++ {
+		if network.Contains(flows[i].Forward.SrcIP) && !network.Contains(flows[i].Reverse.DstIP) {
+			count++
+		}
+	}
+	return count
+}
+
+// masqueradeExprs returns the nftables expressions equivalent to 'ip saddr <network> oifname <iface> masquerade'.
+func masqueradeExprs(network *net.IPNet, iface string) []expr.Any {
+	ifname := make([]byte, syscall.IFNAMSIZ)
+	copy(ifname, iface)
+
+	mask := network.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[net.IPv6len-net.IPv4len:]
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: srcOffset, Len: net.IPv4len},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: net.IPv4len, Mask: mask, Xor: make([]byte, net.IPv4len)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: network.IP.To4()},
+		&expr.Masq{},
+	}
+}
+
+// New generates a Masquerade struct based on the passed in configuration, nothing is changed until Start is called.
+func New(cfg *common.Config) *Masquerade {
+	return &Masquerade{
+		cfg:   cfg,
+		table: &nftables.Table{Name: tableName, Family: nftables.TableFamilyIPv4},
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
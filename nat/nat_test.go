@@ -0,0 +1,131 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package nat
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/supernomad/quantum/common"
+	"github.com/vishvananda/netlink"
+)
+
+func testFlow(src, replyDst string) *netlink.ConntrackFlow {
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.SrcIP = net.ParseIP(src)
+	flow.Reverse.DstIP = net.ParseIP(replyDst)
+	return flow
+}
+
+func TestCountTranslations(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.99.0.0/16")
+
+	flows := []*netlink.ConntrackFlow{
+		testFlow("10.99.0.2", "203.0.113.1"),
+		testFlow("10.99.0.3", "203.0.113.1"),
+		testFlow("10.99.0.2", "10.99.0.2"),
+		testFlow("192.168.1.2", "192.168.1.2"),
+	}
+
+	if count := countTranslations(network, flows); count != 2 {
+		t.Fatalf("countTranslations returned %d instead of 2.", count)
+	}
+}
+
+func TestMasqueradeExprs(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.99.0.0/16")
+
+	exprs := masqueradeExprs(network, "eth0")
+	if len(exprs) != 6 {
+		t.Fatal("masqueradeExprs returned the wrong number of expressions.")
+	}
+
+	ifname := exprs[1].(*expr.Cmp).Data
+	if len(ifname) != 16 || string(ifname[:4]) != "eth0" || ifname[4] != 0 {
+		t.Fatal("masqueradeExprs returned an incorrectly padded interface name.")
+	}
+
+	if !net.IP(exprs[4].(*expr.Cmp).Data).Equal(net.ParseIP("10.99.0.0")) || !common.ArrayEquals(exprs[3].(*expr.Bitwise).Mask, []byte{255, 255, 0, 0}) {
+		t.Fatal("masqueradeExprs returned an incorrect source network match.")
+	}
+
+	if _, ok := exprs[5].(*expr.Masq); !ok {
+		t.Fatal("masqueradeExprs should end with a masquerade expression.")
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	masq := New(&common.Config{Log: common.NewLogger(common.NoopLogger)})
+
+	if err := masq.Start(); err != nil {
+		t.Fatalf("Start should be a noop without any egress interfaces, but returned an error: %s", err.Error())
+	}
+
+	if masq.Translations() != 0 {
+		t.Fatal("Translations should return 0 when not masquerading.")
+	}
+
+	if err := masq.Stop(); err != nil {
+		t.Fatalf("Stop returned an error: %s", err.Error())
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "quantum-nat")
+	defer os.RemoveAll(dir)
+
+	defer func(file string) { ipForwardPath = file }(ipForwardPath)
+	ipForwardPath = path.Join(dir, "ip_forward")
+	ioutil.WriteFile(ipForwardPath, []byte("0\n"), 0644)
+
+	masq := New(&common.Config{Log: common.NewLogger(common.NoopLogger)})
+	if err := masq.enableForwarding(); err != nil {
+		t.Fatalf("enableForwarding returned an error: %s", err.Error())
+	}
+
+	if buf, _ := ioutil.ReadFile(ipForwardPath); string(buf) != "1" {
+		t.Fatal("enableForwarding did not enable ipv4 forwarding.")
+	}
+
+	if err := masq.restoreForwarding(); err != nil {
+		t.Fatalf("restoreForwarding returned an error: %s", err.Error())
+	}
+
+	if buf, _ := ioutil.ReadFile(ipForwardPath); string(buf) != "0\n" {
+		t.Fatal("restoreForwarding did not restore the previous ipv4 forwarding setting.")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "quantum-nat")
+	defer os.RemoveAll(dir)
+
+	defer func(file string) { ipForwardPath = file }(ipForwardPath)
+	ipForwardPath = path.Join(dir, "ip_forward")
+	ioutil.WriteFile(ipForwardPath, []byte("0\n"), 0644)
+
+	masq := New(&common.Config{Log: common.NewLogger(common.NoopLogger)})
+	if err := masq.enableForwarding(); err != nil {
+		t.Fatalf("enableForwarding returned an error: %s", err.Error())
+	}
+
+	masq.started = true
+	go func() {
+		<-masq.stop
+		close(masq.done)
+	}()
+
+	masq.Release()
+	if err := masq.Stop(); err != nil {
+		t.Fatalf("Stop returned an error: %s", err.Error())
+	}
+
+	if buf, _ := ioutil.ReadFile(ipForwardPath); string(buf) != "1" {
+		t.Fatal("Release did not leave ipv4 forwarding to the new process.")
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package node contains the structs and logic to wire together and run a full quantum node in process. This is what the quantum binary itself runs, but it can equally be embedded within other go programs.
+
+A node is built from a *common.Config, which can either be parsed from the command line via common.NewConfig or constructed directly. The datastore, device, and socket types are all taken from the configuration, so that multiple nodes using the mock datastore, device, and socket can run side by side within a single process for testing:
+	cfg := &common.Config{
+		Datastore:     datastore.MOCKDatastore,
+		DeviceType:    device.MOCKDevice,
+		NumWorkers:    1,
+		PrivateIP:     net.ParseIP("10.99.0.1"),
+		NetworkConfig: networkCfg,
+	}
+
+	n, err := node.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := n.Start(ctx); err != nil {
+		return err
+	}
+	defer n.Stop()
+*/
+package node
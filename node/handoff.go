@@ -0,0 +1,102 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package node
+
+import (
+	"errors"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/handoff"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/socket"
+)
+
+// resumed holds the datastore and DTLS session state handed off by the previous process, which the node takes over when it is started.
+type resumed struct {
+	mappings   []*common.Mapping
+	synced     time.Time
+	ticketKeys []byte
+	sessions   map[string][]byte
+}
+
+// initStore initializes the datastore, taking over the mappings handed off by the previous process if there are any.
+func (n *Node) initStore() error {
+	if n.resume != nil {
+		return n.store.Resume(n.resume.mappings, n.resume.synced)
+	}
+	return n.store.Init()
+}
+
+// resumeSessions has the socket take over the DTLS sessions handed off by the previous process if there are any.
+func (n *Node) resumeSessions(sock socket.Socket) error {
+	if n.resume == nil || n.resume.ticketKeys == nil {
+		return nil
+	}
+
+	resumable, ok := sock.(socket.Resumable)
+	if !ok {
+		return nil
+	}
+	return resumable.Resume(n.resume.ticketKeys, n.resume.sessions)
+}
+
+// HandoffState returns the runtime state to hand off to the new process during a rolling restart.
+func (n *Node) HandoffState() *handoff.State {
+	mappings := n.store.Mappings()
+	running := n.cfg.Current()
+
+	state := &handoff.State{
+		PublicKey:     running.PublicKey,
+		PrivateKey:    running.PrivateKey,
+		PublicSalt:    running.PublicSalt,
+		PrivateSalt:   running.PrivateSalt,
+		PrivateIP:     n.cfg.PrivateIP,
+		NetworkConfig: n.cfg.NetworkConfig.String(),
+		Mappings:      make([]string, len(mappings)),
+		LastSync:      n.store.Stats().LastSync,
+	}
+	for i := 0; i < len(mappings); i++ {
+		state.Mappings[i] = mappings[i].String()
+	}
+
+	// Without the DTLS sessions the new process still starts, its sessions are just negotiated from scratch.
+	if resumable, ok := n.sock.(socket.Resumable); ok {
+		keys, sessions, err := resumable.Sessions()
+		if err != nil {
+			n.cfg.Log.Error("node", "Error retrieving the DTLS sessions to hand off", "error", err)
+		} else {
+			state.DTLSTicketKeys = keys
+			state.DTLSSessions = sessions
+		}
+	}
+	return state
+}
+
+// Resume has the node take over the runtime state handed off by the previous process when it is started, rather than initializing the datastore from scratch. The state must already have been applied to the configuration the node was created with, and Resume must be called before Start.
+func (n *Node) Resume(state *handoff.State) error {
+	mappings := make([]*common.Mapping, 0, len(state.Mappings))
+	for _, str := range state.Mappings {
+		mapping, err := common.ParseMapping(str, n.cfg)
+		if err != nil {
+			return errors.New("error parsing a mapping handed off by the previous process: " + err.Error())
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.started {
+		return errors.New("the quantum node has already been started")
+	}
+
+	n.resume = &resumed{mappings: mappings, synced: state.LastSync, ticketKeys: state.DTLSTicketKeys, sessions: state.DTLSSessions}
+	return nil
+}
+
+// RestoreMetrics adds the final packet and byte counts of the previous process to the metrics of the node.
+func (n *Node) RestoreMetrics(metrics *metric.MetricsLog) {
+	n.aggregator.Restore(metrics)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package node
+
+import (
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/rest"
+	"github.com/supernomad/quantum/socket"
+	"github.com/supernomad/quantum/worker"
+)
+
+const (
+	// stuckThreshold is how long a worker can spend handling a single packet before it is considered stuck.
+	stuckThreshold = 5 * time.Second
+
+	// staleSyncIntervals is the number of datastore sync intervals that can pass without a successful sync before the node is no longer ready.
+	staleSyncIntervals = 3
+)
+
+// fdsOpen returns whether or not every one of the file descriptors is still open.
+func fdsOpen(fds []int) bool {
+	for i := 0; i < len(fds); i++ {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fds[i]), syscall.F_GETFD, 0); errno != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Node) workerStates() []worker.State {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.incoming == nil || n.outgoing == nil {
+		return nil
+	}
+	return append(n.incoming.States(), n.outgoing.States()...)
+}
+
+// components returns whether or not the node is running, along with its network device and socket which are nil if the node has never been started, and closed once it has been stopped.
+func (n *Node) components() (bool, device.Device, socket.Socket) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	running := n.started
+	select {
+	case <-n.stopped:
+		running = false
+	default:
+	}
+	return running, n.dev, n.sock
+}
+
+func (n *Node) checkWorkers(states []worker.State) rest.Check {
+	check := rest.Check{Name: "workers", OK: len(states) == n.cfg.NumWorkers*2}
+	if !check.OK {
+		check.Detail = "the workers have not been started"
+		return check
+	}
+
+	running := 0
+	for i := 0; i < len(states); i++ {
+		if states[i].Running {
+			running++
+		}
+	}
+
+	check.OK = running == len(states)
+	check.Detail = strconv.Itoa(running) + " of " + strconv.Itoa(len(states)) + " workers running"
+	return check
+}
+
+// Liveness checks that every worker goroutine is running, and that none of them are stuck handling a single packet.
+func (n *Node) Liveness() []rest.Check {
+	states := n.workerStates()
+	workers := n.checkWorkers(states)
+
+	stuck := rest.Check{Name: "stuck", OK: true}
+	for i := 0; i < len(states); i++ {
+		if states[i].Busy > stuckThreshold {
+			stuck.OK = false
+			stuck.Detail = "the worker for queue " + strconv.Itoa(states[i].Queue) + " has been handling a single packet for " + states[i].Busy.Round(time.Millisecond).String()
+			break
+		}
+	}
+
+	return []rest.Check{workers, stuck}
+}
+
+// Readiness checks that the node is running and has not been drained, that the datastore has been initialized and is in sync, that the network device and socket queues are open, and that every worker is running.
+func (n *Node) Readiness() []rest.Check {
+	stats := n.store.Stats()
+	running, dev, sock := n.components()
+
+	nodeCheck := rest.Check{Name: "node", OK: running && !n.Draining()}
+	if !running {
+		nodeCheck.Detail = "the node is not running"
+	} else if !nodeCheck.OK {
+		nodeCheck.Detail = "the node has been drained"
+	}
+
+	storeCheck := rest.Check{Name: "datastore", OK: stats.Initialized}
+	if !storeCheck.OK {
+		storeCheck.Detail = "the datastore has not been initialized"
+	}
+
+	watchCheck := rest.Check{Name: "watch", OK: stats.Watching}
+	if !watchCheck.OK {
+		watchCheck.Detail = "the datastore is not being watched for changes"
+	}
+
+	syncCheck := rest.Check{Name: "sync", OK: !stats.LastSync.IsZero()}
+	if !syncCheck.OK {
+		syncCheck.Detail = "the datastore has never been synchronized"
+	} else {
+		since := time.Since(stats.LastSync)
+		syncCheck.Detail = "last synchronized " + since.Round(time.Second).String() + " ago"
+		if interval := n.cfg.Current().DatastoreSyncInterval; interval > 0 && since > staleSyncIntervals*interval {
+			syncCheck.OK = false
+		}
+	}
+
+	devCheck := rest.Check{Name: "device", OK: running && dev != nil && fdsOpen(dev.Queues())}
+	if !devCheck.OK {
+		devCheck.Detail = "the network device queues are not open"
+	}
+
+	sockCheck := rest.Check{Name: "socket", OK: running && sock != nil && fdsOpen(sock.Queues())}
+	if !sockCheck.OK {
+		sockCheck.Detail = "the socket queues are not open"
+	}
+
+	return []rest.Check{nodeCheck, storeCheck, watchCheck, syncCheck, devCheck, sockCheck, n.checkWorkers(n.workerStates())}
+}
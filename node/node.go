@@ -0,0 +1,475 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/supernomad/quantum/capture"
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/flow"
+	"github.com/supernomad/quantum/latency"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/nat"
+	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/pmtu"
+	"github.com/supernomad/quantum/rest"
+	"github.com/supernomad/quantum/router"
+	"github.com/supernomad/quantum/socket"
+	"github.com/supernomad/quantum/worker"
+)
+
+// Node struct which wires together and manages the lifecycle of all of the components that make up a quantum node.
+type Node struct {
+	cfg             *common.Config
+	store           datastore.Datastore
+	incomingPlugins []plugin.Plugin
+	outgoingPlugins []plugin.Plugin
+	aggregator      *metric.Aggregator
+	bus             *event.Bus
+	api             *rest.Rest
+	router          *router.Router
+	discovery       *pmtu.Discovery
+	monitor         *latency.Monitor
+	prober          *diag.Prober
+	tracker         *flow.Tracker
+	tap             *capture.Tap
+	masquerade      *nat.Masquerade
+	dev             device.Device
+	sock            socket.Socket
+	incoming        *worker.Incoming
+	outgoing        *worker.Outgoing
+
+	mux      sync.Mutex
+	resume   *resumed
+	started  bool
+	stopped  chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+	draining int32
+	reload   func() error
+}
+
+// Config returns the configuration the node is running with.
+func (n *Node) Config() *common.Config {
+	return n.cfg
+}
+
+// DeviceName returns the name of the underlying network device, or an empty string if the node has not been started.
+func (n *Node) DeviceName() string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.dev == nil {
+		return ""
+	}
+	return n.dev.Name()
+}
+
+// Queues returns the device queue file descriptors followed by the socket queue file descriptors, which are handed off to the new process during a rolling restart.
+func (n *Node) Queues() []int {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.dev == nil || n.sock == nil {
+		return nil
+	}
+
+	fds := make([]int, n.cfg.NumWorkers*2)
+	copy(fds[0:n.cfg.NumWorkers], n.dev.Queues())
+	copy(fds[n.cfg.NumWorkers:n.cfg.NumWorkers*2], n.sock.Queues())
+	return fds
+}
+
+// Peers returns the mappings of every node currently known to the datastore, sorted by private ip address.
+func (n *Node) Peers() []*common.Mapping {
+	peers := n.store.Mappings()
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(peers[i].PrivateIP.To16(), peers[j].PrivateIP.To16()) < 0
+	})
+	return peers
+}
+
+// Gateway returns the mapping of the node that traffic destined outside of the quantum network is routed to, if there is one.
+func (n *Node) Gateway() (*common.Mapping, bool) {
+	return n.router.Gateway()
+}
+
+// DatastoreStats returns the counters tracking the health of the synchronization with the backend datastore.
+func (n *Node) DatastoreStats() datastore.Stats {
+	return n.store.Stats()
+}
+
+// Metrics returns a snapshot of the transmission and reception statistics of the node.
+func (n *Node) Metrics() *metric.MetricsLog {
+	return n.aggregator.MetricsLog()
+}
+
+// Latency returns the latency matrix of the quantum network, as seen by the node.
+func (n *Node) Latency() *latency.Matrix {
+	return n.monitor.Matrix()
+}
+
+// Diagnose the overlay path to the target, which is either an ip address, the machine id of a node, or a hostname, by sending count probes to each quantum node along the path.
+func (n *Node) Diagnose(target string, count int) (*diag.Result, error) {
+	return n.prober.Diagnose(target, count)
+}
+
+// ReleaseFloatingIP gives up the local node's claim on the floating ip, so that another node configured with it can claim it.
+func (n *Node) ReleaseFloatingIP(ip net.IP) error {
+	n.cfg.Log.Info("node", "Releasing the floating ip.", "floating_ip", ip)
+	return n.store.ReleaseFloatingIP(ip)
+}
+
+// MoveFloatingIP hands the local node's claim on the floating ip to the target node, which is either the private ip or the machine id of another node configured with the floating ip.
+func (n *Node) MoveFloatingIP(ip net.IP, target string) error {
+	var node *common.Mapping
+	mappings := n.store.Mappings()
+	for i := 0; i < len(mappings); i++ {
+		if !mappings[i].Floating && (mappings[i].MachineID == target || mappings[i].PrivateIP.String() == target) {
+			node = mappings[i]
+			break
+		}
+	}
+
+	if node == nil {
+		return errors.New("the node '" + target + "' is not part of the quantum network")
+	}
+	if node.PrivateIP.Equal(n.cfg.PrivateIP) {
+		return errors.New("the floating ip cannot be moved to the local node")
+	}
+
+	n.cfg.Log.Info("node", "Moving the floating ip.", "floating_ip", ip, "target", node.PrivateIP)
+	return n.store.MoveFloatingIP(ip, node.PrivateIP)
+}
+
+// Drain gives up every floating ip claimed by the node and marks the node as not ready, so that traffic moves away from it ahead of maintenance. The node keeps passing traffic until it is stopped.
+func (n *Node) Drain() {
+	if atomic.SwapInt32(&n.draining, 1) == 1 {
+		return
+	}
+
+	n.cfg.Log.Info("node", "Draining the quantum node.")
+	n.store.Drain()
+}
+
+// Draining returns whether or not the node has been drained.
+func (n *Node) Draining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+// OnReload sets the function called to reload the quantum process when a reload is requested through the api, which is otherwise refused. The process embedding the node decides how the configuration is reloaded.
+func (n *Node) OnReload(reload func() error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	n.reload = reload
+}
+
+// Reload the quantum process by calling the function set with OnReload.
+func (n *Node) Reload() error {
+	n.mux.Lock()
+	reload := n.reload
+	n.mux.Unlock()
+
+	if reload == nil {
+		return errors.New("reloading is not supported by the process running the quantum node")
+	}
+	return reload()
+}
+
+// RotateKeys replaces the encryption keys with newly generated ones, which are written to the data directory and published in the local mapping so that every peer derives new encryption state for the node. Packets in flight while the peers pick up the new keys are dropped.
+func (n *Node) RotateKeys() error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if !n.started {
+		return errors.New("the quantum node has not been started")
+	}
+	running := n.cfg.Current()
+	if running.PrivateKey == nil {
+		return errors.New("the encryption plugin is not enabled")
+	}
+	if running.EncryptionKeyFile != "" {
+		return errors.New("the encryption keys are loaded from the key file '" + running.EncryptionKeyFile + "', replace the keys in the file and reload quantum instead")
+	}
+
+	_, priv := crypto.GenerateECKeyPair()
+	_, salt := crypto.GenerateECKeyPair()
+	if err := n.cfg.UseKeys(priv, salt); err != nil {
+		return err
+	}
+
+	n.cfg.Log.Info("node", "Rotated the encryption keys.")
+	return n.store.Reload()
+}
+
+// Start initializes the datastore, or takes over the state handed off by the previous process, creates the network device and socket, and starts the workers along with the background routines.
+//
+// The node will be stopped automatically once the supplied context is done.
+func (n *Node) Start(ctx context.Context) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.started {
+		return errors.New("the quantum node has already been started")
+	}
+
+	if err := n.initStore(); err != nil {
+		return err
+	}
+
+	// Everything started so far is stopped again, in the reverse order it was started, if a later step fails.
+	var undo []func()
+	unwind := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	undo = append(undo, n.store.Stop)
+
+	deviceType := n.cfg.DeviceType
+	if deviceType == "" {
+		deviceType = device.TUNDevice
+	}
+
+	dev, err := device.New(deviceType, n.cfg)
+	if err != nil {
+		unwind()
+		return err
+	}
+	undo = append(undo, func() { dev.Close() })
+
+	sock, err := socket.New(n.cfg.NetworkConfig.Backend, n.cfg)
+	if err != nil {
+		unwind()
+		return err
+	}
+	undo = append(undo, func() { sock.Close() })
+
+	if err := n.resumeSessions(sock); err != nil {
+		unwind()
+		return err
+	}
+
+	deps := &worker.Deps{
+		Aggregator: n.aggregator,
+		Router:     n.router,
+		Discovery:  n.discovery,
+		Monitor:    n.monitor,
+		Prober:     n.prober,
+		Tracker:    n.tracker,
+		Tap:        n.tap,
+		Device:     dev,
+		Socket:     sock,
+	}
+
+	if err := n.discovery.Start(); err != nil {
+		unwind()
+		return err
+	}
+	undo = append(undo, n.discovery.Stop)
+
+	if err := n.masquerade.Start(); err != nil {
+		unwind()
+		return err
+	}
+	undo = append(undo, func() { n.masquerade.Stop() })
+
+	if err := n.monitor.Start(sock); err != nil {
+		unwind()
+		return err
+	}
+	undo = append(undo, n.monitor.Stop)
+
+	if err := n.tracker.Start(); err != nil {
+		unwind()
+		return err
+	}
+
+	n.dev = dev
+	n.sock = sock
+	n.outgoing = worker.NewOutgoing(n.cfg, deps, n.outgoingPlugins)
+	n.incoming = worker.NewIncoming(n.cfg, deps, n.incomingPlugins)
+
+	n.prober.Start(n.sock)
+	n.aggregator.Start(n.bus)
+	n.api.Start()
+	n.store.Start()
+
+	for i := 0; i < n.cfg.NumWorkers; i++ {
+		n.incoming.Start(i)
+		n.outgoing.Start(i)
+	}
+
+	n.started = true
+	n.notifyReady()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := n.Stop(); err != nil {
+				n.cfg.Log.Error("node", "Error stopping the quantum node", "error", err)
+			}
+		case <-n.stopped:
+		}
+	}()
+
+	return nil
+}
+
+// Stop the workers and background routines, and close the network device and socket. Calling Stop more than once is a noop that returns the original result.
+func (n *Node) Stop() error {
+	return n.stop(false)
+}
+
+// HandOff stops the node once the new process of a rolling restart has reported ready, leaving the kernel state shared with the new process in place. The 'quantum' nftables table, ipv4 forwarding, and the default route are only torn down by the process that stops without handing off.
+func (n *Node) HandOff() error {
+	return n.stop(true)
+}
+
+func (n *Node) stop(handedOff bool) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if !n.started {
+		return errors.New("the quantum node has not been started")
+	}
+
+	n.stopOnce.Do(func() {
+		defer close(n.stopped)
+
+		// Both directions drain at the same time, before the network device and socket they write to are closed.
+		var workers sync.WaitGroup
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			n.incoming.Stop()
+		}()
+		go func() {
+			defer workers.Done()
+			n.outgoing.Stop()
+		}()
+		workers.Wait()
+
+		n.discovery.Stop()
+		n.monitor.Stop()
+		n.prober.Stop()
+
+		if err := n.tracker.Stop(); err != nil {
+			n.cfg.Log.Error("node", "Error stopping the flow exporter", "error", err)
+		}
+
+		if handedOff {
+			n.masquerade.Release()
+		} else if err := n.masquerade.Stop(); err != nil {
+			n.cfg.Log.Error("node", "Error stopping the masquerade", "error", err)
+		}
+
+		n.api.Stop()
+		n.store.Stop()
+		n.aggregator.Stop()
+
+		if err := n.sock.Close(); err != nil {
+			n.stopErr = err
+			return
+		}
+
+		if handedOff {
+			n.stopErr = n.dev.Release()
+			return
+		}
+		n.stopErr = n.dev.Close()
+	})
+
+	return n.stopErr
+}
+
+// newPlugins creates the named plugins, returning them in the order they are applied to incoming packets and to outgoing packets.
+func newPlugins(names []string, cfg *common.Config) ([]plugin.Plugin, []plugin.Plugin, error) {
+	incomingPlugins := make([]plugin.Plugin, len(names))
+	outgoingPlugins := make([]plugin.Plugin, len(names))
+	for i := 0; i < len(names); i++ {
+		plugin, err := plugin.New(names[i], cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		outgoingPlugins[i] = plugin
+		incomingPlugins[i] = plugin
+	}
+
+	sort.Sort(plugin.Sorter{Plugins: outgoingPlugins})
+	sort.Sort(sort.Reverse(plugin.Sorter{Plugins: incomingPlugins}))
+	return incomingPlugins, outgoingPlugins, nil
+}
+
+// New generates a Node based on the supplied configuration, creating the datastore and plugins. Nothing is started until Start is called.
+func New(cfg *common.Config) (*Node, error) {
+	if cfg.Log == nil {
+		cfg.Log = common.NewLogger(common.NoopLogger)
+	}
+
+	if cfg.MaxPacketLength == 0 {
+		cfg.MaxPacketLength, cfg.MTU = common.MaxPacketLength, common.MTU
+	}
+
+	bus := event.NewBus()
+	store, err := datastore.New(cfg.Datastore, cfg, bus)
+	if err != nil {
+		return nil, err
+	}
+
+	incomingPlugins, outgoingPlugins, err := newPlugins(cfg.Plugins, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregator := metric.New(cfg)
+	rt := router.New(cfg, store)
+	discovery := pmtu.New(cfg, store)
+	monitor := latency.New(cfg, store, bus)
+	tap := capture.New(cfg)
+	aggregator.Counter("datastoreSyncErrors", func() uint64 { return store.Stats().SyncErrors })
+	aggregator.Counter("datastoreWatchErrors", func() uint64 { return store.Stats().WatchErrors })
+	aggregator.Gauge("mappings", func() uint64 { return uint64(len(store.Mappings())) })
+
+	masquerade := nat.New(cfg)
+	if len(cfg.MasqueradeInterfaces) > 0 {
+		aggregator.Gauge("natTranslations", masquerade.Translations)
+	}
+
+	n := &Node{
+		cfg:             cfg,
+		store:           store,
+		incomingPlugins: incomingPlugins,
+		outgoingPlugins: outgoingPlugins,
+		aggregator:      aggregator,
+		bus:             bus,
+		router:          rt,
+		discovery:       discovery,
+		monitor:         monitor,
+		prober:          diag.New(cfg, store, rt, discovery),
+		tracker:         flow.New(cfg),
+		tap:             tap,
+		masquerade:      masquerade,
+		stopped:         make(chan struct{}),
+	}
+	n.api, err = rest.New(cfg, n, aggregator, monitor, tap, bus)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
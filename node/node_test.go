@@ -0,0 +1,469 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/socket"
+	"github.com/supernomad/quantum/systemd"
+)
+
+func testConfig(privateIP string, statsPort int) *common.Config {
+	base, ipnet, _ := net.ParseCIDR("10.99.0.0/16")
+
+	return &common.Config{
+		Log:          common.NewLogger(common.NoopLogger),
+		Datastore:    datastore.MOCKDatastore,
+		DeviceType:   device.MOCKDevice,
+		NumWorkers:   1,
+		PrivateIP:    net.ParseIP(privateIP),
+		StatsRoute:   "/stats",
+		StatsAddress: "127.0.0.1",
+		StatsPort:    statsPort,
+		NetworkConfig: &common.NetworkConfig{
+			Backend: socket.MOCKSocket,
+			BaseIP:  base,
+			IPNet:   ipnet,
+		},
+	}
+}
+
+func TestNode(t *testing.T) {
+	first, err := New(testConfig("10.99.0.1", 1100))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	second, err := New(testConfig("10.99.0.2", 1101))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if err := first.Stop(); err == nil {
+		t.Fatal("Stop should have returned an error for a node that was never started.")
+	}
+
+	for _, check := range first.Readiness() {
+		if check.OK {
+			t.Fatal("A node that was never started passed the", check.Name, "check.")
+		}
+	}
+
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+
+	if err := first.Start(context.Background()); err == nil {
+		t.Fatal("Start should have returned an error for a node that was already started.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := second.Start(ctx); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if first.DeviceName() == "" {
+		t.Fatal("DeviceName returned an empty string for a started node.")
+	}
+
+	if len(first.Queues()) != 2 {
+		t.Fatal("Queues returned the wrong number of file descriptors.")
+	}
+
+	if peers := first.Peers(); len(peers) != 0 {
+		t.Fatal("Peers returned mappings when the mock datastore is empty.")
+	}
+
+	for _, check := range append(first.Readiness(), first.Liveness()...) {
+		if !check.OK {
+			t.Fatal("A started node failed the", check.Name, "check:", check.Detail)
+		}
+	}
+
+	if metrics := first.Metrics(); metrics == nil || metrics.TxMetrics == nil || metrics.RxMetrics == nil {
+		t.Fatal("Metrics returned an incomplete metrics log.")
+	}
+
+	cancel()
+
+	select {
+	case <-second.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Cancelling the context did not stop the node.")
+	}
+
+	if err := first.Stop(); err != nil {
+		t.Fatalf("Stop returned an error: %s", err.Error())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	for _, check := range first.Readiness() {
+		if check.OK && check.Name != "datastore" && check.Name != "sync" {
+			t.Fatal("A stopped node passed the", check.Name, "check.")
+		}
+	}
+
+	if err := first.Stop(); err != nil {
+		t.Fatalf("Stop should be safe to call more than once, but returned an error: %s", err.Error())
+	}
+}
+
+func TestMoveFloatingIP(t *testing.T) {
+	n, err := New(testConfig("10.99.0.1", 1110))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+	store := n.store.(*datastore.Mock)
+
+	floatingIP := net.ParseIP("10.99.100.1")
+	store.InternalMapping = &common.Mapping{MachineID: "remote", PrivateIP: net.ParseIP("10.99.0.2")}
+	if err := n.MoveFloatingIP(floatingIP, "remote"); err != nil {
+		t.Fatal("MoveFloatingIP returned an error for a node identified by its machine id:", err)
+	}
+	if err := n.MoveFloatingIP(floatingIP, "10.99.0.2"); err != nil {
+		t.Fatal("MoveFloatingIP returned an error for a node identified by its private ip:", err)
+	}
+	if err := n.MoveFloatingIP(floatingIP, "woot"); err == nil {
+		t.Fatal("MoveFloatingIP should have returned an error for a node that does not exist.")
+	}
+
+	store.InternalMapping = &common.Mapping{MachineID: "remote", PrivateIP: floatingIP, Floating: true}
+	if err := n.MoveFloatingIP(floatingIP, "remote"); err == nil {
+		t.Fatal("MoveFloatingIP should have returned an error for a floating mapping.")
+	}
+
+	store.InternalMapping = &common.Mapping{MachineID: "local", PrivateIP: net.ParseIP("10.99.0.1")}
+	if err := n.MoveFloatingIP(floatingIP, "local"); err == nil {
+		t.Fatal("MoveFloatingIP should have returned an error for the local node.")
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	cfg := testConfig("10.99.0.3", 1108)
+	cfg.NetworkConfig.Backend = "unknown"
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if err := n.Start(context.Background()); err == nil {
+		t.Fatal("Start should have returned an error for an unknown socket backend.")
+	}
+
+	if n.DeviceName() != "" || n.Queues() != nil {
+		t.Fatal("A node that failed to start kept its network device.")
+	}
+
+	if err := n.Stop(); err == nil {
+		t.Fatal("Stop should have returned an error for a node that failed to start.")
+	}
+
+	cfg.NetworkConfig.Backend = socket.MOCKSocket
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error after a failed start: %s", err.Error())
+	}
+	n.Stop()
+}
+
+func TestReload(t *testing.T) {
+	n, err := New(testConfig("10.99.0.3", 1109))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if err := n.Reload(); err == nil {
+		t.Fatal("Reload should have returned an error without a reload function.")
+	}
+
+	reloaded := false
+	n.OnReload(func() error {
+		reloaded = true
+		return nil
+	})
+	if err := n.Reload(); err != nil || !reloaded {
+		t.Fatal("Reload did not call the reload function:", err)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	n, err := New(testConfig("10.99.0.1", 1102))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if _, err := n.Reconfigure(testConfig("10.99.0.1", 1102)); err == nil {
+		t.Fatal("Reconfigure should have returned an error for a node that was never started.")
+	}
+
+	// The mock device and datastore route every packet to one of the internal mappings, which the plugins require.
+	mapping := &common.Mapping{PrivateIP: net.ParseIP("10.99.0.2")}
+	n.store.(*datastore.Mock).InternalMapping = mapping
+	n.store.(*datastore.Mock).InternalGatewayMapping = mapping
+
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	defer n.Stop()
+
+	if applied, err := n.Reconfigure(testConfig("10.99.0.1", 1102)); err != nil || !applied {
+		t.Fatal("Reconfigure should have applied an unchanged configuration:", err)
+	}
+
+	cfg := testConfig("10.99.0.1", 1103)
+	cfg.Plugins = []string{plugin.CompressionPlugin}
+	cfg.FloatingIPs = []net.IP{net.ParseIP("10.99.2.1")}
+	cfg.LogLevel, cfg.LogFormat = "error", "json"
+	if applied, err := n.Reconfigure(cfg); err != nil || !applied {
+		t.Fatal("Reconfigure did not apply the live changes:", err)
+	}
+	if running := n.cfg.Current(); running.StatsPort != 1103 || len(running.FloatingIPs) != 1 || len(n.incomingPlugins) != 1 || len(n.outgoingPlugins) != 1 {
+		t.Fatal("Reconfigure did not update the running configuration.")
+	}
+	if n.cfg.Log.Level() != common.ErrorLogger {
+		t.Fatal("Reconfigure did not change the log level.")
+	}
+	n.cfg.Log.SetLevel(common.NoopLogger)
+
+	// The api is restarted on the new port.
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get("http://127.0.0.1:1103/stats"); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("The api was not restarted on the new port: %s", err.Error())
+	}
+
+	// Changes that cannot be applied leave the previous configuration running.
+	cfg = testConfig("10.99.0.1", 1103)
+	cfg.Plugins = []string{plugin.CompressionPlugin}
+	cfg.FloatingIPs = []net.IP{net.ParseIP("10.99.2.1")}
+	cfg.LogLevel, cfg.LogFormat = "warn", "json"
+	cfg.StatsTLSCert, cfg.StatsTLSKey = "/missing.crt", "/missing.key"
+	if _, err := n.Reconfigure(cfg); err == nil {
+		t.Fatal("Reconfigure should have returned an error for an api that cannot be created.")
+	}
+	if running := n.cfg.Current(); running.StatsTLSCert != "" || running.LogLevel != "error" {
+		t.Fatal("Reconfigure published the configuration of an api that cannot be created.")
+	}
+
+	cfg = testConfig("10.99.0.1", 1103)
+	cfg.Plugins = []string{plugin.CompressionPlugin}
+	cfg.FloatingIPs = []net.IP{net.ParseIP("10.99.2.2")}
+	cfg.PrivateKey, cfg.PrivateSalt = []byte("woot"), []byte("woot")
+	if _, err := n.Reconfigure(cfg); err == nil {
+		t.Fatal("Reconfigure should have returned an error for invalid encryption keys.")
+	}
+	if running := n.cfg.Current(); !running.FloatingIPs[0].Equal(net.ParseIP("10.99.2.1")) || running.PrivateKey != nil {
+		t.Fatal("Reconfigure did not restore the previous configuration after failing part way through.")
+	}
+
+	cfg = testConfig("10.99.0.1", 1103)
+	cfg.ListenPort = 1200
+	if applied, err := n.Reconfigure(cfg); err != nil || applied {
+		t.Fatal("Reconfigure should have required a rolling restart to change the listen port:", err)
+	}
+	if running := n.cfg.Current(); running.ListenPort == 1200 || len(running.Plugins) != 1 {
+		t.Fatal("Reconfigure changed the running configuration when a rolling restart is required.")
+	}
+
+	cfg = testConfig("10.99.0.1", 1103)
+	cfg.Plugins = []string{"woot"}
+	if _, err := n.Reconfigure(cfg); err == nil {
+		t.Fatal("Reconfigure should have returned an error for an unsupported plugin.")
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig("10.99.0.1", 1107)
+	cfg.DataDir = dir
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if err := n.RotateKeys(); err == nil {
+		t.Fatal("RotateKeys should have returned an error for a node that was never started.")
+	}
+
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	defer n.Stop()
+
+	if err := n.RotateKeys(); err == nil {
+		t.Fatal("RotateKeys should have returned an error without the encryption plugin.")
+	}
+
+	_, priv := crypto.GenerateECKeyPair()
+	_, salt := crypto.GenerateECKeyPair()
+	if err := n.cfg.UseKeys(priv, salt); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RotateKeys(); err != nil {
+		t.Fatal("RotateKeys returned an error:", err)
+	}
+	if running := n.cfg.Current(); bytes.Equal(running.PrivateKey, priv) || bytes.Equal(running.PrivateSalt, salt) {
+		t.Fatal("RotateKeys did not replace the encryption keys.")
+	}
+	if _, err := os.Stat(path.Join(dir, common.KeysFileName)); err != nil {
+		t.Fatal("RotateKeys did not write the new encryption keys to the data directory:", err)
+	}
+
+	// Reloading picks up keys replaced outside of quantum, even though no option has changed.
+	cfg = testConfig("10.99.0.1", 1107)
+	cfg.DataDir = dir
+	if err := cfg.UseKeys(priv, salt); err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.Current()
+	if applied, err := n.Reconfigure(cfg); err != nil || !applied {
+		t.Fatal("Reconfigure did not apply the replaced encryption keys:", err)
+	}
+	if running := n.cfg.Current(); !bytes.Equal(running.PrivateKey, priv) || !bytes.Equal(running.PublicSalt, crypto.GenerateECPublicKey(salt)) {
+		t.Fatal("Reconfigure did not use the replaced encryption keys.")
+	}
+
+	cfg.PSK = []byte("PreSharedKey-32Characters1234567")
+	if applied, err := n.Reconfigure(cfg); err != nil || !applied || !bytes.Equal(n.cfg.Current().PSK, cfg.PSK) {
+		t.Fatal("Reconfigure did not apply the replaced pre-shared key:", err)
+	}
+
+	cfg.EncryptionKeyFile = path.Join(dir, "external")
+	n.cfg.Update(cfg, []string{"encryption-key-file"})
+	if err := n.RotateKeys(); err == nil {
+		t.Fatal("RotateKeys should have returned an error for keys loaded from a key file.")
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifications.Close()
+
+	os.Setenv(systemd.NotifySocketEnv, path.Join(dir, "notify"))
+	os.Setenv(systemd.WatchdogUsecEnv, "20000")
+	defer os.Unsetenv(systemd.NotifySocketEnv)
+	defer os.Unsetenv(systemd.WatchdogUsecEnv)
+
+	n, err := New(testConfig("10.99.0.1", 1104))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	defer n.Stop()
+
+	buf := make([]byte, 1024)
+	notifications.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{systemd.Ready, systemd.Watchdog} {
+		read, err := notifications.Read(buf)
+		if err != nil {
+			t.Fatalf("The node did not notify systemd: %s", err.Error())
+		}
+
+		states := strings.Split(string(buf[:read]), "\n")
+		if states[0] != expected || len(states) != 2 || !strings.HasPrefix(states[1], "STATUS=Running") {
+			t.Fatalf("The node notified systemd with '%s' instead of '%s' and its status.", buf[:read], expected)
+		}
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	running, err := New(testConfig("10.99.0.1", 1105))
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+	running.cfg.IsIPv4Enabled = true
+	running.store.(*datastore.Mock).InternalMapping = &common.Mapping{PrivateIP: net.ParseIP("10.99.0.2"), IPv4: net.ParseIP("192.168.1.2"), Port: 1099}
+
+	if err := running.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	running.aggregator.Record(metric.Tx, 0, metric.NotDropped, 20, nil)
+	running.sock.(*socket.Mock).Resume([]byte("keys"), map[string][]byte{"192.168.1.2": []byte("session")})
+
+	state := running.HandoffState()
+	if len(state.Mappings) != 1 || !state.PrivateIP.Equal(net.ParseIP("10.99.0.1")) || state.LastSync.IsZero() || string(state.DTLSTicketKeys) != "keys" || len(state.DTLSSessions) != 1 {
+		t.Fatal("HandoffState returned an incomplete state:", state)
+	}
+
+	cfg := testConfig("10.99.0.1", 1106)
+	cfg.IsIPv4Enabled = true
+	next, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New returned an error: %s", err.Error())
+	}
+
+	if err := next.Resume(state); err != nil {
+		t.Fatalf("Resume returned an error: %s", err.Error())
+	}
+	if len(next.resume.mappings) != 1 || !next.resume.mappings[0].PrivateIP.Equal(net.ParseIP("10.99.0.2")) {
+		t.Fatal("Resume did not parse the handed off mappings.")
+	}
+
+	if err := next.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	defer next.Stop()
+
+	if !next.DatastoreStats().Initialized {
+		t.Fatal("Start did not take over the handed off datastore state.")
+	}
+	if keys, sessions, _ := next.sock.(*socket.Mock).Sessions(); string(keys) != "keys" || string(sessions["192.168.1.2"]) != "session" {
+		t.Fatal("Start did not take over the handed off DTLS sessions.")
+	}
+	if err := next.Resume(state); err == nil {
+		t.Fatal("Resume should have returned an error for a node that was already started.")
+	}
+
+	if err := running.HandOff(); err != nil {
+		t.Fatalf("HandOff returned an error: %s", err.Error())
+	}
+	if err := running.Stop(); err != nil {
+		t.Fatalf("Stop after HandOff should return the original result, but returned an error: %s", err.Error())
+	}
+	next.RestoreMetrics(running.Metrics())
+	if metrics := next.Metrics(); metrics.TxMetrics.Packets < 1 {
+		t.Fatal("RestoreMetrics did not restore the metrics of the previous process.")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package node
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/rest"
+)
+
+var (
+	// apiOptions are the options which are applied in place by restarting the api.
+	apiOptions = []string{
+		"stats-route",
+		"metrics-route",
+		"latency-route",
+		"capture-route",
+		"events-route",
+		"health-route",
+		"ready-route",
+		"stats-address",
+		"stats-port",
+		"stats-tls-cert",
+		"stats-tls-key",
+		"stats-tls-ca-cert",
+		"stats-read-tokens",
+		"stats-admin-tokens",
+	}
+
+	// liveOptions are the options which can be applied in place, changing any other option requires a rolling restart.
+	liveOptions = append([]string{
+		"plugins",
+		"gateway",
+		"floating-ips",
+		"datastore-sync-interval",
+		"datastore-refresh-interval",
+		"datastore-floating-ip-ttl",
+		"log-level",
+		"log-format",
+		"drain-timeout",
+		"handoff-timeout",
+		"encryption-key-file",
+		"encryption-psk-file",
+	}, apiOptions...)
+)
+
+// changed returns whether or not any of the options are in the changes.
+func changed(changes []string, options ...string) bool {
+	for i := 0; i < len(options); i++ {
+		if common.StringInSlice(options[i], changes) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Reconfigure applies the changes between the running configuration and the supplied configuration without stopping the workers, returning whether or not the changes were applied.
+
+If any of the changed options can only be applied by restarting quantum nothing is changed and false is returned, in which case a rolling restart is required. An error is returned if the changes cannot be applied, in which case the previous running configuration is restored and whatever was applied is undone.
+*/
+func (n *Node) Reconfigure(cfg *common.Config) (bool, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if !n.started {
+		return false, errors.New("the quantum node has not been started")
+	}
+
+	previous := n.cfg.Current()
+
+	// The encryption keys and pre-shared key are loaded again, so keys replaced in their files are picked up even when no option has changed.
+	rekey := previous.PrivateKey != nil && cfg.PrivateKey != nil && (!bytes.Equal(previous.PrivateKey, cfg.PrivateKey) || !bytes.Equal(previous.PSK, cfg.PSK))
+
+	// Reloading restores the configured log level, undoing any change made through the api or with a signal.
+	changes := common.Diff(previous, cfg)
+	if len(changes) == 0 && !rekey {
+		n.cfg.Log.Configure(previous.LogLevel, previous.LogFormat)
+		n.cfg.Log.Info("node", "The configuration is unchanged.")
+		return true, nil
+	}
+
+	var restart []string
+	for _, option := range changes {
+		if !common.StringInSlice(option, liveOptions) {
+			restart = append(restart, option)
+		}
+	}
+	if len(restart) > 0 {
+		n.cfg.Log.Info("node", "The changed options require a rolling restart.", "options", strings.Join(restart, ","))
+		return false, nil
+	}
+
+	incomingPlugins, outgoingPlugins, err := newPlugins(cfg.Plugins, n.cfg)
+	if err != nil {
+		return false, err
+	}
+
+	n.cfg.Log.Info("node", "Applying the changed options in place.", "options", strings.Join(changes, ","), "new_keys", rekey)
+	n.cfg.Update(cfg, changes)
+
+	// The new api is created before anything is applied, so that an api that cannot be created leaves the node untouched. It only starts listening once every change has been applied.
+	var api *rest.Rest
+	if changed(changes, apiOptions...) {
+		if api, err = rest.New(n.cfg, n, n.aggregator, n.monitor, n.tap, n.bus); err != nil {
+			n.cfg.Restore(previous)
+			return false, err
+		}
+	}
+
+	if err := n.apply(cfg, changes, previous); err != nil {
+		n.rollback(changes, previous)
+		return false, err
+	}
+
+	// The plugins are only swapped once the mappings have been parsed again with any new encryption keys.
+	if changed(changes, "plugins") {
+		n.incomingPlugins, n.outgoingPlugins = incomingPlugins, outgoingPlugins
+		n.incoming.SetPlugins(incomingPlugins)
+		n.outgoing.SetPlugins(outgoingPlugins)
+	}
+
+	if api != nil {
+		n.api.Stop()
+		n.api = api
+		n.api.Start()
+	}
+
+	return true, nil
+}
+
+// apply carries out the changes which can fail part way through, once the new running configuration has been published.
+func (n *Node) apply(cfg *common.Config, changes []string, previous *common.Config) error {
+	running := n.cfg.Current()
+	if changed(changes, "log-level", "log-format") {
+		if err := n.cfg.Log.Configure(running.LogLevel, running.LogFormat); err != nil {
+			return err
+		}
+	}
+
+	// The encryption keys are only loaded when encryption is enabled, so the running keys are kept when it is disabled.
+	if cfg.PrivateKey != nil && !bytes.Equal(previous.PrivateKey, cfg.PrivateKey) {
+		if err := n.cfg.UseKeys(cfg.PrivateKey, cfg.PrivateSalt); err != nil {
+			return err
+		}
+	}
+	if cfg.PrivateKey != nil && !bytes.Equal(previous.PSK, cfg.PSK) {
+		n.cfg.UsePSK(cfg.PSK)
+	}
+
+	if changed(changes, "floating-ips") {
+		if err := n.dev.SetFloatingIPs(running.FloatingIPs); err != nil {
+			return err
+		}
+	}
+
+	return n.store.Reload()
+}
+
+// rollback restores the previous running configuration after applying the changes failed, undoing whatever was applied so that the node runs the configuration it ran before.
+func (n *Node) rollback(changes []string, previous *common.Config) {
+	n.cfg.Log.Warn("node", "Applying the changed options failed, restoring the previous configuration.", "options", strings.Join(changes, ","))
+	n.cfg.Restore(previous)
+
+	if changed(changes, "log-level", "log-format") {
+		n.cfg.Log.Configure(previous.LogLevel, previous.LogFormat)
+	}
+
+	if changed(changes, "floating-ips") {
+		if err := n.dev.SetFloatingIPs(previous.FloatingIPs); err != nil {
+			n.cfg.Log.Error("node", "Error restoring the previous floating ips on the network device", "error", err)
+		}
+	}
+
+	// The datastore picks the previous intervals, floating ips, and encryption keys up again.
+	if err := n.store.Reload(); err != nil {
+		n.cfg.Log.Error("node", "Error restoring the previous configuration in the datastore", "error", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package node
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/supernomad/quantum/systemd"
+)
+
+// status summarises the running node, with the named network device, for 'systemctl status'.
+func (n *Node) status(device string) string {
+	return "Running " + device + " as " + n.cfg.PrivateIP.String() + ", " + strconv.Itoa(len(n.store.Mappings())) + " mappings known"
+}
+
+// alive returns the detail of the first failing liveness check, or nil if every worker is running and none of them are stuck.
+func (n *Node) alive() error {
+	for _, check := range n.Liveness() {
+		if !check.OK {
+			return errors.New(check.Detail)
+		}
+	}
+	return nil
+}
+
+// notify sends the states to systemd, logging rather than returning any failure as quantum runs the same either way.
+func (n *Node) notify(states ...string) {
+	if _, err := systemd.Notify(states...); err != nil {
+		n.cfg.Log.Warn("node", "Error notifying systemd", "error", err)
+	}
+}
+
+// notifyReady tells systemd that the node has started, once the datastore has been initialized and the workers are running, and starts pinging the watchdog if it is enabled. The node lock must be held.
+func (n *Node) notifyReady() {
+	n.notify(systemd.Ready, systemd.Status(n.status(n.dev.Name())))
+
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		n.cfg.Log.Warn("node", "Error reading the systemd watchdog configuration, the watchdog will not be pinged", "error", err)
+		return
+	}
+
+	if interval > 0 {
+		go n.watchdog(interval)
+	}
+}
+
+// watchdog pings the systemd watchdog, and updates the status, at the interval until the node is stopped. The pings stop while the liveness checks fail, so that systemd restarts quantum if the workers die or get stuck for longer than the watchdog timeout.
+func (n *Node) watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		if err := n.alive(); err != nil {
+			if !failing {
+				n.cfg.Log.Warn("node", "The liveness checks are failing, no longer pinging the systemd watchdog.", "error", err)
+			}
+			failing = true
+			n.notify(systemd.Status("Failing the liveness checks: " + err.Error()))
+			continue
+		}
+
+		if failing {
+			n.cfg.Log.Info("node", "The liveness checks are passing, pinging the systemd watchdog again.")
+		}
+		failing = false
+		n.notify(systemd.Watchdog, systemd.Status(n.status(n.DeviceName())))
+	}
+}
@@ -6,6 +6,7 @@ package plugin
 import (
 	"github.com/golang/snappy"
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
 )
 
 // Compression plugin struct to use for compressing outgoing packets or decompressing incoming packets.
@@ -27,16 +28,16 @@ func decompress(raw []byte) ([]byte, int) {
 }
 
 // Apply returns the payload/mapping compressed if the direction is Outgoing and decompressed if the direction is Incoming.
-func (comp *Compression) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+func (comp *Compression) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, metric.DropReason) {
 	if !common.StringInSlice(CompressionPlugin, mapping.SupportedPlugins) {
-		return payload, mapping, true
+		return payload, mapping, metric.NotDropped
 	}
 
 	switch direction {
 	case Incoming:
 		decompressed, length := decompress(payload.Packet)
 		if decompressed == nil {
-			return payload, mapping, false
+			return payload, mapping, metric.CompressionDecodeError
 		}
 
 		copy(payload.Raw[common.PacketStart:], decompressed)
@@ -45,14 +46,14 @@ func (comp *Compression) Apply(direction Direction, payload *common.Payload, map
 	case Outgoing:
 		compressed, length := compress(payload.Packet)
 		if compressed == nil {
-			return payload, mapping, false
+			return payload, mapping, metric.CompressionEncodeError
 		}
 
 		copy(payload.Raw[common.PacketStart:], compressed)
 		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
 		payload.Length = common.HeaderSize + length
 	}
-	return payload, mapping, true
+	return payload, mapping, metric.NotDropped
 }
 
 // Close which is a noop.
@@ -5,6 +5,7 @@ package plugin
 
 import (
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
 )
 
 // Encryption plugin struct to use for encrypting outgoing packets or decrypting incoming packets.
@@ -13,16 +14,16 @@ type Encryption struct {
 }
 
 // Apply returns the payload/mapping encrypted if the direction is Outgoing and decrypted if the direction is Incoming.
-func (enc *Encryption) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
+func (enc *Encryption) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, metric.DropReason) {
 	if !common.StringInSlice(EncryptionPlugin, mapping.SupportedPlugins) {
-		return payload, mapping, true
+		return payload, mapping, metric.NotDropped
 	}
 
 	switch direction {
 	case Incoming:
 		length, err := mapping.AES.Decrypt(payload.Packet, payload.IPAddress)
 		if err != nil {
-			return payload, mapping, false
+			return payload, mapping, metric.AuthenticationError
 		}
 
 		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
@@ -30,13 +31,13 @@ func (enc *Encryption) Apply(direction Direction, payload *common.Payload, mappi
 	case Outgoing:
 		length, err := mapping.AES.Encrypt(payload.Raw[common.PacketStart:], len(payload.Packet), payload.IPAddress)
 		if err != nil {
-			return payload, mapping, false
+			return payload, mapping, metric.EncryptionError
 		}
 
 		payload.Packet = payload.Raw[common.PacketStart : common.PacketStart+length]
 		payload.Length = common.HeaderSize + length
 	}
-	return payload, mapping, true
+	return payload, mapping, metric.NotDropped
 }
 
 // Close which is a noop.
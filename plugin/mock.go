@@ -5,15 +5,16 @@ package plugin
 
 import (
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
 )
 
 // Mock plugin struct to use for testing.
 type Mock struct {
 }
 
-// Apply returns the payload/mapping unchanged and always true.
-func (mock *Mock) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool) {
-	return payload, mapping, true
+// Apply returns the payload/mapping unchanged and never drops the packet.
+func (mock *Mock) Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, metric.DropReason) {
+	return payload, mapping, metric.NotDropped
 }
 
 // Close which is a noop.
@@ -7,6 +7,7 @@ import (
 	"errors"
 
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/metric"
 )
 
 const (
@@ -44,8 +45,8 @@ const (
 
 // Plugin interface for a generic multi-queue network device.
 type Plugin interface {
-	// Apply should apply the plugin to the specified payload and mapping.
-	Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, bool)
+	// Apply should apply the plugin to the specified payload and mapping, returning the reason the packet should be dropped or metric.NotDropped.
+	Apply(direction Direction, payload *common.Payload, mapping *common.Mapping) (*common.Payload, *common.Mapping, metric.DropReason)
 
 	// Close should gracefully destroy the plugin.
 	Close() error
@@ -10,6 +10,7 @@ import (
 
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/crypto"
+	"github.com/supernomad/quantum/metric"
 )
 
 var mapping *common.Mapping
@@ -23,7 +24,7 @@ func init() {
 
 	rand.Read(salt)
 
-	aes, _ := crypto.NewAES(key, salt)
+	aes, _ := crypto.NewAES(key, salt, nil)
 	mapping.AES = aes
 }
 
@@ -104,15 +105,15 @@ func TestEncryption(t *testing.T) {
 
 	out := common.NewTunPayload(buf, common.MTU)
 
-	encrypted, _, ok := encryption.Apply(Outgoing, out, mapping)
-	if !ok {
+	encrypted, _, reason := encryption.Apply(Outgoing, out, mapping)
+	if reason.Dropped() {
 		t.Fatal("Failed to encrypt the outgoing payload.")
 	}
 
 	in := common.NewSockPayload(encrypted.Raw, encrypted.Length)
 
-	_, _, ok = encryption.Apply(Incoming, in, mapping)
-	if !ok {
+	_, _, reason = encryption.Apply(Incoming, in, mapping)
+	if reason.Dropped() {
 		t.Fatal("Failed to decrypt the incoming payload.")
 	}
 
@@ -120,6 +121,15 @@ func TestEncryption(t *testing.T) {
 		t.Fatal("The outgoing and incoming payloads don't match after encryption/decryption.")
 	}
 
+	out = common.NewTunPayload(buf, common.MTU)
+	encrypted, _, _ = encryption.Apply(Outgoing, out, mapping)
+	encrypted.Packet[0] ^= 0xff
+
+	in = common.NewSockPayload(encrypted.Raw, encrypted.Length)
+	if _, _, reason = encryption.Apply(Incoming, in, mapping); reason != metric.AuthenticationError {
+		t.Fatal("Decrypting a tampered payload should be dropped as an authentication error, got:", reason)
+	}
+
 	encryption.Close()
 }
 
@@ -141,15 +151,15 @@ func TestCompression(t *testing.T) {
 
 	out := common.NewTunPayload(buf, common.MTU)
 
-	compressed, _, ok := compression.Apply(Outgoing, out, mapping)
-	if !ok {
+	compressed, _, reason := compression.Apply(Outgoing, out, mapping)
+	if reason.Dropped() {
 		t.Fatal("Failed to compress the outgoing payload.")
 	}
 
 	in := common.NewSockPayload(compressed.Raw, compressed.Length)
 
-	_, _, ok = compression.Apply(Incoming, in, mapping)
-	if !ok {
+	_, _, reason = compression.Apply(Incoming, in, mapping)
+	if reason.Dropped() {
 		t.Fatal("Failed to decompress the incoming payload.")
 	}
 
@@ -157,6 +167,16 @@ func TestCompression(t *testing.T) {
 		t.Fatal("The outgoing and incoming payloads don't match after compression/decompression.")
 	}
 
+	garbage := make([]byte, common.MaxPacketLength)
+	for i := range garbage {
+		garbage[i] = 0xff
+	}
+
+	in = common.NewSockPayload(garbage, common.MTU)
+	if _, _, reason = compression.Apply(Incoming, in, mapping); reason != metric.CompressionDecodeError {
+		t.Fatal("Decompressing an invalid payload should be dropped as a compression decode error, got:", reason)
+	}
+
 	compression.Close()
 }
 
@@ -187,10 +207,10 @@ func TestMulti(t *testing.T) {
 
 	payload := common.NewTunPayload(buf, common.MTU)
 
-	var ok bool
+	var reason metric.DropReason
 	for i := 0; i < len(plugins); i++ {
-		payload, mapping, ok = plugins[i].Apply(Outgoing, payload, mapping)
-		if !ok {
+		payload, mapping, reason = plugins[i].Apply(Outgoing, payload, mapping)
+		if reason.Dropped() {
 			t.Fatalf("Failed to apply outgoing plugin: %s", plugins[i].Name())
 		}
 	}
@@ -200,8 +220,8 @@ func TestMulti(t *testing.T) {
 	payload = common.NewSockPayload(payload.Raw, payload.Length)
 
 	for i := 0; i < len(plugins); i++ {
-		payload, mapping, ok = plugins[i].Apply(Incoming, payload, mapping)
-		if !ok {
+		payload, mapping, reason = plugins[i].Apply(Incoming, payload, mapping)
+		if reason.Dropped() {
 			t.Fatalf("Failed to apply incoming plugin: %s", plugins[i].Name())
 		}
 	}
@@ -218,7 +238,7 @@ func TestMulti(t *testing.T) {
 func TestMock(t *testing.T) {
 	mock, _ := New(MockPlugin, &common.Config{})
 
-	if payload, mapping, ok := mock.Apply(Outgoing, nil, nil); !ok || payload != nil || mapping != nil {
+	if payload, mapping, reason := mock.Apply(Outgoing, nil, nil); reason.Dropped() || payload != nil || mapping != nil {
 		t.Fatal("Mock Apply should always return ok.")
 	}
 
@@ -0,0 +1,15 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package pmtu contains the structs and logic to discover the path MTU between quantum nodes.
+
+Discovery is handled by periodically sending padded PMTUProbe control packets, with the don't fragment bit set, to every remote node in the quantum network. The remote node acknowledges each probe it receives in full, and the largest acknowledged probe determines the path MTU to that node. Probes are binary searched between the minimum ipv4 link MTU and the configured link MTU.
+
+Packets from the local network that are too big for the path MTU to their destination, and that have the don't fragment bit set, are dropped by the outgoing workers which send an ICMP "fragmentation needed" error back to the source of the packet. This allows the hosts behind the quantum device to adapt, rather than having their packets blackholed.
+
+Hosts behind upstream firewalls that drop ICMP errors will never see those errors, so the workers can optionally clamp the MSS option of TCP SYN and SYN-ACK packets crossing the quantum network to fit the path MTU to the remote node. This keeps the TCP sessions from stalling in the first place, and applies whether or not discovery is enabled.
+
+Note that discovery is only supported by the udp backend, however every node will acknowledge probes regardless of whether or not it has discovery enabled.
+*/
+package pmtu
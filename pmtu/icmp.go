@@ -0,0 +1,80 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package pmtu
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/supernomad/quantum/common"
+)
+
+const (
+	icmpHeaderSize          = 8
+	icmpProtocol            = 1
+	icmpDestUnreachable     = 3
+	icmpFragmentationNeeded = 4
+	icmpEchoReply           = 0
+	icmpEcho                = 8
+	icmpTTL                 = 64
+)
+
+// DontFragment returns true if the packet is an ipv4 packet with the don't fragment bit set, which is only true for packets that the source would rather have dropped than fragmented.
+//
+// ICMP errors are never considered as a "fragmentation needed" error must not be sent in response to another ICMP error.
+func DontFragment(packet []byte) bool {
+	if len(packet) < common.IPv4HeaderSize || packet[0]>>4 != 4 || packet[6]&0x40 == 0 {
+		return false
+	}
+
+	ihl := int(packet[0]&0x0f) * 4
+	if packet[9] == icmpProtocol && len(packet) > ihl {
+		return packet[ihl] == icmpEcho || packet[ihl] == icmpEchoReply
+	}
+	return true
+}
+
+// FragmentationNeeded generates an ICMP "fragmentation needed" error from the src address, addressed to the source of the packet, which notifies it of the mtu to use. The packet must be a valid ipv4 packet.
+func FragmentationNeeded(src net.IP, packet []byte, mtu int) []byte {
+	// Quote the ip header and the first 8 bytes of the original packet, as required by RFC 792.
+	quoted := int(packet[0]&0x0f)*4 + 8
+	if quoted > len(packet) {
+		quoted = len(packet)
+	}
+
+	buf := make([]byte, common.IPv4HeaderSize+icmpHeaderSize+quoted)
+
+	iph := buf[:common.IPv4HeaderSize]
+	iph[0] = 0x45
+	iph[1] = 0xc0
+	binary.BigEndian.PutUint16(iph[2:4], uint16(len(buf)))
+	iph[8] = icmpTTL
+	iph[9] = icmpProtocol
+	copy(iph[12:16], src.To4())
+	copy(iph[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(iph[10:12], checksum(iph))
+
+	icmp := buf[common.IPv4HeaderSize:]
+	icmp[0] = icmpDestUnreachable
+	icmp[1] = icmpFragmentationNeeded
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[icmpHeaderSize:], packet[:quoted])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	return buf
+}
+
+func checksum(buf []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	}
+	if len(buf)%2 == 1 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
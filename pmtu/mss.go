@@ -0,0 +1,96 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package pmtu
+
+import (
+	"encoding/binary"
+
+	"github.com/supernomad/quantum/common"
+)
+
+const (
+	tcpProtocol   = 6
+	tcpHeaderSize = 20
+	tcpSYN        = 0x02
+
+	tcpOptionEnd    = 0
+	tcpOptionNOP    = 1
+	tcpOptionMSS    = 2
+	tcpOptionMSSLen = 4
+)
+
+// MSS returns the TCP maximum segment size that fits within the mtu.
+func MSS(mtu int) int {
+	return mtu - common.IPv4HeaderSize - tcpHeaderSize
+}
+
+// ClampMSS rewrites the MSS option of an ipv4 TCP SYN or SYN-ACK packet in place so that it is no larger than mss, updating the TCP checksum incrementally. Returns true if the packet was modified.
+func ClampMSS(packet []byte, mss int) bool {
+	if len(packet) < common.IPv4HeaderSize || packet[0]>>4 != 4 || packet[9] != tcpProtocol {
+		return false
+	}
+
+	// Only the first fragment of a packet contains the TCP header.
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return false
+	}
+
+	ihl := int(packet[0]&0x0f) * 4
+	if len(packet) < ihl+tcpHeaderSize {
+		return false
+	}
+
+	tcp := packet[ihl:]
+	if tcp[13]&tcpSYN == 0 {
+		return false
+	}
+
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset > len(tcp) {
+		return false
+	}
+
+	for i := tcpHeaderSize; i < dataOffset; {
+		switch tcp[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNOP:
+			i++
+			continue
+		}
+
+		if i+1 >= dataOffset || tcp[i+1] < 2 {
+			return false
+		}
+
+		if tcp[i] == tcpOptionMSS && tcp[i+1] == tcpOptionMSSLen && i+tcpOptionMSSLen <= dataOffset {
+			old := binary.BigEndian.Uint16(tcp[i+2 : i+4])
+			if int(old) <= mss {
+				return false
+			}
+
+			binary.BigEndian.PutUint16(tcp[i+2:i+4], uint16(mss))
+
+			// The checksum is computed over 16 bit words from the start of the TCP header, so an oddly aligned option is byte swapped within the sum.
+			oldWord, newWord := old, uint16(mss)
+			if (i+2)%2 == 1 {
+				oldWord, newWord = oldWord<<8|oldWord>>8, newWord<<8|newWord>>8
+			}
+			binary.BigEndian.PutUint16(tcp[16:18], updateChecksum(binary.BigEndian.Uint16(tcp[16:18]), oldWord, newWord))
+			return true
+		}
+
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// updateChecksum incrementally updates a ones complement checksum after a 16 bit word changes from "from" to "to", as described in RFC 1624.
+func updateChecksum(sum, from, to uint16) uint16 {
+	s := uint32(^sum) + uint32(^from) + uint32(to)
+	for s>>16 != 0 {
+		s = (s & 0xffff) + (s >> 16)
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,395 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package pmtu
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/socket"
+)
+
+const (
+	probeDataSize = 6
+	probeAttempts = 2
+
+	// maxConcurrentPeers is the most remote nodes that are probed at the same time.
+	maxConcurrentPeers = 16
+
+	minPacketLength = common.MinLinkMTU - common.IPv4HeaderSize - common.UDPHeaderSize
+)
+
+var (
+	probeTimeout = 500 * time.Millisecond
+
+	// peerTimeout bounds how long discovery spends probing a single remote node, after which the largest size acknowledged so far is used.
+	peerTimeout = 5 * time.Second
+)
+
+// Discovery struct for discovering and tracking the path MTU to each remote node in the quantum network.
+type Discovery struct {
+	cfg   *common.Config
+	store datastore.Datastore
+	v4    int
+	v6    int
+
+	// paths holds a map[uint32]int of private ip addresses to discovered path MTUs, which is replaced rather than modified so that the workers can read it without locking.
+	paths atomic.Value
+
+	mux     sync.Mutex
+	pending map[uint32]chan struct{}
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// MTU returns the max size packet that can be sent to the remote node represented by the mapping, which is the configured MTU unless a smaller path MTU has been discovered.
+func (d *Discovery) MTU(mapping *common.Mapping) int {
+	paths := d.paths.Load().(map[uint32]int)
+	if len(paths) == 0 {
+		return d.cfg.MTU
+	}
+
+	ip := mapping.PrivateIP.To4()
+	if ip == nil {
+		return d.cfg.MTU
+	}
+
+	if mtu, ok := paths[common.IPtoInt(ip)]; ok {
+		return mtu
+	}
+	return d.cfg.MTU
+}
+
+// Handle a control payload received from a remote node, returning the reply to send back to that node and true if a reply is required.
+//
+// The reply is written in place over the received payload.
+func (d *Discovery) Handle(payload *common.Payload) (*common.Payload, *common.Mapping, bool) {
+	if payload.Length < common.ControlHeaderSize+probeDataSize {
+		return nil, nil, false
+	}
+
+	data := payload.Raw[common.ControlDataStart:payload.Length]
+	nonce := binary.BigEndian.Uint32(data[0:4])
+	size := int(binary.BigEndian.Uint16(data[4:6]))
+
+	switch common.ControlType(payload.Raw[common.ControlTypeStart]) {
+	case common.PMTUProbe:
+		// A truncated probe means the probe was larger than the local buffers, and must not be acknowledged.
+		if size != payload.Length {
+			return nil, nil, false
+		}
+
+		mapping, ok := d.store.Mapping(common.IPtoInt(payload.Raw[common.ControlIPStart:common.ControlIPEnd]))
+		if !ok || mapping == nil {
+			return nil, nil, false
+		}
+
+		return common.NewControlPayload(payload.Raw, common.PMTUAck, d.cfg.PrivateIP, probeDataSize), mapping, true
+	case common.PMTUAck:
+		d.mux.Lock()
+		if ack, ok := d.pending[nonce]; ok {
+			select {
+			case ack <- struct{}{}:
+			default:
+			}
+		}
+		d.mux.Unlock()
+	}
+
+	return nil, nil, false
+}
+
+// Start periodically discovering the path MTU to each remote node, if path MTU discovery is enabled.
+func (d *Discovery) Start() error {
+	if !d.cfg.PMTUDiscovery {
+		return nil
+	}
+
+	if d.cfg.NetworkConfig.Backend != socket.UDPSocket {
+		d.cfg.Log.Warn("pmtu", "Path MTU discovery is only supported by the udp backend, disabling path MTU discovery.")
+		return nil
+	}
+
+	var err error
+	if d.cfg.IsIPv4Enabled {
+		d.v4, err = createProbeSocket(syscall.AF_INET, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.cfg.IsIPv6Enabled {
+		d.v6, err = createProbeSocket(syscall.AF_INET6, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		if err != nil {
+			d.close()
+			return err
+		}
+	}
+
+	d.mux.Lock()
+	d.started = true
+	d.mux.Unlock()
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(d.cfg.PMTUInterval)
+		defer ticker.Stop()
+
+		d.discoverAll()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.discoverAll()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop discovering path MTUs and close the probe sockets.
+func (d *Discovery) Stop() {
+	d.mux.Lock()
+	started := d.started
+	d.started = false
+	d.mux.Unlock()
+
+	if !started {
+		return
+	}
+
+	close(d.stop)
+	<-d.done
+	d.close()
+}
+
+func (d *Discovery) close() {
+	if d.v4 >= 0 {
+		syscall.Close(d.v4)
+	}
+	if d.v6 >= 0 {
+		syscall.Close(d.v6)
+	}
+}
+
+func (d *Discovery) stopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// discoverAll probes every remote node concurrently, so that unreachable nodes do not hold up discovery for the rest.
+func (d *Discovery) discoverAll() {
+	mappings := d.store.Mappings()
+	peers := make(map[uint32]bool, len(mappings))
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, maxConcurrentPeers)
+	for i := 0; i < len(mappings); i++ {
+		mapping := mappings[i]
+		if mapping.PrivateIP.Equal(d.cfg.PrivateIP) || mapping.Sockaddr == nil {
+			continue
+		}
+
+		ip := common.IPtoInt(mapping.PrivateIP)
+		peers[ip] = true
+
+		select {
+		case <-d.stop:
+			wg.Wait()
+			return
+		case limit <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			if packetLength, ok := d.discover(mapping, time.Now().Add(peerTimeout)); ok {
+				d.setPath(ip, packetLength-common.HeaderSize-common.OverflowSize, mapping)
+			} else {
+				d.deletePath(ip)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if d.stopped() {
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	current := d.paths.Load().(map[uint32]int)
+	paths := make(map[uint32]int, len(current))
+	for ip, mtu := range current {
+		if peers[ip] {
+			paths[ip] = mtu
+		}
+	}
+	d.paths.Store(paths)
+}
+
+// discover the largest packet that can be sent to the remote node, returning false if the remote node never acknowledges a probe. Probing stops at the deadline, in which case the largest size acknowledged so far is returned.
+func (d *Discovery) discover(mapping *common.Mapping, deadline time.Time) (int, bool) {
+	hi := d.cfg.MaxPacketLength
+	if d.probe(mapping, hi, deadline) {
+		return hi, true
+	}
+
+	lo := minPacketLength
+	if !d.probe(mapping, lo, deadline) {
+		return 0, false
+	}
+
+	for lo < hi && time.Now().Before(deadline) && !d.stopped() {
+		mid := (lo + hi + 1) / 2
+		if d.probe(mapping, mid, deadline) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, true
+}
+
+func (d *Discovery) probe(mapping *common.Mapping, size int, deadline time.Time) bool {
+	fd := d.v4
+	if _, ok := mapping.Sockaddr.(*syscall.SockaddrInet6); ok {
+		fd = d.v6
+	}
+	if fd < 0 {
+		return false
+	}
+
+	buf := make([]byte, size)
+	payload := common.NewControlPayload(buf, common.PMTUProbe, d.cfg.PrivateIP, size-common.ControlHeaderSize)
+
+	nonceBuf := make([]byte, 4)
+	rand.Read(nonceBuf)
+	nonce := binary.BigEndian.Uint32(nonceBuf)
+
+	copy(buf[common.ControlDataStart:], nonceBuf)
+	binary.BigEndian.PutUint16(buf[common.ControlDataStart+4:], uint16(size))
+	common.SignControlPayload(payload, d.cfg.Current().PSK)
+
+	ack := make(chan struct{}, 1)
+	d.mux.Lock()
+	d.pending[nonce] = ack
+	d.mux.Unlock()
+
+	defer func() {
+		d.mux.Lock()
+		delete(d.pending, nonce)
+		d.mux.Unlock()
+	}()
+
+	for i := 0; i < probeAttempts; i++ {
+		timeout := probeTimeout
+		if remaining := time.Until(deadline); remaining <= 0 {
+			return false
+		} else if remaining < timeout {
+			timeout = remaining
+		}
+
+		// The probe sockets never fragment locally, so probes larger than the local link MTU fail immediately.
+		if err := syscall.Sendto(fd, payload.Raw[:payload.Length], 0, mapping.Sockaddr); err != nil {
+			return false
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case <-ack:
+			timer.Stop()
+			return true
+		case <-d.stop:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+	return false
+}
+
+func (d *Discovery) setPath(ip uint32, mtu int, mapping *common.Mapping) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	current := d.paths.Load().(map[uint32]int)
+	if existing, ok := current[ip]; ok && existing == mtu {
+		return
+	}
+
+	paths := make(map[uint32]int, len(current)+1)
+	for k, v := range current {
+		paths[k] = v
+	}
+	paths[ip] = mtu
+	d.paths.Store(paths)
+
+	d.cfg.Log.Info("pmtu", "Discovered the path MTU to a peer.", "peer", mapping.PrivateIP, "mtu", mtu)
+}
+
+func (d *Discovery) deletePath(ip uint32) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	current := d.paths.Load().(map[uint32]int)
+	if _, ok := current[ip]; !ok {
+		return
+	}
+
+	paths := make(map[uint32]int, len(current))
+	for k, v := range current {
+		if k != ip {
+			paths[k] = v
+		}
+	}
+	d.paths.Store(paths)
+}
+
+func createProbeSocket(family, level, opt, value int) (int, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return -1, errors.New("error creating the path MTU probe socket: " + err.Error())
+	}
+
+	// Always set the don't fragment bit, and ignore any path MTU the kernel may have cached.
+	if err := syscall.SetsockoptInt(fd, level, opt, value); err != nil {
+		syscall.Close(fd)
+		return -1, errors.New("error setting the path MTU probe socket to not fragment packets: " + err.Error())
+	}
+	return fd, nil
+}
+
+// New generates a Discovery struct based on the passed in configuration and key/value store, nothing is probed until Start is called.
+func New(cfg *common.Config, store datastore.Datastore) *Discovery {
+	d := &Discovery{
+		cfg:     cfg,
+		store:   store,
+		v4:      -1,
+		v6:      -1,
+		pending: make(map[uint32]chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	d.paths.Store(make(map[uint32]int))
+	return d
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package pmtu
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/socket"
+)
+
+func testConfig(privateIP string) *common.Config {
+	return &common.Config{
+		Log:             common.NewLogger(common.NoopLogger),
+		PrivateIP:       net.ParseIP(privateIP),
+		IsIPv4Enabled:   true,
+		PMTUDiscovery:   true,
+		PMTUInterval:    time.Hour,
+		MaxPacketLength: common.MaxPacketLength,
+		MTU:             common.MTU,
+		NetworkConfig:   &common.NetworkConfig{Backend: socket.UDPSocket},
+	}
+}
+
+func testMapping(privateIP string, conn *net.UDPConn) *common.Mapping {
+	sa := &syscall.SockaddrInet4{Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	copy(sa.Addr[:], net.ParseIP("127.0.0.1").To4())
+
+	return &common.Mapping{PrivateIP: net.ParseIP(privateIP), Sockaddr: sa}
+}
+
+// serve emulates the incoming workers of a quantum node, reading at most bufLength bytes per packet.
+func serve(d *Discovery, conn *net.UDPConn, bufLength int) {
+	buf := make([]byte, bufLength)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		payload := common.NewSockPayload(buf, n)
+		if !common.IsControlPayload(payload) {
+			continue
+		}
+
+		if reply, mapping, ok := d.Handle(payload); ok {
+			sa := mapping.Sockaddr.(*syscall.SockaddrInet4)
+			conn.WriteToUDP(reply.Raw[:reply.Length], &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port})
+		}
+	}
+}
+
+func TestDontFragment(t *testing.T) {
+	packet := make([]byte, 48)
+	packet[0] = 0x45
+	packet[9] = syscall.IPPROTO_TCP
+
+	if DontFragment(packet) {
+		t.Fatal("DontFragment returned true for a packet without the don't fragment bit set.")
+	}
+
+	packet[6] = 0x40
+	if !DontFragment(packet) {
+		t.Fatal("DontFragment returned false for a packet with the don't fragment bit set.")
+	}
+
+	packet[9] = icmpProtocol
+	packet[20] = icmpDestUnreachable
+	if DontFragment(packet) {
+		t.Fatal("DontFragment returned true for an ICMP error.")
+	}
+}
+
+func TestFragmentationNeeded(t *testing.T) {
+	packet := make([]byte, 1400)
+	packet[0] = 0x45
+	packet[6] = 0x40
+	copy(packet[12:16], net.ParseIP("10.99.0.2").To4())
+
+	icmp := FragmentationNeeded(net.ParseIP("10.99.0.1"), packet, 1200)
+	if len(icmp) != common.IPv4HeaderSize+icmpHeaderSize+common.IPv4HeaderSize+8 {
+		t.Fatal("FragmentationNeeded returned a packet of the wrong length.")
+	}
+
+	if checksum(icmp[:common.IPv4HeaderSize]) != 0 || checksum(icmp[common.IPv4HeaderSize:]) != 0 {
+		t.Fatal("FragmentationNeeded returned a packet with an invalid checksum.")
+	}
+
+	if !net.IP(icmp[16:20]).Equal(net.ParseIP("10.99.0.2")) {
+		t.Fatal("FragmentationNeeded returned a packet with the wrong destination.")
+	}
+
+	if icmp[20] != icmpDestUnreachable || icmp[21] != icmpFragmentationNeeded || binary.BigEndian.Uint16(icmp[26:28]) != 1200 {
+		t.Fatal("FragmentationNeeded returned a packet with the wrong ICMP type, code, or mtu.")
+	}
+}
+
+func testSYN(options []byte) []byte {
+	packet := make([]byte, common.IPv4HeaderSize+tcpHeaderSize+len(options))
+	packet[0] = 0x45
+	packet[9] = tcpProtocol
+	copy(packet[12:16], net.ParseIP("10.99.0.2").To4())
+	copy(packet[16:20], net.ParseIP("10.99.0.1").To4())
+
+	tcp := packet[common.IPv4HeaderSize:]
+	tcp[12] = byte(len(tcp)/4) << 4
+	tcp[13] = tcpSYN
+	copy(tcp[tcpHeaderSize:], options)
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(packet))
+	return packet
+}
+
+func tcpChecksum(packet []byte) uint16 {
+	tcp := packet[common.IPv4HeaderSize:]
+	pseudo := make([]byte, 12+len(tcp))
+	copy(pseudo[0:8], packet[12:20])
+	pseudo[9] = tcpProtocol
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	copy(pseudo[12:], tcp)
+	return checksum(pseudo)
+}
+
+func TestClampMSS(t *testing.T) {
+	aligned := testSYN([]byte{tcpOptionMSS, tcpOptionMSSLen, 0x05, 0xb4})
+	unaligned := testSYN([]byte{tcpOptionNOP, tcpOptionMSS, tcpOptionMSSLen, 0x23, 0x28, tcpOptionNOP, tcpOptionNOP, tcpOptionEnd})
+
+	for _, packet := range [][]byte{aligned, unaligned} {
+		if ClampMSS(packet, 9000) {
+			t.Fatal("ClampMSS should not increase the MSS.")
+		}
+
+		if !ClampMSS(packet, MSS(1200)) {
+			t.Fatal("ClampMSS should have clamped the MSS.")
+		}
+
+		if tcpChecksum(packet) != 0 {
+			t.Fatal("ClampMSS did not correctly update the TCP checksum.")
+		}
+	}
+
+	if binary.BigEndian.Uint16(aligned[42:44]) != 1160 || binary.BigEndian.Uint16(unaligned[43:45]) != 1160 {
+		t.Fatal("ClampMSS set the wrong MSS.")
+	}
+
+	ack := testSYN([]byte{tcpOptionMSS, tcpOptionMSSLen, 0x05, 0xb4})
+	ack[common.IPv4HeaderSize+13] = 0x10
+	if ClampMSS(ack, MSS(1200)) {
+		t.Fatal("ClampMSS should only modify SYN packets.")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	store := &datastore.Mock{InternalMapping: &common.Mapping{PrivateIP: net.ParseIP("10.99.0.2")}}
+	d := New(testConfig("10.99.0.1"), store)
+
+	buf := make([]byte, 1000)
+	probe := common.NewControlPayload(buf, common.PMTUProbe, net.ParseIP("10.99.0.2"), 1000-common.ControlHeaderSize)
+	binary.BigEndian.PutUint32(buf[common.ControlDataStart:], 1)
+	binary.BigEndian.PutUint16(buf[common.ControlDataStart+4:], 1000)
+
+	if _, _, ok := d.Handle(common.NewSockPayload(buf, 900)); ok {
+		t.Fatal("Handle should not acknowledge a truncated probe.")
+	}
+
+	ack, mapping, ok := d.Handle(probe)
+	if !ok || mapping != store.InternalMapping {
+		t.Fatal("Handle should have acknowledged the probe.")
+	}
+
+	if common.ControlType(ack.Raw[common.ControlTypeStart]) != common.PMTUAck || ack.Length != common.ControlHeaderSize+probeDataSize {
+		t.Fatal("Handle returned a malformed acknowledgement.")
+	}
+
+	pending := make(chan struct{}, 1)
+	d.pending[1] = pending
+
+	if _, _, ok := d.Handle(ack); ok {
+		t.Fatal("Handle should not reply to an acknowledgement.")
+	}
+
+	select {
+	case <-pending:
+	default:
+		t.Fatal("Handle did not notify the pending probe of the acknowledgement.")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	probeTimeout = 50 * time.Millisecond
+
+	local, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer local.Close()
+
+	remote, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer remote.Close()
+
+	remoteMapping := testMapping("10.99.0.2", remote)
+	d := New(testConfig("10.99.0.1"), &datastore.Mock{InternalMapping: remoteMapping})
+	peer := New(testConfig("10.99.0.2"), &datastore.Mock{InternalMapping: testMapping("10.99.0.1", local)})
+
+	if mtu := d.MTU(remoteMapping); mtu != common.MTU {
+		t.Fatal("MTU should return the configured MTU before a path MTU is discovered.")
+	}
+
+	// The remote node can only receive packets of up to 1000 bytes, which is what the discovered path should be limited to.
+	go serve(d, local, common.MaxPacketLength)
+	go serve(peer, remote, 1000)
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start returned an error: %s", err.Error())
+	}
+	defer d.Stop()
+
+	expected := 1000 - common.HeaderSize - common.OverflowSize
+	for i := 0; i < 100 && d.MTU(remoteMapping) != expected; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if mtu := d.MTU(remoteMapping); mtu != expected {
+		t.Fatalf("MTU returned %d instead of the discovered path MTU of %d.", mtu, expected)
+	}
+}
+
+func TestDiscoverDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { probeTimeout = timeout }(probeTimeout)
+	probeTimeout = 500 * time.Millisecond
+
+	// The remote node never acknowledges a probe, so discovery gives up at the deadline rather than waiting out every probe.
+	silent, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer silent.Close()
+
+	d := New(testConfig("10.99.0.1"), &datastore.Mock{})
+	d.v4, _ = createProbeSocket(syscall.AF_INET, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	defer d.close()
+
+	start := time.Now()
+	if _, ok := d.discover(testMapping("10.99.0.2", silent), start.Add(100*time.Millisecond)); ok {
+		t.Fatal("discover should not have found a path to a node that never acknowledges a probe.")
+	}
+
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatal("discover kept probing past the deadline:", elapsed)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// scope is the level of access an api client is granted.
+type scope int
+
+const (
+	// publicScope is required by the routes served to every client, so that load balancers and orchestrators can probe the node without credentials.
+	publicScope scope = iota
+
+	// readScope grants access to the routes that only return information about the node.
+	readScope
+
+	// adminScope grants access to every route, including those that expose traffic or change the state of the node.
+	adminScope
+)
+
+// token is a bearer token along with the scope it grants.
+type token struct {
+	value []byte
+	scope scope
+}
+
+func newTokens(cfg []string, s scope) []token {
+	tokens := make([]token, 0, len(cfg))
+	for i := 0; i < len(cfg); i++ {
+		if cfg[i] != "" {
+			tokens = append(tokens, token{value: []byte(cfg[i]), scope: s})
+		}
+	}
+	return tokens
+}
+
+// authenticate returns the scope granted to the request, and false if the request does not carry a valid bearer token.
+//
+// Every request is granted the admin scope when no tokens are configured, in which case the api is either open or protected by client certificates alone. Requests received over the local api socket are always granted the admin scope, since only the owner of the quantum process can connect to it.
+func (rest *Rest) authenticate(r *http.Request) (scope, bool) {
+	if local, _ := r.Context().Value(localKey{}).(bool); local || len(rest.tokens) == 0 {
+		return adminScope, true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return readScope, false
+	}
+	presented := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+
+	// Compare against every token, so that the time taken does not reveal which token matched.
+	granted, ok := readScope, false
+	for i := 0; i < len(rest.tokens); i++ {
+		if subtle.ConstantTimeCompare(presented, rest.tokens[i].value) == 1 {
+			if !ok || rest.tokens[i].scope > granted {
+				granted = rest.tokens[i].scope
+			}
+			ok = true
+		}
+	}
+	return granted, ok
+}
+
+// authorize wraps the handler so that it is only served to requests granted at least the required scope.
+func (rest *Rest) authorize(required scope, handler http.HandlerFunc) http.HandlerFunc {
+	if required == publicScope {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted, ok := rest.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="quantum"`)
+			rest.writeJSON(w, r, http.StatusUnauthorized, &apiError{Status: http.StatusUnauthorized, Message: "a valid bearer token is required"})
+			return
+		}
+
+		if granted < required {
+			rest.writeJSON(w, r, http.StatusForbidden, &apiError{Status: http.StatusForbidden, Message: "the bearer token does not grant access to '" + r.URL.Path + "'"})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// restricted wraps the handler so that it is never served by an open api, which has no tokens configured, leaving only the clients of the local api socket and the clients presenting an admin token. Routes exposing the traffic crossing the node, or changing its state, are restricted, as client certificates alone do not stop them from being served to any client when the api listens on every address.
+func (rest *Rest) restricted(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if local, _ := r.Context().Value(localKey{}).(bool); !local && len(rest.tokens) == 0 {
+			rest.writeJSON(w, r, http.StatusForbidden, &apiError{Status: http.StatusForbidden, Message: "'" + r.URL.Path + "' is only served over the local api socket, unless admin tokens are configured"})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// newTLSConfig generates the tls configuration to serve the api with, or nil if the api is served over plain http.
+func newTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("error reading the supplied api tls certificate and/or key: " + err.Error())
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.New("error reading the supplied api tls ca certificate: " + err.Error())
+		}
+
+		tlsCfg.ClientCAs = x509.NewCertPool()
+		if !tlsCfg.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("error parsing the supplied api tls ca certificate")
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
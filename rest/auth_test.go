@@ -0,0 +1,270 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/latency"
+	"github.com/supernomad/quantum/metric"
+)
+
+func testAuthConfig() *common.Config {
+	return &common.Config{
+		Log:          common.NewLogger(common.NoopLogger),
+		StatsRoute:   "/stats",
+		CaptureRoute: "/capture",
+		StatsAddress: "127.0.0.1",
+		StatsPort:    1098,
+		NumWorkers:   1,
+	}
+}
+
+func testAuth(t *testing.T, api *Rest, route, bearer string, status int) {
+	r := httptest.NewRequest(http.MethodGet, route, nil)
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, r)
+	if w.Code != status {
+		t.Fatal(route, "with the token", bearer, "returned the wrong status:", w.Code, w.Body.String())
+	}
+}
+
+func TestTokens(t *testing.T) {
+	cfg := testAuthConfig()
+	api, err := New(cfg, &testNode{}, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any tokens the api is open, except for packet captures which are only served over the local api socket.
+	testAuth(t, api, "/v1/health", "", http.StatusOK)
+	testAuth(t, api, "/capture?dir=sideways", "", http.StatusForbidden)
+
+	r := httptest.NewRequest(http.MethodGet, "/capture?dir=sideways", nil)
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localKey{}, true)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("The local api socket was refused a packet capture:", w.Code, w.Body.String())
+	}
+
+	cfg.StatsReadTokens = []string{"reader", ""}
+	cfg.StatsAdminTokens = []string{"admin"}
+	api, err = New(cfg, &testNode{}, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAuth(t, api, "/v1/health", "", http.StatusUnauthorized)
+	testAuth(t, api, "/v1/health", "woot", http.StatusUnauthorized)
+	testAuth(t, api, "/v1/health", "reader", http.StatusOK)
+	testAuth(t, api, "/stats", "admin", http.StatusOK)
+	testAuth(t, api, "/capture?dir=sideways", "reader", http.StatusForbidden)
+	testAuth(t, api, "/capture?dir=sideways", "admin", http.StatusBadRequest)
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/health", nil)
+	r.Header.Set("Authorization", "Basic cmVhZGVyOg==")
+	w = httptest.NewRecorder()
+	api.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("The api accepted a request without a bearer token:", w.Code)
+	}
+}
+
+// testCert generates a certificate signed by the parent, or a self signed ca if the parent is nil, writing the certificate and key out as pem files.
+func testCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	client, _ := testCert(t, dir, "client", ca, caKey)
+
+	cfg := testAuthConfig()
+	cfg.StatsTLSCert = path.Join(dir, "server.crt")
+	cfg.StatsTLSKey = path.Join(dir, "server.key")
+	cfg.StatsTLSCA = path.Join(dir, "ca.crt")
+
+	api, err := New(cfg, &testNode{}, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Start()
+	defer api.Stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	clientCert, err := tls.LoadX509KeyPair(path.Join(dir, "client.crt"), path.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientCert.Leaf, err = x509.ParseCertificate(clientCert.Certificate[0]); err != nil || !clientCert.Leaf.Equal(client) {
+		t.Fatal("The client certificate was not written correctly:", err)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+
+	// Wait for the api to begin listening.
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = authenticated.Get("https://127.0.0.1:1098/v1/health"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("The api did not serve a client with a valid certificate:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("The api returned the wrong status to a client with a valid certificate:", resp.StatusCode)
+	}
+
+	if resp, err := anonymous.Get("https://127.0.0.1:1098/v1/health"); err == nil {
+		resp.Body.Close()
+		t.Fatal("The api served a client without a certificate.")
+	}
+
+	if resp, err := http.Get("http://127.0.0.1:1098/v1/health"); err == nil && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		t.Fatal("The api served a plain http client.")
+	}
+
+	cfg.StatsTLSCA = path.Join(dir, "missing.crt")
+	if _, err := New(cfg, &testNode{}, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus()); err == nil {
+		t.Fatal("New should have returned an error for a missing ca certificate.")
+	}
+
+	cfg.StatsTLSCA = ""
+	cfg.StatsTLSKey = path.Join(dir, "client.key")
+	if _, err := New(cfg, &testNode{}, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus()); err == nil {
+		t.Fatal("New should have returned an error for a mismatched certificate and key.")
+	}
+}
+
+func TestLocalSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quantum-rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testAuthConfig()
+	cfg.DataDir = dir
+	cfg.StatsPort = 1097
+	cfg.StatsReadTokens = []string{"reader"}
+
+	node := &testNode{}
+	api, err := New(cfg, node, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Start()
+
+	info, err := os.Stat(SocketPath(dir))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("The local api socket was not created with the correct permissions:", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", SocketPath(dir))
+		},
+	}}
+
+	// Clients of the local socket are granted full access without a token.
+	resp, err := client.Post("http://quantum/v1/drain", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !node.drained {
+		t.Fatal("The local api socket did not grant full access:", resp.StatusCode)
+	}
+
+	// The socket taken over by the new process of a rolling restart is left alone by the previous process, and removed once the new process stops.
+	cfg.StatsPort = 1096
+	next, err := New(cfg, node, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Start()
+
+	api.Stop()
+	if _, err := os.Stat(SocketPath(dir)); err != nil {
+		t.Fatal("Stopping the previous api removed the socket of the new api:", err)
+	}
+
+	next.Stop()
+	if _, err := os.Stat(SocketPath(dir)); !os.IsNotExist(err) {
+		t.Fatal("Stopping the api left the local api socket behind:", err)
+	}
+}
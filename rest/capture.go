@@ -0,0 +1,135 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/supernomad/quantum/capture"
+	"github.com/supernomad/quantum/version"
+)
+
+var protocols = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+func (rest *Rest) returnCapture(w http.ResponseWriter, r *http.Request) {
+	rest.logRequest(r)
+
+	filter, count, err := parseCaptureQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := rest.tap.Open(filter)
+	defer session.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", capture.ContentType)
+	header.Set("Content-Disposition", "attachment; filename=\"quantum.pcapng\"")
+	header.Set("Server", "quantum v"+version.Version())
+
+	pw, err := capture.NewWriter(w)
+	if err != nil {
+		rest.cfg.Log.Error("rest", "Error writing capture api response", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+
+	// Flush the headers straight away so that the client can begin decoding the stream before the first packet is captured.
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	rest.cfg.Log.Info("rest", "Started a packet capture.", "remote", r.RemoteAddr)
+
+	captured := 0
+	for count == 0 || captured < count {
+		select {
+		case <-r.Context().Done():
+			rest.cfg.Log.Info("rest", "Finished a packet capture.", "remote", r.RemoteAddr, "captured", captured, "dropped", session.Dropped())
+			return
+		case packet := <-session.Packets():
+			if err := pw.WritePacket(packet); err != nil {
+				rest.cfg.Log.Warn("rest", "Error writing capture api response", "remote", r.RemoteAddr, "error", err)
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+			captured++
+		}
+	}
+
+	rest.cfg.Log.Info("rest", "Finished a packet capture.", "remote", r.RemoteAddr, "captured", captured, "dropped", session.Dropped())
+}
+
+// parseCaptureQuery parses the filter and the number of packets to capture from the query string, a count of 0 captures packets until the client disconnects.
+func parseCaptureQuery(query url.Values) (*capture.Filter, int, error) {
+	filter := &capture.Filter{
+		Rx:       true,
+		Tx:       true,
+		Protocol: capture.AnyProtocol,
+		Point:    capture.Before,
+	}
+
+	if peer := query.Get("peer"); peer != "" {
+		filter.Peer = net.ParseIP(peer)
+		if filter.Peer == nil {
+			return nil, 0, errors.New("'peer' must be the private ip address of a remote node")
+		}
+	}
+
+	switch query.Get("dir") {
+	case "", "both":
+	case "rx":
+		filter.Tx = false
+	case "tx":
+		filter.Rx = false
+	default:
+		return nil, 0, errors.New("'dir' must be one of 'rx', 'tx', or 'both'")
+	}
+
+	if proto := strings.ToLower(query.Get("proto")); proto != "" {
+		number, ok := protocols[proto]
+		if !ok {
+			var err error
+			number, err = strconv.Atoi(proto)
+			if err != nil || number < 0 || number > 255 {
+				return nil, 0, errors.New("'proto' must be one of 'icmp', 'icmpv6', 'tcp', 'udp', 'sctp', or an ip protocol number")
+			}
+		}
+		filter.Protocol = number
+	}
+
+	switch query.Get("point") {
+	case "", "before":
+	case "after":
+		filter.Point = capture.After
+	default:
+		return nil, 0, errors.New("'point' must be either 'before' or 'after'")
+	}
+
+	var count int
+	if value := query.Get("count"); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, 0, errors.New("'count' must be a positive number of packets to capture")
+		}
+	}
+
+	return filter, count, nil
+}
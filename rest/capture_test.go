@@ -0,0 +1,37 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/supernomad/quantum/capture"
+)
+
+func TestParseCaptureQuery(t *testing.T) {
+	filter, count, err := parseCaptureQuery(url.Values{})
+	if err != nil || count != 0 || filter.Peer != nil || !filter.Rx || !filter.Tx || filter.Protocol != capture.AnyProtocol || filter.Point != capture.Before {
+		t.Fatal("parseCaptureQuery returned the wrong defaults:", filter, count, err)
+	}
+
+	query, _ := url.ParseQuery("peer=10.99.0.5&dir=rx&proto=TCP&point=after&count=1000")
+	filter, count, err = parseCaptureQuery(query)
+	if err != nil || count != 1000 || filter.Peer.String() != "10.99.0.5" || !filter.Rx || filter.Tx || filter.Protocol != 6 || filter.Point != capture.After {
+		t.Fatal("parseCaptureQuery returned the wrong filter:", filter, count, err)
+	}
+
+	query, _ = url.ParseQuery("dir=tx&proto=47")
+	filter, _, err = parseCaptureQuery(query)
+	if err != nil || filter.Rx || !filter.Tx || filter.Protocol != 47 {
+		t.Fatal("parseCaptureQuery returned the wrong filter:", filter, err)
+	}
+
+	for _, invalid := range []string{"peer=woot", "dir=sideways", "proto=ipx", "proto=256", "point=during", "count=-1", "count=many"} {
+		query, _ := url.ParseQuery(invalid)
+		if _, _, err := parseCaptureQuery(query); err == nil {
+			t.Fatal("parseCaptureQuery accepted an invalid query:", invalid)
+		}
+	}
+}
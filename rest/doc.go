@@ -4,7 +4,44 @@
 /*
 Package rest contains the structs and logic to handle exposing internal metrics via a simple REST api for consumption by a myriad of different collection mechanisms.
 
-The rest api is exposed by default at 'http://127.0.0.1:1099/metrics', but the ip, port, and uri are configurable at run time.
+The rest api is exposed by default at 'http://127.0.0.1:1099/stats', but the ip, port, and uri are configurable at run time.
+
+The same statistics, along with the datastore error counters, the mapping count, and the build version, are also exposed in the prometheus text exposition format at 'http://127.0.0.1:1099/metrics' for scraping.
+
+When latency monitoring is enabled the full mesh latency matrix of the quantum network is exposed at 'http://127.0.0.1:1099/latency', see the latency package for details.
+
+Live packet captures are streamed in the pcapng format from 'http://127.0.0.1:1099/capture', filtered by the 'peer', 'dir' (rx, tx, or both), 'proto', and 'point' (before or after the plugins) query parameters, and ending after 'count' packets or when the client disconnects. See the capture package for details.
+
+Changes to the quantum network are streamed as server-sent events from 'http://127.0.0.1:1099/events', optionally filtered by the comma delimited 'kind' query parameter. Each event is written with its kind as the event name and its json representation as the data, see the event package for details.
+
+The administrative api is versioned, and version 1 exposes the following read only json resources under 'http://127.0.0.1:1099/v1/':
+    - 'node' the summary of the local node's configuration, the same summary logged at startup.
+    - 'peers' every node in the quantum network along with its endpoint and plugins, 'peers/<private ip>' returns a single node.
+    - 'network' the network configuration shared by the quantum network.
+    - 'floating' the floating ip addresses along with the node that currently owns each of them.
+    - 'route' the gateway that traffic destined outside of the quantum network is routed to.
+    - 'health' the general health of the local node, including the liveness and readiness reports below.
+    - 'metrics' the same statistics exposed at '/stats'.
+    - 'ping/<target>' probes the overlay path to an ip, machine id, or hostname, sending the number of probes given by the 'count' query parameter to each hop, see the diag package for details.
+
+Version 1 also exposes the following administrative actions, which only accept POST requests:
+    - 'floating/<ip>/release' releases a floating ip claimed by the local node, and refrains from claiming it again for a few floating ip ttls so that another node can claim it.
+    - 'floating/<ip>/move/<node>' hands a floating ip claimed by the local node to another node, identified by its private ip or machine id, which must also be configured with the floating ip. No other node claims the floating ip until the target node has claimed it, or a few floating ip ttls have passed.
+    - 'drain' releases every floating ip claimed by the local node, refrains from claiming any from then on, and marks the node as not ready.
+    - 'reload' reloads the quantum process, in the same way as sending it a SIGHUP.
+    - 'rotate-keys' replaces the encryption keys of the local node with newly generated ones, and stores them in the data directory.
+
+Liveness and readiness probes are served without authentication, so that load balancers and orchestrators can reach them, and respond with a 503 if any of their checks fail:
+    - 'http://127.0.0.1:1099/healthz' checks that every worker goroutine is running and that none of them are stuck handling a single packet.
+    - 'http://127.0.0.1:1099/readyz' checks that the datastore finished its initial sync, that it is being watched for changes, that the last successful sync is recent, that the network device and socket queues are open, and that every worker is running.
+
+Errors are returned as json objects containing the http 'status' and the 'error' message. Appending '?pretty' to any route indents the response.
+
+The api is served over plain http by default, setting the '--stats-tls-cert' and '--stats-tls-key' serves it over https instead, and setting '--stats-tls-ca-cert' requires every client to present a certificate signed by that ca.
+
+Clients can also be required to present a bearer token in the 'Authorization' header. Tokens listed in '--stats-read-tokens' grant read only access, while tokens listed in '--stats-admin-tokens' grant access to every route, including packet captures. The event stream only requires read only access. If no tokens are configured every client is granted read only access, as packet captures and the v1 actions are then only served over the local api socket, so an api that is reachable from outside of the node should always be protected by tokens or client certificates.
+
+The api is also served over the unix socket 'quantum.sock' in the data directory, which is only accessible to the owner of the quantum process. Requests over the socket are granted full access without a token, and are how the 'quantum ctl' client administers the local node, see the ctl package for details.
 
 The statistics structure that is exposed is the following with both the links and queues objects being variable based on usage:
 	{
@@ -0,0 +1,103 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/version"
+)
+
+var (
+	// keepAliveInterval is how often a comment is written to an idle event stream, so that proxies do not close the connection.
+	keepAliveInterval = 15 * time.Second
+)
+
+func (rest *Rest) returnEvents(w http.ResponseWriter, r *http.Request) {
+	rest.logRequest(r)
+
+	kinds, err := parseEventsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := rest.bus.Subscribe(kinds...)
+	defer sub.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Server", "quantum v"+version.Version())
+
+	// Flush the headers straight away so that the client knows the stream is open before the first event is published.
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	rest.cfg.Log.Info("rest", "Started an event stream.", "remote", r.RemoteAddr)
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	streamed := 0
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			rest.cfg.Log.Info("rest", "Finished an event stream.", "remote", r.RemoteAddr, "streamed", streamed, "dropped", sub.Dropped())
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-sub.Events():
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, e.Bytes())
+			streamed++
+		}
+
+		if err != nil {
+			rest.cfg.Log.Warn("rest", "Error writing events api response", "remote", r.RemoteAddr, "error", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// parseEventsQuery parses the comma delimited kinds of events to stream from the query string, every kind of event is streamed if none are given.
+func parseEventsQuery(query url.Values) ([]event.Kind, error) {
+	var kinds []event.Kind
+	for _, value := range query["kind"] {
+		for _, name := range strings.Split(value, ",") {
+			if name == "" {
+				continue
+			}
+
+			kind, ok := parseKind(name)
+			if !ok {
+				return nil, errors.New("'" + name + "' is not a valid event kind")
+			}
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds, nil
+}
+
+func parseKind(name string) (event.Kind, bool) {
+	for _, kind := range event.Kinds {
+		if string(kind) == name {
+			return kind, true
+		}
+	}
+	return "", false
+}
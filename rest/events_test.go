@@ -0,0 +1,99 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/latency"
+	"github.com/supernomad/quantum/metric"
+)
+
+func TestParseEventsQuery(t *testing.T) {
+	kinds, err := parseEventsQuery(url.Values{})
+	if err != nil || len(kinds) != 0 {
+		t.Fatal("parseEventsQuery should stream every kind of event without a filter:", kinds, err)
+	}
+
+	kinds, err = parseEventsQuery(url.Values{"kind": []string{"peer-up,peer-down", "gateway-changed,"}})
+	if err != nil || len(kinds) != 3 || kinds[0] != event.PeerUp || kinds[2] != event.GatewayChanged {
+		t.Fatal("parseEventsQuery returned the wrong kinds:", kinds, err)
+	}
+
+	if _, err := parseEventsQuery(url.Values{"kind": []string{"peer-sideways"}}); err == nil {
+		t.Fatal("parseEventsQuery should have returned an error for an invalid kind.")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	cfg := testAuthConfig()
+	cfg.EventsRoute = "/events"
+
+	bus := event.NewBus()
+	api, err := New(cfg, &testNode{}, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, bus), nil, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(api.mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?kind=woot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("The events route accepted an invalid kind:", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/events?kind=peer-down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("The events route returned the wrong response:", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The subscription is open once the headers have been received, and only the filtered kind is streamed.
+	bus.Publish(event.New(event.PeerUp, net.ParseIP("10.99.0.2"), nil), event.New(event.PeerDown, net.ParseIP("10.99.0.3"), nil))
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	expected := []string{"event: peer-down", "data: ", ""}
+	for i := 0; i < len(expected); i++ {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, expected[i]) {
+				t.Fatal("The events route streamed the wrong line:", line)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				e := &event.Event{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e); err != nil || !e.PrivateIP.Equal(net.ParseIP("10.99.0.3")) {
+					t.Fatal("The events route streamed the wrong event:", line, err)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("The events route did not stream the published event.")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"net/http"
+)
+
+const (
+	// StatusOK is the status of a report whose checks have all passed.
+	StatusOK = "ok"
+
+	// StatusFailing is the status of a report with at least one failing check.
+	StatusFailing = "failing"
+)
+
+// Check is the result of checking a single component of the node.
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report is the combined result of a set of checks, which is only ok if every check passed.
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+func newReport(checks []Check) *Report {
+	report := &Report{Status: StatusOK, Checks: checks}
+	for i := 0; i < len(checks); i++ {
+		if !checks[i].OK {
+			report.Status = StatusFailing
+		}
+	}
+	if report.Checks == nil {
+		report.Checks = []Check{}
+	}
+	return report
+}
+
+func (rest *Rest) returnReport(w http.ResponseWriter, r *http.Request, report *Report) {
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	rest.writeJSON(w, r, status, report)
+}
+
+func (rest *Rest) returnHealth(w http.ResponseWriter, r *http.Request) {
+	rest.logRequest(r)
+	rest.returnReport(w, r, newReport(rest.node.Liveness()))
+}
+
+func (rest *Rest) returnReady(w http.ResponseWriter, r *http.Request) {
+	rest.logRequest(r)
+	rest.returnReport(w, r, newReport(rest.node.Readiness()))
+}
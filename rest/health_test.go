@@ -0,0 +1,55 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/latency"
+	"github.com/supernomad/quantum/metric"
+)
+
+func TestHealth(t *testing.T) {
+	cfg := testAuthConfig()
+	cfg.HealthRoute = "/healthz"
+	cfg.ReadyRoute = "/readyz"
+	cfg.StatsReadTokens = []string{"reader"}
+
+	node := &testNode{}
+	api, err := New(cfg, node, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The probes are served without a bearer token.
+	report := &Report{}
+	testV1(t, api, http.MethodGet, "/healthz", http.StatusOK, report)
+	if report.Status != StatusOK || len(report.Checks) != 1 || report.Checks[0].Name != "workers" {
+		t.Fatal("/healthz returned the wrong report:", report)
+	}
+
+	report = &Report{}
+	testV1(t, api, http.MethodGet, "/readyz", http.StatusOK, report)
+	if report.Status != StatusOK || len(report.Checks) != 2 {
+		t.Fatal("/readyz returned the wrong report:", report)
+	}
+
+	node.notReady = true
+	report = &Report{}
+	testV1(t, api, http.MethodGet, "/readyz", http.StatusServiceUnavailable, report)
+	if report.Status != StatusFailing || report.Checks[1].OK || report.Checks[1].Detail != "woot" {
+		t.Fatal("/readyz returned the wrong report for a node that is not ready:", report)
+	}
+
+	// The versioned health resource still requires a token.
+	testAuth(t, api, "/v1/health", "", http.StatusUnauthorized)
+	testAuth(t, api, "/v1/health", "reader", http.StatusOK)
+
+	if report := newReport(nil); report.Status != StatusOK || report.Checks == nil {
+		t.Fatal("newReport returned the wrong report for an empty set of checks:", report)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"unicode"
+
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/version"
+)
+
+const (
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	prometheusPrefix      = "quantum_"
+)
+
+type prometheusSample struct {
+	labels string
+	value  uint64
+}
+
+func (rest *Rest) returnMetrics(w http.ResponseWriter, r *http.Request) {
+	rest.logRequest(r)
+
+	header := w.Header()
+	header.Set("Content-Type", prometheusContentType)
+	header.Set("Server", "quantum v"+version.Version())
+
+	buf := &bytes.Buffer{}
+	writePrometheus(buf, rest.aggregator.MetricsLog())
+
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		rest.cfg.Log.Error("rest", "Error writing metrics api response", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+// writePrometheus writes the metrics log to w in the prometheus text exposition format.
+func writePrometheus(w io.Writer, metricsLog *metric.MetricsLog) {
+	writePrometheusFamily(w, "build_info", "gauge", "The version of quantum that is running.", []prometheusSample{
+		{labels: `version="` + version.Version() + `"`, value: 1},
+	})
+
+	directions := []struct {
+		name    string
+		metrics *metric.Metrics
+	}{
+		{"rx", metricsLog.RxMetrics},
+		{"tx", metricsLog.TxMetrics},
+	}
+
+	families := []struct {
+		name  string
+		help  string
+		value func(*metric.Metrics) uint64
+	}{
+		{"packets_total", "The number of packets successfully handled by quantum.", func(m *metric.Metrics) uint64 { return m.Packets }},
+		{"bytes_total", "The number of bytes successfully handled by quantum.", func(m *metric.Metrics) uint64 { return m.Bytes }},
+		{"dropped_packets_total", "The number of packets quantum has dropped.", func(m *metric.Metrics) uint64 { return m.DroppedPackets }},
+		{"dropped_bytes_total", "The number of bytes quantum has dropped.", func(m *metric.Metrics) uint64 { return m.DroppedBytes }},
+	}
+
+	for _, family := range families {
+		var total, queues, peers []prometheusSample
+		for _, direction := range directions {
+			label := `direction="` + direction.name + `"`
+			total = append(total, prometheusSample{labels: label, value: family.value(direction.metrics)})
+
+			for _, queue := range sortedQueues(direction.metrics.Queues) {
+				queues = append(queues, prometheusSample{
+					labels: label + `,queue="` + strconv.Itoa(queue) + `"`,
+					value:  family.value(direction.metrics.Queues[queue]),
+				})
+			}
+
+			for _, peer := range sortedLinks(direction.metrics.Links) {
+				peers = append(peers, prometheusSample{
+					labels: label + `,peer="` + peer + `"`,
+					value:  family.value(direction.metrics.Links[peer]),
+				})
+			}
+		}
+
+		writePrometheusFamily(w, family.name, "counter", family.help, total)
+		writePrometheusFamily(w, "queue_"+family.name, "counter", family.help+" Split out per queue.", queues)
+		writePrometheusFamily(w, "peer_"+family.name, "counter", family.help+" Split out per remote peer.", peers)
+	}
+
+	var reasons []prometheusSample
+	for _, direction := range directions {
+		for _, reason := range sortedValues(direction.metrics.DroppedReasons) {
+			reasons = append(reasons, prometheusSample{
+				labels: `direction="` + direction.name + `",reason="` + snakeCase(reason) + `"`,
+				value:  direction.metrics.DroppedReasons[reason],
+			})
+		}
+	}
+	writePrometheusFamily(w, "dropped_packets_by_reason_total", "counter", "The number of packets quantum has dropped split out by the reason they were dropped.", reasons)
+
+	for _, name := range sortedValues(metricsLog.Counters) {
+		writePrometheusFamily(w, snakeCase(name)+"_total", "counter", "The "+name+" counter reported by quantum.", []prometheusSample{{value: metricsLog.Counters[name]}})
+	}
+
+	for _, name := range sortedValues(metricsLog.Gauges) {
+		writePrometheusFamily(w, snakeCase(name), "gauge", "The "+name+" gauge reported by quantum.", []prometheusSample{{value: metricsLog.Gauges[name]}})
+	}
+}
+
+func writePrometheusFamily(w io.Writer, name, kind, help string, samples []prometheusSample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	name = prometheusPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+
+	for _, sample := range samples {
+		if sample.labels == "" {
+			fmt.Fprintf(w, "%s %d\n", name, sample.value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, sample.labels, sample.value)
+		}
+	}
+}
+
+// snakeCase converts a camel case name, such as 'datastoreSyncErrors', into the snake case name prometheus expects, such as 'datastore_sync_errors'.
+func snakeCase(name string) string {
+	buf := &bytes.Buffer{}
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				buf.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func sortedQueues(queues map[int]*metric.Metrics) []int {
+	keys := make([]int, 0, len(queues))
+	for queue := range queues {
+		keys = append(keys, queue)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func sortedLinks(links map[string]*metric.Metrics) []string {
+	keys := make([]string, 0, len(links))
+	for link := range links {
+		keys = append(keys, link)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedValues(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for name := range values {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
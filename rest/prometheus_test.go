@@ -0,0 +1,69 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/version"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	metricsLog := &metric.MetricsLog{
+		TxMetrics: &metric.Metrics{
+			Packets: 2,
+			Bytes:   40,
+			Queues: map[int]*metric.Metrics{
+				1: {Packets: 1, Bytes: 20},
+				0: {Packets: 1, Bytes: 20},
+			},
+			Links: map[string]*metric.Metrics{
+				"10.99.0.1": {Packets: 2, Bytes: 40},
+			},
+		},
+		RxMetrics: &metric.Metrics{
+			DroppedPackets: 1,
+			DroppedBytes:   20,
+			DroppedReasons: map[string]uint64{"unknownDestination": 1},
+		},
+		Counters: map[string]uint64{"datastoreSyncErrors": 3},
+		Gauges:   map[string]uint64{"mappings": 4},
+	}
+
+	buf := &bytes.Buffer{}
+	writePrometheus(buf, metricsLog)
+	out := buf.String()
+
+	expected := []string{
+		`quantum_build_info{version="` + version.Version() + `"} 1`,
+		"# TYPE quantum_packets_total counter",
+		`quantum_packets_total{direction="tx"} 2`,
+		`quantum_bytes_total{direction="rx"} 0`,
+		`quantum_dropped_packets_total{direction="rx"} 1`,
+		`quantum_dropped_bytes_total{direction="rx"} 20`,
+		`quantum_queue_packets_total{direction="tx",queue="0"} 1` + "\n" + `quantum_queue_packets_total{direction="tx",queue="1"} 1`,
+		`quantum_peer_bytes_total{direction="tx",peer="10.99.0.1"} 40`,
+		`quantum_dropped_packets_by_reason_total{direction="rx",reason="unknown_destination"} 1`,
+		"# TYPE quantum_datastore_sync_errors_total counter\nquantum_datastore_sync_errors_total 3",
+		"# TYPE quantum_mappings gauge\nquantum_mappings 4",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(out, line) {
+			t.Fatalf("The prometheus output is missing %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	if actual := snakeCase("datastoreSyncErrors"); actual != "datastore_sync_errors" {
+		t.Fatal("snakeCase returned the wrong name:", actual)
+	}
+	if actual := snakeCase("mappings"); actual != "mappings" {
+		t.Fatal("snakeCase modified a name without upper case characters:", actual)
+	}
+}
@@ -4,26 +4,60 @@
 package rest
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/supernomad/quantum/capture"
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/latency"
 	"github.com/supernomad/quantum/metric"
 	"github.com/supernomad/quantum/version"
 )
 
+const (
+	// SocketName is the name of the unix socket, within the data directory, that the api is also served on for local administration.
+	SocketName = "quantum.sock"
+)
+
+// localKey marks the context of requests received over the unix socket.
+type localKey struct{}
+
+// SocketPath returns the path of the unix socket the api is served on for local administration.
+func SocketPath(dataDir string) string {
+	return path.Join(dataDir, SocketName)
+}
+
 // Rest is a generic rest api struct for exporting internal information and general purpose api settings.
 type Rest struct {
 	cfg        *common.Config
+	node       Node
+	started    time.Time
 	stopped    bool
+	socket     os.FileInfo
+	mux        *http.ServeMux
 	server     *http.Server
+	local      *http.Server
 	aggregator *metric.Aggregator
+	monitor    *latency.Monitor
+	tap        *capture.Tap
+	bus        *event.Bus
+	routes     map[string]bool
+	tokens     []token
+}
+
+func (rest *Rest) logRequest(r *http.Request) {
+	rest.cfg.Log.Debug("rest", "Received an api request.", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
 }
 
 func (rest *Rest) returnStats(w http.ResponseWriter, r *http.Request) {
-	rest.cfg.Log.Debug.Println("[REST]", "Received an api request:", r)
+	rest.logRequest(r)
 
 	header := w.Header()
 	header.Set("Content-Type", "application/json")
@@ -31,38 +65,160 @@ func (rest *Rest) returnStats(w http.ResponseWriter, r *http.Request) {
 
 	_, err := w.Write(rest.aggregator.Bytes(strings.Contains(r.RequestURI, "pretty")))
 	if err != nil {
-		rest.cfg.Log.Error.Println("[REST]", "Error writing stats api response:", err.Error())
+		rest.cfg.Log.Error("rest", "Error writing stats api response", "remote", r.RemoteAddr, "error", err)
 	}
 }
 
-func (rest *Rest) run() {
-	http.HandleFunc(rest.cfg.StatsRoute, rest.returnStats)
+func (rest *Rest) returnLatency(w http.ResponseWriter, r *http.Request) {
+	rest.logRequest(r)
 
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Server", "quantum v"+version.Version())
+
+	_, err := w.Write(rest.monitor.Matrix().Bytes(strings.Contains(r.RequestURI, "pretty")))
+	if err != nil {
+		rest.cfg.Log.Error("rest", "Error writing latency api response", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+// handle registers the handler for the route, only serving it to clients granted the required scope, unless the route is empty or has already been registered.
+func (rest *Rest) handle(route string, required scope, handler http.HandlerFunc) {
+	if route == "" {
+		return
+	}
+
+	if rest.routes[route] {
+		rest.cfg.Log.Warn("rest", "The api route is configured more than once, only the first use will be served.", "route", route)
+		return
+	}
+
+	rest.routes[route] = true
+	rest.mux.HandleFunc(route, rest.authorize(required, handler))
+}
+
+func (rest *Rest) register() {
+	cfg := rest.cfg.Current()
+	rest.handle(cfg.StatsRoute, readScope, rest.returnStats)
+	rest.handle(cfg.MetricsRoute, readScope, rest.returnMetrics)
+	rest.handle(cfg.LatencyRoute, readScope, rest.returnLatency)
+	rest.handle(cfg.HealthRoute, publicScope, rest.returnHealth)
+	rest.handle(cfg.ReadyRoute, publicScope, rest.returnReady)
+
+	// Packet captures expose the plaintext traffic crossing the node, so they always require an admin token or the local api socket.
+	rest.handle(cfg.CaptureRoute, adminScope, rest.restricted(rest.returnCapture))
+	rest.handle(cfg.EventsRoute, readScope, rest.returnEvents)
+	rest.registerV1()
+}
+
+func (rest *Rest) run() {
 	for {
-		if err := rest.server.ListenAndServe(); err != nil && !rest.stopped {
-			rest.cfg.Log.Error.Println("[REST]", "Error initializing stats api:", err.Error())
+		var err error
+		if rest.server.TLSConfig != nil {
+			err = rest.server.ListenAndServeTLS("", "")
+		} else {
+			err = rest.server.ListenAndServe()
+		}
+
+		if err != nil && !rest.stopped {
+			rest.cfg.Log.Error("rest", "Error initializing stats api", "error", err)
+		}
+
+		if rest.stopped {
+			return
 		}
 
 		time.Sleep(10 * time.Second)
 	}
 }
 
-// Start will start the rest api up on the specified address and routes.
+// serveLocal serves the api on the unix socket within the data directory, which only the owner of the quantum process can connect to.
+func (rest *Rest) serveLocal() {
+	if rest.cfg.DataDir == "" {
+		return
+	}
+
+	// Remove the socket left behind by a previous process, during a rolling restart the previous process is still serving on the old socket.
+	socketPath := SocketPath(rest.cfg.DataDir)
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		rest.cfg.Log.Error("rest", "Error initializing the local api socket", "error", err)
+		return
+	}
+	// The socket is only removed on close while it is still the one created here, see Stop.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		os.Remove(socketPath)
+		rest.cfg.Log.Error("rest", "Error restricting the permissions of the local api socket", "error", err)
+		return
+	}
+
+	rest.socket, err = os.Stat(socketPath)
+	if err != nil {
+		rest.cfg.Log.Warn("rest", "Error reading the local api socket, it will be left behind once the api is stopped", "error", err)
+	}
+
+	go func() {
+		if err := rest.local.Serve(listener); err != nil && !rest.stopped {
+			rest.cfg.Log.Error("rest", "Error serving the local api socket", "error", err)
+		}
+	}()
+}
+
+// Start will start the rest api up on the specified address and routes, along with the local api socket.
 func (rest *Rest) Start() {
+	rest.started = time.Now()
+	rest.serveLocal()
 	go rest.run()
 }
 
-// Stop will stop the rest api.
+// Stop will stop the rest api, and remove the local api socket unless it has been replaced by the new process started during a rolling restart.
 func (rest *Rest) Stop() error {
 	rest.stopped = true
+	rest.local.Close()
+
+	if rest.socket != nil {
+		socketPath := SocketPath(rest.cfg.DataDir)
+		if info, err := os.Stat(socketPath); err == nil && os.SameFile(info, rest.socket) {
+			os.Remove(socketPath)
+		}
+		rest.socket = nil
+	}
+
 	return rest.server.Close()
 }
 
-// New generates an Rest instance exposing metrics and general purpose routes via a REST api interface.
-func New(cfg *common.Config, aggregator *metric.Aggregator) *Rest {
-	return &Rest{
+// New generates an Rest instance exposing metrics, general purpose routes, and the administrative api for the supplied node via a REST api interface.
+func New(cfg *common.Config, node Node, aggregator *metric.Aggregator, monitor *latency.Monitor, tap *capture.Tap, bus *event.Bus) (*Rest, error) {
+	// The api is created again when its options are changed in place, so it is always created from the running configuration.
+	running := cfg.Current()
+	tlsCfg, err := newTLSConfig(running.StatsTLSCert, running.StatsTLSKey, running.StatsTLSCA)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	local := func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localKey{}, true)))
+	}
+
+	rest := &Rest{
 		cfg:        cfg,
-		server:     &http.Server{Addr: fmt.Sprintf("%s:%d", cfg.StatsAddress, cfg.StatsPort)},
+		node:       node,
+		mux:        mux,
+		server:     &http.Server{Addr: fmt.Sprintf("%s:%d", running.StatsAddress, running.StatsPort), Handler: mux, TLSConfig: tlsCfg},
+		local:      &http.Server{Handler: http.HandlerFunc(local)},
 		aggregator: aggregator,
+		monitor:    monitor,
+		tap:        tap,
+		bus:        bus,
+		routes:     make(map[string]bool),
+		tokens:     append(newTokens(running.StatsReadTokens, readScope), newTokens(running.StatsAdminTokens, adminScope)...),
 	}
+	rest.register()
+	return rest, nil
 }
@@ -4,60 +4,127 @@
 package rest
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/supernomad/quantum/capture"
 	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/latency"
 	"github.com/supernomad/quantum/metric"
 )
 
 func TestRest(t *testing.T) {
 	cfg := &common.Config{
 		Log:          common.NewLogger(common.NoopLogger),
-		StatsRoute:   "/metrics",
+		StatsRoute:   "/stats",
+		MetricsRoute: "/metrics",
+		LatencyRoute: "/latency",
+		CaptureRoute: "/capture",
 		StatsPort:    1099,
 		StatsAddress: "127.0.0.1",
 		NumWorkers:   1,
+
+		// Packet captures are only served to admin tokens over tcp.
+		StatsAdminTokens: []string{"admin"},
+	}
+
+	get := func(url string) (*http.Response, error) {
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer admin")
+		return http.DefaultClient.Do(r)
 	}
 
 	aggregator := metric.New(cfg)
-	api := New(cfg, aggregator)
+	tap := capture.New(cfg)
+	api, err := New(cfg, &testNode{}, aggregator, latency.New(cfg, &datastore.Mock{}, event.NewBus()), tap, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	api.Start()
-	aggregator.Start()
 
-	aggregator.Metrics <- &metric.Metric{
-		Type:      metric.Tx,
-		Dropped:   false,
-		PrivateIP: "10.99.0.1",
-		Bytes:     20,
+	mapping := &common.Mapping{PrivateIP: net.ParseIP("10.99.0.1")}
+	aggregator.Record(metric.Tx, 0, metric.NotDropped, 20, mapping)
+	aggregator.Record(metric.Tx, 0, metric.NotDropped, 20, mapping)
+	aggregator.Record(metric.Rx, 0, metric.SocketReadError, 20, nil)
+	aggregator.Record(metric.Rx, 0, metric.NotDropped, 20, mapping)
+
+	time.Sleep(1 * time.Millisecond)
+
+	_, err = get("http://127.0.0.1:1099/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := get("http://127.0.0.1:1099/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != prometheusContentType {
+		t.Fatal("The metrics route returned the wrong content type:", resp.Header.Get("Content-Type"))
+	}
+
+	resp, err = get("http://127.0.0.1:1099/latency?pretty")
+	if err != nil {
+		t.Fatal(err)
 	}
-	aggregator.Metrics <- &metric.Metric{
-		Type:      metric.Tx,
-		Dropped:   false,
-		PrivateIP: "10.99.0.1",
-		Bytes:     20,
+	defer resp.Body.Close()
+
+	matrix := &latency.Matrix{}
+	if err := json.NewDecoder(resp.Body).Decode(matrix); err != nil {
+		t.Fatal("The latency route returned an invalid matrix:", err)
 	}
-	aggregator.Metrics <- &metric.Metric{
-		Type:    metric.Rx,
-		Dropped: true,
-		Bytes:   20,
+
+	resp, err = get("http://127.0.0.1:1099/capture?dir=sideways")
+	if err != nil {
+		t.Fatal(err)
 	}
-	aggregator.Metrics <- &metric.Metric{
-		Type:      metric.Rx,
-		Dropped:   false,
-		PrivateIP: "10.99.0.1",
-		Bytes:     20,
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("The capture route accepted an invalid filter:", resp.StatusCode)
 	}
 
-	time.Sleep(1 * time.Millisecond)
+	// Keep capturing packets until the capture session has been opened and has received one.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		packet := &common.Payload{Packet: make([]byte, common.IPv4HeaderSize)}
+		packet.Packet[0] = 0x45
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				tap.Capture(metric.Tx, capture.Before, 0, packet, mapping)
+			}
+		}
+	}()
+
+	resp, err = get("http://127.0.0.1:1099/capture?peer=10.99.0.1&dir=tx&proto=0&count=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
 
-	_, err := http.Get("http://127.0.0.1:1099/metrics")
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if resp.Header.Get("Content-Type") != capture.ContentType || len(body) == 0 || body[0] != 0x0A {
+		t.Fatal("The capture route returned an invalid capture:", resp.Header.Get("Content-Type"), body)
+	}
 
-	aggregator.Stop()
 	api.Stop()
 }
@@ -0,0 +1,472 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/version"
+)
+
+const (
+	// V1Prefix is the route prefix of version 1 of the administrative api.
+	V1Prefix = "/v1/"
+)
+
+// Node is the view of the running quantum node that the administrative api exposes.
+type Node interface {
+	// DeviceName should return the name of the network device, or an empty string if the node has not been started.
+	DeviceName() string
+
+	// Peers should return the mappings of every node currently known to the datastore, sorted by private ip address.
+	Peers() []*common.Mapping
+
+	// Gateway should return the mapping of the node that traffic destined outside of the quantum network is routed to, if there is one.
+	Gateway() (*common.Mapping, bool)
+
+	// DatastoreStats should return the counters tracking the health of the synchronization with the backend datastore.
+	DatastoreStats() datastore.Stats
+
+	// Liveness should return the result of checking that the worker goroutines are running and processing packets.
+	Liveness() []Check
+
+	// Readiness should return the result of checking that the datastore, network device, socket, and workers are ready to pass traffic.
+	Readiness() []Check
+
+	// Diagnose should probe the overlay path to the target, which is either an ip address, the machine id of a node, or a hostname.
+	Diagnose(target string, count int) (*diag.Result, error)
+
+	// ReleaseFloatingIP should give up the local node's claim on the floating ip, so that another node can claim it.
+	ReleaseFloatingIP(ip net.IP) error
+
+	// MoveFloatingIP should hand the local node's claim on the floating ip to the target node, identified by its private ip or machine id.
+	MoveFloatingIP(ip net.IP, target string) error
+
+	// Drain should give up every floating ip claimed by the local node and mark the node as not ready.
+	Drain()
+
+	// Reload should reload the quantum process.
+	Reload() error
+
+	// RotateKeys should replace the encryption keys of the local node with newly generated ones.
+	RotateKeys() error
+}
+
+// apiError is returned by the resources of the administrative api, and is written out as a json error.
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (err *apiError) Error() string {
+	return err.Message
+}
+
+// NodeInfo is the summary of the local node's configuration.
+type NodeInfo struct {
+	MachineID  string   `json:"machineID"`
+	Version    string   `json:"version"`
+	Device     string   `json:"device"`
+	Network    string   `json:"network"`
+	PrivateIP  net.IP   `json:"privateIP"`
+	PublicIPv4 net.IP   `json:"publicIPv4,omitempty"`
+	PublicIPv6 net.IP   `json:"publicIPv6,omitempty"`
+	ListenPort int      `json:"listenPort"`
+	Datastore  string   `json:"datastore"`
+	Backend    string   `json:"backend"`
+	Plugins    []string `json:"plugins"`
+	Forward    bool     `json:"forward"`
+	Gateway    net.IP   `json:"gatewayIP,omitempty"`
+	Uptime     string   `json:"uptime"`
+}
+
+// Peer is a node in the quantum network, as seen by the local node.
+type Peer struct {
+	MachineID string   `json:"machineID"`
+	PrivateIP net.IP   `json:"privateIP"`
+	Endpoint  string   `json:"endpoint,omitempty"`
+	Plugins   []string `json:"plugins"`
+	Floating  bool     `json:"floating"`
+	Gateway   net.IP   `json:"gatewayIP,omitempty"`
+	Local     bool     `json:"local"`
+}
+
+// FloatingIP is a floating ip address along with the node that currently owns it.
+type FloatingIP struct {
+	IP           net.IP `json:"ip"`
+	OwnerID      string `json:"ownerMachineID"`
+	OwnerIP      net.IP `json:"ownerPrivateIP,omitempty"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	OwnedLocally bool   `json:"ownedLocally"`
+}
+
+// Route is the routing decision the local node makes for traffic destined outside of the quantum network.
+type Route struct {
+	Network string `json:"network"`
+	Forward bool   `json:"forward"`
+	Gateway *Peer  `json:"gateway"`
+}
+
+// Health is the general health of the local node.
+type Health struct {
+	Status    string          `json:"status"`
+	Uptime    string          `json:"uptime"`
+	Peers     int             `json:"peers"`
+	Datastore datastore.Stats `json:"datastore"`
+	Liveness  *Report         `json:"liveness"`
+	Readiness *Report         `json:"readiness"`
+}
+
+// LogLevel is the logging configuration of the local node.
+type LogLevel struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// Result is returned by the actions of the administrative api once they have been carried out.
+type Result struct {
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+func (rest *Rest) peer(mapping *common.Mapping) *Peer {
+	peer := &Peer{
+		MachineID: mapping.MachineID,
+		PrivateIP: mapping.PrivateIP,
+		Plugins:   mapping.SupportedPlugins,
+		Floating:  mapping.Floating,
+		Gateway:   mapping.Gateway,
+		Local:     mapping.MachineID == rest.cfg.MachineID,
+	}
+
+	if mapping.Address != "" {
+		peer.Endpoint = net.JoinHostPort(mapping.Address, strconv.Itoa(mapping.Port))
+	}
+	if peer.Plugins == nil {
+		peer.Plugins = []string{}
+	}
+	return peer
+}
+
+func (rest *Rest) uptime() string {
+	if rest.started.IsZero() {
+		return time.Duration(0).String()
+	}
+	return time.Since(rest.started).Round(time.Second).String()
+}
+
+func (rest *Rest) v1Node(r *http.Request) (interface{}, error) {
+	cfg := rest.cfg.Current()
+	info := &NodeInfo{
+		MachineID:  cfg.MachineID,
+		Version:    version.Version(),
+		Device:     rest.node.DeviceName(),
+		PrivateIP:  cfg.PrivateIP,
+		PublicIPv4: cfg.PublicIPv4,
+		PublicIPv6: cfg.PublicIPv6,
+		ListenPort: cfg.ListenPort,
+		Datastore:  cfg.Datastore,
+		Plugins:    cfg.Plugins,
+		Forward:    cfg.Forward,
+		Uptime:     rest.uptime(),
+	}
+
+	if cfg.NetworkConfig != nil {
+		info.Network = cfg.NetworkConfig.Network
+		info.Backend = cfg.NetworkConfig.Backend
+	}
+	if cfg.Forward {
+		info.Gateway = cfg.Gateway
+	}
+	if info.Plugins == nil {
+		info.Plugins = []string{}
+	}
+	return info, nil
+}
+
+func (rest *Rest) v1Peers(r *http.Request) (interface{}, error) {
+	mappings := rest.node.Peers()
+
+	// Either list every peer, or return the single peer identified by the private ip following the route.
+	ip := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, V1Prefix+"peers"), "/")
+	if ip == "" {
+		peers := make([]*Peer, len(mappings))
+		for i := 0; i < len(mappings); i++ {
+			peers[i] = rest.peer(mappings[i])
+		}
+		return peers, nil
+	}
+
+	privateIP := net.ParseIP(ip)
+	if privateIP == nil {
+		return nil, &apiError{Status: http.StatusBadRequest, Message: "'" + ip + "' is not a valid ip address"}
+	}
+
+	for i := 0; i < len(mappings); i++ {
+		if mappings[i].PrivateIP.Equal(privateIP) {
+			return rest.peer(mappings[i]), nil
+		}
+	}
+	return nil, &apiError{Status: http.StatusNotFound, Message: "no peer with the private ip address '" + ip + "' exists"}
+}
+
+func (rest *Rest) v1Network(r *http.Request) (interface{}, error) {
+	if rest.cfg.NetworkConfig == nil {
+		return nil, &apiError{Status: http.StatusServiceUnavailable, Message: "the network configuration has not been retrieved from the datastore"}
+	}
+	return rest.cfg.NetworkConfig, nil
+}
+
+func (rest *Rest) v1Floating(r *http.Request) (interface{}, error) {
+	mappings := rest.node.Peers()
+
+	owners := make(map[string]net.IP, len(mappings))
+	for i := 0; i < len(mappings); i++ {
+		if !mappings[i].Floating {
+			owners[mappings[i].MachineID] = mappings[i].PrivateIP
+		}
+	}
+
+	floating := []*FloatingIP{}
+	for i := 0; i < len(mappings); i++ {
+		if !mappings[i].Floating {
+			continue
+		}
+
+		peer := rest.peer(mappings[i])
+		floating = append(floating, &FloatingIP{
+			IP:           peer.PrivateIP,
+			OwnerID:      peer.MachineID,
+			OwnerIP:      owners[peer.MachineID],
+			Endpoint:     peer.Endpoint,
+			OwnedLocally: peer.Local,
+		})
+	}
+	return floating, nil
+}
+
+func (rest *Rest) v1Route(r *http.Request) (interface{}, error) {
+	route := &Route{Forward: rest.cfg.Forward}
+	if rest.cfg.NetworkConfig != nil {
+		route.Network = rest.cfg.NetworkConfig.Network
+	}
+	if mapping, ok := rest.node.Gateway(); ok && mapping != nil {
+		route.Gateway = rest.peer(mapping)
+	}
+	return route, nil
+}
+
+func (rest *Rest) v1Health(r *http.Request) (interface{}, error) {
+	health := &Health{
+		Status:    StatusOK,
+		Uptime:    rest.uptime(),
+		Peers:     len(rest.node.Peers()),
+		Datastore: rest.node.DatastoreStats(),
+		Liveness:  newReport(rest.node.Liveness()),
+		Readiness: newReport(rest.node.Readiness()),
+	}
+
+	if health.Liveness.Status != StatusOK || health.Readiness.Status != StatusOK {
+		health.Status = StatusFailing
+	}
+	return health, nil
+}
+
+func (rest *Rest) v1Metrics(r *http.Request) (interface{}, error) {
+	return rest.aggregator.MetricsLog(), nil
+}
+
+func (rest *Rest) v1Ping(r *http.Request) (interface{}, error) {
+	// The target to probe is identified by the route, '/v1/ping/<target>'.
+	target := strings.TrimPrefix(r.URL.Path, V1Prefix+"ping/")
+	if target == "" || strings.Contains(target, "/") {
+		return nil, &apiError{Status: http.StatusNotFound, Message: "the api route '" + r.URL.Path + "' does not exist"}
+	}
+
+	var count int
+	if value := r.URL.Query().Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count <= 0 {
+			return nil, &apiError{Status: http.StatusBadRequest, Message: "'" + value + "' is not a valid probe count"}
+		}
+	}
+
+	if rest.node.DeviceName() == "" {
+		return nil, &apiError{Status: http.StatusServiceUnavailable, Message: "the quantum node has not been started"}
+	}
+
+	result, err := rest.node.Diagnose(target, count)
+	if err != nil {
+		return nil, &apiError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	return result, nil
+}
+
+func (rest *Rest) v1FloatingAction(r *http.Request) (interface{}, error) {
+	// The floating ip is identified by the route, either '/v1/floating/<ip>/release' or '/v1/floating/<ip>/move/<node>'.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, V1Prefix+"floating/"), "/")
+	release := len(parts) == 2 && parts[1] == "release"
+	move := len(parts) == 3 && parts[1] == "move" && parts[2] != ""
+	if !release && !move {
+		return nil, &apiError{Status: http.StatusNotFound, Message: "the api route '" + r.URL.Path + "' does not exist"}
+	}
+
+	ip := parts[0]
+	floatingIP := net.ParseIP(ip)
+	if floatingIP == nil {
+		return nil, &apiError{Status: http.StatusBadRequest, Message: "'" + ip + "' is not a valid ip address"}
+	}
+
+	if release {
+		if err := rest.node.ReleaseFloatingIP(floatingIP); err != nil {
+			return nil, &apiError{Status: http.StatusConflict, Message: "error releasing the floating ip '" + ip + "': " + err.Error()}
+		}
+		return &Result{Action: "release", Message: "released the floating ip '" + ip + "', another node configured with it will claim it"}, nil
+	}
+
+	target := parts[2]
+	if err := rest.node.MoveFloatingIP(floatingIP, target); err != nil {
+		return nil, &apiError{Status: http.StatusConflict, Message: "error moving the floating ip '" + ip + "': " + err.Error()}
+	}
+	return &Result{Action: "move", Message: "moved the floating ip '" + ip + "' to '" + target + "', which will claim it"}, nil
+}
+
+func (rest *Rest) v1Drain(r *http.Request) (interface{}, error) {
+	rest.node.Drain()
+	return &Result{Action: "drain", Message: "released every floating ip, and marked the node as not ready"}, nil
+}
+
+func (rest *Rest) v1Reload(r *http.Request) (interface{}, error) {
+	if err := rest.node.Reload(); err != nil {
+		return nil, errors.New("error reloading the quantum process: " + err.Error())
+	}
+	return &Result{Action: "reload", Message: "reloading the quantum process"}, nil
+}
+
+func (rest *Rest) v1RotateKeys(r *http.Request) (interface{}, error) {
+	if err := rest.node.RotateKeys(); err != nil {
+		return nil, &apiError{Status: http.StatusConflict, Message: "error rotating the encryption keys: " + err.Error()}
+	}
+	return &Result{Action: "rotate-keys", Message: "rotated the encryption keys, every peer derives new encryption state for the node once it picks up the new keys"}, nil
+}
+
+func (rest *Rest) v1LogLevel(r *http.Request) (interface{}, error) {
+	return &LogLevel{Level: rest.cfg.Log.Level().String(), Format: rest.cfg.Current().LogFormat}, nil
+}
+
+func (rest *Rest) v1SetLogLevel(r *http.Request) (interface{}, error) {
+	// The level to log at is identified by the route, '/v1/log-level/<level>'.
+	name := strings.TrimPrefix(r.URL.Path, V1Prefix+"log-level/")
+	level, err := common.ParseLoggerType(name)
+	if err != nil {
+		return nil, &apiError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	rest.cfg.Log.SetLevel(level)
+	rest.cfg.Log.Info("rest", "Changed the log level.", "level", level, "remote", r.RemoteAddr)
+	return &Result{Action: "log-level", Message: "logging at the '" + level.String() + "' level, the configured level is restored when quantum is reloaded"}, nil
+}
+
+func (rest *Rest) v1NotFound(r *http.Request) (interface{}, error) {
+	return nil, &apiError{Status: http.StatusNotFound, Message: "the api route '" + r.URL.Path + "' does not exist"}
+}
+
+// v1 wraps a resource of the administrative api, only allowing GET requests and writing out the resource or error as json.
+func (rest *Rest) v1(resource func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return rest.v1Methods(resource, http.MethodGet, http.MethodHead)
+}
+
+// v1Action wraps an action of the administrative api, only allowing POST requests and writing out the result or error as json.
+func (rest *Rest) v1Action(action func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return rest.v1Methods(action, http.MethodPost)
+}
+
+func (rest *Rest) v1Methods(resource func(r *http.Request) (interface{}, error), methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest.logRequest(r)
+
+		allowed := false
+		for i := 0; i < len(methods); i++ {
+			if r.Method == methods[i] {
+				allowed = true
+			}
+		}
+
+		var value interface{}
+		var err error
+		if !allowed {
+			w.Header().Set("Allow", allow)
+			err = &apiError{Status: http.StatusMethodNotAllowed, Message: "the method '" + r.Method + "' is not allowed"}
+		} else {
+			value, err = resource(r)
+		}
+
+		status := http.StatusOK
+		if err != nil {
+			apiErr, ok := err.(*apiError)
+			if !ok {
+				apiErr = &apiError{Status: http.StatusInternalServerError, Message: err.Error()}
+			}
+			status, value = apiErr.Status, apiErr
+		}
+
+		rest.writeJSON(w, r, status, value)
+	}
+}
+
+// writeJSON writes the value out as json with the given status, the json is indented if the request asks for it to be pretty.
+func (rest *Rest) writeJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Server", "quantum v"+version.Version())
+
+	var buf []byte
+	var err error
+	if _, pretty := r.URL.Query()["pretty"]; pretty {
+		buf, err = json.MarshalIndent(value, "", "  ")
+	} else {
+		buf, err = json.Marshal(value)
+	}
+	if err != nil {
+		rest.cfg.Log.Error("rest", "Error marshalling api response", "remote", r.RemoteAddr, "error", err)
+		status, buf = http.StatusInternalServerError, []byte(`{"status":500,"error":"internal error"}`)
+	}
+
+	w.WriteHeader(status)
+	if _, err := w.Write(append(buf, '\n')); err != nil {
+		rest.cfg.Log.Error("rest", "Error writing api response", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+func (rest *Rest) registerV1() {
+	rest.handle(V1Prefix, readScope, rest.v1(rest.v1NotFound))
+	rest.handle(V1Prefix+"node", readScope, rest.v1(rest.v1Node))
+	rest.handle(V1Prefix+"peers", readScope, rest.v1(rest.v1Peers))
+	rest.handle(V1Prefix+"peers/", readScope, rest.v1(rest.v1Peers))
+	rest.handle(V1Prefix+"network", readScope, rest.v1(rest.v1Network))
+	rest.handle(V1Prefix+"floating", readScope, rest.v1(rest.v1Floating))
+	rest.handle(V1Prefix+"route", readScope, rest.v1(rest.v1Route))
+	rest.handle(V1Prefix+"health", readScope, rest.v1(rest.v1Health))
+	rest.handle(V1Prefix+"metrics", readScope, rest.v1(rest.v1Metrics))
+	rest.handle(V1Prefix+"ping/", readScope, rest.v1(rest.v1Ping))
+	rest.handle(V1Prefix+"log-level", readScope, rest.v1(rest.v1LogLevel))
+
+	// Actions change the state of the node, so they always require an admin token or the local api socket.
+	rest.handle(V1Prefix+"floating/", adminScope, rest.restricted(rest.v1Action(rest.v1FloatingAction)))
+	rest.handle(V1Prefix+"drain", adminScope, rest.restricted(rest.v1Action(rest.v1Drain)))
+	rest.handle(V1Prefix+"reload", adminScope, rest.restricted(rest.v1Action(rest.v1Reload)))
+	rest.handle(V1Prefix+"rotate-keys", adminScope, rest.restricted(rest.v1Action(rest.v1RotateKeys)))
+	rest.handle(V1Prefix+"log-level/", adminScope, rest.restricted(rest.v1Action(rest.v1SetLogLevel)))
+}
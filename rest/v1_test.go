@@ -0,0 +1,322 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/supernomad/quantum/common"
+	"github.com/supernomad/quantum/datastore"
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/latency"
+	"github.com/supernomad/quantum/metric"
+)
+
+// testNode is a node with a fixed set of peers.
+type testNode struct {
+	peers    []*common.Mapping
+	gateway  *common.Mapping
+	notReady bool
+	released []net.IP
+	moved    []net.IP
+	drained  bool
+	reloaded bool
+	rotated  bool
+}
+
+func (node *testNode) DeviceName() string {
+	return "quantum0"
+}
+
+func (node *testNode) Peers() []*common.Mapping {
+	return node.peers
+}
+
+func (node *testNode) Gateway() (*common.Mapping, bool) {
+	return node.gateway, node.gateway != nil
+}
+
+func (node *testNode) DatastoreStats() datastore.Stats {
+	return datastore.Stats{SyncErrors: 1, WatchErrors: 2}
+}
+
+func (node *testNode) Liveness() []Check {
+	return []Check{{Name: "workers", OK: true}}
+}
+
+func (node *testNode) Readiness() []Check {
+	return []Check{{Name: "datastore", OK: true}, {Name: "device", OK: !node.notReady, Detail: "woot"}}
+}
+
+func (node *testNode) Diagnose(target string, count int) (*diag.Result, error) {
+	if target != "10.99.0.2" {
+		return nil, errors.New("error resolving the target '" + target + "'")
+	}
+	return &diag.Result{Target: target, Destination: net.ParseIP(target), Hops: []*diag.Hop{{Role: diag.RoleLocal}, {Role: diag.RolePeer, Sent: count}}}, nil
+}
+
+func (node *testNode) ReleaseFloatingIP(ip net.IP) error {
+	if !ip.Equal(net.ParseIP("10.99.100.1")) {
+		return errors.New("the floating ip is not claimed by the local node")
+	}
+	node.released = append(node.released, ip)
+	return nil
+}
+
+func (node *testNode) MoveFloatingIP(ip net.IP, target string) error {
+	if target != "remote" {
+		return errors.New("the node '" + target + "' is not part of the quantum network")
+	}
+	node.moved = append(node.moved, ip)
+	return nil
+}
+
+func (node *testNode) Drain() {
+	node.drained = true
+}
+
+func (node *testNode) Reload() error {
+	node.reloaded = true
+	return nil
+}
+
+func (node *testNode) RotateKeys() error {
+	if node.rotated {
+		return errors.New("the encryption keys are loaded from a key file")
+	}
+	node.rotated = true
+	return nil
+}
+
+func testV1(t *testing.T, api *Rest, method, route string, status int, v interface{}) {
+	testV1Token(t, api, "", method, route, status, v)
+}
+
+// testV1Token is testV1 for a request presenting the bearer token, or none if the token is empty.
+func testV1Token(t *testing.T, api *Rest, bearer, method, route string, status int, v interface{}) {
+	r := httptest.NewRequest(method, route, nil)
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, r)
+
+	if w.Code != status {
+		t.Fatal(method, route, "returned the wrong status:", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal(method, route, "returned the wrong content type:", w.Header().Get("Content-Type"))
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatal(method, route, "returned invalid json:", err, w.Body.String())
+	}
+}
+
+func TestV1(t *testing.T) {
+	cfg := &common.Config{
+		Log:        common.NewLogger(common.NoopLogger),
+		MachineID:  "local",
+		PrivateIP:  net.ParseIP("10.99.0.1"),
+		ListenPort: 1099,
+		Datastore:  "mock",
+		Forward:    true,
+		Gateway:    net.ParseIP("10.99.0.254"),
+		NetworkConfig: &common.NetworkConfig{
+			Backend: "udp",
+			Network: "10.99.0.0/16",
+		},
+		NumWorkers: 1,
+	}
+
+	local := &common.Mapping{MachineID: "local", PrivateIP: net.ParseIP("10.99.0.1"), Address: "1.1.1.1", Port: 1099}
+	remote := &common.Mapping{MachineID: "remote", PrivateIP: net.ParseIP("10.99.0.2"), Address: "dead::beef", Port: 1099, SupportedPlugins: []string{"encryption"}}
+	floating := &common.Mapping{MachineID: "remote", PrivateIP: net.ParseIP("10.99.100.1"), Address: "dead::beef", Port: 1099, Floating: true}
+
+	node := &testNode{peers: []*common.Mapping{local, remote, floating}, gateway: remote}
+	api, err := New(cfg, node, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &NodeInfo{}
+	testV1(t, api, http.MethodGet, "/v1/node", http.StatusOK, info)
+	if info.MachineID != "local" || info.Device != "quantum0" || info.Network != "10.99.0.0/16" || info.Backend != "udp" || !info.Gateway.Equal(cfg.Gateway) {
+		t.Fatal("/v1/node returned the wrong node info:", info)
+	}
+
+	var peers []*Peer
+	testV1(t, api, http.MethodGet, "/v1/peers?pretty", http.StatusOK, &peers)
+	if len(peers) != 3 || !peers[0].Local || peers[1].Local || peers[1].Endpoint != "[dead::beef]:1099" || peers[1].Plugins[0] != "encryption" {
+		t.Fatal("/v1/peers returned the wrong peers:", peers)
+	}
+
+	peer := &Peer{}
+	testV1(t, api, http.MethodGet, "/v1/peers/10.99.0.2", http.StatusOK, peer)
+	if peer.MachineID != "remote" {
+		t.Fatal("/v1/peers/10.99.0.2 returned the wrong peer:", peer)
+	}
+
+	network := &common.NetworkConfig{}
+	testV1(t, api, http.MethodGet, "/v1/network", http.StatusOK, network)
+	if network.Network != "10.99.0.0/16" {
+		t.Fatal("/v1/network returned the wrong network config:", network)
+	}
+
+	var ips []*FloatingIP
+	testV1(t, api, http.MethodGet, "/v1/floating", http.StatusOK, &ips)
+	if len(ips) != 1 || ips[0].OwnerID != "remote" || !ips[0].OwnerIP.Equal(remote.PrivateIP) || ips[0].OwnedLocally {
+		t.Fatal("/v1/floating returned the wrong floating ips:", ips)
+	}
+
+	route := &Route{}
+	testV1(t, api, http.MethodGet, "/v1/route", http.StatusOK, route)
+	if route.Gateway == nil || route.Gateway.MachineID != "remote" || !route.Forward {
+		t.Fatal("/v1/route returned the wrong route:", route)
+	}
+
+	health := &Health{}
+	testV1(t, api, http.MethodGet, "/v1/health", http.StatusOK, health)
+	if health.Status != StatusOK || health.Peers != 3 || health.Datastore.WatchErrors != 2 || len(health.Readiness.Checks) != 2 {
+		t.Fatal("/v1/health returned the wrong health:", health)
+	}
+
+	diagnosis := &diag.Result{}
+	testV1(t, api, http.MethodGet, "/v1/ping/10.99.0.2?count=2", http.StatusOK, diagnosis)
+	if len(diagnosis.Hops) != 2 || diagnosis.Hops[1].Sent != 2 {
+		t.Fatal("/v1/ping/10.99.0.2 returned the wrong diagnosis:", diagnosis)
+	}
+
+	errors := []struct {
+		method string
+		route  string
+		status int
+	}{
+		{http.MethodGet, "/v1/ping/10.99.0.3", http.StatusBadRequest},
+		{http.MethodGet, "/v1/ping/10.99.0.2?count=woot", http.StatusBadRequest},
+		{http.MethodGet, "/v1/ping/", http.StatusNotFound},
+		{http.MethodGet, "/v1/peers/10.99.0.3", http.StatusNotFound},
+		{http.MethodGet, "/v1/peers/woot", http.StatusBadRequest},
+		{http.MethodGet, "/v1/woot", http.StatusNotFound},
+		{http.MethodPost, "/v1/node", http.StatusMethodNotAllowed},
+	}
+	for _, test := range errors {
+		apiErr := &apiError{}
+		testV1(t, api, test.method, test.route, test.status, apiErr)
+		if apiErr.Status != test.status || apiErr.Message == "" {
+			t.Fatal(test.method, test.route, "returned the wrong error:", apiErr)
+		}
+	}
+
+	node.gateway = nil
+	cfg.NetworkConfig = nil
+	testV1(t, api, http.MethodGet, "/v1/network", http.StatusServiceUnavailable, &apiError{})
+	route = &Route{}
+	testV1(t, api, http.MethodGet, "/v1/route", http.StatusOK, route)
+	if route.Gateway != nil {
+		t.Fatal("/v1/route returned a gateway that does not exist:", route.Gateway)
+	}
+}
+
+func TestV1Actions(t *testing.T) {
+	cfg := testAuthConfig()
+	cfg.StatsAdminTokens = []string{"admin"}
+	node := &testNode{}
+	api, err := New(cfg, node, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &Result{}
+	testV1Token(t, api, "admin", http.MethodPost, "/v1/floating/10.99.100.1/release", http.StatusOK, result)
+	if result.Action != "release" || len(node.released) != 1 {
+		t.Fatal("/v1/floating/10.99.100.1/release did not release the floating ip:", result)
+	}
+
+	testV1Token(t, api, "admin", http.MethodPost, "/v1/floating/10.99.100.1/move/remote", http.StatusOK, result)
+	if result.Action != "move" || len(node.moved) != 1 || !node.moved[0].Equal(net.ParseIP("10.99.100.1")) {
+		t.Fatal("/v1/floating/10.99.100.1/move/remote did not move the floating ip:", result)
+	}
+
+	testV1Token(t, api, "admin", http.MethodPost, "/v1/drain", http.StatusOK, result)
+	testV1Token(t, api, "admin", http.MethodPost, "/v1/reload", http.StatusOK, result)
+	testV1Token(t, api, "admin", http.MethodPost, "/v1/rotate-keys", http.StatusOK, result)
+	if !node.drained || !node.reloaded || !node.rotated {
+		t.Fatal("The drain, reload, and rotate-keys actions were not carried out.")
+	}
+
+	level := &LogLevel{}
+	testV1Token(t, api, "admin", http.MethodPost, "/v1/log-level/error", http.StatusOK, result)
+	testV1Token(t, api, "admin", http.MethodGet, "/v1/log-level", http.StatusOK, level)
+	if result.Action != "log-level" || level.Level != "error" || cfg.Log.Level() != common.ErrorLogger {
+		t.Fatal("/v1/log-level/error did not change the log level:", result, level)
+	}
+
+	metrics := &metric.MetricsLog{}
+	testV1Token(t, api, "admin", http.MethodGet, "/v1/metrics", http.StatusOK, metrics)
+	if metrics.TxMetrics == nil || metrics.RxMetrics == nil {
+		t.Fatal("/v1/metrics returned an incomplete metrics log:", metrics)
+	}
+
+	diagnosis := &diag.Result{}
+	testV1Token(t, api, "admin", http.MethodGet, "/v1/ping/10.99.0.2?count=2", http.StatusOK, diagnosis)
+	if len(diagnosis.Hops) != 2 || diagnosis.Hops[1].Sent != 2 {
+		t.Fatal("/v1/ping/10.99.0.2 returned the wrong diagnosis:", diagnosis)
+	}
+
+	errors := []struct {
+		method string
+		route  string
+		status int
+	}{
+		{http.MethodGet, "/v1/ping/10.99.0.3", http.StatusBadRequest},
+		{http.MethodGet, "/v1/ping/10.99.0.2?count=woot", http.StatusBadRequest},
+		{http.MethodGet, "/v1/ping/", http.StatusNotFound},
+		{http.MethodPost, "/v1/floating/10.99.100.2/release", http.StatusConflict},
+		{http.MethodPost, "/v1/floating/woot/release", http.StatusBadRequest},
+		{http.MethodPost, "/v1/floating/10.99.100.1", http.StatusNotFound},
+		{http.MethodPost, "/v1/floating/10.99.100.1/move/", http.StatusNotFound},
+		{http.MethodPost, "/v1/floating/10.99.100.1/move/woot", http.StatusConflict},
+		{http.MethodPost, "/v1/floating/woot/move/remote", http.StatusBadRequest},
+		{http.MethodGet, "/v1/drain", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v1/rotate-keys", http.StatusConflict},
+		{http.MethodPost, "/v1/metrics", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v1/log-level/trace", http.StatusBadRequest},
+		{http.MethodGet, "/v1/log-level/debug", http.StatusMethodNotAllowed},
+	}
+	for _, test := range errors {
+		testV1Token(t, api, "admin", test.method, test.route, test.status, &apiError{})
+	}
+}
+
+func TestV1ActionsRestricted(t *testing.T) {
+	cfg := testAuthConfig()
+	node := &testNode{}
+	api, err := New(cfg, node, metric.New(cfg), latency.New(cfg, &datastore.Mock{}, event.NewBus()), nil, event.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any tokens the actions are only served over the local api socket.
+	actions := []string{"/v1/floating/10.99.100.1/release", "/v1/floating/10.99.100.1/move/remote", "/v1/drain", "/v1/reload", "/v1/rotate-keys", "/v1/log-level/error"}
+	for _, route := range actions {
+		testV1(t, api, http.MethodPost, route, http.StatusForbidden, &apiError{})
+	}
+	if len(node.released) != 0 || len(node.moved) != 0 || node.drained || node.reloaded || node.rotated {
+		t.Fatal("The open api carried out an action.")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/drain", nil)
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localKey{}, true)))
+	if w.Code != http.StatusOK || !node.drained {
+		t.Fatal("The local api socket was refused an action:", w.Code, w.Body.String())
+	}
+}
@@ -30,6 +30,11 @@ func (rt *Router) Resolve(destination net.IP) (*common.Mapping, bool) {
 	return rt.store.GatewayMapping()
 }
 
+// Gateway returns the mapping of the node that traffic destined outside of the quantum network is routed to, if there is one.
+func (rt *Router) Gateway() (*common.Mapping, bool) {
+	return rt.store.GatewayMapping()
+}
+
 // New returns a Router struct based on the passed in configuration and key/value store.
 func New(cfg *common.Config, store datastore.Datastore) *Router {
 	return &Router{
@@ -14,16 +14,19 @@ import (
 
 // DTLS socket struct for managing a multi-queue openssl based DTLS socket.
 type DTLS struct {
-	cfg     *common.Config
-	stop    bool
-	queues  []int
-	pollFds []int
-	events  [][]syscall.EpollEvent
-	servers []*crypto.DTLSContext
-	clients []*crypto.DTLSContext
-	mux     sync.Mutex
-	writers []map[string]*crypto.DTLSSession
-	readers []map[int32]*crypto.DTLSSession
+	cfg      *common.Config
+	stop     bool
+	queues   []int
+	pollFds  []int
+	events   [][]syscall.EpollEvent
+	waker    common.Waker
+	servers  []*crypto.DTLSContext
+	clients  []*crypto.DTLSContext
+	mux      sync.Mutex
+	sessions map[string][]byte
+	writers  []map[string]*crypto.DTLSSession
+	readers  []map[int32]*crypto.DTLSSession
+	pending  []*crypto.DTLSSession
 }
 
 // Close the DTLS socket and removes associated network configuration.
@@ -59,6 +62,14 @@ func (dtls *DTLS) Close() error {
 		dtls.events = nil
 	}
 
+	// Close the eventfd used to unblock the workers.
+	if dtls.waker >= 0 {
+		if err := dtls.waker.Close(); err != nil {
+			return err
+		}
+		dtls.waker = -1
+	}
+
 	// Close the DTLS writer sessions.
 	if dtls.writers != nil {
 		for i := 0; i < dtls.cfg.NumWorkers; i++ {
@@ -87,27 +98,62 @@ func (dtls *DTLS) Queues() []int {
 	return dtls.queues
 }
 
-// Read a packet off the specified DTLS socket queue and return a *common.Payload representation of the packet.
+// Read a packet off the specified DTLS socket queue and return a *common.Payload representation of the packet. Once the workers are unblocked the sessions are read until none of them has anything left to read.
 func (dtls *DTLS) Read(queue int, buf []byte) (*common.Payload, bool) {
-	n, err := syscall.EpollWait(dtls.pollFds[queue], dtls.events[queue], -1)
-	if err != nil || n < 0 {
-		return nil, false
+	// Records left over from the datagram last read never make the session readable, so they are read first.
+	if session := dtls.pending[queue]; session != nil {
+		return dtls.read(queue, int32(session.Fd), buf)
+	}
+
+	timeout := -1
+	for {
+		n, err := syscall.EpollWait(dtls.pollFds[queue], dtls.events[queue], timeout)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return nil, false
+		}
+
+		for i := 0; i < n; i++ {
+			if fd := dtls.events[queue][i].Fd; fd != int32(dtls.waker) {
+				return dtls.read(queue, fd, buf)
+			}
+		}
+
+		// Once woken the sessions are polled without blocking, and the worker only gives up when none of them is readable.
+		if n == 0 || timeout == 0 {
+			return nil, false
+		}
+		timeout = 0
 	}
+}
 
-	session, ok := dtls.readers[queue][dtls.events[queue][0].Fd]
+// read a packet off the session with the file descriptor, remembering the session if it holds more records than were read.
+func (dtls *DTLS) read(queue int, fd int32, buf []byte) (*common.Payload, bool) {
+	dtls.pending[queue] = nil
+
+	session, ok := dtls.readers[queue][fd]
 	if !ok {
 		return nil, false
 	}
 
 	read, ok := session.Read(buf)
 	if !ok {
-		delete(dtls.readers[queue], dtls.events[queue][0].Fd)
+		delete(dtls.readers[queue], fd)
 		return nil, false
 	}
 
+	if session.Pending() {
+		dtls.pending[queue] = session
+	}
 	return common.NewSockPayload(buf, read), true
 }
 
+// Unblock any worker waiting on a DTLS session.
+func (dtls *DTLS) Unblock() error {
+	return dtls.waker.Wake()
+}
+
 // Write a *common.Payload to the specified DTLS socket queue.
 func (dtls *DTLS) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
 	session, ok := dtls.getWriter(queue, mapping)
@@ -147,15 +193,56 @@ func (dtls *DTLS) getWriter(queue int, mapping *common.Mapping) (*crypto.DTLSSes
 		return session, ok
 	}
 
-	session, err := dtls.clients[queue].Connect(mapping.Address, mapping.Port)
+	session, err := dtls.clients[queue].Connect(mapping.Address, mapping.Port, dtls.sessions[mapping.Address])
 	if err != nil {
 		return nil, false
 	}
 
+	// The session is kept so that it is resumed when reconnecting to the remote node, including by the new process after a rolling restart.
+	if exported, err := session.Export(); err == nil {
+		dtls.sessions[mapping.Address] = exported
+	}
+
 	dtls.writers[queue][mapping.Address] = session
 	return session, true
 }
 
+// Sessions returns the session ticket keys shared by the DTLS servers, along with the last session negotiated with each remote address.
+func (dtls *DTLS) Sessions() ([]byte, map[string][]byte, error) {
+	keys, err := dtls.servers[0].TicketKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dtls.mux.Lock()
+	defer dtls.mux.Unlock()
+
+	sessions := make(map[string][]byte, len(dtls.sessions))
+	for address, session := range dtls.sessions {
+		sessions[address] = session
+	}
+	return keys, sessions, nil
+}
+
+// Resume takes over the session ticket keys and sessions of the previous process, so that the remote nodes resume their sessions with this process and this process resumes its sessions with them.
+func (dtls *DTLS) Resume(keys []byte, sessions map[string][]byte) error {
+	for i := 0; i < dtls.cfg.NumWorkers; i++ {
+		if err := dtls.servers[i].SetTicketKeys(keys); err != nil {
+			return errors.New("error taking over the DTLS session ticket keys: " + err.Error())
+		}
+	}
+
+	dtls.mux.Lock()
+	defer dtls.mux.Unlock()
+
+	for address, session := range sessions {
+		if _, ok := dtls.sessions[address]; !ok {
+			dtls.sessions[address] = session
+		}
+	}
+	return nil
+}
+
 func (dtls *DTLS) accept(queue int) {
 	for !dtls.stop {
 		session, err := dtls.servers[queue].Accept()
@@ -171,28 +258,30 @@ func newDTLS(cfg *common.Config) (*DTLS, error) {
 	crypto.InitDTLS()
 
 	dtls := &DTLS{
-		cfg:     cfg,
-		stop:    false,
-		queues:  make([]int, cfg.NumWorkers),
-		pollFds: make([]int, cfg.NumWorkers),
-		events:  make([][]syscall.EpollEvent, cfg.NumWorkers),
-		servers: make([]*crypto.DTLSContext, cfg.NumWorkers),
-		clients: make([]*crypto.DTLSContext, cfg.NumWorkers),
-		writers: make([]map[string]*crypto.DTLSSession, cfg.NumWorkers),
-		readers: make([]map[int32]*crypto.DTLSSession, cfg.NumWorkers),
+		cfg:      cfg,
+		stop:     false,
+		queues:   make([]int, cfg.NumWorkers),
+		pollFds:  make([]int, cfg.NumWorkers),
+		events:   make([][]syscall.EpollEvent, cfg.NumWorkers),
+		servers:  make([]*crypto.DTLSContext, cfg.NumWorkers),
+		clients:  make([]*crypto.DTLSContext, cfg.NumWorkers),
+		sessions: make(map[string][]byte),
+		writers:  make([]map[string]*crypto.DTLSSession, cfg.NumWorkers),
+		readers:  make([]map[int32]*crypto.DTLSSession, cfg.NumWorkers),
+		pending:  make([]*crypto.DTLSSession, cfg.NumWorkers),
+		waker:    -1,
 	}
 
-	for i := 0; i < dtls.cfg.NumWorkers; i++ {
-		var queue int
-		var err error
+	waker, err := common.NewWaker()
+	if err != nil {
+		return dtls, err
+	}
+	dtls.waker = waker
 
-		if !dtls.cfg.ReuseFDS {
-			queue, err = createUDPSocket(dtls.cfg.IsIPv6Enabled, dtls.cfg.ListenAddr)
-			if err != nil {
-				return dtls, errors.New("error creating the DTLS socket: " + err.Error())
-			}
-		} else {
-			queue = 3 + dtls.cfg.NumWorkers + i
+	for i := 0; i < dtls.cfg.NumWorkers; i++ {
+		queue, err := openQueue(dtls.cfg, i)
+		if err != nil {
+			return dtls, errors.New("error creating the DTLS socket: " + err.Error())
 		}
 
 		dtls.queues[i] = queue
@@ -204,6 +293,17 @@ func newDTLS(cfg *common.Config) (*DTLS, error) {
 
 		dtls.servers[i] = server
 
+		// Every server shares the session ticket keys of the first, as a remote node resuming its session may reach any of the queues.
+		if i > 0 {
+			keys, err := dtls.servers[0].TicketKeys()
+			if err != nil {
+				return dtls, err
+			}
+			if err := server.SetTicketKeys(keys); err != nil {
+				return dtls, err
+			}
+		}
+
 		client, err := crypto.NewClientDTLSContext(cfg.ListenIP.String(), cfg.IsIPv6Enabled, !cfg.DTLSSkipVerify, cfg.DTLSCA, cfg.DTLSCert, cfg.DTLSKey)
 		if err != nil {
 			return dtls, err
@@ -217,7 +317,13 @@ func newDTLS(cfg *common.Config) (*DTLS, error) {
 		}
 
 		dtls.pollFds[i] = pollFd
-		dtls.events[i] = make([]syscall.EpollEvent, 1)
+		// Room for a session alongside the eventfd, so that a woken worker still sees the readable sessions.
+		dtls.events[i] = make([]syscall.EpollEvent, 2)
+
+		wake := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(waker)}
+		if err := syscall.EpollCtl(pollFd, syscall.EPOLL_CTL_ADD, int(waker), wake); err != nil {
+			return dtls, errors.New("Error watching the eventfd: " + err.Error())
+		}
 
 		dtls.writers[i] = make(map[string]*crypto.DTLSSession)
 		dtls.readers[i] = make(map[int32]*crypto.DTLSSession)
@@ -9,6 +9,8 @@ import (
 
 // Mock socket struct to use for testing.
 type Mock struct {
+	ticketKeys []byte
+	sessions   map[string][]byte
 }
 
 // Read which just returns the supplied buffer in the form of a *common.Payload.
@@ -27,10 +29,26 @@ func (mock *Mock) Close() error {
 }
 
 // Queues which is a noop.
+func (mock *Mock) Unblock() error {
+	return nil
+}
+
 func (mock *Mock) Queues() []int {
 	return nil
 }
 
+// Sessions which returns the keys and sessions last passed to Resume.
+func (mock *Mock) Sessions() ([]byte, map[string][]byte, error) {
+	return mock.ticketKeys, mock.sessions, nil
+}
+
+// Resume which records the keys and sessions to return from Sessions.
+func (mock *Mock) Resume(keys []byte, sessions map[string][]byte) error {
+	mock.ticketKeys = keys
+	mock.sessions = sessions
+	return nil
+}
+
 func newMock(cfg *common.Config) (Socket, error) {
 	return &Mock{}, nil
 }
@@ -5,6 +5,7 @@ package socket
 
 import (
 	"errors"
+	"strconv"
 	"syscall"
 
 	"github.com/supernomad/quantum/common"
@@ -29,6 +30,9 @@ type Socket interface {
 	// Write should handle being passed a formatted *common.Payload + *common.Mapping, and write the underlying raw data using the specified socket queue.
 	Write(queue int, payload *common.Payload, mapping *common.Mapping) bool
 
+	// Unblock should wake any worker blocked in Read, after which Read only returns packets already queued on the socket and then returns false.
+	Unblock() error
+
 	// Close should gracefully destroy the socket.
 	Close() error
 
@@ -36,6 +40,15 @@ type Socket interface {
 	Queues() []int
 }
 
+// Resumable interface for sockets holding sessions with the remote nodes, which are handed off to the new process during a rolling restart so that it resumes them rather than negotiating new sessions from scratch.
+type Resumable interface {
+	// Sessions should return the keys remote nodes resume their sessions with, along with the session negotiated with each remote address.
+	Sessions() ([]byte, map[string][]byte, error)
+
+	// Resume should take over the keys and sessions returned by Sessions in the previous process.
+	Resume(keys []byte, sessions map[string][]byte) error
+}
+
 // New generates a socket based on the supplied type and configuration.
 func New(socketType string, cfg *common.Config) (Socket, error) {
 	switch socketType {
@@ -76,3 +89,20 @@ func createUDPSocket(ipv6Enabled bool, sa syscall.Sockaddr) (int, error) {
 
 	return fd, nil
 }
+
+// openQueue returns the file descriptor of the socket for the queue. The socket is inherited from the previous process during a rolling restart, passed in by systemd socket activation, or otherwise created and bound to the configured listen address.
+func openQueue(cfg *common.Config, queue int) (int, error) {
+	if cfg.ReuseFDS {
+		return 3 + cfg.NumWorkers + queue, nil
+	}
+
+	if len(cfg.ListenFDs) > 0 {
+		fd := cfg.ListenFDs[queue]
+		if sockType, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE); err != nil || sockType != syscall.SOCK_DGRAM {
+			return -1, errors.New("error using the socket passed in by systemd, file descriptor " + strconv.Itoa(fd) + " is not a udp socket")
+		}
+		return fd, nil
+	}
+
+	return createUDPSocket(cfg.IsIPv6Enabled, cfg.ListenAddr)
+}
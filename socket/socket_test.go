@@ -288,6 +288,79 @@ func TestUDP(t *testing.T) {
 		t.Run("IPv4", testUDPEndToEndV4)
 		t.Run("IPv6", testUDPEndToEndV6)
 	})
+	t.Run("unblock", testUDPUnblock)
+}
+
+func testUDPUnblock(t *testing.T) {
+	sa := &syscall.SockaddrInet4{Port: 9995}
+	copy(sa.Addr[:], net.ParseIP("127.0.0.1").To4()[:])
+
+	udp, err := New(UDPSocket, &common.Config{NumWorkers: 1, ListenAddr: sa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	payload := &common.Payload{Raw: []byte("hello"), Length: 5}
+	for i := 0; i < 2; i++ {
+		if !udp.Write(0, payload, &common.Mapping{Sockaddr: sa}) {
+			t.Fatal("Failed to write to the UDP socket.")
+		}
+	}
+
+	// The packets already queued are read once the workers are unblocked, after which the read gives up.
+	if err := udp.Unblock(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		if read, ok := udp.Read(0, buf); !ok || read.Length != 5 {
+			t.Fatal("Read did not drain the queued packets once unblocked.")
+		}
+	}
+	if _, ok := udp.Read(0, buf); ok {
+		t.Fatal("Read did not give up once unblocked with nothing left to read.")
+	}
+}
+
+func TestOpenQueue(t *testing.T) {
+	lip := net.ParseIP("127.0.0.1").To4()
+	sa := &syscall.SockaddrInet4{Port: 9997}
+	copy(sa.Addr[:], lip[:])
+
+	activated, err := createUDPSocket(false, sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp, err := New(UDPSocket, &common.Config{
+		NumWorkers: 1,
+		ListenFDs:  []int{activated},
+		ListenAddr: sa,
+		Log:        common.NewLogger(common.NoopLogger),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if queues := udp.Queues(); len(queues) != 1 || queues[0] != activated {
+		t.Fatal("The UDP socket did not use the socket passed in by systemd:", queues)
+	}
+
+	pipe := make([]int, 2)
+	if err := syscall.Pipe(pipe); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	if _, err := openQueue(&common.Config{NumWorkers: 1, ListenFDs: []int{pipe[0]}}, 0); err == nil {
+		t.Fatal("openQueue did not return an error for a passed in file descriptor that is not a udp socket.")
+	}
+
+	if queue, err := openQueue(&common.Config{NumWorkers: 2, ReuseFDS: true, ListenFDs: []int{activated}}, 1); err != nil || queue != 6 {
+		t.Fatal("openQueue did not reuse the socket inherited during a rolling restart:", queue, err)
+	}
 }
 
 func testDTLSEndToEndV4(t *testing.T) {
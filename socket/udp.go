@@ -14,10 +14,18 @@ import (
 type UDP struct {
 	cfg    *common.Config
 	queues []int
+	poller *common.Poller
 }
 
 // Close the UDP socket and removes associated network configuration.
 func (udp *UDP) Close() error {
+	if udp.poller != nil {
+		if err := udp.poller.Close(); err != nil {
+			return err
+		}
+		udp.poller = nil
+	}
+
 	for i := 0; i < len(udp.queues); i++ {
 		if err := syscall.Close(udp.queues[i]); err != nil {
 			return errors.New("error closing the socket queues: " + err.Error())
@@ -31,13 +39,25 @@ func (udp *UDP) Queues() []int {
 	return udp.queues
 }
 
-// Read a packet off the specified UDP socket queue and return a *common.Payload representation of the packet.
+// Read a packet off the specified UDP socket queue and return a *common.Payload representation of the packet. The queue is only waited on once it has nothing left to read.
 func (udp *UDP) Read(queue int, buf []byte) (*common.Payload, bool) {
-	n, _, err := syscall.Recvfrom(udp.queues[queue], buf, 0)
-	if err != nil {
-		return nil, false
+	for {
+		n, _, err := syscall.Recvfrom(udp.queues[queue], buf, syscall.MSG_DONTWAIT)
+		if err == nil {
+			return common.NewSockPayload(buf, n), true
+		} else if err != syscall.EAGAIN {
+			return nil, false
+		}
+
+		if !udp.poller.Wait(queue) {
+			return nil, false
+		}
 	}
-	return common.NewSockPayload(buf, n), true
+}
+
+// Unblock any worker waiting on a UDP socket queue.
+func (udp *UDP) Unblock() error {
+	return udp.poller.Wake()
 }
 
 // Write a *common.Payload to the specified UDP socket queue.
@@ -53,18 +73,17 @@ func newUDP(cfg *common.Config) (*UDP, error) {
 	}
 
 	for i := 0; i < udp.cfg.NumWorkers; i++ {
-		var queue int
-		var err error
-
-		if !udp.cfg.ReuseFDS {
-			queue, err = createUDPSocket(udp.cfg.IsIPv6Enabled, udp.cfg.ListenAddr)
-			if err != nil {
-				return udp, errors.New("error creating the UDP socket: " + err.Error())
-			}
-		} else {
-			queue = 3 + udp.cfg.NumWorkers + i
+		queue, err := openQueue(udp.cfg, i)
+		if err != nil {
+			return udp, errors.New("error creating the UDP socket: " + err.Error())
 		}
 		udp.queues[i] = queue
 	}
+
+	poller, err := common.NewPoller(udp.queues)
+	if err != nil {
+		return udp, err
+	}
+	udp.poller = poller
 	return udp, nil
 }
@@ -0,0 +1,40 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package systemd
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// ListenPIDEnv is the environment variable holding the pid of the process the sockets were passed to.
+	ListenPIDEnv = "LISTEN_PID"
+
+	// ListenFDsEnv is the environment variable holding the number of sockets passed in.
+	ListenFDsEnv = "LISTEN_FDS"
+
+	// listenFDsStart is the first file descriptor passed in by socket activation, directly after stdin, stdout, and stderr.
+	listenFDsStart = 3
+)
+
+// ListenFDs returns the file descriptors of the sockets passed in by systemd socket activation, or nil if there are none meant for this process. The sockets are marked close on exec, and the environment is left as is so that checking again returns the same sockets.
+func ListenFDs() []int {
+	if os.Getenv(ListenPIDEnv) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv(ListenFDsEnv))
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	fds := make([]int, count)
+	for i := 0; i < count; i++ {
+		fds[i] = listenFDsStart + i
+		syscall.CloseOnExec(fds[i])
+	}
+	return fds
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+/*
+Package systemd contains the logic to integrate quantum with systemd, without linking against libsystemd.
+
+The following integrations are supported:
+    - Readiness and status notifications, sent to '$NOTIFY_SOCKET' when quantum is run as a 'Type=notify' service.
+    - Watchdog pings, sent while the workers are alive when the service sets 'WatchdogSec'.
+    - Socket activation, where the udp sockets quantum listens on are passed in by a socket unit via '$LISTEN_FDS' rather than created by quantum.
+
+Every integration is a noop when quantum is not run by systemd, or the corresponding environment variables are not set.
+*/
+package systemd
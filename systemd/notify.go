@@ -0,0 +1,84 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// NotifySocketEnv is the environment variable holding the path of the socket systemd listens for notifications on.
+	NotifySocketEnv = "NOTIFY_SOCKET"
+
+	// WatchdogUsecEnv is the environment variable holding the watchdog timeout in microseconds.
+	WatchdogUsecEnv = "WATCHDOG_USEC"
+
+	// WatchdogPIDEnv is the environment variable holding the pid of the process the watchdog is enabled for.
+	WatchdogPIDEnv = "WATCHDOG_PID"
+
+	// Ready tells systemd that quantum has finished starting up, or reloading.
+	Ready = "READY=1"
+
+	// Reloading tells systemd that quantum is reloading its configuration.
+	Reloading = "RELOADING=1"
+
+	// Stopping tells systemd that quantum is shutting down.
+	Stopping = "STOPPING=1"
+
+	// Watchdog pings the systemd watchdog.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state which sets the free form status of the service, as shown by 'systemctl status'.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// MainPID returns the state which tells systemd the pid of the main quantum process, which changes during a rolling restart.
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// Notify sends the states to systemd in a single notification, returning whether or not it was sent. Nothing is sent, and no error is returned, when quantum was not started with a notify socket.
+func Notify(states ...string) (bool, error) {
+	socket := os.Getenv(NotifySocketEnv)
+	if socket == "" {
+		return false, nil
+	}
+
+	// Abstract socket names start with '@', which is translated to the leading null byte when connecting.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, errors.New("error connecting to the systemd notify socket: " + err.Error())
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, errors.New("error notifying systemd: " + err.Error())
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often the watchdog should be pinged, which is half of the configured watchdog timeout, or zero when the watchdog is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv(WatchdogUsecEnv)
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv(WatchdogPIDEnv); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	timeout, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil || timeout == 0 {
+		return 0, errors.New("error parsing the systemd watchdog timeout '" + usec + "', expected a positive number of microseconds")
+	}
+	return time.Duration(timeout) * time.Microsecond / 2, nil
+}
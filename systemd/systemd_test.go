@@ -0,0 +1,121 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens for notifications the way systemd does, pointing '$NOTIFY_SOCKET' at itself until closed.
+func fakeNotifySocket(t *testing.T, name string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(NotifySocketEnv, name)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	defer os.Unsetenv(NotifySocketEnv)
+
+	os.Unsetenv(NotifySocketEnv)
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Fatal("Notify sent a notification without a notify socket:", sent, err)
+	}
+
+	dir, err := ioutil.TempDir("", "quantum-systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{path.Join(dir, "notify"), "@quantum-test-" + strconv.Itoa(os.Getpid())} {
+		conn := fakeNotifySocket(t, name)
+
+		if sent, err := Notify(Ready, Status("Running"), MainPID(42)); !sent || err != nil {
+			t.Fatal("Notify failed to send the notification:", sent, err)
+		}
+		if notification := readNotification(t, conn); notification != "READY=1\nSTATUS=Running\nMAINPID=42" {
+			t.Fatalf("Notify sent '%s' instead of the supplied states.", notification)
+		}
+		conn.Close()
+	}
+
+	os.Setenv(NotifySocketEnv, path.Join(dir, "missing"))
+	if sent, err := Notify(Stopping); sent || err == nil {
+		t.Fatal("Notify did not return an error for a missing notify socket.")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv(WatchdogUsecEnv)
+	defer os.Unsetenv(WatchdogPIDEnv)
+
+	tests := []struct {
+		usec     string
+		pid      string
+		interval time.Duration
+		err      bool
+	}{
+		{"", "", 0, false},
+		{"30000000", "", 15 * time.Second, false},
+		{"30000000", strconv.Itoa(os.Getpid()), 15 * time.Second, false},
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0, false},
+		{"0", "", 0, true},
+		{"thirty", "", 0, true},
+	}
+
+	for _, test := range tests {
+		os.Setenv(WatchdogUsecEnv, test.usec)
+		os.Setenv(WatchdogPIDEnv, test.pid)
+
+		interval, err := WatchdogInterval()
+		if (err != nil) != test.err {
+			t.Fatalf("WatchdogInterval returned an unexpected error for '%s': %v", test.usec, err)
+		}
+		if interval != test.interval {
+			t.Fatalf("WatchdogInterval returned %s instead of %s for '%s'.", interval, test.interval, test.usec)
+		}
+	}
+}
+
+func TestListenFDs(t *testing.T) {
+	defer os.Unsetenv(ListenPIDEnv)
+	defer os.Unsetenv(ListenFDsEnv)
+
+	os.Setenv(ListenFDsEnv, "2")
+	os.Setenv(ListenPIDEnv, strconv.Itoa(os.Getpid()+1))
+	if fds := ListenFDs(); fds != nil {
+		t.Fatal("ListenFDs returned sockets passed to a different process:", fds)
+	}
+
+	os.Setenv(ListenPIDEnv, strconv.Itoa(os.Getpid()))
+	fds := ListenFDs()
+	if len(fds) != 2 || fds[0] != 3 || fds[1] != 4 {
+		t.Fatal("ListenFDs returned the wrong sockets:", fds)
+	}
+
+	os.Setenv(ListenFDsEnv, "none")
+	if fds := ListenFDs(); fds != nil {
+		t.Fatal("ListenFDs returned sockets for an invalid count:", fds)
+	}
+}
@@ -4,12 +4,17 @@
 package worker
 
 import (
-	"runtime"
+	"sync/atomic"
 
+	"github.com/supernomad/quantum/capture"
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/flow"
+	"github.com/supernomad/quantum/latency"
 	"github.com/supernomad/quantum/metric"
 	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/pmtu"
 	"github.com/supernomad/quantum/router"
 	"github.com/supernomad/quantum/socket"
 )
@@ -18,11 +23,17 @@ import (
 type Incoming struct {
 	cfg        *common.Config
 	aggregator *metric.Aggregator
-	plugins    []plugin.Plugin
+	plugins    atomic.Value
 	dev        device.Device
 	sock       socket.Socket
 	router     *router.Router
-	stop       bool
+	discovery  *pmtu.Discovery
+	monitor    *latency.Monitor
+	prober     *diag.Prober
+	tracker    *flow.Tracker
+	tap        *capture.Tap
+	states     []state
+	life       *lifecycle
 }
 
 func (incoming *Incoming) resolve(payload *common.Payload) (*common.Payload, *common.Mapping, bool) {
@@ -33,78 +44,125 @@ func (incoming *Incoming) resolve(payload *common.Payload) (*common.Payload, *co
 	return nil, nil, false
 }
 
-func (incoming *Incoming) stats(dropped bool, queue int, payload *common.Payload, mapping *common.Mapping) {
-	metric := &metric.Metric{
-		Queue:   queue,
-		Type:    metric.Rx,
-		Dropped: dropped,
+func (incoming *Incoming) control(queue int, payload *common.Payload) bool {
+	// Control packets bypass the plugins, so with a pre-shared key they are authenticated here instead.
+	psk := incoming.cfg.Current().PSK
+	if !common.VerifyControlPayload(payload, psk) {
+		incoming.stats(metric.AuthenticationError, queue, payload, nil)
+		return false
 	}
+	incoming.stats(metric.NotDropped, queue, payload, nil)
 
-	if payload != nil {
-		metric.Bytes += uint64(payload.Length)
+	var reply *common.Payload
+	var mapping *common.Mapping
+	var ok bool
+
+	switch common.ControlType(payload.Raw[common.ControlTypeStart]) {
+	case common.PMTUProbe, common.PMTUAck:
+		reply, mapping, ok = incoming.discovery.Handle(payload)
+	case common.LatencyProbe, common.LatencyReply:
+		reply, mapping, ok = incoming.monitor.Handle(payload)
+	case common.DiagProbe, common.DiagReply:
+		reply, mapping, ok = incoming.prober.Handle(payload)
 	}
 
-	if mapping != nil {
-		metric.PrivateIP = mapping.PrivateIP.String()
+	if ok {
+		common.SignControlPayload(reply, psk)
+		return incoming.sock.Write(queue, reply, mapping)
 	}
+	return true
+}
 
-	incoming.aggregator.Metrics <- metric
+func (incoming *Incoming) stats(reason metric.DropReason, queue int, payload *common.Payload, mapping *common.Mapping) {
+	var bytes int
+	if payload != nil {
+		bytes = payload.Length
+	}
+
+	incoming.aggregator.Record(metric.Rx, queue, reason, bytes, mapping)
 }
 
 func (incoming *Incoming) pipeline(buf []byte, queue int) bool {
 	payload, ok := incoming.sock.Read(queue, buf)
 	if !ok {
-		incoming.stats(true, queue, payload, nil)
+		if incoming.life.draining() {
+			incoming.states[queue].drain()
+			return ok
+		}
+		incoming.stats(metric.SocketReadError, queue, payload, nil)
 		return ok
 	}
+	incoming.states[queue].busy()
+	defer incoming.states[queue].idle()
+
+	if common.IsControlPayload(payload) {
+		return incoming.control(queue, payload)
+	}
 	payload, mapping, ok := incoming.resolve(payload)
 	if !ok {
-		incoming.stats(true, queue, payload, mapping)
+		incoming.stats(metric.UnknownDestination, queue, payload, mapping)
 		return ok
 	}
-	for i := 0; i < len(incoming.plugins); i++ {
-		payload, mapping, ok = incoming.plugins[i].Apply(plugin.Incoming, payload, mapping)
-		if !ok {
-			incoming.stats(true, queue, payload, mapping)
-			return ok
+	incoming.tap.Capture(metric.Rx, capture.Before, queue, payload, mapping)
+	plugins := incoming.plugins.Load().([]plugin.Plugin)
+	for i := 0; i < len(plugins); i++ {
+		var reason metric.DropReason
+		payload, mapping, reason = plugins[i].Apply(plugin.Incoming, payload, mapping)
+		if reason.Dropped() {
+			incoming.stats(reason, queue, payload, mapping)
+			return false
 		}
 	}
+	if incoming.cfg.ClampMSS {
+		pmtu.ClampMSS(payload.Packet, pmtu.MSS(incoming.discovery.MTU(mapping)))
+	}
+	incoming.tap.Capture(metric.Rx, capture.After, queue, payload, mapping)
 	ok = incoming.dev.Write(queue, payload)
 	if !ok {
-		incoming.stats(true, queue, payload, mapping)
+		incoming.stats(metric.DeviceWriteError, queue, payload, mapping)
 		return ok
 	}
-	incoming.stats(false, queue, payload, mapping)
+	incoming.tracker.Track(metric.Rx, queue, payload.Packet)
+	incoming.stats(metric.NotDropped, queue, payload, mapping)
 	return true
 }
 
-// Start handling packets.
+// Start handling packets off the specified queue.
 func (incoming *Incoming) Start(queue int) {
-	go func() {
-		// We want to pin this routine to a specific thread to reduce switching costs.
-		runtime.LockOSThread()
+	incoming.life.run("incoming", queue, &incoming.states[queue], incoming.pipeline)
+}
 
-		buf := make([]byte, common.MaxPacketLength)
-		for !incoming.stop {
-			incoming.pipeline(buf, queue)
-		}
-	}()
+// SetPlugins replaces the plugins applied to each packet, without interrupting the workers.
+func (incoming *Incoming) SetPlugins(plugins []plugin.Plugin) {
+	incoming.plugins.Store(plugins)
+}
+
+// States returns the state of each worker goroutine, indexed by queue.
+func (incoming *Incoming) States() []State {
+	return snapshot(incoming.states)
 }
 
-// Stop handling packets.
+// Stop handling packets and shutdown, returning once every worker has exited. The workers first drain the packets already queued, for up to the drain timeout.
 func (incoming *Incoming) Stop() {
-	incoming.stop = true
+	incoming.life.stop(incoming.sock.Unblock)
 }
 
 // NewIncoming generates a new Incoming worker which once started will handle packets coming from the remote nodes in the quantum network destined for the local node.
-func NewIncoming(cfg *common.Config, aggregator *metric.Aggregator, rt *router.Router, plugins []plugin.Plugin, dev device.Device, sock socket.Socket) *Incoming {
-	return &Incoming{
+func NewIncoming(cfg *common.Config, deps *Deps, plugins []plugin.Plugin) *Incoming {
+	incoming := &Incoming{
 		cfg:        cfg,
-		aggregator: aggregator,
-		plugins:    plugins,
-		dev:        dev,
-		sock:       sock,
-		router:     rt,
-		stop:       false,
+		aggregator: deps.Aggregator,
+		dev:        deps.Device,
+		sock:       deps.Socket,
+		router:     deps.Router,
+		discovery:  deps.Discovery,
+		monitor:    deps.Monitor,
+		prober:     deps.Prober,
+		tracker:    deps.Tracker,
+		tap:        deps.Tap,
+		states:     make([]state, cfg.NumWorkers),
+		life:       newLifecycle(cfg),
 	}
+	incoming.SetPlugins(plugins)
+	return incoming
 }
@@ -0,0 +1,87 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package worker
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supernomad/quantum/common"
+)
+
+// lifecycle manages the worker goroutines handling one direction of traffic, so that stopping them drains the packets already queued and then waits for every goroutine to exit.
+type lifecycle struct {
+	cfg      *common.Config
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping int32
+}
+
+// run starts a worker goroutine for the queue, which is pinned to its own thread and handles packets until its queue has been drained after stopping, or the drain timeout expires.
+func (l *lifecycle) run(component string, queue int, s *state, handle func(buf []byte, queue int) bool) {
+	s.start()
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		defer s.exit()
+
+		// We want to pin this routine to a specific thread to reduce switching costs.
+		runtime.LockOSThread()
+		l.cfg.Log.Debug("worker", "Started the "+component+" worker.", "queue", queue)
+
+		buf := make([]byte, l.cfg.MaxPacketLength)
+		for l.ctx.Err() == nil && !s.isDrained() {
+			handle(buf, queue)
+		}
+
+		l.cfg.Log.Debug("worker", "Stopped the "+component+" worker.", "queue", queue, "drained", s.isDrained())
+	}()
+}
+
+// draining returns whether or not the workers have been told to stop, in which case a failed read means the queue has been drained.
+func (l *lifecycle) draining() bool {
+	return atomic.LoadInt32(&l.stopping) == 1
+}
+
+// stop the workers, unblocking any waiting for a packet, and wait for every worker to drain its queue and exit. Workers still running once the drain timeout expires exit after the packet they are handling.
+func (l *lifecycle) stop(unblock func() error) {
+	if atomic.CompareAndSwapInt32(&l.stopping, 0, 1) {
+		if err := unblock(); err != nil {
+			l.cfg.Log.Error("worker", "Error unblocking the workers, waiting for the drain timeout", "error", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(l.cfg.Current().DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		if l.cfg.Current().DrainTimeout > 0 {
+			l.cfg.Log.Warn("worker", "The workers did not drain within the drain timeout, dropping any packets still queued.", "timeout", l.cfg.Current().DrainTimeout)
+		}
+		l.cancel()
+		<-done
+	}
+	l.cancel()
+}
+
+func newLifecycle(cfg *common.Config) *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
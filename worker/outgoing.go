@@ -4,12 +4,15 @@
 package worker
 
 import (
-	"runtime"
+	"sync/atomic"
 
+	"github.com/supernomad/quantum/capture"
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/flow"
 	"github.com/supernomad/quantum/metric"
 	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/pmtu"
 	"github.com/supernomad/quantum/router"
 	"github.com/supernomad/quantum/socket"
 )
@@ -18,11 +21,15 @@ import (
 type Outgoing struct {
 	cfg        *common.Config
 	aggregator *metric.Aggregator
-	plugins    []plugin.Plugin
+	plugins    atomic.Value
 	dev        device.Device
 	sock       socket.Socket
 	router     *router.Router
-	stop       bool
+	discovery  *pmtu.Discovery
+	tracker    *flow.Tracker
+	tap        *capture.Tap
+	states     []state
+	life       *lifecycle
 }
 
 func (outgoing *Outgoing) resolve(payload *common.Payload) (*common.Payload, *common.Mapping, bool) {
@@ -34,78 +41,103 @@ func (outgoing *Outgoing) resolve(payload *common.Payload) (*common.Payload, *co
 	return nil, nil, false
 }
 
-func (outgoing *Outgoing) stats(dropped bool, queue int, payload *common.Payload, mapping *common.Mapping) {
-	metric := &metric.Metric{
-		Queue:   queue,
-		Type:    metric.Tx,
-		Dropped: dropped,
-	}
+func (outgoing *Outgoing) fragmentationNeeded(queue int, payload *common.Payload, mtu int) {
+	icmp := pmtu.FragmentationNeeded(outgoing.cfg.PrivateIP, payload.Packet, mtu)
+	outgoing.dev.Write(queue, &common.Payload{Packet: icmp, Length: len(icmp)})
+}
 
+func (outgoing *Outgoing) stats(reason metric.DropReason, queue int, payload *common.Payload, mapping *common.Mapping) {
+	var bytes int
 	if payload != nil {
-		metric.Bytes += uint64(payload.Length)
-	}
-
-	if mapping != nil {
-		metric.PrivateIP = mapping.PrivateIP.String()
+		bytes = payload.Length
 	}
 
-	outgoing.aggregator.Metrics <- metric
+	outgoing.aggregator.Record(metric.Tx, queue, reason, bytes, mapping)
 }
 
 func (outgoing *Outgoing) pipeline(buf []byte, queue int) bool {
 	payload, ok := outgoing.dev.Read(queue, buf)
 	if !ok {
-		outgoing.stats(true, queue, payload, nil)
+		if outgoing.life.draining() {
+			outgoing.states[queue].drain()
+			return ok
+		}
+		outgoing.stats(metric.DeviceReadError, queue, payload, nil)
 		return ok
 	}
+	outgoing.states[queue].busy()
+	defer outgoing.states[queue].idle()
+
 	payload, mapping, ok := outgoing.resolve(payload)
 	if !ok {
-		outgoing.stats(true, queue, payload, mapping)
+		outgoing.stats(metric.UnknownDestination, queue, payload, mapping)
 		return ok
 	}
-	for i := 0; i < len(outgoing.plugins); i++ {
-		payload, mapping, ok = outgoing.plugins[i].Apply(plugin.Outgoing, payload, mapping)
-		if !ok {
-			outgoing.stats(true, queue, payload, mapping)
-			return ok
+	if mtu := outgoing.discovery.MTU(mapping); len(payload.Packet) > mtu && pmtu.DontFragment(payload.Packet) {
+		outgoing.fragmentationNeeded(queue, payload, mtu)
+		outgoing.stats(metric.PacketTooBig, queue, payload, mapping)
+		return false
+	}
+	if outgoing.cfg.ClampMSS {
+		pmtu.ClampMSS(payload.Packet, pmtu.MSS(outgoing.discovery.MTU(mapping)))
+	}
+	// Flows are classified before the plugins are applied, as the plugins may transform the packet beyond recognition, but only recorded once the packet has been sent.
+	tracked := outgoing.tracker.Classify(metric.Tx, payload.Packet)
+	outgoing.tap.Capture(metric.Tx, capture.Before, queue, payload, mapping)
+	plugins := outgoing.plugins.Load().([]plugin.Plugin)
+	for i := 0; i < len(plugins); i++ {
+		var reason metric.DropReason
+		payload, mapping, reason = plugins[i].Apply(plugin.Outgoing, payload, mapping)
+		if reason.Dropped() {
+			outgoing.stats(reason, queue, payload, mapping)
+			return false
 		}
 	}
+	outgoing.tap.Capture(metric.Tx, capture.After, queue, payload, mapping)
 	ok = outgoing.sock.Write(queue, payload, mapping)
 	if !ok {
-		outgoing.stats(true, queue, payload, mapping)
+		outgoing.stats(metric.SocketWriteError, queue, payload, mapping)
 		return ok
 	}
-	outgoing.stats(false, queue, payload, mapping)
+	outgoing.tracker.Record(queue, tracked)
+	outgoing.stats(metric.NotDropped, queue, payload, mapping)
 	return true
 }
 
-// Start handling packets.
+// Start handling packets off the specified queue.
 func (outgoing *Outgoing) Start(queue int) {
-	go func() {
-		// We want to pin this routine to a specific thread to reduce switching costs.
-		runtime.LockOSThread()
+	outgoing.life.run("outgoing", queue, &outgoing.states[queue], outgoing.pipeline)
+}
 
-		buf := make([]byte, common.MaxPacketLength)
-		for !outgoing.stop {
-			outgoing.pipeline(buf, queue)
-		}
-	}()
+// SetPlugins replaces the plugins applied to each packet, without interrupting the workers.
+func (outgoing *Outgoing) SetPlugins(plugins []plugin.Plugin) {
+	outgoing.plugins.Store(plugins)
+}
+
+// States returns the state of each worker goroutine, indexed by queue.
+func (outgoing *Outgoing) States() []State {
+	return snapshot(outgoing.states)
 }
 
-// Stop handling packets and shutdown.
+// Stop handling packets and shutdown, returning once every worker has exited. The workers first drain the packets already queued, for up to the drain timeout.
 func (outgoing *Outgoing) Stop() {
-	outgoing.stop = true
+	outgoing.life.stop(outgoing.dev.Unblock)
 }
 
 // NewOutgoing generates an Outgoing worker which once started will handle packets coming from the local node destined for remote nodes in the quantum network.
-func NewOutgoing(cfg *common.Config, aggregator *metric.Aggregator, rt *router.Router, plugins []plugin.Plugin, dev device.Device, sock socket.Socket) *Outgoing {
-	return &Outgoing{
+func NewOutgoing(cfg *common.Config, deps *Deps, plugins []plugin.Plugin) *Outgoing {
+	outgoing := &Outgoing{
 		cfg:        cfg,
-		aggregator: aggregator,
-		plugins:    plugins,
-		dev:        dev,
-		sock:       sock,
-		router:     rt,
-		stop:       false,
+		aggregator: deps.Aggregator,
+		dev:        deps.Device,
+		sock:       deps.Socket,
+		router:     deps.Router,
+		discovery:  deps.Discovery,
+		tracker:    deps.Tracker,
+		tap:        deps.Tap,
+		states:     make([]state, cfg.NumWorkers),
+		life:       newLifecycle(cfg),
 	}
+	outgoing.SetPlugins(plugins)
+	return outgoing
 }
@@ -0,0 +1,70 @@
+// Copyright (c) 2016-2018 Christian Saide <supernomad>
+// Licensed under the MPL-2.0, for details see https://github.com/supernomad/quantum/blob/master/LICENSE
+
+package worker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State of a single worker goroutine.
+type State struct {
+	// The queue the worker handles.
+	Queue int
+
+	// Whether or not the worker goroutine is running.
+	Running bool
+
+	// How long the worker has been handling its current packet, which is zero while the worker is waiting for a packet to arrive.
+	Busy time.Duration
+}
+
+// state tracks a single worker goroutine, it is padded out to a cache line so that the workers do not contend with each other.
+type state struct {
+	running   int32
+	drained   int32
+	busySince int64
+	_         [52]byte
+}
+
+func (s *state) busy() {
+	atomic.StoreInt64(&s.busySince, time.Now().UnixNano())
+}
+
+func (s *state) idle() {
+	atomic.StoreInt64(&s.busySince, 0)
+}
+
+func (s *state) start() {
+	atomic.StoreInt32(&s.drained, 0)
+	atomic.StoreInt32(&s.running, 1)
+}
+
+// drain marks the queue as having nothing left to read once the worker has been told to stop.
+func (s *state) drain() {
+	atomic.StoreInt32(&s.drained, 1)
+}
+
+func (s *state) isDrained() bool {
+	return atomic.LoadInt32(&s.drained) == 1
+}
+
+func (s *state) exit() {
+	atomic.StoreInt64(&s.busySince, 0)
+	atomic.StoreInt32(&s.running, 0)
+}
+
+func snapshot(states []state) []State {
+	now := time.Now().UnixNano()
+
+	snapshot := make([]State, len(states))
+	for i := 0; i < len(states); i++ {
+		snapshot[i].Queue = i
+		snapshot[i].Running = atomic.LoadInt32(&states[i].running) == 1
+		if since := atomic.LoadInt64(&states[i].busySince); since != 0 {
+			snapshot[i].Busy = time.Duration(now - since)
+		}
+	}
+	return snapshot
+}
@@ -5,3 +5,28 @@
 Package worker contains the structs and logic to handle routing, encrypting, and analyzing traffic over the quantum network. Each worker handles one direction of network traffic, either incoming traffic from remote nodes or outgoing traffic destined for remote nodes.
 */
 package worker
+
+import (
+	"github.com/supernomad/quantum/capture"
+	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/flow"
+	"github.com/supernomad/quantum/latency"
+	"github.com/supernomad/quantum/metric"
+	"github.com/supernomad/quantum/pmtu"
+	"github.com/supernomad/quantum/router"
+	"github.com/supernomad/quantum/socket"
+)
+
+// Deps are the components the workers hand packets to and record them with. The outgoing workers ignore the latency monitor and diagnostic prober, which only answer incoming control packets.
+type Deps struct {
+	Aggregator *metric.Aggregator
+	Router     *router.Router
+	Discovery  *pmtu.Discovery
+	Monitor    *latency.Monitor
+	Prober     *diag.Prober
+	Tracker    *flow.Tracker
+	Tap        *capture.Tap
+	Device     device.Device
+	Socket     socket.Socket
+}
@@ -9,11 +9,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/supernomad/quantum/capture"
 	"github.com/supernomad/quantum/common"
 	"github.com/supernomad/quantum/datastore"
 	"github.com/supernomad/quantum/device"
+	"github.com/supernomad/quantum/diag"
+	"github.com/supernomad/quantum/event"
+	"github.com/supernomad/quantum/flow"
+	"github.com/supernomad/quantum/latency"
 	"github.com/supernomad/quantum/metric"
 	"github.com/supernomad/quantum/plugin"
+	"github.com/supernomad/quantum/pmtu"
 	"github.com/supernomad/quantum/router"
 	"github.com/supernomad/quantum/socket"
 )
@@ -31,6 +37,46 @@ var (
 	privateIP = "10.1.1.1"
 )
 
+// queued is a socket which blocks reading until a packet is queued, or until it is unblocked after which it drains the queued packets. It records the packets written to it.
+type queued struct {
+	packets   chan []byte
+	unblocked chan struct{}
+	written   []*common.Payload
+}
+
+func (q *queued) Read(queue int, buf []byte) (*common.Payload, bool) {
+	select {
+	case packet := <-q.packets:
+		return common.NewSockPayload(buf, copy(buf, packet)), true
+	case <-q.unblocked:
+	}
+
+	select {
+	case packet := <-q.packets:
+		return common.NewSockPayload(buf, copy(buf, packet)), true
+	default:
+		return nil, false
+	}
+}
+
+func (q *queued) Write(queue int, payload *common.Payload, mapping *common.Mapping) bool {
+	q.written = append(q.written, payload)
+	return true
+}
+
+func (q *queued) Unblock() error {
+	close(q.unblocked)
+	return nil
+}
+
+func (q *queued) Close() error {
+	return nil
+}
+
+func (q *queued) Queues() []int {
+	return nil
+}
+
 func init() {
 	ip := net.ParseIP("10.8.0.1")
 	ipv6 := net.ParseIP("dead::beef")
@@ -52,14 +98,25 @@ func init() {
 			Log:        common.NewLogger(common.NoopLogger),
 			NumWorkers: 1,
 		})
-	aggregator.Start()
 
 	netCfg := &common.NetworkConfig{BaseIP: base, IPNet: ipnet}
-	cfg = &common.Config{NumWorkers: 1, PrivateIP: ip, IsIPv6Enabled: true, IsIPv4Enabled: true, NetworkConfig: netCfg}
+	cfg = &common.Config{Log: common.NewLogger(common.NoopLogger), NumWorkers: 1, PrivateIP: ip, IsIPv6Enabled: true, IsIPv4Enabled: true, MaxPacketLength: common.MaxPacketLength, MTU: common.MTU, NetworkConfig: netCfg}
 	rt = router.New(cfg, store)
+	discovery := pmtu.New(cfg, store)
 
-	incoming = NewIncoming(cfg, aggregator, rt, []plugin.Plugin{}, dev, sock)
-	outgoing = NewOutgoing(cfg, aggregator, rt, []plugin.Plugin{}, dev, sock)
+	deps := &Deps{
+		Aggregator: aggregator,
+		Router:     rt,
+		Discovery:  discovery,
+		Monitor:    latency.New(cfg, store, event.NewBus()),
+		Prober:     diag.New(cfg, store, rt, discovery),
+		Tracker:    flow.New(cfg),
+		Tap:        capture.New(cfg),
+		Device:     dev,
+		Socket:     sock,
+	}
+	incoming = NewIncoming(cfg, deps, []plugin.Plugin{})
+	outgoing = NewOutgoing(cfg, deps, []plugin.Plugin{})
 }
 
 func benchmarkIncomingPipeline(buf []byte, queue int, b *testing.B) {
@@ -87,10 +144,80 @@ func TestIncomingPipeline(t *testing.T) {
 	}
 }
 
+func TestIncomingControlPipeline(t *testing.T) {
+	buf := make([]byte, common.MaxPacketLength)
+	rand.Read(buf)
+
+	payload := common.NewControlPayload(buf, common.PMTUAck, net.ParseIP("10.8.0.2"), 6)
+	if !common.IsControlPayload(payload) || !incoming.pipeline(payload.Raw, 0) {
+		panic("Control pipeline failed something is wrong.")
+	}
+}
+
+func TestIncomingLatencyPipeline(t *testing.T) {
+	buf := make([]byte, common.MaxPacketLength)
+	rand.Read(buf)
+
+	payload := common.NewControlPayload(buf, common.LatencyProbe, net.ParseIP("10.8.0.2"), 12)
+	if !common.IsControlPayload(payload) || !incoming.pipeline(payload.Raw, 0) {
+		panic("Latency control pipeline failed something is wrong.")
+	}
+}
+
+func TestIncomingControlPSK(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	pskCfg := &common.Config{Log: common.NewLogger(common.NoopLogger), NumWorkers: 1, PrivateIP: net.ParseIP("10.8.0.1"), MaxPacketLength: common.MaxPacketLength, MTU: common.MTU, NetworkConfig: cfg.NetworkConfig, PSK: psk}
+	q := &queued{packets: make(chan []byte, 1), unblocked: make(chan struct{})}
+
+	discovery := pmtu.New(pskCfg, store)
+	deps := &Deps{
+		Aggregator: metric.New(pskCfg),
+		Router:     rt,
+		Discovery:  discovery,
+		Monitor:    latency.New(pskCfg, store, event.NewBus()),
+		Prober:     diag.New(pskCfg, store, rt, discovery),
+		Tracker:    flow.New(pskCfg),
+		Tap:        capture.New(pskCfg),
+		Device:     dev,
+		Socket:     q,
+	}
+	authenticated := NewIncoming(pskCfg, deps, []plugin.Plugin{})
+
+	probe := func(key []byte) bool {
+		packet := make([]byte, common.ControlHeaderSize+12)
+		payload := common.NewControlPayload(packet, common.LatencyProbe, net.ParseIP("10.8.0.2"), 12)
+		common.SignControlPayload(payload, key)
+
+		q.packets <- packet
+		return authenticated.pipeline(make([]byte, common.MaxPacketLength), 0)
+	}
+
+	if probe(nil) || probe([]byte("fedcba9876543210fedcba9876543210")) || len(q.written) != 0 {
+		t.Fatal("A node without the pre-shared key got a reply to its control packet.")
+	}
+	if drops := authenticated.aggregator.MetricsLog().RxMetrics.DroppedReasons[metric.AuthenticationError.String()]; drops != 2 {
+		t.Fatalf("The unauthenticated control packets were not recorded as authentication drops, got: %d", drops)
+	}
+
+	if !probe(psk) || len(q.written) != 1 {
+		t.Fatal("A node with the pre-shared key did not get a reply to its control packet.")
+	}
+	if reply := q.written[0]; common.ControlType(reply.Raw[common.ControlTypeStart]) != common.LatencyReply || !common.VerifyControlPayload(reply, psk) {
+		t.Fatal("The reply to the control packet was not signed with the pre-shared key.")
+	}
+}
+
 func TestIncoming(t *testing.T) {
 	incoming.Start(0)
 	time.Sleep(5 * time.Millisecond)
+	if states := incoming.States(); !states[0].Running {
+		t.Fatal("States reported a started worker as not running:", states)
+	}
+
 	incoming.Stop()
+	if states := incoming.States(); states[0].Running || states[0].Busy != 0 {
+		t.Fatal("States reported a stopped worker as running:", states)
+	}
 }
 
 func benchmarkOutgoingPipeline(buf []byte, queue int, b *testing.B) {
@@ -120,5 +247,71 @@ func TestOutgoingPipeline(t *testing.T) {
 func TestOutgoing(t *testing.T) {
 	outgoing.Start(0)
 	time.Sleep(5 * time.Millisecond)
+	if states := outgoing.States(); !states[0].Running {
+		t.Fatal("States reported a started worker as not running:", states)
+	}
+
 	outgoing.Stop()
+	if states := outgoing.States(); states[0].Running || states[0].Busy != 0 {
+		t.Fatal("States reported a stopped worker as running:", states)
+	}
+}
+
+func TestStopDrains(t *testing.T) {
+	drainCfg := *cfg
+	drainCfg.DrainTimeout = time.Second
+
+	q := &queued{packets: make(chan []byte, 10), unblocked: make(chan struct{})}
+	drained := NewIncoming(&drainCfg, &Deps{Aggregator: metric.New(&drainCfg), Router: rt, Tracker: flow.New(&drainCfg), Tap: capture.New(&drainCfg), Device: dev, Socket: q}, []plugin.Plugin{})
+
+	// The worker is blocked waiting for a packet, so stopping it has to wake it before the queued packets are drained.
+	drained.Start(0)
+	time.Sleep(5 * time.Millisecond)
+	for i := 0; i < cap(q.packets); i++ {
+		packet := make([]byte, common.MaxPacketLength)
+		rand.Read(packet)
+		q.packets <- packet
+	}
+
+	drained.Stop()
+	if len(q.packets) != 0 {
+		t.Fatal("Stop returned before the queued packets were drained:", len(q.packets))
+	}
+	if states := drained.States(); states[0].Running {
+		t.Fatal("Stop returned before the worker exited:", states)
+	}
+
+	// The mock device never runs out of packets, so the worker is stopped once the drain timeout expires.
+	drainCfg.DrainTimeout = 10 * time.Millisecond
+	flooded := NewOutgoing(&drainCfg, &Deps{Aggregator: metric.New(&drainCfg), Router: rt, Discovery: pmtu.New(&drainCfg, store), Tracker: flow.New(&drainCfg), Tap: capture.New(&drainCfg), Device: dev, Socket: sock}, []plugin.Plugin{})
+	flooded.Start(0)
+
+	start := time.Now()
+	flooded.Stop()
+	if elapsed := time.Since(start); elapsed < drainCfg.DrainTimeout {
+		t.Fatal("Stop returned before the drain timeout expired:", elapsed)
+	}
+	if states := flooded.States(); states[0].Running {
+		t.Fatal("Stop returned before the worker exited:", states)
+	}
+}
+
+func TestState(t *testing.T) {
+	states := make([]state, 2)
+	states[1].start()
+	states[1].busy()
+	time.Sleep(time.Millisecond)
+
+	current := snapshot(states)
+	if current[0].Queue != 0 || current[0].Running || current[0].Busy != 0 {
+		t.Fatal("snapshot reported the wrong state for an idle worker:", current[0])
+	}
+	if current[1].Queue != 1 || !current[1].Running || current[1].Busy < time.Millisecond {
+		t.Fatal("snapshot reported the wrong state for a busy worker:", current[1])
+	}
+
+	states[1].idle()
+	if current := snapshot(states); current[1].Busy != 0 {
+		t.Fatal("snapshot reported an idle worker as busy:", current[1])
+	}
 }